@@ -0,0 +1,300 @@
+package activerecord
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Scope string
+
+const (
+	ScopeProfileRead       Scope = "profile:read"
+	ScopeWalletsRead       Scope = "wallets:read"
+	ScopeTransactionsWrite Scope = "transactions:write"
+
+	apiKeyPrefix       = "fk_"
+	apiKeySecretBytes  = 32
+	apiKeyDisplayChars = 11
+	maxAPIKeyNameLen   = 100
+)
+
+var scopes = map[Scope]bool{
+	ScopeProfileRead:       true,
+	ScopeWalletsRead:       true,
+	ScopeTransactionsWrite: true,
+}
+
+func newAPIKeyFactory(store store) APIKeyFactory {
+	return APIKeyFactory{
+		store: store,
+	}
+}
+
+// APIKeyFactory manages API keys which give programs scoped access on behalf of their users.
+// Only hashes of the keys are stored, a key is shown once when it is created
+type APIKeyFactory struct {
+	store store
+}
+
+// New creates an API key and returns it together with its secret token.
+// allowedIPs contains IPs or CIDRs, an empty list allows any IP. A nil expiresAt means the key does not expire
+func (f APIKeyFactory) New(userID uuid.UUID, name string, scopes []Scope, expiresAt *time.Time, allowedIPs []string) (*APIKey, string, error) {
+	k := &APIKey{
+		store:     f.store,
+		id:        uuid.New(),
+		userID:    userID,
+		createdAt: time.Now().UTC(),
+	}
+
+	err := k.set(name, scopes, expiresAt, allowedIPs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := make([]byte, apiKeySecretBytes)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	k.hash = hashAPIKey(token)
+	k.prefix = token[:apiKeyDisplayChars]
+	return k, token, nil
+}
+
+// Authenticate finds the key by its token and checks that it is not expired and allowed for the IP
+func (f APIKeyFactory) Authenticate(ctx context.Context, token string, ip net.IP) (*APIKey, error) {
+	k, err := f.store.apiKeys().findByHash(ctx, hashAPIKey(token))
+	if err != nil {
+		if _, ok := err.(NotFoundError); ok {
+			return nil, invalidAPIKey
+		}
+
+		return nil, err
+	}
+
+	if k.Expired() {
+		return nil, invalidAPIKey
+	}
+
+	if !k.AllowsIP(ip) {
+		return nil, apiKeyIPNotAllowed
+	}
+
+	now := time.Now().UTC()
+	err = f.store.apiKeys().setLastUsedAt(ctx, k.id, now)
+	if err != nil {
+		return nil, err
+	}
+
+	k.store = f.store
+	k.lastUsedAt = &now
+	return k, nil
+}
+
+// Find returns the key of the user, keys of other users are not found
+func (f APIKeyFactory) Find(ctx context.Context, userID, id uuid.UUID) (*APIKey, error) {
+	k, err := f.store.apiKeys().find(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	k.store = f.store
+	return k, nil
+}
+
+func (f APIKeyFactory) FindByUserID(ctx context.Context, userID uuid.UUID) ([]*APIKey, error) {
+	keys, err := f.store.apiKeys().findByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		k.store = f.store
+	}
+
+	return keys, nil
+}
+
+type APIKey struct {
+	store  store
+	id     uuid.UUID
+	userID uuid.UUID
+	name   string
+	// prefix is the beginning of the token which helps users to tell their keys apart
+	prefix     string
+	hash       string
+	scopes     []Scope
+	allowedIPs []string
+	createdAt  time.Time
+	expiresAt  *time.Time
+	lastUsedAt *time.Time
+}
+
+func (k *APIKey) set(name string, scopes []Scope, expiresAt *time.Time, allowedIPs []string) error {
+	if name == "" || len(name) > maxAPIKeyNameLen {
+		return invalidAPIKeyName
+	}
+
+	if len(scopes) == 0 {
+		return invalidScope
+	}
+
+	for _, s := range scopes {
+		if !validScope(s) {
+			return invalidScope
+		}
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return invalidAPIKeyExpiry
+	}
+
+	for _, ip := range allowedIPs {
+		if ParseIPNet(ip) == nil {
+			return invalidIPAllowlist
+		}
+	}
+
+	k.name = name
+	k.scopes = scopes
+	k.expiresAt = expiresAt
+	k.allowedIPs = allowedIPs
+	if k.allowedIPs == nil {
+		k.allowedIPs = []string{}
+	}
+
+	return nil
+}
+
+func (k *APIKey) Save(ctx context.Context) error {
+	return k.store.apiKeys().insert(ctx, k)
+}
+
+// Update replaces the settings of the key, the token stays the same
+func (k *APIKey) Update(ctx context.Context, name string, scopes []Scope, expiresAt *time.Time, allowedIPs []string) error {
+	err := k.set(name, scopes, expiresAt, allowedIPs)
+	if err != nil {
+		return err
+	}
+
+	return k.store.apiKeys().update(ctx, k)
+}
+
+// Delete revokes the key
+func (k *APIKey) Delete(ctx context.Context) error {
+	return k.store.apiKeys().delete(ctx, k.id)
+}
+
+func (k *APIKey) HasScope(scope Scope) bool {
+	for _, s := range k.scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *APIKey) Expired() bool {
+	return k.expiresAt != nil && !time.Now().Before(*k.expiresAt)
+}
+
+// AllowsIP tells if the key can be used from the IP
+func (k *APIKey) AllowsIP(ip net.IP) bool {
+	if len(k.allowedIPs) == 0 {
+		return true
+	}
+
+	for _, allowed := range k.allowedIPs {
+		ipNet := ParseIPNet(allowed)
+		if ipNet != nil && ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *APIKey) scopeStrings() []string {
+	s := make([]string, 0, len(k.scopes))
+	for _, scope := range k.scopes {
+		s = append(s, string(scope))
+	}
+
+	return s
+}
+
+func (k *APIKey) ID() uuid.UUID {
+	return k.id
+}
+
+func (k *APIKey) UserID() uuid.UUID {
+	return k.userID
+}
+
+func (k *APIKey) Name() string {
+	return k.name
+}
+
+func (k *APIKey) Prefix() string {
+	return k.prefix
+}
+
+func (k *APIKey) Scopes() []Scope {
+	return k.scopes
+}
+
+func (k *APIKey) AllowedIPs() []string {
+	return k.allowedIPs
+}
+
+func (k *APIKey) CreatedAt() time.Time {
+	return k.createdAt
+}
+
+func (k *APIKey) ExpiresAt() *time.Time {
+	return k.expiresAt
+}
+
+func (k *APIKey) LastUsedAt() *time.Time {
+	return k.lastUsedAt
+}
+
+func validScope(s Scope) bool {
+	return scopes[s]
+}
+
+// ParseIPNet parses an IP or a CIDR, a single IP is a network of one address
+func ParseIPNet(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err == nil {
+		return ipNet
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func hashAPIKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
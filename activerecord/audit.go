@@ -0,0 +1,58 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEventKind string
+
+const (
+	AuditAccountLocked   AuditEventKind = "account_locked"
+	AuditIPLocked        AuditEventKind = "ip_locked"
+	AuditAccountUnlocked AuditEventKind = "account_unlocked"
+)
+
+func newAuditLog(store store) AuditLog {
+	return AuditLog{
+		store: store,
+	}
+}
+
+// AuditLog records security events
+type AuditLog struct {
+	store store
+}
+
+// Record saves the event, its ID and CreatedAt are set if they are empty
+func (a AuditLog) Record(ctx context.Context, e *AuditEvent) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+
+	return a.store.auditEvents().insert(ctx, e)
+}
+
+// FindByUserID returns the events of the user, the latest first
+func (a AuditLog) FindByUserID(ctx context.Context, userID uuid.UUID) ([]*AuditEvent, error) {
+	return a.store.auditEvents().findByUserID(ctx, userID)
+}
+
+type AuditEvent struct {
+	ID   uuid.UUID
+	Kind AuditEventKind
+	// UserID is the user the event is about, if it is known
+	UserID *uuid.UUID
+	// Subject is what the event is about, e.g. an email or an IP
+	Subject string
+	// Actor is the user who caused the event, nil for events caused by the system
+	Actor     *uuid.UUID
+	IP        string
+	CreatedAt time.Time
+}
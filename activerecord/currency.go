@@ -0,0 +1,285 @@
+package activerecord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const maxCurrencyPrecision = 18
+
+var currencySymbolRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{1,15}$`)
+
+func newCurrencyRegistry(store store) CurrencyRegistry {
+	return CurrencyRegistry{
+		store: store,
+	}
+}
+
+// CurrencyRegistry is a factory of stored currencies
+type CurrencyRegistry struct {
+	store store
+}
+
+func (cr CurrencyRegistry) New(symbol, name string, precision int32, feeSchedules map[TransactionKind]FeeSchedule, signupBonus decimal.Decimal, serviceWallet string) (*Currency, error) {
+	return newCurrency(cr.store, symbol, name, precision, feeSchedules, signupBonus, serviceWallet)
+}
+
+func (cr CurrencyRegistry) Find(ctx context.Context, symbol string) (*Currency, error) {
+	c, err := cr.store.currencies().find(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store = cr.store
+	return c, nil
+}
+
+func (cr CurrencyRegistry) All(ctx context.Context) ([]*Currency, error) {
+	return cr.findAll(ctx, false)
+}
+
+func (cr CurrencyRegistry) Enabled(ctx context.Context) ([]*Currency, error) {
+	return cr.findAll(ctx, true)
+}
+
+func (cr CurrencyRegistry) findAll(ctx context.Context, enabledOnly bool) ([]*Currency, error) {
+	currencies, err := cr.store.currencies().findAll(ctx, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range currencies {
+		c.store = cr.store
+	}
+
+	return currencies, nil
+}
+
+// FeeRevenue is the sum of fees collected in the currency fee wallet during a period
+type FeeRevenue struct {
+	Currency  string
+	FeeWallet string
+	Revenue   decimal.Decimal
+	Count     int64
+}
+
+// FeeRevenue returns fees collected per currency in [since, until). Zero values mean no restriction
+func (cr CurrencyRegistry) FeeRevenue(ctx context.Context, since, until time.Time) ([]FeeRevenue, error) {
+	return cr.store.currencies().feeRevenue(ctx, since.UTC(), until.UTC())
+}
+
+func newCurrency(store store, symbol, name string, precision int32, feeSchedules map[TransactionKind]FeeSchedule, signupBonus decimal.Decimal, serviceWallet string) (*Currency, error) {
+	if !currencySymbolRegexp.MatchString(symbol) {
+		return nil, invalidCurrencySymbol
+	}
+
+	if name == "" {
+		return nil, invalidCurrencyName
+	}
+
+	if precision < 0 || precision > maxCurrencyPrecision {
+		return nil, invalidCurrencyPrecision
+	}
+
+	schedules := make(map[TransactionKind]FeeSchedule, len(feeSchedules))
+	for kind, schedule := range feeSchedules {
+		if !chargeableKind(kind) || schedule == nil {
+			return nil, invalidFeeSchedule
+		}
+
+		schedules[kind] = schedule
+	}
+
+	if signupBonus.IsNegative() || !signupBonus.Equal(signupBonus.Truncate(precision)) {
+		return nil, invalidSignupBonus
+	}
+
+	if serviceWallet == "" {
+		serviceWallet = newAddress()
+	}
+
+	return &Currency{
+		store:          store,
+		symbol:         symbol,
+		name:           name,
+		precision:      precision,
+		feeSchedules:   schedules,
+		signupBonus:    signupBonus,
+		serviceWallet:  serviceWallet,
+		feeWallet:      newAddress(),
+		issuanceWallet: newAddress(),
+		enabled:        true,
+	}, nil
+}
+
+type Currency struct {
+	store        store
+	symbol       string
+	name         string
+	precision    int32
+	feeSchedules map[TransactionKind]FeeSchedule
+	signupBonus  decimal.Decimal
+	// serviceWallet is the treasury, a system wallet which pays signup bonuses
+	serviceWallet string
+	// feeWallet is a system wallet which collects transfer fees
+	feeWallet string
+	// issuanceWallet is the counterparty of mints and burns, its balance is the negated supply
+	issuanceWallet string
+	enabled        bool
+}
+
+func (c *Currency) parseFeeSchedules(data string) error {
+	var raw map[TransactionKind]json.RawMessage
+	err := json.Unmarshal([]byte(data), &raw)
+	if err != nil {
+		return err
+	}
+
+	c.feeSchedules = make(map[TransactionKind]FeeSchedule, len(raw))
+	for kind, r := range raw {
+		schedule, err := ParseFeeSchedule(r)
+		if err != nil {
+			return fmt.Errorf("invalid %s fee schedule of currency %s: %w", kind, c.symbol, err)
+		}
+
+		c.feeSchedules[kind] = schedule
+	}
+
+	return nil
+}
+
+// Save inserts the currency together with its treasury, fee and issuance wallets owned by the system.
+// The treasury is empty until coins are minted into it
+func (c *Currency) Save(ctx context.Context) error {
+	tx, err := c.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.currencies().insert(ctx, c)
+	if err != nil {
+		if err == errUniqueViolation {
+			return currencyConflictError
+		}
+
+		return err
+	}
+
+	for kind, schedule := range c.feeSchedules {
+		err = tx.currencies().saveFeeSchedule(ctx, c.symbol, kind, schedule)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, address := range []string{c.serviceWallet, c.feeWallet, c.issuanceWallet} {
+		err = tx.wallets().insert(ctx, systemOwner, address, c.symbol)
+		if err != nil {
+			if err == errUniqueViolation {
+				return currencyConflictError
+			}
+
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// SetEnabled enables or disables the currency.
+// New users get wallets only for enabled currencies, existing wallets keep working
+func (c *Currency) SetEnabled(ctx context.Context, enabled bool) error {
+	err := c.store.currencies().setEnabled(ctx, c.symbol, enabled)
+	if err != nil {
+		return err
+	}
+
+	c.enabled = enabled
+	return nil
+}
+
+// SetFeeSchedule replaces the fee schedule of the transaction kind
+func (c *Currency) SetFeeSchedule(ctx context.Context, kind TransactionKind, schedule FeeSchedule) error {
+	if !chargeableKind(kind) || schedule == nil {
+		return invalidFeeSchedule
+	}
+
+	err := c.store.currencies().saveFeeSchedule(ctx, c.symbol, kind, schedule)
+	if err != nil {
+		return err
+	}
+
+	c.feeSchedules[kind] = schedule
+	return nil
+}
+
+// FeeSchedule returns the fee schedule of the transaction kind, kinds without a schedule are not charged
+func (c *Currency) FeeSchedule(kind TransactionKind) FeeSchedule {
+	schedule, ok := c.feeSchedules[kind]
+	if !ok {
+		return noFee
+	}
+
+	return schedule
+}
+
+func (c *Currency) FeeSchedules() map[TransactionKind]FeeSchedule {
+	return c.feeSchedules
+}
+
+// CalculateFee returns the fee for the amount rounded to the currency precision and the applied fee policy
+func (c *Currency) CalculateFee(kind TransactionKind, amount decimal.Decimal) (decimal.Decimal, string) {
+	schedule := c.FeeSchedule(kind)
+	return schedule.Fee(amount).Round(c.precision), schedule.Policy()
+}
+
+// ValidateAmount checks that the amount is positive and fits the currency precision
+func (c *Currency) ValidateAmount(amount decimal.Decimal) error {
+	if amount.Equal(decimal.Zero) || amount.IsNegative() {
+		return invalidAmount
+	}
+
+	if !amount.Equal(amount.Truncate(c.precision)) {
+		return tooPreciseAmount
+	}
+
+	return nil
+}
+
+func (c *Currency) Symbol() string {
+	return c.symbol
+}
+
+func (c *Currency) Name() string {
+	return c.name
+}
+
+func (c *Currency) Precision() int32 {
+	return c.precision
+}
+
+func (c *Currency) SignupBonus() decimal.Decimal {
+	return c.signupBonus
+}
+
+func (c *Currency) ServiceWallet() string {
+	return c.serviceWallet
+}
+
+func (c *Currency) FeeWallet() string {
+	return c.feeWallet
+}
+
+func (c *Currency) IssuanceWallet() string {
+	return c.issuanceWallet
+}
+
+func (c *Currency) Enabled() bool {
+	return c.enabled
+}
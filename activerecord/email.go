@@ -0,0 +1,39 @@
+package activerecord
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+)
+
+// EmailValidator checks emails of new users. Emails are normalized before they are validated.
+// It returns false for emails which are not accepted and an error only if the check itself has failed
+type EmailValidator interface {
+	ValidateEmail(ctx context.Context, email string) (bool, error)
+}
+
+// SyntaxEmailValidator accepts plain addresses like user@example.com without checking that their domains exist
+type SyntaxEmailValidator struct{}
+
+func (SyntaxEmailValidator) ValidateEmail(_ context.Context, email string) (bool, error) {
+	if strings.ContainsAny(email, " <>") {
+		return false, nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// NormalizeEmail trims and lowercases the email, emails are stored and looked up normalized
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EmailDomain returns the part of the email after the last @
+func EmailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
@@ -0,0 +1,84 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EmailTokenPurpose string
+
+const (
+	VerifyEmailToken   EmailTokenPurpose = "verify_email"
+	ResetPasswordToken EmailTokenPurpose = "reset_password"
+)
+
+func newEmailTokenFactory(store store) EmailTokenFactory {
+	return EmailTokenFactory{
+		store: store,
+	}
+}
+
+// EmailTokenFactory manages single-use tokens which are sent to users by email.
+// Records only make tokens single-use, the tokens themselves are signed by the service
+type EmailTokenFactory struct {
+	store store
+}
+
+func (f EmailTokenFactory) Issue(ctx context.Context, userID uuid.UUID, purpose EmailTokenPurpose, ttl time.Duration) (*EmailToken, error) {
+	now := time.Now().UTC()
+	t := &EmailToken{
+		id:        uuid.New(),
+		userID:    userID,
+		purpose:   purpose,
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+	}
+
+	err := f.store.emailTokens().insert(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Use marks the token as used. Used, expired and unknown tokens are rejected
+func (f EmailTokenFactory) Use(ctx context.Context, id uuid.UUID, purpose EmailTokenPurpose) (*EmailToken, error) {
+	t, err := f.store.emailTokens().use(ctx, id, purpose, time.Now().UTC())
+	if err != nil {
+		if _, ok := err.(NotFoundError); ok {
+			return nil, invalidEmailToken
+		}
+
+		return nil, err
+	}
+
+	return t, nil
+}
+
+type EmailToken struct {
+	id        uuid.UUID
+	userID    uuid.UUID
+	purpose   EmailTokenPurpose
+	createdAt time.Time
+	expiresAt time.Time
+	usedAt    *time.Time
+}
+
+func (t *EmailToken) ID() uuid.UUID {
+	return t.id
+}
+
+func (t *EmailToken) UserID() uuid.UUID {
+	return t.userID
+}
+
+func (t *EmailToken) Purpose() EmailTokenPurpose {
+	return t.purpose
+}
+
+func (t *EmailToken) ExpiresAt() time.Time {
+	return t.expiresAt
+}
@@ -14,15 +14,52 @@ type NotFoundError struct {
 	error
 }
 
+type InsufficientFundsError struct {
+	error
+}
+
+// UnauthorizedError means that the presented credentials are not accepted
+type UnauthorizedError struct {
+	error
+}
+
 var (
-	invalidPasswordError   = ValidationError{errors.New("invalid password")}
-	invalidEmailError      = ValidationError{errors.New("invalid email")}
-	invalidFirstNameError  = ValidationError{errors.New("invalid first name")}
-	invalidLastNameError   = ValidationError{errors.New("invalid last name")}
-	invalidCurrency        = ValidationError{errors.New("invalid currency")}
-	invalidAddress         = ValidationError{errors.New("invalid address")}
-	invalidAmount          = ValidationError{errors.New("invalid amount")}
-	emailConflictError     = ConflictError{errors.New("user with such email already exists")}
-	walletCurrencyMismatch = ConflictError{errors.New("wallet currency mismatch")}
-	notFoundError          = ConflictError{errors.New("not found")}
+	invalidPasswordError     = ValidationError{errors.New("invalid password")}
+	invalidEmailError        = ValidationError{errors.New("invalid email")}
+	invalidFirstNameError    = ValidationError{errors.New("invalid first name")}
+	invalidLastNameError     = ValidationError{errors.New("invalid last name")}
+	invalidCurrency          = ValidationError{errors.New("invalid currency")}
+	invalidCurrencySymbol    = ValidationError{errors.New("invalid currency symbol")}
+	invalidCurrencyName      = ValidationError{errors.New("invalid currency name")}
+	invalidCurrencyPrecision = ValidationError{errors.New("invalid currency precision")}
+	invalidFeeSchedule       = ValidationError{errors.New("invalid fee schedule")}
+	invalidSignupBonus       = ValidationError{errors.New("invalid signup bonus")}
+	invalidAddress           = ValidationError{errors.New("invalid address")}
+	invalidAmount            = ValidationError{errors.New("invalid amount")}
+	tooPreciseAmount         = ValidationError{errors.New("amount has too many decimal places")}
+	invalidDirection         = ValidationError{errors.New("invalid direction")}
+	invalidCursor            = ValidationError{errors.New("invalid cursor")}
+	invalidSupplyReason      = ValidationError{errors.New("reason of supply change is required")}
+	invalidSigningAlgorithm  = ValidationError{errors.New("invalid signing algorithm")}
+	invalidAPIKeyName        = ValidationError{errors.New("invalid API key name")}
+	invalidScope             = ValidationError{errors.New("invalid scope")}
+	invalidAPIKeyExpiry      = ValidationError{errors.New("API key expiry must be in the future")}
+	invalidIPAllowlist       = ValidationError{errors.New("invalid IP allowlist")}
+	invalidEmailToken        = ValidationError{errors.New("invalid or expired token")}
+	emptyJournalEntry        = ValidationError{errors.New("journal entry has no postings")}
+	unbalancedJournalEntry   = ValidationError{errors.New("journal entry postings do not sum up to zero")}
+	sameWalletTransfer       = ValidationError{errors.New("cannot transfer to the same wallet")}
+	emailConflictError       = ConflictError{errors.New("user with such email already exists")}
+	walletCurrencyMismatch   = ConflictError{errors.New("wallet currency mismatch")}
+	currencyConflictError    = ConflictError{errors.New("currency with such symbol or service wallet already exists")}
+	twoFactorAlreadyEnabled  = ConflictError{errors.New("two-factor authentication is already enabled")}
+	twoFactorNotEnabled      = ConflictError{errors.New("two-factor authentication is not enabled")}
+	notFoundError            = NotFoundError{errors.New("not found")}
+	insufficientFunds        = InsufficientFundsError{errors.New("insufficient funds")}
+	treasuryDepleted         = InsufficientFundsError{errors.New("treasury has insufficient funds")}
+	invalidRefreshToken      = UnauthorizedError{errors.New("invalid refresh token")}
+	refreshTokenReused       = UnauthorizedError{errors.New("refresh token has already been used, the session is revoked")}
+	invalidOTP               = UnauthorizedError{errors.New("invalid one-time password")}
+	invalidAPIKey            = UnauthorizedError{errors.New("invalid API key")}
+	apiKeyIPNotAllowed       = UnauthorizedError{errors.New("API key is not allowed from this IP")}
 )
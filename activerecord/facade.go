@@ -2,12 +2,11 @@ package activerecord
 
 import (
 	"context"
+	"sort"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
-)
-
-const (
-	uniqueConstraintViolation = "23505"
+	"github.com/shopspring/decimal"
 )
 
 type DBTransaction interface {
@@ -16,32 +15,202 @@ type DBTransaction interface {
 }
 
 type Facade interface {
-	Tx(ctx context.Context) (DBTransaction, error)
+	// Tx begins a DB transaction and returns a facade scoped to it.
+	// Factories of the scoped facade and all records produced by them use the DB transaction.
+	// Calling Tx on a scoped facade creates a savepoint
+	Tx(ctx context.Context) (TxFacade, error)
+	// WithTx runs fn with a scoped facade, commits the DB transaction if fn succeeds and rolls it back otherwise
+	WithTx(ctx context.Context, fn func(Facade) error) error
 	User() UserFactory
 	Wallet() WalletFactory
+	Currency() CurrencyRegistry
+	IdempotencyKey() IdempotencyKeyFactory
+	Session() SessionFactory
+	// SigningKey returns the factory of access token keys, which encrypts and decrypts private keys with the secret
+	SigningKey(secret []byte) SigningKeyFactory
+	APIKey() APIKeyFactory
+	TwoFactor() TwoFactorFactory
+	LoginThrottle() LoginThrottle
+	EmailToken() EmailTokenFactory
+	Audit() AuditLog
+	Ledger() Ledger
+	Treasury() Treasury
+	// Reconcile checks the ledger invariants and reports their violations
+	Reconcile(ctx context.Context) (*ReconciliationReport, error)
+	Transfer(ctx context.Context, owner uuid.UUID, from, to string, amount decimal.Decimal) (*Transaction, error)
+}
+
+type TxFacade interface {
+	Facade
+	DBTransaction
 }
 
-func New(db *pgxpool.Pool) Facade {
-	return facade{db}
+// New creates a facade over the pool. New users' emails are checked by emailValidator,
+// SyntaxEmailValidator is used if it is nil
+func New(db *pgxpool.Pool, emailValidator EmailValidator) Facade {
+	if emailValidator == nil {
+		emailValidator = SyntaxEmailValidator{}
+	}
+
+	return facade{
+		store:          postgresStore{db: db},
+		emailValidator: emailValidator,
+	}
 }
 
 type facade struct {
-	db *pgxpool.Pool
+	store          store
+	emailValidator EmailValidator
 }
 
 func (f facade) User() UserFactory {
-	return newUserFactory(f.db)
+	return newUserFactory(f.store, f.emailValidator)
 }
 
 func (f facade) Wallet() WalletFactory {
-	return newWalletFactory(f.db)
+	return newWalletFactory(f.store)
+}
+
+func (f facade) Currency() CurrencyRegistry {
+	return newCurrencyRegistry(f.store)
+}
+
+func (f facade) IdempotencyKey() IdempotencyKeyFactory {
+	return newIdempotencyKeyFactory(f.store)
+}
+
+func (f facade) Session() SessionFactory {
+	return newSessionFactory(f.store)
+}
+
+func (f facade) SigningKey(secret []byte) SigningKeyFactory {
+	return newSigningKeyFactory(f.store, secret)
+}
+
+func (f facade) APIKey() APIKeyFactory {
+	return newAPIKeyFactory(f.store)
+}
+
+func (f facade) TwoFactor() TwoFactorFactory {
+	return newTwoFactorFactory(f.store)
+}
+
+func (f facade) LoginThrottle() LoginThrottle {
+	return newLoginThrottle(f.store)
+}
+
+func (f facade) EmailToken() EmailTokenFactory {
+	return newEmailTokenFactory(f.store)
+}
+
+func (f facade) Audit() AuditLog {
+	return newAuditLog(f.store)
+}
+
+func (f facade) Ledger() Ledger {
+	return newLedger(f.store)
+}
+
+func (f facade) Treasury() Treasury {
+	return newTreasury(f.store)
 }
 
-func (f facade) Tx(ctx context.Context) (DBTransaction, error) {
-	tx, err := f.db.Begin(ctx)
+func (f facade) Tx(ctx context.Context) (TxFacade, error) {
+	tx, err := f.store.begin(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return tx, nil
+	return txFacade{
+		facade: facade{
+			store:          tx,
+			emailValidator: f.emailValidator,
+		},
+		tx:     tx,
+	}, nil
+}
+
+func (f facade) WithTx(ctx context.Context, fn func(Facade) error) error {
+	tx, err := f.Tx(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback(ctx)
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		// The original error is more valuable for the caller than the rollback one.
+		// If the rollback fails, the connection is closed and Postgres discards the DB transaction anyway
+		_ = tx.Rollback(ctx)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Transfer moves amount from the owner's wallet to the wallet with the given address.
+// Both wallets are locked for the whole DB transaction, so concurrent transfers
+// from the same wallet are serialized and cannot overdraw it. They are locked in the order of their addresses,
+// so transfers in opposite directions between the same wallets do not deadlock
+func (f facade) Transfer(ctx context.Context, owner uuid.UUID, from, to string, amount decimal.Decimal) (*Transaction, error) {
+	if from == to {
+		return nil, sameWalletTransfer
+	}
+
+	var t *Transaction
+	err := f.WithTx(ctx, func(tx Facade) error {
+		addresses := []string{from, to}
+		sort.Strings(addresses)
+
+		locked := make(map[string]*Wallet, len(addresses))
+		for _, address := range addresses {
+			w, err := tx.Wallet().FindByAddressForUpdate(ctx, address)
+			if err != nil {
+				return err
+			}
+
+			locked[address] = w
+		}
+
+		sender, receiver := locked[from], locked[to]
+		if sender.UserID() != owner {
+			return notFoundError
+		}
+
+		var err error
+		t, err = receiver.AcceptTransaction(sender, amount)
+		if err != nil {
+			return err
+		}
+
+		if sender.Balance().LessThan(t.FullAmount()) {
+			return insufficientFunds
+		}
+
+		return t.Save(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+type txFacade struct {
+	facade
+	tx txStore
+}
+
+func (f txFacade) Commit(ctx context.Context) error {
+	return f.tx.Commit(ctx)
+}
+
+func (f txFacade) Rollback(ctx context.Context) error {
+	return f.tx.Rollback(ctx)
 }
@@ -0,0 +1,245 @@
+package activerecord
+
+import (
+	"encoding/json"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	flatFeeType       = "flat"
+	percentageFeeType = "percentage"
+	tieredFeeType     = "tiered"
+	cappedFeeType     = "capped"
+)
+
+// FeeSchedule calculates the fee charged from the sender of a transaction
+type FeeSchedule interface {
+	Fee(amount decimal.Decimal) decimal.Decimal
+	// Policy is a JSON description of the schedule, it is recorded on every transaction charged by the schedule
+	Policy() string
+	spec() feeScheduleSpec
+}
+
+// noFee is used for transaction kinds without a configured fee schedule
+var noFee FeeSchedule = FlatFee{Amount: decimal.Zero}
+
+// FlatFee charges the same fee regardless of the amount
+type FlatFee struct {
+	Amount decimal.Decimal
+}
+
+func (f FlatFee) Fee(decimal.Decimal) decimal.Decimal {
+	return f.Amount
+}
+
+func (f FlatFee) Policy() string {
+	return policy(f)
+}
+
+func (f FlatFee) spec() feeScheduleSpec {
+	return feeScheduleSpec{Type: flatFeeType, Amount: &f.Amount}
+}
+
+// PercentageFee charges a share of the amount, e.g. 0.2 is 20%
+type PercentageFee struct {
+	Rate decimal.Decimal
+}
+
+func (f PercentageFee) Fee(amount decimal.Decimal) decimal.Decimal {
+	return amount.Mul(f.Rate)
+}
+
+func (f PercentageFee) Policy() string {
+	return policy(f)
+}
+
+func (f PercentageFee) spec() feeScheduleSpec {
+	return feeScheduleSpec{Type: percentageFeeType, Rate: &f.Rate}
+}
+
+type FeeTier struct {
+	// From is the minimal amount the tier applies to
+	From     decimal.Decimal
+	Schedule FeeSchedule
+}
+
+// TieredFee applies the schedule of the tier with the greatest From which is not greater than the amount.
+// Tiers are sorted by From in ascending order, amounts below the first tier are not charged
+type TieredFee struct {
+	Tiers []FeeTier
+}
+
+func (f TieredFee) Fee(amount decimal.Decimal) decimal.Decimal {
+	fee := decimal.Zero
+	for _, t := range f.Tiers {
+		if amount.LessThan(t.From) {
+			break
+		}
+
+		fee = t.Schedule.Fee(amount)
+	}
+
+	return fee
+}
+
+func (f TieredFee) Policy() string {
+	return policy(f)
+}
+
+func (f TieredFee) spec() feeScheduleSpec {
+	s := feeScheduleSpec{Type: tieredFeeType}
+	for _, t := range f.Tiers {
+		from := t.From
+		schedule := t.Schedule.spec()
+		s.Tiers = append(s.Tiers, feeTierSpec{From: &from, Schedule: &schedule})
+	}
+
+	return s
+}
+
+// CappedFee keeps the fee of the underlying schedule within [Min, Max]
+type CappedFee struct {
+	Schedule FeeSchedule
+	Min      decimal.NullDecimal
+	Max      decimal.NullDecimal
+}
+
+func (f CappedFee) Fee(amount decimal.Decimal) decimal.Decimal {
+	fee := f.Schedule.Fee(amount)
+	if f.Min.Valid && fee.LessThan(f.Min.Decimal) {
+		fee = f.Min.Decimal
+	}
+
+	if f.Max.Valid && fee.GreaterThan(f.Max.Decimal) {
+		fee = f.Max.Decimal
+	}
+
+	return fee
+}
+
+func (f CappedFee) Policy() string {
+	return policy(f)
+}
+
+func (f CappedFee) spec() feeScheduleSpec {
+	schedule := f.Schedule.spec()
+	s := feeScheduleSpec{Type: cappedFeeType, Schedule: &schedule}
+	if f.Min.Valid {
+		s.Min = &f.Min.Decimal
+	}
+
+	if f.Max.Valid {
+		s.Max = &f.Max.Decimal
+	}
+
+	return s
+}
+
+// ParseFeeSchedule parses the JSON description of a fee schedule, e.g.
+//	{"type":"capped","schedule":{"type":"percentage","rate":"0.01"},"min":"0.1","max":"10"}
+func ParseFeeSchedule(data []byte) (FeeSchedule, error) {
+	var s feeScheduleSpec
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, invalidFeeSchedule
+	}
+
+	return s.schedule()
+}
+
+type feeScheduleSpec struct {
+	Type     string           `json:"type"`
+	Amount   *decimal.Decimal `json:"amount,omitempty"`
+	Rate     *decimal.Decimal `json:"rate,omitempty"`
+	Tiers    []feeTierSpec    `json:"tiers,omitempty"`
+	Schedule *feeScheduleSpec `json:"schedule,omitempty"`
+	Min      *decimal.Decimal `json:"min,omitempty"`
+	Max      *decimal.Decimal `json:"max,omitempty"`
+}
+
+type feeTierSpec struct {
+	From     *decimal.Decimal `json:"from"`
+	Schedule *feeScheduleSpec `json:"schedule"`
+}
+
+func (s feeScheduleSpec) schedule() (FeeSchedule, error) {
+	switch s.Type {
+	case flatFeeType:
+		if s.Amount == nil || s.Amount.IsNegative() {
+			return nil, invalidFeeSchedule
+		}
+
+		return FlatFee{Amount: *s.Amount}, nil
+	case percentageFeeType:
+		if s.Rate == nil || s.Rate.IsNegative() || s.Rate.GreaterThan(decimal.NewFromInt(1)) {
+			return nil, invalidFeeSchedule
+		}
+
+		return PercentageFee{Rate: *s.Rate}, nil
+	case tieredFeeType:
+		if len(s.Tiers) == 0 {
+			return nil, invalidFeeSchedule
+		}
+
+		var f TieredFee
+		for i, t := range s.Tiers {
+			if t.From == nil || t.From.IsNegative() || t.Schedule == nil {
+				return nil, invalidFeeSchedule
+			}
+
+			if i > 0 && !t.From.GreaterThan(*s.Tiers[i-1].From) {
+				return nil, invalidFeeSchedule
+			}
+
+			schedule, err := t.Schedule.schedule()
+			if err != nil {
+				return nil, err
+			}
+
+			f.Tiers = append(f.Tiers, FeeTier{From: *t.From, Schedule: schedule})
+		}
+
+		return f, nil
+	case cappedFeeType:
+		if s.Schedule == nil {
+			return nil, invalidFeeSchedule
+		}
+
+		schedule, err := s.Schedule.schedule()
+		if err != nil {
+			return nil, err
+		}
+
+		f := CappedFee{Schedule: schedule}
+		if s.Min != nil {
+			if s.Min.IsNegative() {
+				return nil, invalidFeeSchedule
+			}
+
+			f.Min = decimal.NullDecimal{Decimal: *s.Min, Valid: true}
+		}
+
+		if s.Max != nil {
+			if s.Max.IsNegative() || (s.Min != nil && s.Max.LessThan(*s.Min)) {
+				return nil, invalidFeeSchedule
+			}
+
+			f.Max = decimal.NullDecimal{Decimal: *s.Max, Valid: true}
+		}
+
+		return f, nil
+	default:
+		return nil, invalidFeeSchedule
+	}
+}
+
+func policy(f FeeSchedule) string {
+	b, err := json.Marshal(f.spec())
+	if err != nil {
+		// feeScheduleSpec consists of strings and decimals only, marshaling cannot fail
+		panic(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,114 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+)
+
+func newIdempotencyKeyFactory(store store) IdempotencyKeyFactory {
+	return IdempotencyKeyFactory{
+		store: store,
+	}
+}
+
+type IdempotencyKeyFactory struct {
+	store store
+}
+
+// Claim reserves the key within the scope for the request with the given hash.
+// If the key is already reserved and not expired, the existing key is returned and claimed is false
+func (f IdempotencyKeyFactory) Claim(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (k *IdempotencyKey, claimed bool, err error) {
+	now := time.Now().UTC()
+	k = &IdempotencyKey{
+		store:       f.store,
+		scope:       scope,
+		key:         key,
+		requestHash: requestHash,
+		createdAt:   now,
+		expiresAt:   now.Add(ttl),
+	}
+
+	// Expired keys are taken over as if they did not exist
+	claimed, err = f.store.idempotencyKeys().claim(ctx, k)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if claimed {
+		return k, true, nil
+	}
+
+	k, err = f.store.idempotencyKeys().find(ctx, scope, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	k.store = f.store
+	return k, false, nil
+}
+
+// DeleteExpired removes expired keys and returns the number of removed keys
+func (f IdempotencyKeyFactory) DeleteExpired(ctx context.Context) (int64, error) {
+	return f.store.idempotencyKeys().deleteExpired(ctx, time.Now().UTC())
+}
+
+// IdempotencyKey stores the response of the first request made with the key,
+// so that retries of the same request get the same response instead of repeating side effects
+type IdempotencyKey struct {
+	store       store
+	scope       string
+	key         string
+	requestHash string
+	// status is zero while the first request is in progress
+	status      int
+	contentType string
+	response    []byte
+	createdAt   time.Time
+	expiresAt   time.Time
+}
+
+// Complete stores the response of the request
+func (k *IdempotencyKey) Complete(ctx context.Context, status int, contentType string, response []byte) error {
+	err := k.store.idempotencyKeys().complete(ctx, k.scope, k.key, status, contentType, response)
+	if err != nil {
+		return err
+	}
+
+	k.status = status
+	k.contentType = contentType
+	k.response = response
+	return nil
+}
+
+// Release removes the key, so the request can be retried with it
+func (k *IdempotencyKey) Release(ctx context.Context) error {
+	return k.store.idempotencyKeys().delete(ctx, k.scope, k.key)
+}
+
+func (k *IdempotencyKey) Key() string {
+	return k.key
+}
+
+func (k *IdempotencyKey) RequestHash() string {
+	return k.requestHash
+}
+
+func (k *IdempotencyKey) Completed() bool {
+	return k.status != 0
+}
+
+func (k *IdempotencyKey) Status() int {
+	return k.status
+}
+
+func (k *IdempotencyKey) ContentType() string {
+	return k.contentType
+}
+
+func (k *IdempotencyKey) Response() []byte {
+	return k.response
+}
+
+func (k *IdempotencyKey) ExpiresAt() time.Time {
+	return k.expiresAt
+}
@@ -0,0 +1,219 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func newLedger(store store) Ledger {
+	return Ledger{
+		store: store,
+	}
+}
+
+// Ledger is a double-entry journal. Every business operation is a journal entry
+// whose postings sum up to zero per currency, so funds are never created or lost implicitly.
+// Wallet balances are the sums of their postings
+type Ledger struct {
+	store store
+}
+
+func (l Ledger) NewEntry(kind TransactionKind, description string) *JournalEntry {
+	return newJournalEntry(l.store, uuid.New(), kind, description, time.Now().UTC())
+}
+
+// Post saves the entry and applies its postings to the stored wallet balances
+func (l Ledger) Post(ctx context.Context, entry *JournalEntry) error {
+	entry.store = l.store
+	return entry.Save(ctx)
+}
+
+func (l Ledger) FindEntry(ctx context.Context, id uuid.UUID) (*JournalEntry, error) {
+	e, err := l.store.ledger().findEntry(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	e.store = l.store
+	return e, nil
+}
+
+// FindPostings returns all postings of the wallet in the order they were posted
+func (l Ledger) FindPostings(ctx context.Context, wallet string) ([]Posting, error) {
+	return l.store.ledger().findPostings(ctx, wallet)
+}
+
+// Balance sums up all postings of the wallet
+func (l Ledger) Balance(ctx context.Context, wallet string) (decimal.Decimal, error) {
+	return l.store.ledger().balance(ctx, wallet)
+}
+
+// BalanceAt returns the balance of the wallet at the moment, postings made exactly at the moment are included.
+// It starts from the latest end-of-day snapshot before the moment, so only the postings after it are summed up
+func (l Ledger) BalanceAt(ctx context.Context, wallet string, at time.Time) (decimal.Decimal, error) {
+	return l.store.ledger().balanceAt(ctx, wallet, at.UTC())
+}
+
+// SnapshotDelay is how long after its end a day is snapshotted. Postings are dated when their journal entry is created,
+// so a DB transaction which is still running at midnight may commit postings of the previous day later.
+// Snapshotted days are never recomputed, so DB transactions which post must be shorter than the delay
+const SnapshotDelay = 10 * time.Minute
+
+// SnapshotBalances stores end-of-day balances for every day which ended at least SnapshotDelay before the moment
+// and has not been snapshotted yet, and returns the number of snapshotted days.
+// Snapshots are sparse: a wallet gets a snapshot only for the days it has postings on
+func (l Ledger) SnapshotBalances(ctx context.Context, until time.Time) (int, error) {
+	from, err := l.store.ledger().nextSnapshotDay(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if from == nil {
+		return 0, nil
+	}
+
+	until = until.Add(-SnapshotDelay).UTC()
+	days := 0
+	for day := *from; !day.AddDate(0, 0, 1).After(until); day = day.AddDate(0, 0, 1) {
+		err := l.snapshotDay(ctx, day)
+		if err != nil {
+			return days, err
+		}
+
+		days++
+	}
+
+	return days, nil
+}
+
+func (l Ledger) snapshotDay(ctx context.Context, day time.Time) error {
+	tx, err := l.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.ledger().snapshotDay(ctx, day)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Posting changes the wallet balance by the signed amount
+type Posting struct {
+	EntryID   uuid.UUID
+	Wallet    string
+	Currency  string
+	Amount    decimal.Decimal
+	CreatedAt time.Time
+}
+
+func newJournalEntry(store store, id uuid.UUID, kind TransactionKind, description string, createdAt time.Time) *JournalEntry {
+	return &JournalEntry{
+		store:       store,
+		id:          id,
+		kind:        kind,
+		description: description,
+		createdAt:   createdAt,
+	}
+}
+
+type JournalEntry struct {
+	store       store
+	id          uuid.UUID
+	kind        TransactionKind
+	description string
+	createdAt   time.Time
+	postings    []Posting
+}
+
+// Credit increases the wallet balance by the amount
+func (e *JournalEntry) Credit(wallet, currency string, amount decimal.Decimal) *JournalEntry {
+	return e.post(wallet, currency, amount)
+}
+
+// Debit decreases the wallet balance by the amount
+func (e *JournalEntry) Debit(wallet, currency string, amount decimal.Decimal) *JournalEntry {
+	return e.post(wallet, currency, amount.Neg())
+}
+
+func (e *JournalEntry) post(wallet, currency string, amount decimal.Decimal) *JournalEntry {
+	if amount.IsZero() {
+		return e
+	}
+
+	e.postings = append(e.postings, Posting{
+		EntryID:   e.id,
+		Wallet:    wallet,
+		Currency:  currency,
+		Amount:    amount,
+		CreatedAt: e.createdAt,
+	})
+	return e
+}
+
+// Balanced tells if the postings sum up to zero in every currency
+func (e *JournalEntry) Balanced() bool {
+	sums := make(map[string]decimal.Decimal)
+	for _, p := range e.postings {
+		sums[p.Currency] = sums[p.Currency].Add(p.Amount)
+	}
+
+	for _, s := range sums {
+		if !s.IsZero() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Save inserts the entry with its postings and applies them to the stored balances in one DB transaction.
+// Postgres checks that the entry is balanced on commit as well
+func (e *JournalEntry) Save(ctx context.Context) error {
+	if len(e.postings) == 0 {
+		return emptyJournalEntry
+	}
+
+	if !e.Balanced() {
+		return unbalancedJournalEntry
+	}
+
+	tx, err := e.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.ledger().insert(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (e *JournalEntry) ID() uuid.UUID {
+	return e.id
+}
+
+func (e *JournalEntry) Kind() TransactionKind {
+	return e.kind
+}
+
+func (e *JournalEntry) Description() string {
+	return e.description
+}
+
+func (e *JournalEntry) CreatedAt() time.Time {
+	return e.createdAt
+}
+
+func (e *JournalEntry) Postings() []Posting {
+	return e.postings
+}
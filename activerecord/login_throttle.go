@@ -0,0 +1,110 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+)
+
+// ThrottlePolicy defines how failed attempts slow down the next ones
+type ThrottlePolicy struct {
+	// FreeAttempts is how many failures are not delayed
+	FreeAttempts int
+	// BaseDelay is the delay after the first delayed failure, it doubles with every next one up to Lockout
+	BaseDelay time.Duration
+	// LockoutAttempts is the number of failures which locks the key out for Lockout
+	LockoutAttempts int
+	Lockout         time.Duration
+	// Window is how long a failure is remembered since the last one
+	Window time.Duration
+}
+
+// backoff returns the delay after the failure. A delay never blocks longer than a lockout,
+// the doubling stops there, so it cannot overflow however many failures there are
+func (p ThrottlePolicy) backoff(failures int) time.Duration {
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.Lockout; i++ {
+		delay *= 2
+	}
+
+	if delay > p.Lockout {
+		return p.Lockout
+	}
+
+	return delay
+}
+
+func newLoginThrottle(store store) LoginThrottle {
+	return LoginThrottle{
+		store: store,
+	}
+}
+
+// LoginThrottle counts failed sign in attempts by keys, such as an account or a client IP,
+// and blocks keys with too many failures
+type LoginThrottle struct {
+	store store
+}
+
+// AccountThrottleKey returns the key of the account with the email, it does not depend on whether the account exists
+func AccountThrottleKey(email string) string {
+	return "account:" + NormalizeEmail(email)
+}
+
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// BlockedUntil returns the latest moment until which any of the keys is blocked, or zero time if none of them is blocked
+func (t LoginThrottle) BlockedUntil(ctx context.Context, now time.Time, keys ...string) (time.Time, error) {
+	until, err := t.store.loginThrottles().blockedUntil(ctx, keys, now.UTC())
+	if err != nil || until == nil {
+		return time.Time{}, err
+	}
+
+	return *until, nil
+}
+
+// Fail counts a failure of the key and blocks it according to the policy.
+// It tells if the key has been locked out
+func (t LoginThrottle) Fail(ctx context.Context, key string, policy ThrottlePolicy, now time.Time) (bool, error) {
+	now = now.UTC()
+	tx, err := t.store.begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	failures, lastFailureAt, err := tx.loginThrottles().failures(ctx, key, now)
+	if err != nil {
+		return false, err
+	}
+
+	if now.Sub(lastFailureAt) > policy.Window {
+		failures = 0
+	}
+	failures++
+
+	var blockedUntil *time.Time
+	locked := false
+	switch {
+	case failures >= policy.LockoutAttempts:
+		until := now.Add(policy.Lockout)
+		blockedUntil = &until
+		locked = true
+	case failures > policy.FreeAttempts:
+		until := now.Add(policy.backoff(failures))
+		blockedUntil = &until
+	}
+
+	err = tx.loginThrottles().update(ctx, key, failures, now, blockedUntil)
+	if err != nil {
+		return false, err
+	}
+
+	return locked, tx.Commit(ctx)
+}
+
+// Reset forgets the failures of the keys and unblocks them
+func (t LoginThrottle) Reset(ctx context.Context, keys ...string) error {
+	return t.store.loginThrottles().delete(ctx, keys)
+}
@@ -0,0 +1,460 @@
+package activerecord
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// errTxClosed is returned when a committed or rolled back DB transaction of the memory store is used
+var errTxClosed = errors.New("tx is closed")
+
+// NewMemory creates a facade which keeps the records in memory, e.g. for tests which do not need Postgres.
+// The store starts with the currencies and the genesis supply created by the migrations.
+// New users' emails are checked by emailValidator, SyntaxEmailValidator is used if it is nil
+func NewMemory(emailValidator EmailValidator) Facade {
+	if emailValidator == nil {
+		emailValidator = SyntaxEmailValidator{}
+	}
+
+	s := memoryStore{
+		db: &memoryDB{
+			lock: make(chan struct{}, 1),
+			data: newMemoryData(),
+		},
+	}
+
+	err := seedMemory(context.Background(), s)
+	if err != nil {
+		panic(err)
+	}
+
+	return facade{
+		store:          s,
+		emailValidator: emailValidator,
+	}
+}
+
+// seedMemory creates the currencies of the migrations, every currency gets a genesis mint of 1000000 coins
+func seedMemory(ctx context.Context, s memoryStore) error {
+	currencies := []struct {
+		symbol        string
+		name          string
+		precision     int32
+		serviceWallet string
+	}{
+		{"fBTC", "Fake Bitcoin", 8, strings.Repeat("0", 64)},
+		{"fETH", "Fake Ether", 18, strings.Repeat("1", 64)},
+	}
+
+	for _, seed := range currencies {
+		c := &Currency{
+			store:     s,
+			symbol:    seed.symbol,
+			name:      seed.name,
+			precision: seed.precision,
+			feeSchedules: map[TransactionKind]FeeSchedule{
+				TransferTransaction: PercentageFee{Rate: decimal.RequireFromString("0.2")},
+				BonusTransaction:    FlatFee{Amount: decimal.Zero},
+				InternalTransaction: FlatFee{Amount: decimal.Zero},
+			},
+			signupBonus:    decimal.NewFromInt(100),
+			serviceWallet:  seed.serviceWallet,
+			feeWallet:      seedAddress("fee-" + seed.symbol),
+			issuanceWallet: seedAddress("issuance-" + seed.symbol),
+			enabled:        true,
+		}
+
+		err := c.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = newTreasury(s).Mint(ctx, c, decimal.NewFromInt(1000000), systemOwner, "genesis")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seedAddress derives the address of a system wallet the same way the migrations do
+func seedAddress(seed string) string {
+	hash := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(hash[:])
+}
+
+// memoryDB holds the committed data. A DB transaction holds the lock until it ends,
+// so DB transactions of the memory store are serialized, which is stricter than FOR UPDATE locks of Postgres
+type memoryDB struct {
+	lock chan struct{}
+	data *memoryData
+}
+
+func (db *memoryDB) acquire(ctx context.Context) error {
+	select {
+	case db.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (db *memoryDB) release() {
+	<-db.lock
+}
+
+// memoryTx works on a copy of the data of its parent, which replaces the parent data on commit.
+// The top-level DB transaction has no parent and replaces the committed data
+type memoryTx struct {
+	db     *memoryDB
+	parent *memoryTx
+	data   *memoryData
+	done   bool
+}
+
+func (t *memoryTx) Commit(context.Context) error {
+	if t.done {
+		return errTxClosed
+	}
+
+	t.done = true
+	if t.parent != nil {
+		t.parent.data = t.data
+		return nil
+	}
+
+	t.db.data = t.data
+	t.db.release()
+	return nil
+}
+
+func (t *memoryTx) Rollback(context.Context) error {
+	if t.done {
+		return errTxClosed
+	}
+
+	t.done = true
+	if t.parent == nil {
+		t.db.release()
+	}
+
+	return nil
+}
+
+// memoryStore keeps the records in memory. Outside of a DB transaction every repository call takes the lock,
+// so calls which change several records check everything before the first change
+type memoryStore struct {
+	db *memoryDB
+	tx *memoryTx
+}
+
+// beginSnapshot starts a DB transaction, which holds the lock until it ends, so nothing changes the records meanwhile
+func (s memoryStore) beginSnapshot(ctx context.Context) (txStore, error) {
+	return s.begin(ctx)
+}
+
+func (s memoryStore) begin(ctx context.Context) (txStore, error) {
+	tx := &memoryTx{
+		db:     s.db,
+		parent: s.tx,
+	}
+
+	if s.tx != nil {
+		if s.tx.done {
+			return nil, errTxClosed
+		}
+
+		tx.data = s.tx.data.clone()
+	} else {
+		err := s.db.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		tx.data = s.db.data.clone()
+	}
+
+	return memoryTxStore{
+		memoryStore: memoryStore{db: s.db, tx: tx},
+		memoryTx:    tx,
+	}, nil
+}
+
+// run calls fn with the data of the DB transaction, or with the committed data under the lock
+func (s memoryStore) run(ctx context.Context, fn func(d *memoryData) error) error {
+	if s.tx != nil {
+		if s.tx.done {
+			return errTxClosed
+		}
+
+		return fn(s.tx.data)
+	}
+
+	err := s.db.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.db.release()
+
+	return fn(s.db.data)
+}
+
+func (s memoryStore) users() userRepository {
+	return memoryUsers{s}
+}
+
+func (s memoryStore) wallets() walletRepository {
+	return memoryWallets{s}
+}
+
+func (s memoryStore) currencies() currencyRepository {
+	return memoryCurrencies{s}
+}
+
+func (s memoryStore) transactions() transactionRepository {
+	return memoryTransactions{s}
+}
+
+func (s memoryStore) ledger() ledgerRepository {
+	return memoryLedger{s}
+}
+
+func (s memoryStore) supply() supplyRepository {
+	return memorySupply{s}
+}
+
+func (s memoryStore) reconciliation() reconciliationRepository {
+	return memoryReconciliation{s}
+}
+
+func (s memoryStore) idempotencyKeys() idempotencyKeyRepository {
+	return memoryIdempotencyKeys{s}
+}
+
+func (s memoryStore) sessions() sessionRepository {
+	return memorySessions{s}
+}
+
+func (s memoryStore) signingKeys() signingKeyRepository {
+	return memorySigningKeys{s}
+}
+
+func (s memoryStore) apiKeys() apiKeyRepository {
+	return memoryAPIKeys{s}
+}
+
+func (s memoryStore) twoFactors() twoFactorRepository {
+	return memoryTwoFactors{s}
+}
+
+func (s memoryStore) loginThrottles() loginThrottleRepository {
+	return memoryLoginThrottles{s}
+}
+
+func (s memoryStore) emailTokens() emailTokenRepository {
+	return memoryEmailTokens{s}
+}
+
+func (s memoryStore) auditEvents() auditRepository {
+	return memoryAuditEvents{s}
+}
+
+type memoryTxStore struct {
+	memoryStore
+	*memoryTx
+}
+
+type (
+	memoryWallet struct {
+		userID   uuid.UUID
+		currency string
+	}
+
+	memoryBalance struct {
+		currency string
+		balance  decimal.Decimal
+	}
+
+	memoryFeeScheduleKey struct {
+		currency string
+		kind     TransactionKind
+	}
+
+	memoryEntry struct {
+		kind        TransactionKind
+		description string
+		createdAt   time.Time
+	}
+
+	memoryPosting struct {
+		id int64
+		Posting
+	}
+
+	memorySnapshotKey struct {
+		wallet string
+		day    time.Time
+	}
+
+	memoryIdempotencyKey struct {
+		scope string
+		key   string
+	}
+
+	memoryRefreshToken struct {
+		sessionID uuid.UUID
+		createdAt time.Time
+		usedAt    *time.Time
+	}
+
+	memoryRecoveryCode struct {
+		userID uuid.UUID
+		hash   string
+	}
+
+	memoryLoginThrottle struct {
+		failures      int
+		lastFailureAt time.Time
+		blockedUntil  *time.Time
+	}
+)
+
+// memoryData is a set of tables. Stored values are never changed in place, updates replace them,
+// so a copy of the maps is enough to isolate a DB transaction. Append-only slices are shared,
+// appending to a copy with a full capacity does not change the original
+type memoryData struct {
+	users          map[uuid.UUID]User
+	emails         map[string]uuid.UUID
+	wallets        map[string]memoryWallet
+	balances       map[string]memoryBalance
+	currencies     map[string]Currency
+	feeSchedules   map[memoryFeeScheduleKey]string
+	transactions   []Transaction
+	entries        map[uuid.UUID]memoryEntry
+	postings       []memoryPosting
+	snapshots      map[memorySnapshotKey]decimal.Decimal
+	snapshotDays   map[time.Time]struct{}
+	supply         []SupplyOperation
+	idempotency    map[memoryIdempotencyKey]IdempotencyKey
+	sessions       map[uuid.UUID]Session
+	refreshTokens  map[string]memoryRefreshToken
+	signingKeys    map[string]SigningKey
+	apiKeys        map[uuid.UUID]APIKey
+	twoFactors     map[uuid.UUID]TwoFactor
+	recoveryCodes  map[memoryRecoveryCode]*time.Time
+	loginThrottles map[string]memoryLoginThrottle
+	emailTokens    map[uuid.UUID]EmailToken
+	auditEvents    []AuditEvent
+}
+
+func newMemoryData() *memoryData {
+	return &memoryData{
+		users:          make(map[uuid.UUID]User),
+		emails:         make(map[string]uuid.UUID),
+		wallets:        make(map[string]memoryWallet),
+		balances:       make(map[string]memoryBalance),
+		currencies:     make(map[string]Currency),
+		feeSchedules:   make(map[memoryFeeScheduleKey]string),
+		entries:        make(map[uuid.UUID]memoryEntry),
+		snapshots:      make(map[memorySnapshotKey]decimal.Decimal),
+		snapshotDays:   make(map[time.Time]struct{}),
+		idempotency:    make(map[memoryIdempotencyKey]IdempotencyKey),
+		sessions:       make(map[uuid.UUID]Session),
+		refreshTokens:  make(map[string]memoryRefreshToken),
+		signingKeys:    make(map[string]SigningKey),
+		apiKeys:        make(map[uuid.UUID]APIKey),
+		twoFactors:     make(map[uuid.UUID]TwoFactor),
+		recoveryCodes:  make(map[memoryRecoveryCode]*time.Time),
+		loginThrottles: make(map[string]memoryLoginThrottle),
+		emailTokens:    make(map[uuid.UUID]EmailToken),
+	}
+}
+
+func (d *memoryData) clone() *memoryData {
+	c := newMemoryData()
+	for k, v := range d.users {
+		c.users[k] = v
+	}
+
+	for k, v := range d.emails {
+		c.emails[k] = v
+	}
+
+	for k, v := range d.wallets {
+		c.wallets[k] = v
+	}
+
+	for k, v := range d.balances {
+		c.balances[k] = v
+	}
+
+	for k, v := range d.currencies {
+		c.currencies[k] = v
+	}
+
+	for k, v := range d.feeSchedules {
+		c.feeSchedules[k] = v
+	}
+
+	for k, v := range d.entries {
+		c.entries[k] = v
+	}
+
+	for k, v := range d.snapshots {
+		c.snapshots[k] = v
+	}
+
+	for k, v := range d.snapshotDays {
+		c.snapshotDays[k] = v
+	}
+
+	for k, v := range d.idempotency {
+		c.idempotency[k] = v
+	}
+
+	for k, v := range d.sessions {
+		c.sessions[k] = v
+	}
+
+	for k, v := range d.refreshTokens {
+		c.refreshTokens[k] = v
+	}
+
+	for k, v := range d.signingKeys {
+		c.signingKeys[k] = v
+	}
+
+	for k, v := range d.apiKeys {
+		c.apiKeys[k] = v
+	}
+
+	for k, v := range d.twoFactors {
+		c.twoFactors[k] = v
+	}
+
+	for k, v := range d.recoveryCodes {
+		c.recoveryCodes[k] = v
+	}
+
+	for k, v := range d.loginThrottles {
+		c.loginThrottles[k] = v
+	}
+
+	for k, v := range d.emailTokens {
+		c.emailTokens[k] = v
+	}
+
+	c.transactions = d.transactions[:len(d.transactions):len(d.transactions)]
+	c.postings = d.postings[:len(d.postings):len(d.postings)]
+	c.supply = d.supply[:len(d.supply):len(d.supply)]
+	c.auditEvents = d.auditEvents[:len(d.auditEvents):len(d.auditEvents)]
+	return c
+}
@@ -0,0 +1,766 @@
+package activerecord
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type memoryUsers struct {
+	s memoryStore
+}
+
+func (r memoryUsers) insert(ctx context.Context, u *User) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.users[u.id]; ok {
+			return errUniqueViolation
+		}
+
+		if _, ok := d.emails[u.email]; ok {
+			return errUniqueViolation
+		}
+
+		d.users[u.id] = User{
+			id:              u.id,
+			email:           u.email,
+			password:        u.password,
+			firstName:       u.firstName,
+			lastName:        u.lastName,
+			admin:           u.admin,
+			emailVerifiedAt: u.emailVerifiedAt,
+		}
+		d.emails[u.email] = u.id
+		return nil
+	})
+}
+
+func (r memoryUsers) findByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	var user *User
+	err := r.s.run(ctx, func(d *memoryData) error {
+		u, ok := d.users[id]
+		if !ok {
+			return notFoundError
+		}
+
+		user = &u
+		return nil
+	})
+	return user, err
+}
+
+func (r memoryUsers) findByEmail(ctx context.Context, email string) (*User, error) {
+	var user *User
+	err := r.s.run(ctx, func(d *memoryData) error {
+		u, ok := d.users[d.emails[email]]
+		if !ok {
+			return notFoundError
+		}
+
+		user = &u
+		return nil
+	})
+	return user, err
+}
+
+// update replaces the user with the result of fn, missing users are not updated
+func (r memoryUsers) update(ctx context.Context, id uuid.UUID, fn func(u *User)) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		u, ok := d.users[id]
+		if ok {
+			fn(&u)
+			d.users[id] = u
+		}
+
+		return nil
+	})
+}
+
+func (r memoryUsers) setAdmin(ctx context.Context, id uuid.UUID, admin bool) error {
+	return r.update(ctx, id, func(u *User) {
+		u.admin = admin
+	})
+}
+
+func (r memoryUsers) verifyEmail(ctx context.Context, id uuid.UUID, at time.Time) error {
+	return r.update(ctx, id, func(u *User) {
+		if u.emailVerifiedAt == nil {
+			u.emailVerifiedAt = &at
+		}
+	})
+}
+
+func (r memoryUsers) setPassword(ctx context.Context, id uuid.UUID, hash string) error {
+	return r.update(ctx, id, func(u *User) {
+		u.password = hash
+	})
+}
+
+type memoryIdempotencyKeys struct {
+	s memoryStore
+}
+
+func (r memoryIdempotencyKeys) claim(ctx context.Context, k *IdempotencyKey) (bool, error) {
+	var claimed bool
+	err := r.s.run(ctx, func(d *memoryData) error {
+		key := memoryIdempotencyKey{scope: k.scope, key: k.key}
+		if existing, ok := d.idempotency[key]; ok && existing.expiresAt.After(k.createdAt) {
+			return nil
+		}
+
+		d.idempotency[key] = IdempotencyKey{
+			scope:       k.scope,
+			key:         k.key,
+			requestHash: k.requestHash,
+			createdAt:   k.createdAt,
+			expiresAt:   k.expiresAt,
+		}
+		claimed = true
+		return nil
+	})
+	return claimed, err
+}
+
+func (r memoryIdempotencyKeys) find(ctx context.Context, scope, key string) (*IdempotencyKey, error) {
+	var k *IdempotencyKey
+	err := r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.idempotency[memoryIdempotencyKey{scope: scope, key: key}]
+		if !ok {
+			return notFoundError
+		}
+
+		k = &stored
+		return nil
+	})
+	return k, err
+}
+
+func (r memoryIdempotencyKeys) complete(ctx context.Context, scope, key string, status int, contentType string, response []byte) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		id := memoryIdempotencyKey{scope: scope, key: key}
+		k, ok := d.idempotency[id]
+		if ok {
+			k.status = status
+			k.contentType = contentType
+			k.response = append([]byte(nil), response...)
+			d.idempotency[id] = k
+		}
+
+		return nil
+	})
+}
+
+func (r memoryIdempotencyKeys) delete(ctx context.Context, scope, key string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		delete(d.idempotency, memoryIdempotencyKey{scope: scope, key: key})
+		return nil
+	})
+}
+
+func (r memoryIdempotencyKeys) deleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for id, k := range d.idempotency {
+			if !k.expiresAt.After(now) {
+				delete(d.idempotency, id)
+				deleted++
+			}
+		}
+
+		return nil
+	})
+	return deleted, err
+}
+
+type memorySessions struct {
+	s memoryStore
+}
+
+func (r memorySessions) insert(ctx context.Context, s *Session) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.sessions[s.id]; ok {
+			return errUniqueViolation
+		}
+
+		stored := *s
+		stored.store = nil
+		d.sessions[s.id] = stored
+		return nil
+	})
+}
+
+func (r memorySessions) find(ctx context.Context, id uuid.UUID) (*Session, error) {
+	var s *Session
+	err := r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.sessions[id]
+		if !ok {
+			return notFoundError
+		}
+
+		s = &stored
+		return nil
+	})
+	return s, err
+}
+
+func (r memorySessions) findActiveByUserID(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Session, error) {
+	var sessions []*Session
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, s := range d.sessions {
+			if s.userID == userID && s.revokedAt == nil && s.expiresAt.After(now) {
+				s := s
+				sessions = append(sessions, &s)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].createdAt.After(sessions[j].createdAt)
+	})
+	return sessions, nil
+}
+
+// update replaces the session with the result of fn, missing sessions are not updated
+func (r memorySessions) update(ctx context.Context, id uuid.UUID, fn func(s *Session)) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		s, ok := d.sessions[id]
+		if ok {
+			fn(&s)
+			d.sessions[id] = s
+		}
+
+		return nil
+	})
+}
+
+func (r memorySessions) extend(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	return r.update(ctx, id, func(s *Session) {
+		s.expiresAt = expiresAt
+	})
+}
+
+func (r memorySessions) revoke(ctx context.Context, id uuid.UUID, at time.Time) error {
+	return r.update(ctx, id, func(s *Session) {
+		if s.revokedAt == nil {
+			s.revokedAt = &at
+		}
+	})
+}
+
+func (r memorySessions) revokeByUserID(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		for id, s := range d.sessions {
+			if s.userID == userID && s.revokedAt == nil {
+				s.revokedAt = &at
+				d.sessions[id] = s
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r memorySessions) insertRefreshToken(ctx context.Context, hash string, sessionID uuid.UUID, createdAt time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.refreshTokens[hash]; ok {
+			return errUniqueViolation
+		}
+
+		d.refreshTokens[hash] = memoryRefreshToken{
+			sessionID: sessionID,
+			createdAt: createdAt,
+		}
+		return nil
+	})
+}
+
+func (r memorySessions) findRefreshToken(ctx context.Context, hash string) (uuid.UUID, *time.Time, error) {
+	var t memoryRefreshToken
+	err := r.s.run(ctx, func(d *memoryData) error {
+		var ok bool
+		t, ok = d.refreshTokens[hash]
+		if !ok {
+			return notFoundError
+		}
+
+		return nil
+	})
+	if err != nil {
+		return uuid.UUID{}, nil, err
+	}
+
+	return t.sessionID, t.usedAt, nil
+}
+
+func (r memorySessions) useRefreshToken(ctx context.Context, hash string, at time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		t, ok := d.refreshTokens[hash]
+		if ok {
+			t.usedAt = &at
+			d.refreshTokens[hash] = t
+		}
+
+		return nil
+	})
+}
+
+type memorySigningKeys struct {
+	s memoryStore
+}
+
+// lock does nothing, DB transactions of the memory store are serialized
+func (r memorySigningKeys) lock(ctx context.Context) error {
+	return nil
+}
+
+func (r memorySigningKeys) findActive(ctx context.Context, now time.Time) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, k := range d.signingKeys {
+			if k.expiresAt == nil || k.expiresAt.After(now) {
+				k := k
+				keys = append(keys, &k)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if (a.retiredAt == nil) != (b.retiredAt == nil) {
+			return a.retiredAt == nil
+		}
+
+		if a.retiredAt != nil && !a.retiredAt.Equal(*b.retiredAt) {
+			return a.retiredAt.After(*b.retiredAt)
+		}
+
+		return a.createdAt.After(b.createdAt)
+	})
+	return keys, nil
+}
+
+func (r memorySigningKeys) findAll(ctx context.Context) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, k := range d.signingKeys {
+			k := k
+			keys = append(keys, &k)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].createdAt.Before(keys[j].createdAt)
+	})
+	return keys, nil
+}
+
+func (r memorySigningKeys) hasSigningKey(ctx context.Context) (bool, error) {
+	var exists bool
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, k := range d.signingKeys {
+			if k.retiredAt == nil {
+				exists = true
+			}
+		}
+
+		return nil
+	})
+	return exists, err
+}
+
+func (r memorySigningKeys) retire(ctx context.Context, at, expiresAt time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		for id, k := range d.signingKeys {
+			if k.retiredAt == nil {
+				k.retiredAt = &at
+				k.expiresAt = &expiresAt
+				d.signingKeys[id] = k
+			}
+		}
+
+		return nil
+	})
+}
+
+// insert keeps only the stored private key like the DB stores do, so the factory decodes it the same way
+func (r memorySigningKeys) insert(ctx context.Context, k *SigningKey) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.signingKeys[k.id]; ok {
+			return errUniqueViolation
+		}
+
+		stored := *k
+		stored.privateKey = nil
+		d.signingKeys[k.id] = stored
+		return nil
+	})
+}
+
+func (r memorySigningKeys) updatePrivateKey(ctx context.Context, id, storedPrivateKey string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		k, ok := d.signingKeys[id]
+		if ok {
+			k.storedPrivateKey = storedPrivateKey
+			d.signingKeys[id] = k
+		}
+
+		return nil
+	})
+}
+
+type memoryAPIKeys struct {
+	s memoryStore
+}
+
+// copyAPIKey copies the key with its slices, so the stored key does not share them with the caller
+func copyAPIKey(k APIKey) *APIKey {
+	k.store = nil
+	k.scopes = append([]Scope(nil), k.scopes...)
+	k.allowedIPs = append([]string(nil), k.allowedIPs...)
+	return &k
+}
+
+func (r memoryAPIKeys) insert(ctx context.Context, k *APIKey) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.apiKeys[k.id]; ok {
+			return errUniqueViolation
+		}
+
+		d.apiKeys[k.id] = *copyAPIKey(*k)
+		return nil
+	})
+}
+
+func (r memoryAPIKeys) findByHash(ctx context.Context, hash string) (*APIKey, error) {
+	return r.findOne(ctx, func(k APIKey) bool {
+		return k.hash == hash
+	})
+}
+
+func (r memoryAPIKeys) find(ctx context.Context, userID, id uuid.UUID) (*APIKey, error) {
+	return r.findOne(ctx, func(k APIKey) bool {
+		return k.userID == userID && k.id == id
+	})
+}
+
+func (r memoryAPIKeys) findOne(ctx context.Context, match func(k APIKey) bool) (*APIKey, error) {
+	var key *APIKey
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, k := range d.apiKeys {
+			if match(k) {
+				key = copyAPIKey(k)
+				return nil
+			}
+		}
+
+		return notFoundError
+	})
+	return key, err
+}
+
+func (r memoryAPIKeys) findByUserID(ctx context.Context, userID uuid.UUID) ([]*APIKey, error) {
+	var keys []*APIKey
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, k := range d.apiKeys {
+			if k.userID == userID {
+				keys = append(keys, copyAPIKey(k))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].createdAt.Before(keys[j].createdAt)
+	})
+	return keys, nil
+}
+
+func (r memoryAPIKeys) update(ctx context.Context, k *APIKey) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.apiKeys[k.id]
+		if ok {
+			updated := copyAPIKey(*k)
+			stored.name = updated.name
+			stored.scopes = updated.scopes
+			stored.allowedIPs = updated.allowedIPs
+			stored.expiresAt = updated.expiresAt
+			d.apiKeys[k.id] = stored
+		}
+
+		return nil
+	})
+}
+
+func (r memoryAPIKeys) setLastUsedAt(ctx context.Context, id uuid.UUID, at time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		k, ok := d.apiKeys[id]
+		if ok {
+			k.lastUsedAt = &at
+			d.apiKeys[id] = k
+		}
+
+		return nil
+	})
+}
+
+func (r memoryAPIKeys) delete(ctx context.Context, id uuid.UUID) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		delete(d.apiKeys, id)
+		return nil
+	})
+}
+
+type memoryTwoFactors struct {
+	s memoryStore
+}
+
+func (r memoryTwoFactors) enroll(ctx context.Context, t *TwoFactor) (bool, error) {
+	var enrolled bool
+	err := r.s.run(ctx, func(d *memoryData) error {
+		if existing, ok := d.twoFactors[t.userID]; ok && existing.confirmedAt != nil {
+			return nil
+		}
+
+		d.twoFactors[t.userID] = TwoFactor{
+			userID:    t.userID,
+			secret:    t.secret,
+			createdAt: t.createdAt,
+		}
+		enrolled = true
+		return nil
+	})
+	return enrolled, err
+}
+
+func (r memoryTwoFactors) find(ctx context.Context, userID uuid.UUID) (*TwoFactor, error) {
+	var t *TwoFactor
+	err := r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.twoFactors[userID]
+		if !ok {
+			return notFoundError
+		}
+
+		t = &stored
+		return nil
+	})
+	return t, err
+}
+
+func (r memoryTwoFactors) advanceStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	var advanced bool
+	err := r.s.run(ctx, func(d *memoryData) error {
+		t, ok := d.twoFactors[userID]
+		if ok && t.lastStep < step {
+			t.lastStep = step
+			d.twoFactors[userID] = t
+			advanced = true
+		}
+
+		return nil
+	})
+	return advanced, err
+}
+
+func (r memoryTwoFactors) confirm(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		t, ok := d.twoFactors[userID]
+		if ok {
+			t.confirmedAt = &at
+			d.twoFactors[userID] = t
+		}
+
+		return nil
+	})
+}
+
+func (r memoryTwoFactors) delete(ctx context.Context, userID uuid.UUID) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		d.deleteRecoveryCodes(userID)
+		delete(d.twoFactors, userID)
+		return nil
+	})
+}
+
+func (d *memoryData) deleteRecoveryCodes(userID uuid.UUID) {
+	for code := range d.recoveryCodes {
+		if code.userID == userID {
+			delete(d.recoveryCodes, code)
+		}
+	}
+}
+
+func (r memoryTwoFactors) replaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		d.deleteRecoveryCodes(userID)
+		for _, hash := range hashes {
+			d.recoveryCodes[memoryRecoveryCode{userID: userID, hash: hash}] = nil
+		}
+
+		return nil
+	})
+}
+
+func (r memoryTwoFactors) useRecoveryCode(ctx context.Context, userID uuid.UUID, hash string, at time.Time) (bool, error) {
+	var used bool
+	err := r.s.run(ctx, func(d *memoryData) error {
+		code := memoryRecoveryCode{userID: userID, hash: hash}
+		usedAt, ok := d.recoveryCodes[code]
+		if ok && usedAt == nil {
+			d.recoveryCodes[code] = &at
+			used = true
+		}
+
+		return nil
+	})
+	return used, err
+}
+
+type memoryLoginThrottles struct {
+	s memoryStore
+}
+
+func (r memoryLoginThrottles) blockedUntil(ctx context.Context, keys []string, now time.Time) (*time.Time, error) {
+	var until *time.Time
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, key := range keys {
+			t, ok := d.loginThrottles[key]
+			if !ok || t.blockedUntil == nil || !t.blockedUntil.After(now) {
+				continue
+			}
+
+			if until == nil || t.blockedUntil.After(*until) {
+				until = t.blockedUntil
+			}
+		}
+
+		return nil
+	})
+	return until, err
+}
+
+func (r memoryLoginThrottles) failures(ctx context.Context, key string, now time.Time) (int, time.Time, error) {
+	var t memoryLoginThrottle
+	err := r.s.run(ctx, func(d *memoryData) error {
+		var ok bool
+		t, ok = d.loginThrottles[key]
+		if !ok {
+			t = memoryLoginThrottle{lastFailureAt: now}
+			d.loginThrottles[key] = t
+		}
+
+		return nil
+	})
+	return t.failures, t.lastFailureAt, err
+}
+
+func (r memoryLoginThrottles) update(ctx context.Context, key string, failures int, lastFailureAt time.Time, blockedUntil *time.Time) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.loginThrottles[key]; ok {
+			d.loginThrottles[key] = memoryLoginThrottle{
+				failures:      failures,
+				lastFailureAt: lastFailureAt,
+				blockedUntil:  blockedUntil,
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r memoryLoginThrottles) delete(ctx context.Context, keys []string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		for _, key := range keys {
+			delete(d.loginThrottles, key)
+		}
+
+		return nil
+	})
+}
+
+type memoryEmailTokens struct {
+	s memoryStore
+}
+
+func (r memoryEmailTokens) insert(ctx context.Context, t *EmailToken) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.emailTokens[t.id]; ok {
+			return errUniqueViolation
+		}
+
+		d.emailTokens[t.id] = *t
+		return nil
+	})
+}
+
+func (r memoryEmailTokens) use(ctx context.Context, id uuid.UUID, purpose EmailTokenPurpose, now time.Time) (*EmailToken, error) {
+	var t *EmailToken
+	err := r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.emailTokens[id]
+		if !ok || stored.purpose != purpose || stored.usedAt != nil || !stored.expiresAt.After(now) {
+			return notFoundError
+		}
+
+		stored.usedAt = &now
+		d.emailTokens[id] = stored
+		t = &stored
+		return nil
+	})
+	return t, err
+}
+
+type memoryAuditEvents struct {
+	s memoryStore
+}
+
+func (r memoryAuditEvents) insert(ctx context.Context, e *AuditEvent) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		d.auditEvents = append(d.auditEvents, *e)
+		return nil
+	})
+}
+
+func (r memoryAuditEvents) findByUserID(ctx context.Context, userID uuid.UUID) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, e := range d.auditEvents {
+			if e.UserID != nil && *e.UserID == userID {
+				e := e
+				events = append(events, &e)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+
+		return lessUUID(events[j].ID, events[i].ID)
+	})
+	return events, nil
+}
@@ -0,0 +1,798 @@
+package activerecord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// lessUUID orders UUIDs the same way Postgres does
+func lessUUID(a, b uuid.UUID) bool {
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// truncateDay truncates the moment to the beginning of its day in UTC
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// currency returns the currency with its fee schedules
+func (d *memoryData) currency(symbol string) (*Currency, error) {
+	c, ok := d.currencies[symbol]
+	if !ok {
+		return nil, notFoundError
+	}
+
+	c.feeSchedules = make(map[TransactionKind]FeeSchedule)
+	for key, policy := range d.feeSchedules {
+		if key.currency != symbol {
+			continue
+		}
+
+		schedule, err := ParseFeeSchedule([]byte(policy))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s fee schedule of currency %s: %w", key.kind, symbol, err)
+		}
+
+		c.feeSchedules[key.kind] = schedule
+	}
+
+	return &c, nil
+}
+
+// wallet returns the wallet with its currency and stored balance
+func (d *memoryData) wallet(address string) (*Wallet, error) {
+	w, ok := d.wallets[address]
+	if !ok {
+		return nil, notFoundError
+	}
+
+	c, err := d.currency(w.currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{
+		userID:   w.userID,
+		address:  address,
+		currency: c,
+		balance:  d.balances[address].balance,
+	}, nil
+}
+
+type memoryWallets struct {
+	s memoryStore
+}
+
+func (r memoryWallets) insert(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.wallets[address]; ok {
+			return errUniqueViolation
+		}
+
+		d.wallets[address] = memoryWallet{userID: userID, currency: currency}
+		return nil
+	})
+}
+
+func (r memoryWallets) insertIfNotExists(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.wallets[address]; !ok {
+			d.wallets[address] = memoryWallet{userID: userID, currency: currency}
+		}
+
+		return nil
+	})
+}
+
+func (r memoryWallets) findByUserID(ctx context.Context, userID uuid.UUID) ([]*Wallet, error) {
+	var wallets []*Wallet
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for address, w := range d.wallets {
+			if w.userID != userID {
+				continue
+			}
+
+			wallet, err := d.wallet(address)
+			if err != nil {
+				return err
+			}
+
+			wallets = append(wallets, wallet)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(wallets, func(i, j int) bool {
+		if wallets[i].currency.symbol != wallets[j].currency.symbol {
+			return wallets[i].currency.symbol < wallets[j].currency.symbol
+		}
+
+		return wallets[i].address < wallets[j].address
+	})
+	return wallets, nil
+}
+
+// findByAddress does not need to lock the wallet, DB transactions of the memory store are serialized
+func (r memoryWallets) findByAddress(ctx context.Context, address string, forUpdate bool) (*Wallet, error) {
+	var w *Wallet
+	err := r.s.run(ctx, func(d *memoryData) error {
+		var err error
+		w, err = d.wallet(address)
+		return err
+	})
+	return w, err
+}
+
+func (r memoryWallets) balanceMismatches(ctx context.Context) ([]BalanceMismatch, error) {
+	var mismatches []BalanceMismatch
+	err := r.s.run(ctx, func(d *memoryData) error {
+		replayed := make(map[string]decimal.Decimal)
+		for _, p := range d.postings {
+			replayed[p.Wallet] = replayed[p.Wallet].Add(p.Amount)
+		}
+
+		for address := range d.balances {
+			if _, ok := replayed[address]; !ok {
+				replayed[address] = decimal.Zero
+			}
+		}
+
+		for address, balance := range replayed {
+			stored := d.balances[address].balance
+			if !stored.Equal(balance) {
+				mismatches = append(mismatches, BalanceMismatch{
+					Address:  address,
+					Stored:   stored,
+					Replayed: balance,
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Address < mismatches[j].Address
+	})
+	return mismatches, nil
+}
+
+type memoryCurrencies struct {
+	s memoryStore
+}
+
+func (r memoryCurrencies) insert(ctx context.Context, c *Currency) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.currencies[c.symbol]; ok {
+			return errUniqueViolation
+		}
+
+		stored := *c
+		stored.store = nil
+		stored.feeSchedules = nil
+		d.currencies[c.symbol] = stored
+		return nil
+	})
+}
+
+func (r memoryCurrencies) saveFeeSchedule(ctx context.Context, currency string, kind TransactionKind, schedule FeeSchedule) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		d.feeSchedules[memoryFeeScheduleKey{currency: currency, kind: kind}] = schedule.Policy()
+		return nil
+	})
+}
+
+func (r memoryCurrencies) find(ctx context.Context, symbol string) (*Currency, error) {
+	var c *Currency
+	err := r.s.run(ctx, func(d *memoryData) error {
+		var err error
+		c, err = d.currency(symbol)
+		return err
+	})
+	return c, err
+}
+
+func (r memoryCurrencies) findAll(ctx context.Context, enabledOnly bool) ([]*Currency, error) {
+	var currencies []*Currency
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for symbol, stored := range d.currencies {
+			if enabledOnly && !stored.enabled {
+				continue
+			}
+
+			c, err := d.currency(symbol)
+			if err != nil {
+				return err
+			}
+
+			currencies = append(currencies, c)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(currencies, func(i, j int) bool {
+		return currencies[i].symbol < currencies[j].symbol
+	})
+	return currencies, nil
+}
+
+func (r memoryCurrencies) setEnabled(ctx context.Context, symbol string, enabled bool) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		c, ok := d.currencies[symbol]
+		if ok {
+			c.enabled = enabled
+			d.currencies[symbol] = c
+		}
+
+		return nil
+	})
+}
+
+func (r memoryCurrencies) feeRevenue(ctx context.Context, since, until time.Time) ([]FeeRevenue, error) {
+	var revenues []FeeRevenue
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, c := range d.currencies {
+			fr := FeeRevenue{
+				Currency:  c.symbol,
+				FeeWallet: c.feeWallet,
+			}
+
+			for _, p := range d.postings {
+				if p.Wallet != c.feeWallet {
+					continue
+				}
+
+				if !since.IsZero() && p.CreatedAt.Before(since) {
+					continue
+				}
+
+				if !until.IsZero() && !p.CreatedAt.Before(until) {
+					continue
+				}
+
+				fr.Revenue = fr.Revenue.Add(p.Amount)
+				fr.Count++
+			}
+
+			revenues = append(revenues, fr)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(revenues, func(i, j int) bool {
+		return revenues[i].Currency < revenues[j].Currency
+	})
+	return revenues, nil
+}
+
+type memoryTransactions struct {
+	s memoryStore
+}
+
+func (r memoryTransactions) insert(ctx context.Context, t *Transaction) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		stored := *t
+		stored.store = nil
+		stored.feeWallet = ""
+		d.transactions = append(d.transactions, stored)
+		return nil
+	})
+}
+
+func (r memoryTransactions) findByWallet(ctx context.Context, wallet string, filter TransactionFilter, cursor *transactionCursor, limit int) ([]*Transaction, error) {
+	var txs []*Transaction
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, t := range d.transactions {
+			if !transactionMatches(t, wallet, filter, cursor) {
+				continue
+			}
+
+			t := t
+			txs = append(txs, &t)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(txs, func(i, j int) bool {
+		return transactionBefore(txs[j], txs[i].timestamp, txs[i].id)
+	})
+
+	if len(txs) > limit {
+		txs = txs[:limit]
+	}
+
+	return txs, nil
+}
+
+// transactionBefore tells if the transaction goes before (timestamp, id) in the ascending order
+func transactionBefore(t *Transaction, timestamp time.Time, id uuid.UUID) bool {
+	if !t.timestamp.Equal(timestamp) {
+		return t.timestamp.Before(timestamp)
+	}
+
+	return lessUUID(t.id, id)
+}
+
+func transactionMatches(t Transaction, wallet string, filter TransactionFilter, cursor *transactionCursor) bool {
+	switch filter.Direction {
+	case Incoming:
+		if t.to != wallet {
+			return false
+		}
+	case Outgoing:
+		if t.from != wallet {
+			return false
+		}
+	default:
+		if t.to != wallet && t.from != wallet {
+			return false
+		}
+	}
+
+	if !filter.Since.IsZero() && t.timestamp.Before(filter.Since) {
+		return false
+	}
+
+	if !filter.Until.IsZero() && !t.timestamp.Before(filter.Until) {
+		return false
+	}
+
+	if filter.MinAmount.Valid && t.amount.LessThan(filter.MinAmount.Decimal) {
+		return false
+	}
+
+	if filter.MaxAmount.Valid && t.amount.GreaterThan(filter.MaxAmount.Decimal) {
+		return false
+	}
+
+	return cursor == nil || transactionBefore(&t, cursor.timestamp, cursor.id)
+}
+
+type memoryLedger struct {
+	s memoryStore
+}
+
+// insert checks that the entry is balanced like the deferred constraint of Postgres does
+func (r memoryLedger) insert(ctx context.Context, e *JournalEntry) error {
+	if !e.Balanced() {
+		return unbalancedJournalEntry
+	}
+
+	return r.s.run(ctx, func(d *memoryData) error {
+		if _, ok := d.entries[e.id]; ok {
+			return errUniqueViolation
+		}
+
+		d.entries[e.id] = memoryEntry{
+			kind:        e.kind,
+			description: e.description,
+			createdAt:   e.createdAt,
+		}
+
+		for _, p := range e.postings {
+			d.postings = append(d.postings, memoryPosting{
+				id:      int64(len(d.postings) + 1),
+				Posting: p,
+			})
+
+			b, ok := d.balances[p.Wallet]
+			if !ok {
+				b.currency = p.Currency
+			}
+
+			b.balance = b.balance.Add(p.Amount)
+			d.balances[p.Wallet] = b
+		}
+
+		return nil
+	})
+}
+
+func (r memoryLedger) findEntry(ctx context.Context, id uuid.UUID) (*JournalEntry, error) {
+	var e *JournalEntry
+	err := r.s.run(ctx, func(d *memoryData) error {
+		stored, ok := d.entries[id]
+		if !ok {
+			return notFoundError
+		}
+
+		e = &JournalEntry{
+			id:          id,
+			kind:        stored.kind,
+			description: stored.description,
+			createdAt:   stored.createdAt,
+		}
+
+		for _, p := range d.postings {
+			if p.EntryID == id {
+				e.postings = append(e.postings, p.Posting)
+			}
+		}
+
+		return nil
+	})
+	return e, err
+}
+
+func (r memoryLedger) findPostings(ctx context.Context, wallet string) ([]Posting, error) {
+	var postings []Posting
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, p := range d.postings {
+			if p.Wallet == wallet {
+				postings = append(postings, p.Posting)
+			}
+		}
+
+		return nil
+	})
+	return postings, err
+}
+
+func (r memoryLedger) balance(ctx context.Context, wallet string) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, p := range d.postings {
+			if p.Wallet == wallet {
+				balance = balance.Add(p.Amount)
+			}
+		}
+
+		return nil
+	})
+	return balance, err
+}
+
+func (r memoryLedger) balanceAt(ctx context.Context, wallet string, at time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.s.run(ctx, func(d *memoryData) error {
+		var since *time.Time
+		for key, b := range d.snapshots {
+			next := key.day.AddDate(0, 0, 1)
+			if key.wallet != wallet || next.After(at) || (since != nil && !next.After(*since)) {
+				continue
+			}
+
+			since = &next
+			balance = b
+		}
+
+		for _, p := range d.postings {
+			if p.Wallet != wallet || p.CreatedAt.After(at) || (since != nil && p.CreatedAt.Before(*since)) {
+				continue
+			}
+
+			balance = balance.Add(p.Amount)
+		}
+
+		return nil
+	})
+	return balance, err
+}
+
+func (r memoryLedger) nextSnapshotDay(ctx context.Context) (*time.Time, error) {
+	var next *time.Time
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for snapshotted := range d.snapshotDays {
+			t := snapshotted.AddDate(0, 0, 1)
+			if next == nil || t.After(*next) {
+				next = &t
+			}
+		}
+
+		if next != nil {
+			return nil
+		}
+
+		for _, p := range d.postings {
+			t := truncateDay(p.CreatedAt)
+			if next == nil || t.Before(*next) {
+				next = &t
+			}
+		}
+
+		return nil
+	})
+	return next, err
+}
+
+func (r memoryLedger) snapshotDay(ctx context.Context, snapshotted time.Time) error {
+	snapshotted = truncateDay(snapshotted)
+	next := snapshotted.AddDate(0, 0, 1)
+	return r.s.run(ctx, func(d *memoryData) error {
+		wallets := make(map[string]struct{})
+		for _, p := range d.postings {
+			if !p.CreatedAt.Before(snapshotted) && p.CreatedAt.Before(next) {
+				wallets[p.Wallet] = struct{}{}
+			}
+		}
+
+		for wallet := range wallets {
+			var since *time.Time
+			var balance decimal.Decimal
+			for key, b := range d.snapshots {
+				if key.wallet != wallet || !key.day.Before(snapshotted) {
+					continue
+				}
+
+				prev := key.day.AddDate(0, 0, 1)
+				if since == nil || prev.After(*since) {
+					since = &prev
+					balance = b
+				}
+			}
+
+			for _, p := range d.postings {
+				if p.Wallet != wallet || !p.CreatedAt.Before(next) || (since != nil && p.CreatedAt.Before(*since)) {
+					continue
+				}
+
+				balance = balance.Add(p.Amount)
+			}
+
+			d.snapshots[memorySnapshotKey{wallet: wallet, day: snapshotted}] = balance
+		}
+
+		d.snapshotDays[snapshotted] = struct{}{}
+		return nil
+	})
+}
+
+type memorySupply struct {
+	s memoryStore
+}
+
+func (r memorySupply) insert(ctx context.Context, op *SupplyOperation) error {
+	return r.s.run(ctx, func(d *memoryData) error {
+		d.supply = append(d.supply, *op)
+		return nil
+	})
+}
+
+func (r memorySupply) supply(ctx context.Context, c *Currency) (*Supply, error) {
+	s := &Supply{
+		Currency: c.symbol,
+	}
+
+	err := r.s.run(ctx, func(d *memoryData) error {
+		s.Minted, s.Burned = d.supplyTotals(c.symbol)
+		s.Issued = d.balances[c.issuanceWallet].balance.Neg()
+		s.Treasury = d.balances[c.serviceWallet].balance
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// supplyTotals sums up the minted and the burned amounts of the currency
+func (d *memoryData) supplyTotals(currency string) (minted, burned decimal.Decimal) {
+	for _, op := range d.supply {
+		if op.Currency != currency {
+			continue
+		}
+
+		switch op.Kind {
+		case MintTransaction:
+			minted = minted.Add(op.Amount)
+		case BurnTransaction:
+			burned = burned.Add(op.Amount)
+		}
+	}
+
+	return minted, burned
+}
+
+func (r memorySupply) findByCurrency(ctx context.Context, currency string) ([]*SupplyOperation, error) {
+	var ops []*SupplyOperation
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, op := range d.supply {
+			if op.Currency == currency {
+				op := op
+				ops = append(ops, &op)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if !ops[i].CreatedAt.Equal(ops[j].CreatedAt) {
+			return ops[i].CreatedAt.After(ops[j].CreatedAt)
+		}
+
+		return lessUUID(ops[j].ID, ops[i].ID)
+	})
+	return ops, nil
+}
+
+type memoryReconciliation struct {
+	s memoryStore
+}
+
+func (r memoryReconciliation) countWallets(ctx context.Context) (int, error) {
+	var count int
+	err := r.s.run(ctx, func(d *memoryData) error {
+		count = len(d.wallets)
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryReconciliation) negativeBalances(ctx context.Context) ([]NegativeBalance, error) {
+	var balances []NegativeBalance
+	err := r.s.run(ctx, func(d *memoryData) error {
+		issuance := make(map[string]struct{})
+		for _, c := range d.currencies {
+			issuance[c.issuanceWallet] = struct{}{}
+		}
+
+		for address, b := range d.balances {
+			if _, ok := issuance[address]; ok || !b.balance.IsNegative() {
+				continue
+			}
+
+			balances = append(balances, NegativeBalance{
+				Address:  address,
+				Currency: b.currency,
+				Balance:  b.balance,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Address < balances[j].Address
+	})
+	return balances, nil
+}
+
+func (r memoryReconciliation) orphanAddresses(ctx context.Context) ([]OrphanAddress, error) {
+	var orphans []OrphanAddress
+	err := r.s.run(ctx, func(d *memoryData) error {
+		found := make(map[OrphanAddress]struct{})
+		orphan := func(address, source string) {
+			if _, ok := d.wallets[address]; ok {
+				return
+			}
+
+			o := OrphanAddress{Address: address, Source: source}
+			if _, ok := found[o]; !ok {
+				found[o] = struct{}{}
+				orphans = append(orphans, o)
+			}
+		}
+
+		for _, t := range d.transactions {
+			orphan(t.to, "transactions")
+			orphan(t.from, "transactions")
+		}
+
+		for _, p := range d.postings {
+			orphan(p.Wallet, "postings")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Address != orphans[j].Address {
+			return orphans[i].Address < orphans[j].Address
+		}
+
+		return orphans[i].Source < orphans[j].Source
+	})
+	return orphans, nil
+}
+
+// currencyMismatches orders the records by their IDs as text like Postgres does
+func (r memoryReconciliation) currencyMismatches(ctx context.Context) ([]CurrencyMismatch, error) {
+	var mismatches []CurrencyMismatch
+	err := r.s.run(ctx, func(d *memoryData) error {
+		mismatch := func(source, id, address, currency string) {
+			w, ok := d.wallets[address]
+			if !ok || w.currency == currency {
+				return
+			}
+
+			mismatches = append(mismatches, CurrencyMismatch{
+				Source:         source,
+				ID:             id,
+				Address:        address,
+				Currency:       currency,
+				WalletCurrency: w.currency,
+			})
+		}
+
+		for _, t := range d.transactions {
+			mismatch("transactions", t.id.String(), t.to, t.currency)
+			mismatch("transactions", t.id.String(), t.from, t.currency)
+		}
+
+		for _, p := range d.postings {
+			mismatch("postings", strconv.FormatInt(p.id, 10), p.Wallet, p.Currency)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		if mismatches[i].Source != mismatches[j].Source {
+			return mismatches[i].Source < mismatches[j].Source
+		}
+
+		return mismatches[i].ID < mismatches[j].ID
+	})
+	return mismatches, nil
+}
+
+func (r memoryReconciliation) issuance(ctx context.Context) ([]SupplyMismatch, error) {
+	var issuance []SupplyMismatch
+	err := r.s.run(ctx, func(d *memoryData) error {
+		for _, c := range d.currencies {
+			s := SupplyMismatch{
+				Currency: c.symbol,
+			}
+
+			for _, p := range d.postings {
+				if p.Currency == c.symbol && p.Wallet != c.issuanceWallet {
+					s.Issued = s.Issued.Add(p.Amount)
+				}
+			}
+
+			s.Minted, s.Burned = d.supplyTotals(c.symbol)
+			issuance = append(issuance, s)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(issuance, func(i, j int) bool {
+		return issuance[i].Currency < issuance[j].Currency
+	})
+	return issuance, nil
+}
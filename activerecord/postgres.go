@@ -0,0 +1,145 @@
+package activerecord
+
+import (
+	"context"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgtype/pgxtype"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	uniqueConstraintViolation = "23505"
+)
+
+// dbConn is implemented by both *pgxpool.Pool and pgx.Tx,
+// so the same repositories work either on the pool or inside a DB transaction
+type dbConn interface {
+	pgxtype.Querier
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// postgresStore keeps the records in Postgres, the schema is created by the migrations package
+type postgresStore struct {
+	db dbConn
+}
+
+// begin starts a DB transaction, or a savepoint if the store is already in one
+func (s postgresStore) begin(ctx context.Context) (txStore, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return postgresTx{
+		postgresStore: postgresStore{db: tx},
+		tx:            tx,
+	}, nil
+}
+
+// beginSnapshot starts a REPEATABLE READ read-only DB transaction, so every query sees the same snapshot.
+// In a DB transaction it creates a savepoint, which sees what the DB transaction does
+func (s postgresStore) beginSnapshot(ctx context.Context) (txStore, error) {
+	pool, ok := s.db.(interface {
+		BeginTx(ctx context.Context, options pgx.TxOptions) (pgx.Tx, error)
+	})
+	if !ok {
+		return s.begin(ctx)
+	}
+
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+
+	return postgresTx{
+		postgresStore: postgresStore{db: tx},
+		tx:            tx,
+	}, nil
+}
+
+func (s postgresStore) users() userRepository {
+	return postgresUsers{db: s.db}
+}
+
+func (s postgresStore) wallets() walletRepository {
+	return postgresWallets{db: s.db}
+}
+
+func (s postgresStore) currencies() currencyRepository {
+	return postgresCurrencies{db: s.db}
+}
+
+func (s postgresStore) transactions() transactionRepository {
+	return postgresTransactions{db: s.db}
+}
+
+func (s postgresStore) ledger() ledgerRepository {
+	return postgresLedger{db: s.db}
+}
+
+func (s postgresStore) supply() supplyRepository {
+	return postgresSupply{db: s.db}
+}
+
+func (s postgresStore) reconciliation() reconciliationRepository {
+	return postgresReconciliation{db: s.db}
+}
+
+func (s postgresStore) idempotencyKeys() idempotencyKeyRepository {
+	return postgresIdempotencyKeys{db: s.db}
+}
+
+func (s postgresStore) sessions() sessionRepository {
+	return postgresSessions{db: s.db}
+}
+
+func (s postgresStore) signingKeys() signingKeyRepository {
+	return postgresSigningKeys{db: s.db}
+}
+
+func (s postgresStore) apiKeys() apiKeyRepository {
+	return postgresAPIKeys{db: s.db}
+}
+
+func (s postgresStore) twoFactors() twoFactorRepository {
+	return postgresTwoFactors{db: s.db}
+}
+
+func (s postgresStore) loginThrottles() loginThrottleRepository {
+	return postgresLoginThrottles{db: s.db}
+}
+
+func (s postgresStore) emailTokens() emailTokenRepository {
+	return postgresEmailTokens{db: s.db}
+}
+
+func (s postgresStore) auditEvents() auditRepository {
+	return postgresAuditEvents{db: s.db}
+}
+
+type postgresTx struct {
+	postgresStore
+	tx pgx.Tx
+}
+
+func (t postgresTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t postgresTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+// postgresError turns unique constraint violations into errUniqueViolation and missing rows into notFoundError
+func postgresError(err error) error {
+	if err == pgx.ErrNoRows {
+		return notFoundError
+	}
+
+	if e, ok := err.(*pgconn.PgError); ok && e.Code == uniqueConstraintViolation {
+		return errUniqueViolation
+	}
+
+	return err
+}
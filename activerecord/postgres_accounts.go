@@ -0,0 +1,536 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	apiKeyColumns = `id,user_id,name,prefix,scopes,allowed_ips,created_at,expires_at,last_used_at`
+	// signingKeysLock is the advisory lock key which serializes changes of the signing key
+	signingKeysLock = 727001
+)
+
+type postgresUsers struct {
+	db dbConn
+}
+
+func (r postgresUsers) insert(ctx context.Context, u *User) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO users(id, email, password, first_name, last_name) VALUES($1,$2,$3,$4,$5)`,
+		u.id, u.email, u.password, u.firstName, u.lastName)
+	return postgresError(err)
+}
+
+func (r postgresUsers) findByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	return r.findOne(ctx, `WHERE id=$1`, id)
+}
+
+func (r postgresUsers) findByEmail(ctx context.Context, email string) (*User, error) {
+	return r.findOne(ctx, `WHERE email=$1`, email)
+}
+
+func (r postgresUsers) findOne(ctx context.Context, where string, whereParams ...interface{}) (*User, error) {
+	user := &User{}
+	err := r.db.QueryRow(ctx, `SELECT id,email,password,first_name,last_name,is_admin,email_verified_at FROM users `+where, whereParams...).
+		Scan(&user.id, &user.email, &user.password, &user.firstName, &user.lastName, &user.admin, &user.emailVerifiedAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return user, nil
+}
+
+func (r postgresUsers) setAdmin(ctx context.Context, id uuid.UUID, admin bool) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET is_admin=$2 WHERE id=$1`, id, admin)
+	return err
+}
+
+func (r postgresUsers) verifyEmail(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET email_verified_at=$2 WHERE id=$1 AND email_verified_at IS NULL`, id, at)
+	return err
+}
+
+func (r postgresUsers) setPassword(ctx context.Context, id uuid.UUID, hash string) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET password=$2 WHERE id=$1`, id, hash)
+	return err
+}
+
+type postgresIdempotencyKeys struct {
+	db dbConn
+}
+
+func (r postgresIdempotencyKeys) claim(ctx context.Context, k *IdempotencyKey) (bool, error) {
+	tag, err := r.db.Exec(ctx, `INSERT INTO idempotency_keys(scope, key, request_hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)
+									ON CONFLICT (scope, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, status=NULL, content_type=NULL,
+										response=NULL, created_at=EXCLUDED.created_at, expires_at=EXCLUDED.expires_at
+									WHERE idempotency_keys.expires_at <= EXCLUDED.created_at`,
+						k.scope, k.key, k.requestHash, k.createdAt, k.expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r postgresIdempotencyKeys) find(ctx context.Context, scope, key string) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	var status *int
+	var contentType *string
+	err := r.db.QueryRow(ctx, `SELECT scope,key,request_hash,status,content_type,response,created_at,expires_at FROM idempotency_keys
+								WHERE scope=$1 AND key=$2`, scope, key).
+		Scan(&k.scope, &k.key, &k.requestHash, &status, &contentType, &k.response, &k.createdAt, &k.expiresAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	if status != nil {
+		k.status = *status
+	}
+
+	if contentType != nil {
+		k.contentType = *contentType
+	}
+
+	return k, nil
+}
+
+func (r postgresIdempotencyKeys) complete(ctx context.Context, scope, key string, status int, contentType string, response []byte) error {
+	_, err := r.db.Exec(ctx, `UPDATE idempotency_keys SET status=$3, content_type=$4, response=$5 WHERE scope=$1 AND key=$2`,
+		scope, key, status, contentType, response)
+	return err
+}
+
+func (r postgresIdempotencyKeys) delete(ctx context.Context, scope, key string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2`, scope, key)
+	return err
+}
+
+func (r postgresIdempotencyKeys) deleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	tag, err := r.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+type postgresSessions struct {
+	db dbConn
+}
+
+func (r postgresSessions) insert(ctx context.Context, s *Session) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO sessions(id, user_id, created_at, expires_at) VALUES($1, $2, $3, $4)`,
+		s.id, s.userID, s.createdAt, s.expiresAt)
+	return err
+}
+
+func scanSession(row pgx.Row) (*Session, error) {
+	s := &Session{}
+	err := row.Scan(&s.id, &s.userID, &s.createdAt, &s.expiresAt, &s.revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (r postgresSessions) find(ctx context.Context, id uuid.UUID) (*Session, error) {
+	s, err := scanSession(r.db.QueryRow(ctx, `SELECT id,user_id,created_at,expires_at,revoked_at FROM sessions WHERE id=$1`, id))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return s, nil
+}
+
+func (r postgresSessions) findActiveByUserID(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Session, error) {
+	rows, err := r.db.Query(ctx, `SELECT id,user_id,created_at,expires_at,revoked_at FROM sessions
+									WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > $2
+									ORDER BY created_at DESC`, userID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return sessions, nil
+}
+
+func (r postgresSessions) extend(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE sessions SET expires_at=$2 WHERE id=$1`, id, expiresAt)
+	return err
+}
+
+func (r postgresSessions) revoke(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE sessions SET revoked_at=$2 WHERE id=$1 AND revoked_at IS NULL`, id, at)
+	return err
+}
+
+func (r postgresSessions) revokeByUserID(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE sessions SET revoked_at=$2 WHERE user_id=$1 AND revoked_at IS NULL`, userID, at)
+	return err
+}
+
+func (r postgresSessions) insertRefreshToken(ctx context.Context, hash string, sessionID uuid.UUID, createdAt time.Time) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO refresh_tokens(hash, session_id, created_at) VALUES($1, $2, $3)`, hash, sessionID, createdAt)
+	return err
+}
+
+func (r postgresSessions) findRefreshToken(ctx context.Context, hash string) (uuid.UUID, *time.Time, error) {
+	var sessionID uuid.UUID
+	var usedAt *time.Time
+	err := r.db.QueryRow(ctx, `SELECT session_id,used_at FROM refresh_tokens WHERE hash=$1 FOR UPDATE`, hash).
+		Scan(&sessionID, &usedAt)
+	if err != nil {
+		return uuid.UUID{}, nil, postgresError(err)
+	}
+
+	return sessionID, usedAt, nil
+}
+
+func (r postgresSessions) useRefreshToken(ctx context.Context, hash string, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE refresh_tokens SET used_at=$2 WHERE hash=$1`, hash, at)
+	return err
+}
+
+type postgresSigningKeys struct {
+	db dbConn
+}
+
+func (r postgresSigningKeys) lock(ctx context.Context) error {
+	_, err := r.db.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeysLock)
+	return err
+}
+
+func (r postgresSigningKeys) findActive(ctx context.Context, now time.Time) ([]*SigningKey, error) {
+	rows, err := r.db.Query(ctx, `SELECT kid,algorithm,private_key,created_at,retired_at,expires_at FROM signing_keys
+									WHERE expires_at IS NULL OR expires_at > $1
+									ORDER BY retired_at DESC NULLS FIRST, created_at DESC`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPostgresSigningKeys(rows)
+}
+
+func (r postgresSigningKeys) findAll(ctx context.Context) ([]*SigningKey, error) {
+	rows, err := r.db.Query(ctx, `SELECT kid,algorithm,private_key,created_at,retired_at,expires_at FROM signing_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPostgresSigningKeys(rows)
+}
+
+func (r postgresSigningKeys) hasSigningKey(ctx context.Context) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM signing_keys WHERE retired_at IS NULL)`).Scan(&exists)
+	return exists, err
+}
+
+func (r postgresSigningKeys) retire(ctx context.Context, at, expiresAt time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE signing_keys SET retired_at=$1, expires_at=$2 WHERE retired_at IS NULL`, at, expiresAt)
+	return err
+}
+
+func (r postgresSigningKeys) insert(ctx context.Context, k *SigningKey) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO signing_keys(kid, algorithm, private_key, created_at) VALUES($1, $2, $3, $4)`,
+		k.id, k.algorithm, k.storedPrivateKey, k.createdAt)
+	return err
+}
+
+func (r postgresSigningKeys) updatePrivateKey(ctx context.Context, id, storedPrivateKey string) error {
+	_, err := r.db.Exec(ctx, `UPDATE signing_keys SET private_key=$2 WHERE kid=$1`, id, storedPrivateKey)
+	return err
+}
+
+func scanPostgresSigningKeys(rows pgx.Rows) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	for rows.Next() {
+		k := &SigningKey{}
+		err := rows.Scan(&k.id, &k.algorithm, &k.storedPrivateKey, &k.createdAt, &k.retiredAt, &k.expiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return keys, nil
+}
+
+type postgresAPIKeys struct {
+	db dbConn
+}
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes []string
+	err := row.Scan(&k.id, &k.userID, &k.name, &k.prefix, &scopes, &k.allowedIPs, &k.createdAt, &k.expiresAt, &k.lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	k.scopes = make([]Scope, 0, len(scopes))
+	for _, s := range scopes {
+		k.scopes = append(k.scopes, Scope(s))
+	}
+
+	return k, nil
+}
+
+func (r postgresAPIKeys) insert(ctx context.Context, k *APIKey) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO api_keys(id, user_id, name, prefix, hash, scopes, allowed_ips, created_at, expires_at)
+									VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+						k.id, k.userID, k.name, k.prefix, k.hash, k.scopeStrings(), k.allowedIPs, k.createdAt, k.expiresAt)
+	return err
+}
+
+func (r postgresAPIKeys) findByHash(ctx context.Context, hash string) (*APIKey, error) {
+	return r.findOne(ctx, `WHERE hash=$1`, hash)
+}
+
+func (r postgresAPIKeys) find(ctx context.Context, userID, id uuid.UUID) (*APIKey, error) {
+	return r.findOne(ctx, `WHERE user_id=$1 AND id=$2`, userID, id)
+}
+
+func (r postgresAPIKeys) findOne(ctx context.Context, where string, params ...interface{}) (*APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRow(ctx, `SELECT `+apiKeyColumns+` FROM api_keys `+where, params...))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return k, nil
+}
+
+func (r postgresAPIKeys) findByUserID(ctx context.Context, userID uuid.UUID) ([]*APIKey, error) {
+	rows, err := r.db.Query(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id=$1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return keys, nil
+}
+
+func (r postgresAPIKeys) update(ctx context.Context, k *APIKey) error {
+	_, err := r.db.Exec(ctx, `UPDATE api_keys SET name=$2, scopes=$3, allowed_ips=$4, expires_at=$5 WHERE id=$1`,
+		k.id, k.name, k.scopeStrings(), k.allowedIPs, k.expiresAt)
+	return err
+}
+
+func (r postgresAPIKeys) setLastUsedAt(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE api_keys SET last_used_at=$2 WHERE id=$1`, id, at)
+	return err
+}
+
+func (r postgresAPIKeys) delete(ctx context.Context, id uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM api_keys WHERE id=$1`, id)
+	return err
+}
+
+type postgresTwoFactors struct {
+	db dbConn
+}
+
+func (r postgresTwoFactors) enroll(ctx context.Context, t *TwoFactor) (bool, error) {
+	tag, err := r.db.Exec(ctx, `INSERT INTO two_factors(user_id, secret, created_at) VALUES($1, $2, $3)
+									ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, created_at=EXCLUDED.created_at, last_step=0
+									WHERE two_factors.confirmed_at IS NULL`,
+						t.userID, t.secret, t.createdAt)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r postgresTwoFactors) find(ctx context.Context, userID uuid.UUID) (*TwoFactor, error) {
+	t := &TwoFactor{}
+	err := r.db.QueryRow(ctx, `SELECT user_id,secret,created_at,confirmed_at,last_step FROM two_factors WHERE user_id=$1`, userID).
+		Scan(&t.userID, &t.secret, &t.createdAt, &t.confirmedAt, &t.lastStep)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return t, nil
+}
+
+func (r postgresTwoFactors) advanceStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE two_factors SET last_step=$2 WHERE user_id=$1 AND last_step < $2`, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (r postgresTwoFactors) confirm(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE two_factors SET confirmed_at=$2 WHERE user_id=$1`, userID, at)
+	return err
+}
+
+func (r postgresTwoFactors) delete(ctx context.Context, userID uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(ctx, `DELETE FROM two_factors WHERE user_id=$1`, userID)
+	return err
+}
+
+func (r postgresTwoFactors) replaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err = r.db.Exec(ctx, `INSERT INTO recovery_codes(hash, user_id) VALUES($1, $2)`, hash, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r postgresTwoFactors) useRecoveryCode(ctx context.Context, userID uuid.UUID, hash string, at time.Time) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE recovery_codes SET used_at=$3 WHERE user_id=$1 AND hash=$2 AND used_at IS NULL`, userID, hash, at)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+type postgresLoginThrottles struct {
+	db dbConn
+}
+
+func (r postgresLoginThrottles) blockedUntil(ctx context.Context, keys []string, now time.Time) (*time.Time, error) {
+	var until *time.Time
+	err := r.db.QueryRow(ctx, `SELECT MAX(blocked_until) FROM login_throttles WHERE key = ANY($1) AND blocked_until > $2`, keys, now).
+		Scan(&until)
+	return until, err
+}
+
+func (r postgresLoginThrottles) failures(ctx context.Context, key string, now time.Time) (int, time.Time, error) {
+	_, err := r.db.Exec(ctx, `INSERT INTO login_throttles(key, failures, last_failure_at) VALUES($1, 0, $2) ON CONFLICT (key) DO NOTHING`, key, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var failures int
+	var lastFailureAt time.Time
+	err = r.db.QueryRow(ctx, `SELECT failures,last_failure_at FROM login_throttles WHERE key=$1 FOR UPDATE`, key).
+		Scan(&failures, &lastFailureAt)
+	return failures, lastFailureAt, err
+}
+
+func (r postgresLoginThrottles) update(ctx context.Context, key string, failures int, lastFailureAt time.Time, blockedUntil *time.Time) error {
+	_, err := r.db.Exec(ctx, `UPDATE login_throttles SET failures=$2, last_failure_at=$3, blocked_until=$4 WHERE key=$1`,
+		key, failures, lastFailureAt, blockedUntil)
+	return err
+}
+
+func (r postgresLoginThrottles) delete(ctx context.Context, keys []string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM login_throttles WHERE key = ANY($1)`, keys)
+	return err
+}
+
+type postgresEmailTokens struct {
+	db dbConn
+}
+
+func (r postgresEmailTokens) insert(ctx context.Context, t *EmailToken) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO email_tokens(id, user_id, purpose, created_at, expires_at) VALUES($1, $2, $3, $4, $5)`,
+		t.id, t.userID, t.purpose, t.createdAt, t.expiresAt)
+	return err
+}
+
+func (r postgresEmailTokens) use(ctx context.Context, id uuid.UUID, purpose EmailTokenPurpose, now time.Time) (*EmailToken, error) {
+	t := &EmailToken{
+		id:      id,
+		purpose: purpose,
+		usedAt:  &now,
+	}
+
+	err := r.db.QueryRow(ctx, `UPDATE email_tokens SET used_at=$3
+									WHERE id=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > $3
+									RETURNING user_id,created_at,expires_at`, id, purpose, now).
+		Scan(&t.userID, &t.createdAt, &t.expiresAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return t, nil
+}
+
+type postgresAuditEvents struct {
+	db dbConn
+}
+
+func (r postgresAuditEvents) insert(ctx context.Context, e *AuditEvent) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO audit_events(id, kind, user_id, subject, actor, ip, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		e.ID, e.Kind, e.UserID, e.Subject, e.Actor, e.IP, e.CreatedAt)
+	return err
+}
+
+func (r postgresAuditEvents) findByUserID(ctx context.Context, userID uuid.UUID) ([]*AuditEvent, error) {
+	rows, err := r.db.Query(ctx, `SELECT id,kind,user_id,subject,actor,ip,created_at FROM audit_events
+									WHERE user_id=$1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*AuditEvent
+	for rows.Next() {
+		e := &AuditEvent{}
+		err := rows.Scan(&e.ID, &e.Kind, &e.UserID, &e.Subject, &e.Actor, &e.IP, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return events, nil
+}
@@ -0,0 +1,627 @@
+package activerecord
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// currencyColumns are scanned by scanCurrency, fee schedules are aggregated into a JSON object by kind
+	currencyColumns = `c.symbol,c.name,c.decimals,
+		COALESCE((SELECT jsonb_object_agg(f.kind, f.schedule) FROM fee_schedules f WHERE f.currency=c.symbol), '{}')::text,
+		c.signup_bonus,c.service_wallet,c.fee_wallet,c.issuance_wallet,c.enabled`
+	walletColumns = `w.user_id,w.wallet,COALESCE(b.balance, 0),` + currencyColumns
+	walletTables  = `user_wallets w
+							JOIN currencies c ON c.symbol=w.currency
+							LEFT JOIN wallet_balances b ON b.wallet=w.wallet`
+)
+
+// scanCurrency scans currencyColumns after the other fields of the row
+func scanCurrency(row pgx.Row, fields ...interface{}) (*Currency, error) {
+	c := &Currency{}
+	var feeSchedules string
+	fields = append(fields, &c.symbol, &c.name, &c.precision, &feeSchedules, &c.signupBonus, &c.serviceWallet, &c.feeWallet, &c.issuanceWallet, &c.enabled)
+	err := row.Scan(fields...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.parseFeeSchedules(feeSchedules)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func scanWallet(row pgx.Row) (*Wallet, error) {
+	w := &Wallet{}
+	c, err := scanCurrency(row, &w.userID, &w.address, &w.balance)
+	if err != nil {
+		return nil, err
+	}
+
+	w.currency = c
+	return w, nil
+}
+
+type postgresWallets struct {
+	db dbConn
+}
+
+func (r postgresWallets) insert(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO user_wallets(user_id, wallet, currency) VALUES($1, $2, $3)`, userID, address, currency)
+	return postgresError(err)
+}
+
+func (r postgresWallets) insertIfNotExists(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO user_wallets(user_id,wallet,currency) VALUES($1,$2,$3) ON CONFLICT DO NOTHING`,
+									userID, address, currency)
+	return err
+}
+
+// findByUserID finds the wallets together with their stored balances in a single query
+func (r postgresWallets) findByUserID(ctx context.Context, userID uuid.UUID) ([]*Wallet, error) {
+	rows, err := r.db.Query(ctx, `SELECT `+walletColumns+` FROM `+walletTables+` WHERE w.user_id=$1 ORDER BY c.symbol`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var wallets []*Wallet
+	for rows.Next() {
+		w, err := scanWallet(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		wallets = append(wallets, w)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return wallets, nil
+}
+
+// findByAddress locks the wallet row with FOR UPDATE before the balance is read
+func (r postgresWallets) findByAddress(ctx context.Context, address string, forUpdate bool) (*Wallet, error) {
+	if forUpdate {
+		var userID uuid.UUID
+		err := r.db.QueryRow(ctx, `SELECT user_id FROM user_wallets WHERE wallet=$1 FOR UPDATE`, address).Scan(&userID)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+	}
+
+	w, err := scanWallet(r.db.QueryRow(ctx, `SELECT `+walletColumns+` FROM `+walletTables+` WHERE w.wallet=$1`, address))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return w, nil
+}
+
+func (r postgresWallets) balanceMismatches(ctx context.Context) ([]BalanceMismatch, error) {
+	rows, err := r.db.Query(ctx, `SELECT a.wallet,COALESCE(b.balance, 0),COALESCE(p.balance, 0) FROM (
+								SELECT wallet FROM wallet_balances
+								UNION SELECT wallet FROM postings
+							) a LEFT JOIN wallet_balances b ON b.wallet=a.wallet
+							LEFT JOIN (SELECT wallet, SUM(amount) AS balance FROM postings GROUP BY wallet) p ON p.wallet=a.wallet
+							WHERE COALESCE(b.balance, 0) <> COALESCE(p.balance, 0)
+							ORDER BY a.wallet`)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []BalanceMismatch
+	for rows.Next() {
+		var m BalanceMismatch
+		err := rows.Scan(&m.Address, &m.Stored, &m.Replayed)
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return mismatches, nil
+}
+
+type postgresCurrencies struct {
+	db dbConn
+}
+
+func (r postgresCurrencies) insert(ctx context.Context, c *Currency) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO currencies(symbol, name, decimals, signup_bonus, service_wallet, fee_wallet, issuance_wallet, enabled)
+									VALUES($1, $2, $3, $4::numeric, $5, $6, $7, $8)`,
+						c.symbol, c.name, c.precision, c.signupBonus.String(), c.serviceWallet, c.feeWallet, c.issuanceWallet, c.enabled)
+	return postgresError(err)
+}
+
+func (r postgresCurrencies) saveFeeSchedule(ctx context.Context, currency string, kind TransactionKind, schedule FeeSchedule) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO fee_schedules(currency, kind, schedule) VALUES($1, $2, $3::jsonb)
+									ON CONFLICT (currency, kind) DO UPDATE SET schedule=EXCLUDED.schedule`,
+						currency, string(kind), schedule.Policy())
+	return err
+}
+
+func (r postgresCurrencies) find(ctx context.Context, symbol string) (*Currency, error) {
+	c, err := scanCurrency(r.db.QueryRow(ctx, `SELECT `+currencyColumns+` FROM currencies c WHERE c.symbol=$1`, symbol))
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	return c, nil
+}
+
+func (r postgresCurrencies) findAll(ctx context.Context, enabledOnly bool) ([]*Currency, error) {
+	where := ``
+	if enabledOnly {
+		where = `WHERE c.enabled`
+	}
+
+	rows, err := r.db.Query(ctx, fmt.Sprintf(`SELECT %s FROM currencies c %s ORDER BY c.symbol`, currencyColumns, where))
+	if err != nil {
+		return nil, err
+	}
+
+	var currencies []*Currency
+	for rows.Next() {
+		c, err := scanCurrency(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		currencies = append(currencies, c)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return currencies, nil
+}
+
+func (r postgresCurrencies) setEnabled(ctx context.Context, symbol string, enabled bool) error {
+	_, err := r.db.Exec(ctx, `UPDATE currencies SET enabled=$2 WHERE symbol=$1`, symbol, enabled)
+	return err
+}
+
+func (r postgresCurrencies) feeRevenue(ctx context.Context, since, until time.Time) ([]FeeRevenue, error) {
+	var params []interface{}
+	cond := ""
+	if !since.IsZero() {
+		params = append(params, since)
+		cond += fmt.Sprintf(" AND p.created_at >= $%d", len(params))
+	}
+
+	if !until.IsZero() {
+		params = append(params, until)
+		cond += fmt.Sprintf(" AND p.created_at < $%d", len(params))
+	}
+
+	q := fmt.Sprintf(`SELECT c.symbol,c.fee_wallet,COALESCE(SUM(p.amount), 0),COUNT(p.id) FROM currencies c
+							LEFT JOIN postings p ON p.wallet=c.fee_wallet%s
+							GROUP BY c.symbol,c.fee_wallet ORDER BY c.symbol`, cond)
+	rows, err := r.db.Query(ctx, q, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var revenues []FeeRevenue
+	for rows.Next() {
+		var fr FeeRevenue
+		err := rows.Scan(&fr.Currency, &fr.FeeWallet, &fr.Revenue, &fr.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		revenues = append(revenues, fr)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return revenues, nil
+}
+
+type postgresTransactions struct {
+	db dbConn
+}
+
+func (r postgresTransactions) insert(ctx context.Context, t *Transaction) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO transactions(id, kind, currency, from_wallet, to_wallet, amount, fee, fee_policy, timestamp)
+									VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+						t.id, string(t.kind), t.currency, t.from, t.to, t.amount.String(), t.fee.String(), t.feePolicy, t.timestamp)
+	return err
+}
+
+func (r postgresTransactions) findByWallet(ctx context.Context, wallet string, filter TransactionFilter, cursor *transactionCursor, limit int) ([]*Transaction, error) {
+	params := []interface{}{wallet}
+	var conds []string
+	where := func(cond string, param interface{}) {
+		params = append(params, param)
+		conds = append(conds, fmt.Sprintf(cond, len(params)))
+	}
+
+	switch filter.Direction {
+	case Incoming:
+		conds = append(conds, "to_wallet=$1")
+	case Outgoing:
+		conds = append(conds, "from_wallet=$1")
+	default:
+		conds = append(conds, "(to_wallet=$1 OR from_wallet=$1)")
+	}
+
+	if !filter.Since.IsZero() {
+		where("timestamp >= $%d", filter.Since.UTC())
+	}
+
+	if !filter.Until.IsZero() {
+		where("timestamp < $%d", filter.Until.UTC())
+	}
+
+	if filter.MinAmount.Valid {
+		where("amount >= $%d::numeric", filter.MinAmount.Decimal.String())
+	}
+
+	if filter.MaxAmount.Valid {
+		where("amount <= $%d::numeric", filter.MaxAmount.Decimal.String())
+	}
+
+	if cursor != nil {
+		params = append(params, cursor.timestamp, cursor.id)
+		conds = append(conds, fmt.Sprintf("(timestamp, id) < ($%d, $%d)", len(params)-1, len(params)))
+	}
+
+	q := fmt.Sprintf(`SELECT id,kind,currency,to_wallet,from_wallet,amount,fee,fee_policy,timestamp FROM transactions
+							WHERE %s ORDER BY timestamp DESC, id DESC LIMIT %d`, strings.Join(conds, " AND "), limit)
+	rows, err := r.db.Query(ctx, q, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var txs []*Transaction
+	for rows.Next() {
+		t := &Transaction{}
+		err := rows.Scan(&t.id, &t.kind, &t.currency, &t.to, &t.from, &t.amount, &t.fee, &t.feePolicy, &t.timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		txs = append(txs, t)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return txs, nil
+}
+
+type postgresLedger struct {
+	db dbConn
+}
+
+// insert relies on the surrounding DB transaction, the DB checks that the entry is balanced on commit.
+// Balances are updated in the order of wallets, so entries which share wallets lock their balances in the same order
+// and cannot deadlock, whatever the order of their postings is
+func (r postgresLedger) insert(ctx context.Context, e *JournalEntry) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO journal_entries(id, kind, description, created_at) VALUES($1, $2, $3, $4)`,
+		e.id, string(e.kind), e.description, e.createdAt)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range e.postings {
+		_, err = r.db.Exec(ctx, `INSERT INTO postings(entry_id, wallet, currency, amount, created_at) VALUES($1, $2, $3, $4::numeric, $5)`,
+			p.EntryID, p.Wallet, p.Currency, p.Amount.String(), p.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	postings := append([]Posting(nil), e.postings...)
+	sort.SliceStable(postings, func(i, j int) bool {
+		return postings[i].Wallet < postings[j].Wallet
+	})
+
+	for _, p := range postings {
+		err = r.addBalance(ctx, p.Wallet, p.Currency, p.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r postgresLedger) addBalance(ctx context.Context, wallet, currency string, delta decimal.Decimal) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO wallet_balances(wallet, currency, balance) VALUES($1, $2, $3::numeric)
+									ON CONFLICT (wallet) DO UPDATE SET balance=wallet_balances.balance+EXCLUDED.balance`,
+						wallet, currency, delta.String())
+	return err
+}
+
+func (r postgresLedger) findEntry(ctx context.Context, id uuid.UUID) (*JournalEntry, error) {
+	e := &JournalEntry{}
+	err := r.db.QueryRow(ctx, `SELECT id,kind,description,created_at FROM journal_entries WHERE id=$1`, id).
+		Scan(&e.id, &e.kind, &e.description, &e.createdAt)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+
+	e.postings, err = r.queryPostings(ctx, `WHERE entry_id=$1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (r postgresLedger) findPostings(ctx context.Context, wallet string) ([]Posting, error) {
+	return r.queryPostings(ctx, `WHERE wallet=$1 ORDER BY id`, wallet)
+}
+
+func (r postgresLedger) queryPostings(ctx context.Context, where string, params ...interface{}) ([]Posting, error) {
+	rows, err := r.db.Query(ctx, `SELECT entry_id,wallet,currency,amount,created_at FROM postings `+where, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var postings []Posting
+	for rows.Next() {
+		var p Posting
+		err := rows.Scan(&p.EntryID, &p.Wallet, &p.Currency, &p.Amount, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		postings = append(postings, p)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return postings, nil
+}
+
+func (r postgresLedger) balance(ctx context.Context, wallet string) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.db.QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0) FROM postings WHERE wallet=$1`, wallet).Scan(&balance)
+	return balance, err
+}
+
+func (r postgresLedger) balanceAt(ctx context.Context, wallet string, at time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.db.QueryRow(ctx, `SELECT COALESCE(s.balance, 0) + COALESCE((SELECT SUM(p.amount) FROM postings p
+										WHERE p.wallet=$1 AND p.created_at <= $2::timestamp
+										AND p.created_at >= COALESCE(s.day + 1, '-infinity'::date)), 0)
+									FROM (SELECT 1) one LEFT JOIN LATERAL (
+										SELECT day, balance FROM balance_snapshots
+										WHERE wallet=$1 AND day + 1 <= $2::timestamp
+										ORDER BY day DESC LIMIT 1
+									) s ON TRUE`,
+						wallet, at).Scan(&balance)
+	return balance, err
+}
+
+func (r postgresLedger) nextSnapshotDay(ctx context.Context) (*time.Time, error) {
+	var day *time.Time
+	err := r.db.QueryRow(ctx, `SELECT COALESCE((SELECT MAX(day) + 1 FROM balance_snapshot_days),
+										(SELECT MIN(created_at)::date FROM postings))::timestamp`).Scan(&day)
+	return day, err
+}
+
+func (r postgresLedger) snapshotDay(ctx context.Context, day time.Time) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO balance_snapshots (wallet, day, balance)
+							SELECT d.wallet, $1::date, COALESCE(prev.balance, 0) + (SELECT SUM(p.amount) FROM postings p
+								WHERE p.wallet=d.wallet AND p.created_at < $1::date + 1
+								AND p.created_at >= COALESCE(prev.day + 1, '-infinity'::date))
+							FROM (
+								SELECT DISTINCT wallet FROM postings WHERE created_at >= $1::date AND created_at < $1::date + 1
+							) d LEFT JOIN LATERAL (
+								SELECT day, balance FROM balance_snapshots s WHERE s.wallet=d.wallet AND s.day < $1::date
+								ORDER BY day DESC LIMIT 1
+							) prev ON TRUE
+							ON CONFLICT (wallet, day) DO UPDATE SET balance=EXCLUDED.balance`, day)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(ctx, `INSERT INTO balance_snapshot_days (day) VALUES($1::date) ON CONFLICT DO NOTHING`, day)
+	return err
+}
+
+type postgresSupply struct {
+	db dbConn
+}
+
+func (r postgresSupply) insert(ctx context.Context, op *SupplyOperation) error {
+	_, err := r.db.Exec(ctx, `INSERT INTO supply_operations(id, kind, currency, amount, actor, reason, created_at)
+									VALUES($1, $2, $3, $4::numeric, $5, $6, $7)`,
+						op.ID, string(op.Kind), op.Currency, op.Amount.String(), op.Actor, op.Reason, op.CreatedAt)
+	return err
+}
+
+func (r postgresSupply) supply(ctx context.Context, c *Currency) (*Supply, error) {
+	s := &Supply{
+		Currency: c.symbol,
+	}
+
+	err := r.db.QueryRow(ctx, `SELECT
+									COALESCE((SELECT SUM(amount) FROM supply_operations WHERE currency=$1 AND kind='mint'), 0),
+									COALESCE((SELECT SUM(amount) FROM supply_operations WHERE currency=$1 AND kind='burn'), 0),
+									COALESCE((SELECT -balance FROM wallet_balances WHERE wallet=$2), 0),
+									COALESCE((SELECT balance FROM wallet_balances WHERE wallet=$3), 0)`,
+						c.symbol, c.issuanceWallet, c.serviceWallet).
+		Scan(&s.Minted, &s.Burned, &s.Issued, &s.Treasury)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (r postgresSupply) findByCurrency(ctx context.Context, currency string) ([]*SupplyOperation, error) {
+	rows, err := r.db.Query(ctx, `SELECT id,kind,currency,amount,actor,reason,created_at FROM supply_operations
+									WHERE currency=$1 ORDER BY created_at DESC, id DESC`, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []*SupplyOperation
+	for rows.Next() {
+		op := &SupplyOperation{}
+		err := rows.Scan(&op.ID, &op.Kind, &op.Currency, &op.Amount, &op.Actor, &op.Reason, &op.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, op)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return ops, nil
+}
+
+type postgresReconciliation struct {
+	db dbConn
+}
+
+func (r postgresReconciliation) countWallets(ctx context.Context) (int, error) {
+	var count int
+	err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM user_wallets`).Scan(&count)
+	return count, err
+}
+
+func (r postgresReconciliation) negativeBalances(ctx context.Context) ([]NegativeBalance, error) {
+	rows, err := r.db.Query(ctx, `SELECT b.wallet,b.currency,b.balance FROM wallet_balances b
+									WHERE b.balance < 0 AND b.wallet NOT IN (SELECT issuance_wallet FROM currencies)
+									ORDER BY b.wallet`)
+	if err != nil {
+		return nil, err
+	}
+
+	var balances []NegativeBalance
+	for rows.Next() {
+		var n NegativeBalance
+		err := rows.Scan(&n.Address, &n.Currency, &n.Balance)
+		if err != nil {
+			return nil, err
+		}
+
+		balances = append(balances, n)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return balances, nil
+}
+
+func (r postgresReconciliation) orphanAddresses(ctx context.Context) ([]OrphanAddress, error) {
+	rows, err := r.db.Query(ctx, `SELECT a.wallet,a.source FROM (
+									SELECT to_wallet AS wallet, 'transactions' AS source FROM transactions
+									UNION SELECT from_wallet, 'transactions' FROM transactions
+									UNION SELECT wallet, 'postings' FROM postings
+								) a WHERE NOT EXISTS (SELECT 1 FROM user_wallets w WHERE w.wallet=a.wallet)
+								ORDER BY a.wallet, a.source`)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []OrphanAddress
+	for rows.Next() {
+		var o OrphanAddress
+		err := rows.Scan(&o.Address, &o.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		orphans = append(orphans, o)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return orphans, nil
+}
+
+func (r postgresReconciliation) currencyMismatches(ctx context.Context) ([]CurrencyMismatch, error) {
+	rows, err := r.db.Query(ctx, `SELECT m.source,m.id,m.wallet,m.currency,w.currency FROM (
+									SELECT 'transactions' AS source, id::text AS id, to_wallet AS wallet, currency FROM transactions
+									UNION ALL SELECT 'transactions', id::text, from_wallet, currency FROM transactions
+									UNION ALL SELECT 'postings', id::text, wallet, currency FROM postings
+								) m JOIN user_wallets w ON w.wallet=m.wallet
+								WHERE w.currency<>m.currency
+								ORDER BY m.source, m.id`)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []CurrencyMismatch
+	for rows.Next() {
+		var m CurrencyMismatch
+		err := rows.Scan(&m.Source, &m.ID, &m.Address, &m.Currency, &m.WalletCurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return mismatches, nil
+}
+
+// issuance sums up the coins held by wallets from the postings, so the check does not depend on the stored balances
+func (r postgresReconciliation) issuance(ctx context.Context) ([]SupplyMismatch, error) {
+	rows, err := r.db.Query(ctx, `SELECT c.symbol,
+									COALESCE((SELECT SUM(p.amount) FROM postings p WHERE p.currency=c.symbol AND p.wallet<>c.issuance_wallet), 0),
+									COALESCE((SELECT SUM(s.amount) FROM supply_operations s WHERE s.currency=c.symbol AND s.kind='mint'), 0),
+									COALESCE((SELECT SUM(s.amount) FROM supply_operations s WHERE s.currency=c.symbol AND s.kind='burn'), 0)
+								FROM currencies c ORDER BY c.symbol`)
+	if err != nil {
+		return nil, err
+	}
+
+	var issuance []SupplyMismatch
+	for rows.Next() {
+		var s SupplyMismatch
+		err := rows.Scan(&s.Currency, &s.Issued, &s.Minted, &s.Burned)
+		if err != nil {
+			return nil, err
+		}
+
+		issuance = append(issuance, s)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return issuance, nil
+}
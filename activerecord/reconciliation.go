@@ -0,0 +1,120 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ReconciliationReport lists violations of the ledger invariants. It is serialized as is by the reconcile command
+type ReconciliationReport struct {
+	CheckedAt          time.Time          `json:"checkedAt"`
+	Wallets            int                `json:"wallets"`
+	BalanceMismatches  []BalanceMismatch  `json:"balanceMismatches"`
+	NegativeBalances   []NegativeBalance  `json:"negativeBalances"`
+	OrphanAddresses    []OrphanAddress    `json:"orphanAddresses"`
+	CurrencyMismatches []CurrencyMismatch `json:"currencyMismatches"`
+	SupplyMismatches   []SupplyMismatch   `json:"supplyMismatches"`
+}
+
+// OK tells if no violations were found
+func (r *ReconciliationReport) OK() bool {
+	return len(r.BalanceMismatches) == 0 && len(r.NegativeBalances) == 0 && len(r.OrphanAddresses) == 0 &&
+		len(r.CurrencyMismatches) == 0 && len(r.SupplyMismatches) == 0
+}
+
+type NegativeBalance struct {
+	Address  string          `json:"address"`
+	Currency string          `json:"currency"`
+	Balance  decimal.Decimal `json:"balance"`
+}
+
+// OrphanAddress is an address which is used by transactions or postings but does not exist in user_wallets
+type OrphanAddress struct {
+	Address string `json:"address"`
+	Source  string `json:"source"`
+}
+
+// CurrencyMismatch is a transaction or a posting in a currency different from the currency of its wallet
+type CurrencyMismatch struct {
+	Source         string `json:"source"`
+	ID             string `json:"id"`
+	Address        string `json:"address"`
+	Currency       string `json:"currency"`
+	WalletCurrency string `json:"walletCurrency"`
+}
+
+// SupplyMismatch is a currency whose coins held by wallets do not match minted minus burned
+type SupplyMismatch struct {
+	Currency string          `json:"currency"`
+	Issued   decimal.Decimal `json:"issued"`
+	Minted   decimal.Decimal `json:"minted"`
+	Burned   decimal.Decimal `json:"burned"`
+}
+
+// Reconcile checks the ledger invariants:
+// stored balances match the replayed postings, only issuance wallets have negative balances,
+// every used address exists in user_wallets with the currency of its transactions,
+// and the coins held by the wallets of every currency equal minted minus burned.
+// All the checks read the same snapshot, so transfers committed meanwhile are not reported as violations
+func (f facade) Reconcile(ctx context.Context) (*ReconciliationReport, error) {
+	r := &ReconciliationReport{
+		CheckedAt:          time.Now().UTC(),
+		BalanceMismatches:  []BalanceMismatch{},
+		NegativeBalances:   []NegativeBalance{},
+		OrphanAddresses:    []OrphanAddress{},
+		CurrencyMismatches: []CurrencyMismatch{},
+		SupplyMismatches:   []SupplyMismatch{},
+	}
+
+	tx, err := f.store.beginSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	reconciliation := tx.reconciliation()
+	wallets, err := reconciliation.countWallets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.Wallets = wallets
+
+	mismatches, err := newWalletFactory(tx).VerifyBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.BalanceMismatches = append(r.BalanceMismatches, mismatches...)
+
+	negative, err := reconciliation.negativeBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.NegativeBalances = append(r.NegativeBalances, negative...)
+
+	orphans, err := reconciliation.orphanAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.OrphanAddresses = append(r.OrphanAddresses, orphans...)
+
+	currencyMismatches, err := reconciliation.currencyMismatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.CurrencyMismatches = append(r.CurrencyMismatches, currencyMismatches...)
+
+	issuance, err := reconciliation.issuance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range issuance {
+		if !s.Issued.Equal(s.Minted.Sub(s.Burned)) {
+			r.SupplyMismatches = append(r.SupplyMismatches, s)
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,222 @@
+package activerecord
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid")
+
+const refreshTokenBytes = 32
+
+func newSessionFactory(store store) SessionFactory {
+	return SessionFactory{
+		store: store,
+	}
+}
+
+// SessionFactory manages login sessions. A session is a family of refresh tokens:
+// every refresh rotates the token, and presenting a rotated token again revokes the whole session
+type SessionFactory struct {
+	store store
+}
+
+// Start creates a session for the user and returns it together with its first refresh token
+func (sf SessionFactory) Start(ctx context.Context, userID uuid.UUID, ttl time.Duration) (*Session, string, error) {
+	now := time.Now().UTC()
+	s := &Session{
+		store:     sf.store,
+		id:        uuid.New(),
+		userID:    userID,
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+	}
+
+	tx, err := sf.store.begin(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.sessions().insert(ctx, s)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := s.issueRefreshToken(ctx, tx, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return s, token, nil
+}
+
+// Refresh exchanges the refresh token for a new one and extends the session by ttl.
+// If the token has already been exchanged, it is treated as stolen and the session is revoked
+func (sf SessionFactory) Refresh(ctx context.Context, token string, ttl time.Duration) (*Session, string, error) {
+	tx, err := sf.store.begin(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	sessionID, usedAt, err := tx.sessions().findRefreshToken(ctx, hashRefreshToken(token))
+	if err != nil {
+		if _, ok := err.(NotFoundError); ok {
+			return nil, "", invalidRefreshToken
+		}
+
+		return nil, "", err
+	}
+
+	s, err := newSessionFactory(tx).Find(ctx, sessionID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now().UTC()
+	if usedAt != nil {
+		if s.Active() {
+			err = s.Revoke(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+
+			err = tx.Commit(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+
+		return nil, "", refreshTokenReused
+	}
+
+	if !s.Active() {
+		return nil, "", invalidRefreshToken
+	}
+
+	err = tx.sessions().useRefreshToken(ctx, hashRefreshToken(token), now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.expiresAt = now.Add(ttl)
+	err = tx.sessions().extend(ctx, s.id, s.expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newToken, err := s.issueRefreshToken(ctx, tx, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.store = sf.store
+	return s, newToken, nil
+}
+
+func (sf SessionFactory) Find(ctx context.Context, id uuid.UUID) (*Session, error) {
+	s, err := sf.store.sessions().find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.store = sf.store
+	return s, nil
+}
+
+// RevokeByUserID revokes all sessions of the user
+func (sf SessionFactory) RevokeByUserID(ctx context.Context, userID uuid.UUID) error {
+	return sf.store.sessions().revokeByUserID(ctx, userID, time.Now().UTC())
+}
+
+// FindActiveByUserID returns sessions of the user which are neither revoked nor expired, the latest first
+func (sf SessionFactory) FindActiveByUserID(ctx context.Context, userID uuid.UUID) ([]*Session, error) {
+	sessions, err := sf.store.sessions().findActiveByUserID(ctx, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range sessions {
+		s.store = sf.store
+	}
+
+	return sessions, nil
+}
+
+type Session struct {
+	store     store
+	id        uuid.UUID
+	userID    uuid.UUID
+	createdAt time.Time
+	expiresAt time.Time
+	revokedAt *time.Time
+}
+
+// issueRefreshToken stores the hash of a new random refresh token of the session and returns the token
+func (s *Session) issueRefreshToken(ctx context.Context, store store, now time.Time) (string, error) {
+	b := make([]byte, refreshTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err = store.sessions().insertRefreshToken(ctx, hashRefreshToken(token), s.id, now)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Revoke ends the session, its access and refresh tokens are not accepted anymore
+func (s *Session) Revoke(ctx context.Context) error {
+	now := time.Now().UTC()
+	err := s.store.sessions().revoke(ctx, s.id, now)
+	if err != nil {
+		return err
+	}
+
+	s.revokedAt = &now
+	return nil
+}
+
+// Active tells if the session is neither revoked nor expired
+func (s *Session) Active() bool {
+	return s.revokedAt == nil && time.Now().Before(s.expiresAt)
+}
+
+func (s *Session) ID() uuid.UUID {
+	return s.id
+}
+
+func (s *Session) UserID() uuid.UUID {
+	return s.userID
+}
+
+func (s *Session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+func (s *Session) ExpiresAt() time.Time {
+	return s.expiresAt
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
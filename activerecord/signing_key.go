@@ -0,0 +1,330 @@
+package activerecord
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+
+	plainPrivateKeyType  = "PRIVATE KEY"
+	sealedPrivateKeyType = "SEALED PRIVATE KEY"
+)
+
+var errNoSigningKeySecret = errors.New("signing keys are encrypted, but the key-encryption secret is not set")
+
+func newSigningKeyFactory(store store, secret []byte) SigningKeyFactory {
+	return SigningKeyFactory{
+		store:  store,
+		secret: secret,
+	}
+}
+
+// SigningKeyFactory stores the keys which sign and verify access tokens.
+// Only the latest key signs, older keys verify until the end of their grace period.
+// Private keys are stored encrypted with the secret, without the secret they are stored as plain PEM
+type SigningKeyFactory struct {
+	store  store
+	secret []byte
+}
+
+// FindActive returns the keys which are not expired, the signing key first
+func (f SigningKeyFactory) FindActive(ctx context.Context) ([]*SigningKey, error) {
+	keys, err := f.store.signingKeys().findActive(ctx, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		k.privateKey, err = parsePrivateKey(k.id, k.storedPrivateKey, f.secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// EncryptPlain encrypts the keys stored as plain PEM before the secret was set, including expired ones.
+// It returns the number of encrypted keys
+func (f SigningKeyFactory) EncryptPlain(ctx context.Context) (int, error) {
+	if len(f.secret) == 0 {
+		return 0, nil
+	}
+
+	encrypted := 0
+	err := f.change(ctx, func(tx store, now time.Time) error {
+		keys, err := tx.signingKeys().findAll(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			block, _ := pem.Decode([]byte(k.storedPrivateKey))
+			if block == nil || block.Type != plainPrivateKeyType {
+				continue
+			}
+
+			privateKey, err := parsePrivateKey(k.id, k.storedPrivateKey, nil)
+			if err != nil {
+				return err
+			}
+
+			stored, err := marshalPrivateKey(k.id, privateKey, f.secret)
+			if err != nil {
+				return err
+			}
+
+			err = tx.signingKeys().updatePrivateKey(ctx, k.id, stored)
+			if err != nil {
+				return err
+			}
+			encrypted++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return encrypted, nil
+}
+
+// EnsureSigningKey creates a signing key of the algorithm unless there already is one
+func (f SigningKeyFactory) EnsureSigningKey(ctx context.Context, algorithm string) error {
+	return f.change(ctx, func(tx store, now time.Time) error {
+		exists, err := tx.signingKeys().hasSigningKey(ctx)
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = insertSigningKey(ctx, tx, algorithm, now, f.secret)
+		return err
+	})
+}
+
+// Rotate creates a new signing key of the algorithm. Previous keys stop signing
+// and keep verifying tokens during the grace period, which should not be shorter than the access token lifetime
+func (f SigningKeyFactory) Rotate(ctx context.Context, algorithm string, grace time.Duration) (*SigningKey, error) {
+	var k *SigningKey
+	err := f.change(ctx, func(tx store, now time.Time) error {
+		err := tx.signingKeys().retire(ctx, now, now.Add(grace))
+		if err != nil {
+			return err
+		}
+
+		k, err = insertSigningKey(ctx, tx, algorithm, now, f.secret)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (f SigningKeyFactory) change(ctx context.Context, fn func(tx store, now time.Time) error) error {
+	tx, err := f.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.signingKeys().lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func insertSigningKey(ctx context.Context, store store, algorithm string, now time.Time, secret []byte) (*SigningKey, error) {
+	k, err := newSigningKey(algorithm, now)
+	if err != nil {
+		return nil, err
+	}
+
+	k.storedPrivateKey, err = marshalPrivateKey(k.id, k.privateKey, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.signingKeys().insert(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func newSigningKey(algorithm string, now time.Time) (*SigningKey, error) {
+	k := &SigningKey{
+		id:        uuid.New().String(),
+		algorithm: algorithm,
+		createdAt: now,
+	}
+
+	var err error
+	switch algorithm {
+	case RS256:
+		k.privateKey, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case EdDSA:
+		_, k.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, invalidSigningAlgorithm
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// marshalPrivateKey encodes the key as PKCS8 PEM. With a secret the PEM is encrypted by AES-256-GCM
+// and bound to the key id, so a stored key cannot be passed off as another one
+func marshalPrivateKey(id string, key crypto.Signer, secret []byte) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	plain := pem.EncodeToMemory(&pem.Block{Type: plainPrivateKeyType, Bytes: der})
+	if len(secret) == 0 {
+		return string(plain), nil
+	}
+
+	aead, err := signingKeyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, []byte(id))
+	return string(pem.EncodeToMemory(&pem.Block{Type: sealedPrivateKeyType, Bytes: sealed})), nil
+}
+
+// parsePrivateKey decodes a key encoded by marshalPrivateKey. Plain keys are accepted with any secret,
+// they are left by the versions which did not encrypt keys
+func parsePrivateKey(id, data string, secret []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("invalid PEM private key")
+	}
+
+	if block.Type == sealedPrivateKeyType {
+		if len(secret) == 0 {
+			return nil, errNoSigningKeySecret
+		}
+
+		aead, err := signingKeyCipher(secret)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(block.Bytes) < aead.NonceSize() {
+			return nil, fmt.Errorf("signing key %s is corrupted", id)
+		}
+
+		nonce, sealed := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, sealed, []byte(id))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt signing key %s, the key-encryption secret is wrong", id)
+		}
+
+		block, _ = pem.Decode(plain)
+		if block == nil {
+			return nil, errors.New("invalid PEM private key")
+		}
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+
+	return signer, nil
+}
+
+// signingKeyCipher derives the AES-256 key from the secret, which may be of any length
+func signingKeyCipher(secret []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type SigningKey struct {
+	// id is the kid header of the tokens signed by the key
+	id         string
+	algorithm  string
+	privateKey crypto.Signer
+	// storedPrivateKey is the private key as it is stored, see marshalPrivateKey
+	storedPrivateKey string
+	createdAt        time.Time
+	// retiredAt is set when the key stops signing
+	retiredAt *time.Time
+	// expiresAt is set when the key is retired, after it the key stops verifying
+	expiresAt *time.Time
+}
+
+func (k *SigningKey) ID() string {
+	return k.id
+}
+
+func (k *SigningKey) Algorithm() string {
+	return k.algorithm
+}
+
+// Signing tells if the key signs new tokens
+func (k *SigningKey) Signing() bool {
+	return k.retiredAt == nil
+}
+
+func (k *SigningKey) PrivateKey() crypto.Signer {
+	return k.privateKey
+}
+
+func (k *SigningKey) PublicKey() crypto.PublicKey {
+	return k.privateKey.Public()
+}
+
+func (k *SigningKey) ExpiresAt() *time.Time {
+	return k.expiresAt
+}
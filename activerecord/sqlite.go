@@ -0,0 +1,318 @@
+package activerecord
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteOptions keep the DB file consistent with the Postgres schema and make timestamps comparable as strings:
+// foreign keys are enforced, DB transactions take the write lock when they begin instead of failing on upgrade,
+// timestamps are written as UTC strings which sort in time order and parsed back by SQL functions like MAX
+const sqliteOptions = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+	"&_txlock=immediate&_time_format=sqlite&_timezone=UTC&_texttotime=1"
+
+// The decimal functions do the math of amounts, which SQLite keeps as strings, with exact decimals,
+// so the SQL of SQLite stays close to the SQL of Postgres NUMERIC
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("decimal_add", 2, decimalAdd)
+	sqlite.MustRegisterDeterministicScalarFunction("decimal_cmp", 2, decimalCmp)
+	sqlite.MustRegisterFunction("decimal_sum", &sqlite.FunctionImpl{
+		NArgs:         1,
+		Deterministic: true,
+		MakeAggregate: func(sqlite.FunctionContext) (sqlite.AggregateFunction, error) {
+			return &decimalSum{}, nil
+		},
+	})
+}
+
+// OpenSQLite opens the SQLite DB file at path, it is created if it does not exist.
+// The pool has a single connection, so DB transactions of the process are serialized, readers wait for them as well
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?"+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewSQLite creates a facade over a DB opened by OpenSQLite, the schema is created by migrations.NewSQLite.
+// New users' emails are checked by emailValidator, SyntaxEmailValidator is used if it is nil
+func NewSQLite(db *sql.DB, emailValidator EmailValidator) Facade {
+	if emailValidator == nil {
+		emailValidator = SyntaxEmailValidator{}
+	}
+
+	return facade{
+		store:          sqliteStore{db: db},
+		emailValidator: emailValidator,
+	}
+}
+
+// sqliteConn is implemented by both *sql.DB and *sql.Tx
+type sqliteConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqliteStore keeps the records in SQLite. Rows are not locked for update,
+// the DB transaction holds the write lock of the whole DB from its beginning
+type sqliteStore struct {
+	db *sql.DB
+	tx *sql.Tx
+	// savepoints counts the savepoints of the DB transaction to name them
+	savepoints *int
+}
+
+func (s sqliteStore) conn() sqliteConn {
+	if s.tx != nil {
+		return s.tx
+	}
+
+	return s.db
+}
+
+// beginSnapshot starts a DB transaction. SQLite transactions are serializable and the store has a single connection,
+// so nothing changes the DB until the transaction ends
+func (s sqliteStore) beginSnapshot(ctx context.Context) (txStore, error) {
+	return s.begin(ctx)
+}
+
+// begin starts a DB transaction, or a savepoint if the store is already in one
+func (s sqliteStore) begin(ctx context.Context) (txStore, error) {
+	if s.tx == nil {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sqliteTx{sqliteStore: sqliteStore{db: s.db, tx: tx, savepoints: new(int)}}, nil
+	}
+
+	*s.savepoints++
+	savepoint := fmt.Sprintf("sp_%d", *s.savepoints)
+	_, err := s.tx.ExecContext(ctx, `SAVEPOINT `+savepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteTx{sqliteStore: s, savepoint: savepoint}, nil
+}
+
+func (s sqliteStore) users() userRepository {
+	return sqliteUsers{db: s.conn()}
+}
+
+func (s sqliteStore) wallets() walletRepository {
+	return sqliteWallets{db: s.conn()}
+}
+
+func (s sqliteStore) currencies() currencyRepository {
+	return sqliteCurrencies{db: s.conn()}
+}
+
+func (s sqliteStore) transactions() transactionRepository {
+	return sqliteTransactions{db: s.conn()}
+}
+
+func (s sqliteStore) ledger() ledgerRepository {
+	return sqliteLedger{db: s.conn()}
+}
+
+func (s sqliteStore) supply() supplyRepository {
+	return sqliteSupply{db: s.conn()}
+}
+
+func (s sqliteStore) reconciliation() reconciliationRepository {
+	return sqliteReconciliation{db: s.conn()}
+}
+
+func (s sqliteStore) idempotencyKeys() idempotencyKeyRepository {
+	return sqliteIdempotencyKeys{db: s.conn()}
+}
+
+func (s sqliteStore) sessions() sessionRepository {
+	return sqliteSessions{db: s.conn()}
+}
+
+func (s sqliteStore) signingKeys() signingKeyRepository {
+	return sqliteSigningKeys{db: s.conn()}
+}
+
+func (s sqliteStore) apiKeys() apiKeyRepository {
+	return sqliteAPIKeys{db: s.conn()}
+}
+
+func (s sqliteStore) twoFactors() twoFactorRepository {
+	return sqliteTwoFactors{db: s.conn()}
+}
+
+func (s sqliteStore) loginThrottles() loginThrottleRepository {
+	return sqliteLoginThrottles{db: s.conn()}
+}
+
+func (s sqliteStore) emailTokens() emailTokenRepository {
+	return sqliteEmailTokens{db: s.conn()}
+}
+
+func (s sqliteStore) auditEvents() auditRepository {
+	return sqliteAuditEvents{db: s.conn()}
+}
+
+type sqliteTx struct {
+	sqliteStore
+	// savepoint is empty for the DB transaction itself
+	savepoint string
+	done      bool
+}
+
+func (t *sqliteTx) Commit(ctx context.Context) error {
+	if t.savepoint == "" {
+		return t.tx.Commit()
+	}
+
+	if t.done {
+		return sql.ErrTxDone
+	}
+
+	t.done = true
+	_, err := t.tx.ExecContext(ctx, `RELEASE SAVEPOINT `+t.savepoint)
+	return err
+}
+
+// Rollback of a savepoint undoes its changes and removes it, the DB transaction goes on
+func (t *sqliteTx) Rollback(ctx context.Context) error {
+	if t.savepoint == "" {
+		return t.tx.Rollback()
+	}
+
+	if t.done {
+		return sql.ErrTxDone
+	}
+
+	t.done = true
+	_, err := t.tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT `+t.savepoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tx.ExecContext(ctx, `RELEASE SAVEPOINT `+t.savepoint)
+	return err
+}
+
+// sqliteError turns unique constraint violations into errUniqueViolation and missing rows into notFoundError
+func sqliteError(err error) error {
+	if err == sql.ErrNoRows {
+		return notFoundError
+	}
+
+	var e *sqlite.Error
+	if errors.As(err, &e) && (e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return errUniqueViolation
+	}
+
+	return err
+}
+
+// sqliteDecimal converts an argument of a decimal function, NULL is not valid
+func sqliteDecimal(v driver.Value) (decimal.Decimal, bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return decimal.Zero, false, nil
+	case int64:
+		return decimal.NewFromInt(v), true, nil
+	case float64:
+		return decimal.NewFromFloat(v), true, nil
+	case string:
+		d, err := decimal.NewFromString(v)
+		return d, true, err
+	case []byte:
+		d, err := decimal.NewFromString(string(v))
+		return d, true, err
+	default:
+		return decimal.Zero, false, fmt.Errorf("%T is not a decimal", v)
+	}
+}
+
+// decimalAdd returns the sum of two decimals as a string, NULL if any of them is NULL
+func decimalAdd(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	a, aValid, err := sqliteDecimal(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	b, bValid, err := sqliteDecimal(args[1])
+	if err != nil || !aValid || !bValid {
+		return nil, err
+	}
+
+	return a.Add(b).String(), nil
+}
+
+// decimalCmp returns -1, 0 or 1 like decimal.Cmp, NULL if any of the decimals is NULL
+func decimalCmp(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	a, aValid, err := sqliteDecimal(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	b, bValid, err := sqliteDecimal(args[1])
+	if err != nil || !aValid || !bValid {
+		return nil, err
+	}
+
+	return int64(a.Cmp(b)), nil
+}
+
+// decimalSum is the aggregate decimal_sum, it skips NULLs and returns NULL if there is nothing to sum like SUM
+type decimalSum struct {
+	sum   decimal.Decimal
+	count int
+}
+
+func (s *decimalSum) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	d, valid, err := sqliteDecimal(args[0])
+	if err != nil || !valid {
+		return err
+	}
+
+	s.sum = s.sum.Add(d)
+	s.count++
+	return nil
+}
+
+func (s *decimalSum) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	d, valid, err := sqliteDecimal(args[0])
+	if err != nil || !valid {
+		return err
+	}
+
+	s.sum = s.sum.Sub(d)
+	s.count--
+	return nil
+}
+
+func (s *decimalSum) WindowValue(*sqlite.FunctionContext) (driver.Value, error) {
+	if s.count == 0 {
+		return nil, nil
+	}
+
+	return s.sum.String(), nil
+}
+
+func (s *decimalSum) Final(*sqlite.FunctionContext) {}
@@ -0,0 +1,567 @@
+package activerecord
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type sqliteUsers struct {
+	db sqliteConn
+}
+
+func (r sqliteUsers) insert(ctx context.Context, u *User) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO users(id, email, password, first_name, last_name) VALUES($1,$2,$3,$4,$5)`,
+		u.id, u.email, u.password, u.firstName, u.lastName)
+	return sqliteError(err)
+}
+
+func (r sqliteUsers) findByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	return r.findOne(ctx, `WHERE id=$1`, id)
+}
+
+func (r sqliteUsers) findByEmail(ctx context.Context, email string) (*User, error) {
+	return r.findOne(ctx, `WHERE email=$1`, email)
+}
+
+func (r sqliteUsers) findOne(ctx context.Context, where string, whereParams ...interface{}) (*User, error) {
+	user := &User{}
+	err := r.db.QueryRowContext(ctx, `SELECT id,email,password,first_name,last_name,is_admin,email_verified_at FROM users `+where, whereParams...).
+		Scan(&user.id, &user.email, &user.password, &user.firstName, &user.lastName, &user.admin, &user.emailVerifiedAt)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return user, nil
+}
+
+func (r sqliteUsers) setAdmin(ctx context.Context, id uuid.UUID, admin bool) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET is_admin=$2 WHERE id=$1`, id, admin)
+	return err
+}
+
+func (r sqliteUsers) verifyEmail(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET email_verified_at=$2 WHERE id=$1 AND email_verified_at IS NULL`, id, at)
+	return err
+}
+
+func (r sqliteUsers) setPassword(ctx context.Context, id uuid.UUID, hash string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET password=$2 WHERE id=$1`, id, hash)
+	return err
+}
+
+// rowsAffected tells if the statement has changed exactly one row
+func rowsAffected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+type sqliteIdempotencyKeys struct {
+	db sqliteConn
+}
+
+func (r sqliteIdempotencyKeys) claim(ctx context.Context, k *IdempotencyKey) (bool, error) {
+	return rowsAffected(r.db.ExecContext(ctx, `INSERT INTO idempotency_keys(scope, key, request_hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)
+									ON CONFLICT (scope, key) DO UPDATE SET request_hash=excluded.request_hash, status=NULL, content_type=NULL,
+										response=NULL, created_at=excluded.created_at, expires_at=excluded.expires_at
+									WHERE idempotency_keys.expires_at <= excluded.created_at`,
+						k.scope, k.key, k.requestHash, k.createdAt, k.expiresAt))
+}
+
+func (r sqliteIdempotencyKeys) find(ctx context.Context, scope, key string) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	var status *int
+	var contentType *string
+	err := r.db.QueryRowContext(ctx, `SELECT scope,key,request_hash,status,content_type,response,created_at,expires_at FROM idempotency_keys
+								WHERE scope=$1 AND key=$2`, scope, key).
+		Scan(&k.scope, &k.key, &k.requestHash, &status, &contentType, &k.response, &k.createdAt, &k.expiresAt)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	if status != nil {
+		k.status = *status
+	}
+
+	if contentType != nil {
+		k.contentType = *contentType
+	}
+
+	return k, nil
+}
+
+func (r sqliteIdempotencyKeys) complete(ctx context.Context, scope, key string, status int, contentType string, response []byte) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE idempotency_keys SET status=$3, content_type=$4, response=$5 WHERE scope=$1 AND key=$2`,
+		scope, key, status, contentType, response)
+	return err
+}
+
+func (r sqliteIdempotencyKeys) delete(ctx context.Context, scope, key string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2`, scope, key)
+	return err
+}
+
+func (r sqliteIdempotencyKeys) deleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+type sqliteSessions struct {
+	db sqliteConn
+}
+
+func (r sqliteSessions) insert(ctx context.Context, s *Session) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO sessions(id, user_id, created_at, expires_at) VALUES($1, $2, $3, $4)`,
+		s.id, s.userID, s.createdAt, s.expiresAt)
+	return err
+}
+
+func (r sqliteSessions) find(ctx context.Context, id uuid.UUID) (*Session, error) {
+	s, err := scanSession(r.db.QueryRowContext(ctx, `SELECT id,user_id,created_at,expires_at,revoked_at FROM sessions WHERE id=$1`, id))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return s, nil
+}
+
+func (r sqliteSessions) findActiveByUserID(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Session, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id,user_id,created_at,expires_at,revoked_at FROM sessions
+									WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > $2
+									ORDER BY created_at DESC`, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return sessions, nil
+}
+
+func (r sqliteSessions) extend(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE sessions SET expires_at=$2 WHERE id=$1`, id, expiresAt)
+	return err
+}
+
+func (r sqliteSessions) revoke(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE sessions SET revoked_at=$2 WHERE id=$1 AND revoked_at IS NULL`, id, at)
+	return err
+}
+
+func (r sqliteSessions) revokeByUserID(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE sessions SET revoked_at=$2 WHERE user_id=$1 AND revoked_at IS NULL`, userID, at)
+	return err
+}
+
+func (r sqliteSessions) insertRefreshToken(ctx context.Context, hash string, sessionID uuid.UUID, createdAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO refresh_tokens(hash, session_id, created_at) VALUES($1, $2, $3)`, hash, sessionID, createdAt)
+	return err
+}
+
+func (r sqliteSessions) findRefreshToken(ctx context.Context, hash string) (uuid.UUID, *time.Time, error) {
+	var sessionID uuid.UUID
+	var usedAt *time.Time
+	err := r.db.QueryRowContext(ctx, `SELECT session_id,used_at FROM refresh_tokens WHERE hash=$1`, hash).
+		Scan(&sessionID, &usedAt)
+	if err != nil {
+		return uuid.UUID{}, nil, sqliteError(err)
+	}
+
+	return sessionID, usedAt, nil
+}
+
+func (r sqliteSessions) useRefreshToken(ctx context.Context, hash string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE refresh_tokens SET used_at=$2 WHERE hash=$1`, hash, at)
+	return err
+}
+
+type sqliteSigningKeys struct {
+	db sqliteConn
+}
+
+// lock does nothing, the DB transaction has held the write lock since it began
+func (r sqliteSigningKeys) lock(context.Context) error {
+	return nil
+}
+
+func (r sqliteSigningKeys) findActive(ctx context.Context, now time.Time) ([]*SigningKey, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT kid,algorithm,private_key,created_at,retired_at,expires_at FROM signing_keys
+									WHERE expires_at IS NULL OR expires_at > $1
+									ORDER BY retired_at DESC NULLS FIRST, created_at DESC`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSQLiteSigningKeys(rows)
+}
+
+func (r sqliteSigningKeys) findAll(ctx context.Context) ([]*SigningKey, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT kid,algorithm,private_key,created_at,retired_at,expires_at FROM signing_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSQLiteSigningKeys(rows)
+}
+
+func (r sqliteSigningKeys) hasSigningKey(ctx context.Context) (bool, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM signing_keys WHERE retired_at IS NULL)`).Scan(&exists)
+	return exists, err
+}
+
+func (r sqliteSigningKeys) retire(ctx context.Context, at, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE signing_keys SET retired_at=$1, expires_at=$2 WHERE retired_at IS NULL`, at, expiresAt)
+	return err
+}
+
+func (r sqliteSigningKeys) insert(ctx context.Context, k *SigningKey) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO signing_keys(kid, algorithm, private_key, created_at) VALUES($1, $2, $3, $4)`,
+		k.id, k.algorithm, k.storedPrivateKey, k.createdAt)
+	return err
+}
+
+func (r sqliteSigningKeys) updatePrivateKey(ctx context.Context, id, storedPrivateKey string) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE signing_keys SET private_key=$2 WHERE kid=$1`, id, storedPrivateKey)
+	return err
+}
+
+func scanSQLiteSigningKeys(rows *sql.Rows) ([]*SigningKey, error) {
+	var keys []*SigningKey
+	for rows.Next() {
+		k := &SigningKey{}
+		err := rows.Scan(&k.id, &k.algorithm, &k.storedPrivateKey, &k.createdAt, &k.retiredAt, &k.expiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return keys, nil
+}
+
+// sqliteAPIKeys keeps scopes and allowed IPs as JSON arrays, SQLite has no array columns
+type sqliteAPIKeys struct {
+	db sqliteConn
+}
+
+func scanSQLiteAPIKey(row interface{ Scan(dest ...interface{}) error }) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes, allowedIPs string
+	err := row.Scan(&k.id, &k.userID, &k.name, &k.prefix, &scopes, &allowedIPs, &k.createdAt, &k.expiresAt, &k.lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(scopes), &k.scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(allowedIPs), &k.allowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// marshalAPIKeyLists returns the scopes and the allowed IPs of the key as JSON arrays
+func marshalAPIKeyLists(k *APIKey) (string, string, error) {
+	allowedIPs := k.allowedIPs
+	if allowedIPs == nil {
+		allowedIPs = []string{}
+	}
+
+	scopes, err := json.Marshal(k.scopeStrings())
+	if err != nil {
+		return "", "", err
+	}
+
+	ips, err := json.Marshal(allowedIPs)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(scopes), string(ips), nil
+}
+
+func (r sqliteAPIKeys) insert(ctx context.Context, k *APIKey) error {
+	scopes, allowedIPs, err := marshalAPIKeyLists(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO api_keys(id, user_id, name, prefix, hash, scopes, allowed_ips, created_at, expires_at)
+									VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+						k.id, k.userID, k.name, k.prefix, k.hash, scopes, allowedIPs, k.createdAt, k.expiresAt)
+	return err
+}
+
+func (r sqliteAPIKeys) findByHash(ctx context.Context, hash string) (*APIKey, error) {
+	return r.findOne(ctx, `WHERE hash=$1`, hash)
+}
+
+func (r sqliteAPIKeys) find(ctx context.Context, userID, id uuid.UUID) (*APIKey, error) {
+	return r.findOne(ctx, `WHERE user_id=$1 AND id=$2`, userID, id)
+}
+
+func (r sqliteAPIKeys) findOne(ctx context.Context, where string, params ...interface{}) (*APIKey, error) {
+	k, err := scanSQLiteAPIKey(r.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys `+where, params...))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return k, nil
+}
+
+func (r sqliteAPIKeys) findByUserID(ctx context.Context, userID uuid.UUID) ([]*APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id=$1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return keys, nil
+}
+
+func (r sqliteAPIKeys) update(ctx context.Context, k *APIKey) error {
+	scopes, allowedIPs, err := marshalAPIKeyLists(k)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, `UPDATE api_keys SET name=$2, scopes=$3, allowed_ips=$4, expires_at=$5 WHERE id=$1`,
+		k.id, k.name, scopes, allowedIPs, k.expiresAt)
+	return err
+}
+
+func (r sqliteAPIKeys) setLastUsedAt(ctx context.Context, id uuid.UUID, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at=$2 WHERE id=$1`, id, at)
+	return err
+}
+
+func (r sqliteAPIKeys) delete(ctx context.Context, id uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id=$1`, id)
+	return err
+}
+
+type sqliteTwoFactors struct {
+	db sqliteConn
+}
+
+func (r sqliteTwoFactors) enroll(ctx context.Context, t *TwoFactor) (bool, error) {
+	return rowsAffected(r.db.ExecContext(ctx, `INSERT INTO two_factors(user_id, secret, created_at) VALUES($1, $2, $3)
+									ON CONFLICT (user_id) DO UPDATE SET secret=excluded.secret, created_at=excluded.created_at, last_step=0
+									WHERE two_factors.confirmed_at IS NULL`,
+						t.userID, t.secret, t.createdAt))
+}
+
+func (r sqliteTwoFactors) find(ctx context.Context, userID uuid.UUID) (*TwoFactor, error) {
+	t := &TwoFactor{}
+	err := r.db.QueryRowContext(ctx, `SELECT user_id,secret,created_at,confirmed_at,last_step FROM two_factors WHERE user_id=$1`, userID).
+		Scan(&t.userID, &t.secret, &t.createdAt, &t.confirmedAt, &t.lastStep)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return t, nil
+}
+
+func (r sqliteTwoFactors) advanceStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	return rowsAffected(r.db.ExecContext(ctx, `UPDATE two_factors SET last_step=$2 WHERE user_id=$1 AND last_step < $2`, userID, step))
+}
+
+func (r sqliteTwoFactors) confirm(ctx context.Context, userID uuid.UUID, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE two_factors SET confirmed_at=$2 WHERE user_id=$1`, userID, at)
+	return err
+}
+
+func (r sqliteTwoFactors) delete(ctx context.Context, userID uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, `DELETE FROM two_factors WHERE user_id=$1`, userID)
+	return err
+}
+
+func (r sqliteTwoFactors) replaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err = r.db.ExecContext(ctx, `INSERT INTO recovery_codes(hash, user_id) VALUES($1, $2)`, hash, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r sqliteTwoFactors) useRecoveryCode(ctx context.Context, userID uuid.UUID, hash string, at time.Time) (bool, error) {
+	return rowsAffected(r.db.ExecContext(ctx, `UPDATE recovery_codes SET used_at=$3 WHERE user_id=$1 AND hash=$2 AND used_at IS NULL`, userID, hash, at))
+}
+
+// sqliteIn returns the placeholders of values for IN, numbered after params, and params followed by values
+func sqliteIn(params []interface{}, values []string) (string, []interface{}) {
+	placeholders := make([]string, 0, len(values))
+	for _, v := range values {
+		params = append(params, v)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(params)))
+	}
+
+	return strings.Join(placeholders, ","), params
+}
+
+type sqliteLoginThrottles struct {
+	db sqliteConn
+}
+
+func (r sqliteLoginThrottles) blockedUntil(ctx context.Context, keys []string, now time.Time) (*time.Time, error) {
+	in, params := sqliteIn([]interface{}{now}, keys)
+	var until *time.Time
+	err := r.db.QueryRowContext(ctx, `SELECT MAX(blocked_until) FROM login_throttles WHERE key IN (`+in+`) AND blocked_until > $1`, params...).
+		Scan(&until)
+	return until, err
+}
+
+func (r sqliteLoginThrottles) failures(ctx context.Context, key string, now time.Time) (int, time.Time, error) {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO login_throttles(key, failures, last_failure_at) VALUES($1, 0, $2) ON CONFLICT (key) DO NOTHING`, key, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var failures int
+	var lastFailureAt time.Time
+	err = r.db.QueryRowContext(ctx, `SELECT failures,last_failure_at FROM login_throttles WHERE key=$1`, key).
+		Scan(&failures, &lastFailureAt)
+	return failures, lastFailureAt, err
+}
+
+func (r sqliteLoginThrottles) update(ctx context.Context, key string, failures int, lastFailureAt time.Time, blockedUntil *time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE login_throttles SET failures=$2, last_failure_at=$3, blocked_until=$4 WHERE key=$1`,
+		key, failures, lastFailureAt, blockedUntil)
+	return err
+}
+
+func (r sqliteLoginThrottles) delete(ctx context.Context, keys []string) error {
+	in, params := sqliteIn(nil, keys)
+	_, err := r.db.ExecContext(ctx, `DELETE FROM login_throttles WHERE key IN (`+in+`)`, params...)
+	return err
+}
+
+type sqliteEmailTokens struct {
+	db sqliteConn
+}
+
+func (r sqliteEmailTokens) insert(ctx context.Context, t *EmailToken) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO email_tokens(id, user_id, purpose, created_at, expires_at) VALUES($1, $2, $3, $4, $5)`,
+		t.id, t.userID, t.purpose, t.createdAt, t.expiresAt)
+	return err
+}
+
+func (r sqliteEmailTokens) use(ctx context.Context, id uuid.UUID, purpose EmailTokenPurpose, now time.Time) (*EmailToken, error) {
+	t := &EmailToken{
+		id:      id,
+		purpose: purpose,
+		usedAt:  &now,
+	}
+
+	err := r.db.QueryRowContext(ctx, `UPDATE email_tokens SET used_at=$3
+									WHERE id=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > $3
+									RETURNING user_id,created_at,expires_at`, id, purpose, now).
+		Scan(&t.userID, &t.createdAt, &t.expiresAt)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return t, nil
+}
+
+type sqliteAuditEvents struct {
+	db sqliteConn
+}
+
+func (r sqliteAuditEvents) insert(ctx context.Context, e *AuditEvent) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO audit_events(id, kind, user_id, subject, actor, ip, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		e.ID, e.Kind, e.UserID, e.Subject, e.Actor, e.IP, e.CreatedAt)
+	return err
+}
+
+func (r sqliteAuditEvents) findByUserID(ctx context.Context, userID uuid.UUID) ([]*AuditEvent, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id,kind,user_id,subject,actor,ip,created_at FROM audit_events
+									WHERE user_id=$1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		e := &AuditEvent{}
+		err := rows.Scan(&e.ID, &e.Kind, &e.UserID, &e.Subject, &e.Actor, &e.IP, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return events, nil
+}
@@ -0,0 +1,591 @@
+package activerecord
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// sqliteCurrencyColumns are scanned by scanCurrency like currencyColumns
+	sqliteCurrencyColumns = `c.symbol,c.name,c.decimals,
+		COALESCE((SELECT json_group_object(f.kind, json(f.schedule)) FROM fee_schedules f WHERE f.currency=c.symbol), '{}'),
+		c.signup_bonus,c.service_wallet,c.fee_wallet,c.issuance_wallet,c.enabled`
+	sqliteWalletColumns = `w.user_id,w.wallet,COALESCE(b.balance, 0),` + sqliteCurrencyColumns
+)
+
+type sqliteWallets struct {
+	db sqliteConn
+}
+
+func (r sqliteWallets) insert(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO user_wallets(user_id, wallet, currency) VALUES($1, $2, $3)`, userID, address, currency)
+	return sqliteError(err)
+}
+
+func (r sqliteWallets) insertIfNotExists(ctx context.Context, userID uuid.UUID, address, currency string) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO user_wallets(user_id,wallet,currency) VALUES($1,$2,$3) ON CONFLICT DO NOTHING`,
+									userID, address, currency)
+	return err
+}
+
+func (r sqliteWallets) findByUserID(ctx context.Context, userID uuid.UUID) ([]*Wallet, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+sqliteWalletColumns+` FROM `+walletTables+` WHERE w.user_id=$1 ORDER BY c.symbol`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wallets []*Wallet
+	for rows.Next() {
+		w, err := scanWallet(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		wallets = append(wallets, w)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return wallets, nil
+}
+
+// findByAddress does not lock anything, the DB transaction has held the write lock since it began
+func (r sqliteWallets) findByAddress(ctx context.Context, address string, forUpdate bool) (*Wallet, error) {
+	w, err := scanWallet(r.db.QueryRowContext(ctx, `SELECT `+sqliteWalletColumns+` FROM `+walletTables+` WHERE w.wallet=$1`, address))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return w, nil
+}
+
+func (r sqliteWallets) balanceMismatches(ctx context.Context) ([]BalanceMismatch, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT a.wallet,COALESCE(b.balance, 0),COALESCE(p.balance, 0) FROM (
+								SELECT wallet FROM wallet_balances
+								UNION SELECT wallet FROM postings
+							) a LEFT JOIN wallet_balances b ON b.wallet=a.wallet
+							LEFT JOIN (SELECT wallet, decimal_sum(amount) AS balance FROM postings GROUP BY wallet) p ON p.wallet=a.wallet
+							WHERE decimal_cmp(COALESCE(b.balance, 0), COALESCE(p.balance, 0)) <> 0
+							ORDER BY a.wallet`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mismatches []BalanceMismatch
+	for rows.Next() {
+		var m BalanceMismatch
+		err := rows.Scan(&m.Address, &m.Stored, &m.Replayed)
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return mismatches, nil
+}
+
+type sqliteCurrencies struct {
+	db sqliteConn
+}
+
+func (r sqliteCurrencies) insert(ctx context.Context, c *Currency) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO currencies(symbol, name, decimals, signup_bonus, service_wallet, fee_wallet, issuance_wallet, enabled)
+									VALUES($1, $2, $3, $4, $5, $6, $7, $8)`,
+						c.symbol, c.name, c.precision, c.signupBonus.String(), c.serviceWallet, c.feeWallet, c.issuanceWallet, c.enabled)
+	return sqliteError(err)
+}
+
+func (r sqliteCurrencies) saveFeeSchedule(ctx context.Context, currency string, kind TransactionKind, schedule FeeSchedule) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO fee_schedules(currency, kind, schedule) VALUES($1, $2, $3)
+									ON CONFLICT (currency, kind) DO UPDATE SET schedule=excluded.schedule`,
+						currency, string(kind), schedule.Policy())
+	return err
+}
+
+func (r sqliteCurrencies) find(ctx context.Context, symbol string) (*Currency, error) {
+	c, err := scanCurrency(r.db.QueryRowContext(ctx, `SELECT `+sqliteCurrencyColumns+` FROM currencies c WHERE c.symbol=$1`, symbol))
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return c, nil
+}
+
+func (r sqliteCurrencies) findAll(ctx context.Context, enabledOnly bool) ([]*Currency, error) {
+	where := ``
+	if enabledOnly {
+		where = `WHERE c.enabled`
+	}
+
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM currencies c %s ORDER BY c.symbol`, sqliteCurrencyColumns, where))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var currencies []*Currency
+	for rows.Next() {
+		c, err := scanCurrency(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		currencies = append(currencies, c)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return currencies, nil
+}
+
+func (r sqliteCurrencies) setEnabled(ctx context.Context, symbol string, enabled bool) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE currencies SET enabled=$2 WHERE symbol=$1`, symbol, enabled)
+	return err
+}
+
+func (r sqliteCurrencies) feeRevenue(ctx context.Context, since, until time.Time) ([]FeeRevenue, error) {
+	var params []interface{}
+	cond := ""
+	if !since.IsZero() {
+		params = append(params, since)
+		cond += fmt.Sprintf(" AND p.created_at >= $%d", len(params))
+	}
+
+	if !until.IsZero() {
+		params = append(params, until)
+		cond += fmt.Sprintf(" AND p.created_at < $%d", len(params))
+	}
+
+	q := fmt.Sprintf(`SELECT c.symbol,c.fee_wallet,COALESCE(decimal_sum(p.amount), 0),COUNT(p.id) FROM currencies c
+							LEFT JOIN postings p ON p.wallet=c.fee_wallet%s
+							GROUP BY c.symbol,c.fee_wallet ORDER BY c.symbol`, cond)
+	rows, err := r.db.QueryContext(ctx, q, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revenues []FeeRevenue
+	for rows.Next() {
+		var fr FeeRevenue
+		err := rows.Scan(&fr.Currency, &fr.FeeWallet, &fr.Revenue, &fr.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		revenues = append(revenues, fr)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return revenues, nil
+}
+
+type sqliteTransactions struct {
+	db sqliteConn
+}
+
+func (r sqliteTransactions) insert(ctx context.Context, t *Transaction) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO transactions(id, kind, currency, from_wallet, to_wallet, amount, fee, fee_policy, timestamp)
+									VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+						t.id, string(t.kind), t.currency, t.from, t.to, t.amount.String(), t.fee.String(), t.feePolicy, t.timestamp)
+	return err
+}
+
+// findByWallet compares amounts by decimal_cmp, as strings they would be compared alphabetically
+func (r sqliteTransactions) findByWallet(ctx context.Context, wallet string, filter TransactionFilter, cursor *transactionCursor, limit int) ([]*Transaction, error) {
+	params := []interface{}{wallet}
+	var conds []string
+	where := func(cond string, param interface{}) {
+		params = append(params, param)
+		conds = append(conds, fmt.Sprintf(cond, len(params)))
+	}
+
+	switch filter.Direction {
+	case Incoming:
+		conds = append(conds, "to_wallet=$1")
+	case Outgoing:
+		conds = append(conds, "from_wallet=$1")
+	default:
+		conds = append(conds, "(to_wallet=$1 OR from_wallet=$1)")
+	}
+
+	if !filter.Since.IsZero() {
+		where("timestamp >= $%d", filter.Since.UTC())
+	}
+
+	if !filter.Until.IsZero() {
+		where("timestamp < $%d", filter.Until.UTC())
+	}
+
+	if filter.MinAmount.Valid {
+		where("decimal_cmp(amount, $%d) >= 0", filter.MinAmount.Decimal.String())
+	}
+
+	if filter.MaxAmount.Valid {
+		where("decimal_cmp(amount, $%d) <= 0", filter.MaxAmount.Decimal.String())
+	}
+
+	if cursor != nil {
+		params = append(params, cursor.timestamp, cursor.id)
+		conds = append(conds, fmt.Sprintf("(timestamp, id) < ($%d, $%d)", len(params)-1, len(params)))
+	}
+
+	q := fmt.Sprintf(`SELECT id,kind,currency,to_wallet,from_wallet,amount,fee,fee_policy,timestamp FROM transactions
+							WHERE %s ORDER BY timestamp DESC, id DESC LIMIT %d`, strings.Join(conds, " AND "), limit)
+	rows, err := r.db.QueryContext(ctx, q, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txs []*Transaction
+	for rows.Next() {
+		t := &Transaction{}
+		err := rows.Scan(&t.id, &t.kind, &t.currency, &t.to, &t.from, &t.amount, &t.fee, &t.feePolicy, &t.timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		txs = append(txs, t)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return txs, nil
+}
+
+type sqliteLedger struct {
+	db sqliteConn
+}
+
+// insert checks that the entry is balanced itself, SQLite has no deferred triggers to check it on commit
+func (r sqliteLedger) insert(ctx context.Context, e *JournalEntry) error {
+	if !e.Balanced() {
+		return unbalancedJournalEntry
+	}
+
+	_, err := r.db.ExecContext(ctx, `INSERT INTO journal_entries(id, kind, description, created_at) VALUES($1, $2, $3, $4)`,
+		e.id, string(e.kind), e.description, e.createdAt)
+	if err != nil {
+		return sqliteError(err)
+	}
+
+	for _, p := range e.postings {
+		_, err = r.db.ExecContext(ctx, `INSERT INTO postings(entry_id, wallet, currency, amount, created_at) VALUES($1, $2, $3, $4, $5)`,
+			p.EntryID, p.Wallet, p.Currency, p.Amount.String(), p.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.db.ExecContext(ctx, `INSERT INTO wallet_balances(wallet, currency, balance) VALUES($1, $2, $3)
+									ON CONFLICT (wallet) DO UPDATE SET balance=decimal_add(wallet_balances.balance, excluded.balance)`,
+						p.Wallet, p.Currency, p.Amount.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r sqliteLedger) findEntry(ctx context.Context, id uuid.UUID) (*JournalEntry, error) {
+	e := &JournalEntry{}
+	err := r.db.QueryRowContext(ctx, `SELECT id,kind,description,created_at FROM journal_entries WHERE id=$1`, id).
+		Scan(&e.id, &e.kind, &e.description, &e.createdAt)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+
+	e.postings, err = r.queryPostings(ctx, `WHERE entry_id=$1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (r sqliteLedger) findPostings(ctx context.Context, wallet string) ([]Posting, error) {
+	return r.queryPostings(ctx, `WHERE wallet=$1 ORDER BY id`, wallet)
+}
+
+func (r sqliteLedger) queryPostings(ctx context.Context, where string, params ...interface{}) ([]Posting, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT entry_id,wallet,currency,amount,created_at FROM postings `+where, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postings []Posting
+	for rows.Next() {
+		var p Posting
+		err := rows.Scan(&p.EntryID, &p.Wallet, &p.Currency, &p.Amount, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		postings = append(postings, p)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return postings, nil
+}
+
+func (r sqliteLedger) balance(ctx context.Context, wallet string) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE(decimal_sum(amount), 0) FROM postings WHERE wallet=$1`, wallet).Scan(&balance)
+	return balance, err
+}
+
+// balanceAt works like the Postgres one. Days are kept as YYYY-MM-DD strings, which precede the timestamps of their midnights
+func (r sqliteLedger) balanceAt(ctx context.Context, wallet string, at time.Time) (decimal.Decimal, error) {
+	var balance decimal.Decimal
+	err := r.db.QueryRowContext(ctx, `SELECT decimal_add(COALESCE(s.balance, 0), COALESCE((SELECT decimal_sum(p.amount) FROM postings p
+										WHERE p.wallet=$1 AND p.created_at <= $2
+										AND p.created_at >= COALESCE(date(s.day, '+1 day'), '')), 0))
+									FROM (SELECT 1) one LEFT JOIN (
+										SELECT day, balance FROM balance_snapshots
+										WHERE wallet=$1 AND date(day, '+1 day') <= $2
+										ORDER BY day DESC LIMIT 1
+									) s ON TRUE`,
+						wallet, at).Scan(&balance)
+	return balance, err
+}
+
+func (r sqliteLedger) nextSnapshotDay(ctx context.Context) (*time.Time, error) {
+	var day *time.Time
+	err := r.db.QueryRowContext(ctx, `SELECT COALESCE((SELECT date(MAX(day), '+1 day') FROM balance_snapshot_days),
+										(SELECT date(MIN(created_at)) FROM postings))`).Scan(&day)
+	return day, err
+}
+
+// snapshotDay finds the previous snapshot of every wallet by subqueries, SQLite has no LATERAL joins
+func (r sqliteLedger) snapshotDay(ctx context.Context, day time.Time) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO balance_snapshots (wallet, day, balance)
+							SELECT d.wallet, date($1), decimal_add(
+								COALESCE((SELECT s.balance FROM balance_snapshots s WHERE s.wallet=d.wallet AND s.day < date($1)
+									ORDER BY s.day DESC LIMIT 1), 0),
+								(SELECT decimal_sum(p.amount) FROM postings p
+									WHERE p.wallet=d.wallet AND p.created_at < date($1, '+1 day')
+									AND p.created_at >= COALESCE((SELECT date(s.day, '+1 day') FROM balance_snapshots s
+										WHERE s.wallet=d.wallet AND s.day < date($1) ORDER BY s.day DESC LIMIT 1), '')))
+							FROM (
+								SELECT DISTINCT wallet FROM postings WHERE created_at >= date($1) AND created_at < date($1, '+1 day')
+							) d WHERE TRUE
+							ON CONFLICT (wallet, day) DO UPDATE SET balance=excluded.balance`, day)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO balance_snapshot_days (day) VALUES(date($1)) ON CONFLICT DO NOTHING`, day)
+	return err
+}
+
+type sqliteSupply struct {
+	db sqliteConn
+}
+
+func (r sqliteSupply) insert(ctx context.Context, op *SupplyOperation) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO supply_operations(id, kind, currency, amount, actor, reason, created_at)
+									VALUES($1, $2, $3, $4, $5, $6, $7)`,
+						op.ID, string(op.Kind), op.Currency, op.Amount.String(), op.Actor, op.Reason, op.CreatedAt)
+	return err
+}
+
+// supply reads the balance of the issuance wallet, coins in circulation are its negation
+func (r sqliteSupply) supply(ctx context.Context, c *Currency) (*Supply, error) {
+	s := &Supply{
+		Currency: c.symbol,
+	}
+
+	err := r.db.QueryRowContext(ctx, `SELECT
+									COALESCE((SELECT decimal_sum(amount) FROM supply_operations WHERE currency=$1 AND kind='mint'), 0),
+									COALESCE((SELECT decimal_sum(amount) FROM supply_operations WHERE currency=$1 AND kind='burn'), 0),
+									COALESCE((SELECT balance FROM wallet_balances WHERE wallet=$2), 0),
+									COALESCE((SELECT balance FROM wallet_balances WHERE wallet=$3), 0)`,
+						c.symbol, c.issuanceWallet, c.serviceWallet).
+		Scan(&s.Minted, &s.Burned, &s.Issued, &s.Treasury)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Issued = s.Issued.Neg()
+	return s, nil
+}
+
+func (r sqliteSupply) findByCurrency(ctx context.Context, currency string) ([]*SupplyOperation, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id,kind,currency,amount,actor,reason,created_at FROM supply_operations
+									WHERE currency=$1 ORDER BY created_at DESC, id DESC`, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ops []*SupplyOperation
+	for rows.Next() {
+		op := &SupplyOperation{}
+		err := rows.Scan(&op.ID, &op.Kind, &op.Currency, &op.Amount, &op.Actor, &op.Reason, &op.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, op)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return ops, nil
+}
+
+type sqliteReconciliation struct {
+	db sqliteConn
+}
+
+func (r sqliteReconciliation) countWallets(ctx context.Context) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM user_wallets`).Scan(&count)
+	return count, err
+}
+
+func (r sqliteReconciliation) negativeBalances(ctx context.Context) ([]NegativeBalance, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT b.wallet,b.currency,b.balance FROM wallet_balances b
+									WHERE decimal_cmp(b.balance, 0) < 0 AND b.wallet NOT IN (SELECT issuance_wallet FROM currencies)
+									ORDER BY b.wallet`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []NegativeBalance
+	for rows.Next() {
+		var n NegativeBalance
+		err := rows.Scan(&n.Address, &n.Currency, &n.Balance)
+		if err != nil {
+			return nil, err
+		}
+
+		balances = append(balances, n)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return balances, nil
+}
+
+func (r sqliteReconciliation) orphanAddresses(ctx context.Context) ([]OrphanAddress, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT a.wallet,a.source FROM (
+									SELECT to_wallet AS wallet, 'transactions' AS source FROM transactions
+									UNION SELECT from_wallet, 'transactions' FROM transactions
+									UNION SELECT wallet, 'postings' FROM postings
+								) a WHERE NOT EXISTS (SELECT 1 FROM user_wallets w WHERE w.wallet=a.wallet)
+								ORDER BY a.wallet, a.source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orphans []OrphanAddress
+	for rows.Next() {
+		var o OrphanAddress
+		err := rows.Scan(&o.Address, &o.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		orphans = append(orphans, o)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return orphans, nil
+}
+
+func (r sqliteReconciliation) currencyMismatches(ctx context.Context) ([]CurrencyMismatch, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT m.source,m.id,m.wallet,m.currency,w.currency FROM (
+									SELECT 'transactions' AS source, id, to_wallet AS wallet, currency FROM transactions
+									UNION ALL SELECT 'transactions', id, from_wallet, currency FROM transactions
+									UNION ALL SELECT 'postings', CAST(id AS TEXT), wallet, currency FROM postings
+								) m JOIN user_wallets w ON w.wallet=m.wallet
+								WHERE w.currency<>m.currency
+								ORDER BY m.source, m.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mismatches []CurrencyMismatch
+	for rows.Next() {
+		var m CurrencyMismatch
+		err := rows.Scan(&m.Source, &m.ID, &m.Address, &m.Currency, &m.WalletCurrency)
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return mismatches, nil
+}
+
+// issuance sums up the coins held by wallets from the postings, so the check does not depend on the stored balances
+func (r sqliteReconciliation) issuance(ctx context.Context) ([]SupplyMismatch, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT c.symbol,
+									COALESCE((SELECT decimal_sum(p.amount) FROM postings p WHERE p.currency=c.symbol AND p.wallet<>c.issuance_wallet), 0),
+									COALESCE((SELECT decimal_sum(s.amount) FROM supply_operations s WHERE s.currency=c.symbol AND s.kind='mint'), 0),
+									COALESCE((SELECT decimal_sum(s.amount) FROM supply_operations s WHERE s.currency=c.symbol AND s.kind='burn'), 0)
+								FROM currencies c ORDER BY c.symbol`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var issuance []SupplyMismatch
+	for rows.Next() {
+		var s SupplyMismatch
+		err := rows.Scan(&s.Currency, &s.Issued, &s.Minted, &s.Burned)
+		if err != nil {
+			return nil, err
+		}
+
+		issuance = append(issuance, s)
+	}
+
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return issuance, nil
+}
@@ -0,0 +1,205 @@
+package activerecord
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// errUniqueViolation is returned by repositories when a record conflicts with an existing one.
+// Records turn it into ConflictError with a message about the conflict
+var errUniqueViolation = errors.New("unique constraint violation")
+
+// store keeps the records. Factories and records work with any store, so the same code runs
+// on Postgres and in memory. Repositories return notFoundError if there is no such record.
+// A store returned by begin keeps its changes until they are committed, calling begin on it creates a savepoint.
+// A store returned by beginSnapshot only reads, and all of its reads see the same state of the DB
+type store interface {
+	begin(ctx context.Context) (txStore, error)
+	beginSnapshot(ctx context.Context) (txStore, error)
+	users() userRepository
+	wallets() walletRepository
+	currencies() currencyRepository
+	transactions() transactionRepository
+	ledger() ledgerRepository
+	supply() supplyRepository
+	reconciliation() reconciliationRepository
+	idempotencyKeys() idempotencyKeyRepository
+	sessions() sessionRepository
+	signingKeys() signingKeyRepository
+	apiKeys() apiKeyRepository
+	twoFactors() twoFactorRepository
+	loginThrottles() loginThrottleRepository
+	emailTokens() emailTokenRepository
+	auditEvents() auditRepository
+}
+
+type txStore interface {
+	store
+	DBTransaction
+}
+
+type userRepository interface {
+	insert(ctx context.Context, u *User) error
+	findByID(ctx context.Context, id uuid.UUID) (*User, error)
+	findByEmail(ctx context.Context, email string) (*User, error)
+	setAdmin(ctx context.Context, id uuid.UUID, admin bool) error
+	// verifyEmail sets the moment of the email verification unless it is already set
+	verifyEmail(ctx context.Context, id uuid.UUID, at time.Time) error
+	setPassword(ctx context.Context, id uuid.UUID, hash string) error
+}
+
+type walletRepository interface {
+	insert(ctx context.Context, userID uuid.UUID, address, currency string) error
+	// insertIfNotExists does nothing if the address is already taken
+	insertIfNotExists(ctx context.Context, userID uuid.UUID, address, currency string) error
+	// findByUserID returns the wallets with their currencies and stored balances ordered by currency symbol
+	findByUserID(ctx context.Context, userID uuid.UUID) ([]*Wallet, error)
+	// findByAddress locks the wallet until the end of the DB transaction if forUpdate is set
+	findByAddress(ctx context.Context, address string, forUpdate bool) (*Wallet, error)
+	// balanceMismatches returns the addresses whose stored balance differs from the sum of their postings,
+	// ordered by address
+	balanceMismatches(ctx context.Context) ([]BalanceMismatch, error)
+}
+
+type currencyRepository interface {
+	insert(ctx context.Context, c *Currency) error
+	saveFeeSchedule(ctx context.Context, currency string, kind TransactionKind, schedule FeeSchedule) error
+	find(ctx context.Context, symbol string) (*Currency, error)
+	// findAll returns the currencies ordered by symbol
+	findAll(ctx context.Context, enabledOnly bool) ([]*Currency, error)
+	setEnabled(ctx context.Context, symbol string, enabled bool) error
+	feeRevenue(ctx context.Context, since, until time.Time) ([]FeeRevenue, error)
+}
+
+// transactionCursor points at the last transaction of the previous page
+type transactionCursor struct {
+	timestamp time.Time
+	id        uuid.UUID
+}
+
+type transactionRepository interface {
+	insert(ctx context.Context, t *Transaction) error
+	// findByWallet returns up to limit transactions of the wallet which match the filter and go after the cursor,
+	// the newest first. The cursor and the limit of the filter are ignored
+	findByWallet(ctx context.Context, wallet string, filter TransactionFilter, cursor *transactionCursor, limit int) ([]*Transaction, error)
+}
+
+type ledgerRepository interface {
+	// insert saves the entry with its postings and applies them to the stored balances
+	insert(ctx context.Context, e *JournalEntry) error
+	findEntry(ctx context.Context, id uuid.UUID) (*JournalEntry, error)
+	// findPostings returns the postings of the wallet in the order they were posted
+	findPostings(ctx context.Context, wallet string) ([]Posting, error)
+	balance(ctx context.Context, wallet string) (decimal.Decimal, error)
+	balanceAt(ctx context.Context, wallet string, at time.Time) (decimal.Decimal, error)
+	// nextSnapshotDay returns the first day which has not been snapshotted, nil if there are no postings
+	nextSnapshotDay(ctx context.Context) (*time.Time, error)
+	// snapshotDay stores end-of-day balances of the wallets with postings on the day and marks the day as snapshotted
+	snapshotDay(ctx context.Context, day time.Time) error
+}
+
+type supplyRepository interface {
+	insert(ctx context.Context, op *SupplyOperation) error
+	supply(ctx context.Context, c *Currency) (*Supply, error)
+	// findByCurrency returns the operations of the currency, the latest first
+	findByCurrency(ctx context.Context, currency string) ([]*SupplyOperation, error)
+}
+
+type reconciliationRepository interface {
+	countWallets(ctx context.Context) (int, error)
+	negativeBalances(ctx context.Context) ([]NegativeBalance, error)
+	orphanAddresses(ctx context.Context) ([]OrphanAddress, error)
+	currencyMismatches(ctx context.Context) ([]CurrencyMismatch, error)
+	// issuance returns the coins held by wallets together with minted and burned totals of every currency
+	issuance(ctx context.Context) ([]SupplyMismatch, error)
+}
+
+type idempotencyKeyRepository interface {
+	// claim saves the key or takes over an expired one, it tells if the key has been claimed
+	claim(ctx context.Context, k *IdempotencyKey) (bool, error)
+	find(ctx context.Context, scope, key string) (*IdempotencyKey, error)
+	complete(ctx context.Context, scope, key string, status int, contentType string, response []byte) error
+	delete(ctx context.Context, scope, key string) error
+	deleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+type sessionRepository interface {
+	insert(ctx context.Context, s *Session) error
+	find(ctx context.Context, id uuid.UUID) (*Session, error)
+	// findActiveByUserID returns sessions which are neither revoked nor expired, the latest first
+	findActiveByUserID(ctx context.Context, userID uuid.UUID, now time.Time) ([]*Session, error)
+	extend(ctx context.Context, id uuid.UUID, expiresAt time.Time) error
+	revoke(ctx context.Context, id uuid.UUID, at time.Time) error
+	revokeByUserID(ctx context.Context, userID uuid.UUID, at time.Time) error
+	insertRefreshToken(ctx context.Context, hash string, sessionID uuid.UUID, createdAt time.Time) error
+	// findRefreshToken returns the session of the token and when it was used, the token is locked until the end of the DB transaction
+	findRefreshToken(ctx context.Context, hash string) (uuid.UUID, *time.Time, error)
+	useRefreshToken(ctx context.Context, hash string, at time.Time) error
+}
+
+type signingKeyRepository interface {
+	// lock serializes changes of the signing keys until the end of the DB transaction
+	lock(ctx context.Context) error
+	// findActive returns the keys which are not expired, the signing key first.
+	// Keys are returned with their stored private keys only, the factory decodes them
+	findActive(ctx context.Context, now time.Time) ([]*SigningKey, error)
+	// findAll returns every key, including expired ones, with its stored private key only
+	findAll(ctx context.Context) ([]*SigningKey, error)
+	hasSigningKey(ctx context.Context) (bool, error)
+	// retire stops the signing key from signing, it verifies until expiresAt
+	retire(ctx context.Context, at, expiresAt time.Time) error
+	// insert saves the key with its stored private key
+	insert(ctx context.Context, k *SigningKey) error
+	updatePrivateKey(ctx context.Context, id, storedPrivateKey string) error
+}
+
+type apiKeyRepository interface {
+	insert(ctx context.Context, k *APIKey) error
+	findByHash(ctx context.Context, hash string) (*APIKey, error)
+	find(ctx context.Context, userID, id uuid.UUID) (*APIKey, error)
+	// findByUserID returns the keys of the user, the oldest first
+	findByUserID(ctx context.Context, userID uuid.UUID) ([]*APIKey, error)
+	update(ctx context.Context, k *APIKey) error
+	setLastUsedAt(ctx context.Context, id uuid.UUID, at time.Time) error
+	delete(ctx context.Context, id uuid.UUID) error
+}
+
+type twoFactorRepository interface {
+	// enroll saves the factor unless the user has a confirmed one, it tells if the factor has been saved
+	enroll(ctx context.Context, t *TwoFactor) (bool, error)
+	find(ctx context.Context, userID uuid.UUID) (*TwoFactor, error)
+	// advanceStep sets the last accepted step if it is newer than the stored one, it tells if the step has been advanced
+	advanceStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	confirm(ctx context.Context, userID uuid.UUID, at time.Time) error
+	// delete removes the factor together with its recovery codes
+	delete(ctx context.Context, userID uuid.UUID) error
+	replaceRecoveryCodes(ctx context.Context, userID uuid.UUID, hashes []string) error
+	// useRecoveryCode marks the code as used, it tells if there was such an unused code
+	useRecoveryCode(ctx context.Context, userID uuid.UUID, hash string, at time.Time) (bool, error)
+}
+
+type loginThrottleRepository interface {
+	// blockedUntil returns the latest moment after now until which any of the keys is blocked, nil if none of them is blocked
+	blockedUntil(ctx context.Context, keys []string, now time.Time) (*time.Time, error)
+	// failures returns the failures of the key and the moment of the last one, the key is locked until the end of the DB transaction.
+	// A key without failures is created with now as the last failure moment
+	failures(ctx context.Context, key string, now time.Time) (int, time.Time, error)
+	update(ctx context.Context, key string, failures int, lastFailureAt time.Time, blockedUntil *time.Time) error
+	delete(ctx context.Context, keys []string) error
+}
+
+type emailTokenRepository interface {
+	insert(ctx context.Context, t *EmailToken) error
+	// use marks the token as used unless it is used or expired
+	use(ctx context.Context, id uuid.UUID, purpose EmailTokenPurpose, now time.Time) (*EmailToken, error)
+}
+
+type auditRepository interface {
+	insert(ctx context.Context, e *AuditEvent) error
+	// findByUserID returns the events of the user, the latest first
+	findByUserID(ctx context.Context, userID uuid.UUID) ([]*AuditEvent, error)
+}
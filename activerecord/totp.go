@@ -0,0 +1,98 @@
+package activerecord
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is how many periods before and after the current one are accepted to tolerate clock drift
+	totpSkew        = 1
+	totpSecretBytes = 20
+	totpIssuer      = "FakeCoins"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPCode returns the time-based one-time password (RFC 6238, HMAC-SHA1, 6 digits, 30 seconds) of the base32 secret at the moment
+func TOTPCode(secret string, at time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, totpStep(at)), nil
+}
+
+// TOTPProvisioningURI returns the otpauth URI which authenticator apps import, usually from a QR code
+func TOTPProvisioningURI(secret, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	label := url.PathEscape(totpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// matchTOTP returns the step of the code if it is valid at the moment
+func matchTOTP(secret, code string, at time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := totpStep(at)
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if hmac.Equal([]byte(hotp(key, step+i)), []byte(code)) {
+			return step + i, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpStep(at time.Time) int64 {
+	return at.Unix() / int64(totpPeriod.Seconds())
+}
+
+// hotp is the HMAC-based one-time password of RFC 4226
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
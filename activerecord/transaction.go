@@ -2,48 +2,152 @@ package activerecord
 
 import (
 	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgtype/pgxtype"
 	"github.com/shopspring/decimal"
 )
 
-var feeRate = decimal.NewFromFloat32(0.2)
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+type TransactionKind string
+
+const (
+	TransferTransaction TransactionKind = "transfer"
+	BonusTransaction    TransactionKind = "bonus"
+	// InternalTransaction moves funds between system wallets
+	InternalTransaction TransactionKind = "internal"
+	// MintTransaction and BurnTransaction are journal entries which change the supply of a currency
+	MintTransaction TransactionKind = "mint"
+	BurnTransaction TransactionKind = "burn"
+)
+
+// chargeableKind tells if transactions of the kind can have a fee schedule
+func chargeableKind(kind TransactionKind) bool {
+	return kind == TransferTransaction || kind == BonusTransaction || kind == InternalTransaction
+}
+
+type TransactionDirection string
+
+const (
+	Incoming TransactionDirection = "incoming"
+	Outgoing TransactionDirection = "outgoing"
+)
+
+// TransactionFilter narrows down the wallet transaction history.
+// Zero values mean no restriction
+type TransactionFilter struct {
+	Direction TransactionDirection
+	Since     time.Time
+	Until     time.Time
+	MinAmount decimal.NullDecimal
+	MaxAmount decimal.NullDecimal
+	Cursor    string
+	Limit     int
+}
 
-func newTransactionFactory(db pgxtype.Querier) TransactionFactory {
-	return TransactionFactory{db: db}
+type TransactionPage struct {
+	Transactions []*Transaction
+	NextCursor   string
+}
+
+func newTransactionFactory(store store) TransactionFactory {
+	return TransactionFactory{store: store}
 }
 
 type TransactionFactory struct {
-	db pgxtype.Querier
+	store store
 }
 
-func (ts TransactionFactory) FindAllWithWallet(ctx context.Context, wallet string) ([]*Transaction, error) {
-	rows, err := ts.db.Query(ctx, `SELECT id,currency,to_wallet,from_wallet,amount,fee,timestamp FROM transactions
-							WHERE to_wallet=$1 OR from_wallet=$1`, wallet)
-	if err != nil {
-		return nil, err
+// FindPageWithWallet returns wallet transactions ordered from the newest to the oldest.
+// Pagination is cursor based, so new transactions do not shift the pages which have been already read
+func (ts TransactionFactory) FindPageWithWallet(ctx context.Context, wallet string, filter TransactionFilter) (*TransactionPage, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultPageLimit
 	}
 
-	var txs []*Transaction
-	for rows.Next() {
-		t := &Transaction{
-			db: ts.db,
-		}
-		err := rows.Scan(&t.id, &t.currency, &t.to, &t.from, &t.amount, &t.fee, &t.timestamp)
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	switch filter.Direction {
+	case "", Incoming, Outgoing:
+	default:
+		return nil, invalidDirection
+	}
+
+	var cursor *transactionCursor
+	if filter.Cursor != "" {
+		timestamp, id, err := decodeCursor(filter.Cursor)
 		if err != nil {
 			return nil, err
 		}
 
-		txs = append(txs, t)
+		cursor = &transactionCursor{
+			timestamp: timestamp,
+			id:        id,
+		}
+	}
+
+	txs, err := ts.store.transactions().findByWallet(ctx, wallet, filter, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range txs {
+		t.store = ts.store
+	}
+
+	page := &TransactionPage{
+		Transactions: txs,
+	}
+
+	if len(txs) > limit {
+		page.Transactions = txs[:limit]
+		page.NextCursor = encodeCursor(txs[limit-1])
+	}
+
+	return page, nil
+}
+
+func encodeCursor(t *Transaction) string {
+	c := strconv.FormatInt(t.timestamp.UnixNano(), 10) + ":" + t.id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(c))
+}
+
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, invalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return time.Time{}, uuid.UUID{}, invalidCursor
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, invalidCursor
+	}
+
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return time.Time{}, uuid.UUID{}, invalidCursor
 	}
 
-	return txs, nil
+	return time.Unix(0, nanos).UTC(), id, nil
 }
 
-func newTransaction(db pgxtype.Querier, currency, from, to string, amount decimal.Decimal) (*Transaction, error) {
-	if currency == "" {
+func newTransaction(store store, kind TransactionKind, currency *Currency, from, to string, amount decimal.Decimal) (*Transaction, error) {
+	if currency == nil {
 		return nil, invalidCurrency
 	}
 
@@ -51,45 +155,124 @@ func newTransaction(db pgxtype.Querier, currency, from, to string, amount decima
 		return nil, invalidAddress
 	}
 
-	if amount.Equal(decimal.Zero) || amount.IsNegative() {
-		return nil, invalidAmount
+	err := currency.ValidateAmount(amount)
+	if err != nil {
+		return nil, err
 	}
 
+	fee, feePolicy := currency.CalculateFee(kind, amount)
 	t := &Transaction{
 		id: uuid.New(),
-		db: db,
-		currency: currency,
+		store: store,
+		kind: kind,
+		currency: currency.symbol,
 		from: from,
 		to: to,
 		amount: amount,
+		fee: fee,
+		feePolicy: feePolicy,
+		feeWallet: currency.feeWallet,
 		timestamp: time.Now().UTC(),
 	}
 
-	t.fee = t.CalculateFee()
-
 	return t, nil
 }
 
 type Transaction struct {
-	db pgxtype.Querier
+	store store
 	id uuid.UUID
+	kind TransactionKind
 	currency string
 	from string
 	to string
 	amount decimal.Decimal
 	fee decimal.Decimal
+	// feePolicy describes the fee schedule applied to the transaction
+	feePolicy string
+	// feeWallet collects the fee, it is known only for new transactions
+	feeWallet string
 	timestamp time.Time
 }
 
-func (t *Transaction) CalculateFee() decimal.Decimal {
-	return t.amount.Mul(feeRate)
+// Save inserts the transaction and posts its journal entry with the same ID in one DB transaction.
+// The sender is debited by the amount with the fee, the receiver is credited by the amount
+// and the currency fee wallet is credited by the fee
+func (t *Transaction) Save(ctx context.Context) error {
+	tx, err := t.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.transactions().insert(ctx, t)
+	if err != nil {
+		return err
+	}
+
+	err = newLedger(tx).Post(ctx, t.JournalEntry())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (t *Transaction) Save(ctx context.Context) error {
-	_, err := t.db.Exec(ctx, `INSERT INTO transactions(id, currency, from_wallet, to_wallet, amount, fee, timestamp)
-									VALUES($1, $2, $3, $4, $5, $6, $7)`,
-						t.id, t.currency, t.from, t.to, t.amount.String(), t.fee.String(), t.timestamp)
-	return err
+// JournalEntry returns the ledger entry of a new transaction
+func (t *Transaction) JournalEntry() *JournalEntry {
+	return newJournalEntry(t.store, t.id, t.kind, "", t.timestamp).
+		Debit(t.from, t.currency, t.FullAmount()).
+		Credit(t.to, t.currency, t.amount).
+		Credit(t.feeWallet, t.currency, t.fee)
+}
+
+func (t *Transaction) ID() uuid.UUID {
+	return t.id
+}
+
+func (t *Transaction) Kind() TransactionKind {
+	return t.kind
+}
+
+func (t *Transaction) Currency() string {
+	return t.currency
+}
+
+func (t *Transaction) From() string {
+	return t.from
+}
+
+func (t *Transaction) To() string {
+	return t.to
+}
+
+// Direction tells if the transaction is incoming or outgoing relative to the wallet
+func (t *Transaction) Direction(wallet string) TransactionDirection {
+	if t.to == wallet {
+		return Incoming
+	}
+
+	return Outgoing
+}
+
+// Counterparty returns the address of the other side of the transaction relative to the wallet
+func (t *Transaction) Counterparty(wallet string) string {
+	if t.to == wallet {
+		return t.from
+	}
+
+	return t.to
+}
+
+func (t *Transaction) Fee() decimal.Decimal {
+	return t.fee
+}
+
+func (t *Transaction) FeePolicy() string {
+	return t.feePolicy
+}
+
+func (t *Transaction) Timestamp() time.Time {
+	return t.timestamp
 }
 
 func (t *Transaction) Amount() decimal.Decimal {
@@ -97,5 +280,5 @@ func (t *Transaction) Amount() decimal.Decimal {
 }
 
 func (t *Transaction) FullAmount() decimal.Decimal {
-	return t.amount.Add(t.CalculateFee())
+	return t.amount.Add(t.fee)
 }
@@ -0,0 +1,125 @@
+package activerecord
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func newTreasury(store store) Treasury {
+	return Treasury{
+		store: store,
+	}
+}
+
+// Treasury controls the supply of currencies. Coins are created only by Mint,
+// which credits the currency treasury wallet, and destroyed only by Burn, which debits it.
+// Both are posted to the ledger against the currency issuance wallet and recorded as supply operations
+type Treasury struct {
+	store store
+}
+
+// Mint creates amount of new coins in the treasury wallet of the currency
+func (t Treasury) Mint(ctx context.Context, c *Currency, amount decimal.Decimal, actor uuid.UUID, reason string) (*SupplyOperation, error) {
+	return t.change(ctx, MintTransaction, c, amount, actor, reason)
+}
+
+// Burn destroys amount of coins held by the treasury wallet of the currency
+func (t Treasury) Burn(ctx context.Context, c *Currency, amount decimal.Decimal, actor uuid.UUID, reason string) (*SupplyOperation, error) {
+	return t.change(ctx, BurnTransaction, c, amount, actor, reason)
+}
+
+func (t Treasury) change(ctx context.Context, kind TransactionKind, c *Currency, amount decimal.Decimal, actor uuid.UUID, reason string) (*SupplyOperation, error) {
+	err := c.ValidateAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if reason == "" {
+		return nil, invalidSupplyReason
+	}
+
+	tx, err := t.store.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	treasury, err := newWalletFactory(tx).FindByAddressForUpdate(ctx, c.serviceWallet)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := newLedger(tx)
+	entry := ledger.NewEntry(kind, reason)
+	if kind == MintTransaction {
+		entry.Debit(c.issuanceWallet, c.symbol, amount).Credit(treasury.address, c.symbol, amount)
+	} else {
+		if treasury.Balance().LessThan(amount) {
+			return nil, treasuryDepleted
+		}
+
+		entry.Debit(treasury.address, c.symbol, amount).Credit(c.issuanceWallet, c.symbol, amount)
+	}
+
+	err = ledger.Post(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &SupplyOperation{
+		ID:        entry.ID(),
+		Kind:      kind,
+		Currency:  c.symbol,
+		Amount:    amount,
+		Actor:     actor,
+		Reason:    reason,
+		CreatedAt: entry.CreatedAt(),
+	}
+
+	err = tx.supply().insert(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// Supply returns the supply of the currency together with the totals of its supply operations
+func (t Treasury) Supply(ctx context.Context, c *Currency) (*Supply, error) {
+	return t.store.supply().supply(ctx, c)
+}
+
+// FindOperations returns the supply operations of the currency, the latest first
+func (t Treasury) FindOperations(ctx context.Context, c *Currency) ([]*SupplyOperation, error) {
+	return t.store.supply().findByCurrency(ctx, c.symbol)
+}
+
+// SupplyOperation is the audit record of a mint or a burn, its ID is the ID of the journal entry
+type SupplyOperation struct {
+	ID       uuid.UUID
+	Kind     TransactionKind
+	Currency string
+	Amount   decimal.Decimal
+	// Actor is the user who changed the supply
+	Actor     uuid.UUID
+	Reason    string
+	CreatedAt time.Time
+}
+
+type Supply struct {
+	Currency string
+	Minted   decimal.Decimal
+	Burned   decimal.Decimal
+	// Issued is the amount of coins in all wallets of the currency, it equals Minted - Burned
+	Issued decimal.Decimal
+	// Treasury is the balance of the treasury wallet, the part of Issued which is not distributed yet
+	Treasury decimal.Decimal
+}
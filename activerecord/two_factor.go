@@ -0,0 +1,216 @@
+package activerecord
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+func newTwoFactorFactory(store store) TwoFactorFactory {
+	return TwoFactorFactory{
+		store: store,
+	}
+}
+
+// TwoFactorFactory manages TOTP second factors of users.
+// A factor is enrolled first and enabled only after it is confirmed with a code from the authenticator app
+type TwoFactorFactory struct {
+	store store
+}
+
+// Enroll creates a new TOTP secret for the user, replacing the one which has not been confirmed yet
+func (f TwoFactorFactory) Enroll(ctx context.Context, userID uuid.UUID, now time.Time) (*TwoFactor, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TwoFactor{
+		store:     f.store,
+		userID:    userID,
+		secret:    secret,
+		createdAt: now.UTC(),
+	}
+
+	enrolled, err := f.store.twoFactors().enroll(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if !enrolled {
+		return nil, twoFactorAlreadyEnabled
+	}
+
+	return t, nil
+}
+
+// Find returns the second factor of the user, enrolled or enabled
+func (f TwoFactorFactory) Find(ctx context.Context, userID uuid.UUID) (*TwoFactor, error) {
+	t, err := f.store.twoFactors().find(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	t.store = f.store
+	return t, nil
+}
+
+type TwoFactor struct {
+	store  store
+	userID uuid.UUID
+	// secret is the base32 TOTP key shared with the authenticator app
+	secret      string
+	createdAt   time.Time
+	confirmedAt *time.Time
+	// lastStep is the time step of the last accepted code, codes of it and earlier steps cannot be replayed
+	lastStep int64
+}
+
+// Confirm enables the factor if the code is valid and returns one-time recovery codes, they are shown only once
+func (t *TwoFactor) Confirm(ctx context.Context, code string, now time.Time) ([]string, error) {
+	if t.Enabled() {
+		return nil, twoFactorAlreadyEnabled
+	}
+
+	tx, err := t.store.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = t.useTOTP(ctx, tx, code, now)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmedAt := now.UTC()
+	err = tx.twoFactors().confirm(ctx, t.userID, confirmedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := t.replaceRecoveryCodes(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t.confirmedAt = &confirmedAt
+	return codes, nil
+}
+
+// Verify accepts a TOTP code or an unused recovery code, each of them can be used only once
+func (t *TwoFactor) Verify(ctx context.Context, code string, now time.Time) error {
+	if !t.Enabled() {
+		return twoFactorNotEnabled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return t.useTOTP(ctx, t.store, code, now)
+	}
+
+	used, err := t.store.twoFactors().useRecoveryCode(ctx, t.userID, hashRecoveryCode(code), now.UTC())
+	if err != nil {
+		return err
+	}
+
+	if !used {
+		return invalidOTP
+	}
+
+	return nil
+}
+
+// Disable removes the factor and its recovery codes
+func (t *TwoFactor) Disable(ctx context.Context) error {
+	tx, err := t.store.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.twoFactors().delete(ctx, t.userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// useTOTP accepts the code if it is valid and newer than the last accepted one.
+// The step is advanced by a conditional update, so concurrent requests cannot use the same code twice
+func (t *TwoFactor) useTOTP(ctx context.Context, store store, code string, now time.Time) error {
+	step, ok := matchTOTP(t.secret, code, now)
+	if !ok {
+		return invalidOTP
+	}
+
+	advanced, err := store.twoFactors().advanceStep(ctx, t.userID, step)
+	if err != nil {
+		return err
+	}
+
+	if !advanced {
+		return invalidOTP
+	}
+
+	t.lastStep = step
+	return nil
+}
+
+func (t *TwoFactor) replaceRecoveryCodes(ctx context.Context, store store) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:len(code)/2] + "-" + code[len(code)/2:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err := store.twoFactors().replaceRecoveryCodes(ctx, t.userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (t *TwoFactor) UserID() uuid.UUID {
+	return t.userID
+}
+
+func (t *TwoFactor) Secret() string {
+	return t.secret
+}
+
+// Enabled tells if the factor has been confirmed and is required to sign in
+func (t *TwoFactor) Enabled() bool {
+	return t.confirmedAt != nil
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(hash[:])
+}
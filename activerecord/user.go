@@ -2,67 +2,58 @@ package activerecord
 
 import (
 	"context"
-	"fmt"
-	"net"
-	"net/mail"
 	"regexp"
-	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgconn"
-	"github.com/jackc/pgtype/pgxtype"
-	"github.com/jackc/pgx/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func newUserFactory(db pgxtype.Querier) UserFactory {
+func newUserFactory(store store, emailValidator EmailValidator) UserFactory {
 	return UserFactory{
-		db: db,
+		store:          store,
+		emailValidator: emailValidator,
 	}
 }
 
 type UserFactory struct {
-	db pgxtype.Querier
+	store          store
+	emailValidator EmailValidator
 }
 
-func (uf UserFactory) New(email, password, firstName, lastName string) (*User, error) {
-	return newUser(uf.db, email, password, firstName, lastName)
+// New validates the email, which may look it up in DNS, and hashes the password. Nothing is stored until Save,
+// so a new user can be created before a DB transaction and attached to it with Attach
+func (uf UserFactory) New(ctx context.Context, email, password, firstName, lastName string) (*User, error) {
+	return newUser(ctx, uf.store, uf.emailValidator, email, password, firstName, lastName)
 }
 
-func (uf UserFactory) FindByEmail(ctx context.Context, email string) (*User, error) {
-	return uf.findOne(ctx, `WHERE email=$1`, email)
-}
-
-func (uf UserFactory) FindByID(ctx context.Context, id uuid.UUID) (*User, error) {
-	return uf.findOne(ctx, `WHERE id=$1`, id)
+// Attach makes the unsaved user and the wallets it creates use the store of the factory, e.g. of a DB transaction
+func (uf UserFactory) Attach(u *User) *User {
+	u.store = uf.store
+	return u
 }
 
-func (uf UserFactory) findOne(ctx context.Context, where string, whereParams ...interface{}) (*User, error) {
-	user := &User{
-		db:        uf.db,
-		id:        uuid.UUID{},
-		email:     "",
-		password:  "",
-		firstName: "",
-		lastName:  "",
-		wallets:   nil,
+func (uf UserFactory) FindByEmail(ctx context.Context, email string) (*User, error) {
+	user, err := uf.store.users().findByEmail(ctx, NormalizeEmail(email))
+	if err != nil {
+		return nil, err
 	}
 
-	q := fmt.Sprintf(`SELECT id,email,password,first_name,last_name FROM users %s`, where)
-	err := uf.db.QueryRow(ctx, q, whereParams...).
-		Scan(&user.id, &user.email, &user.password, &user.firstName, &user.lastName)
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, notFoundError
-		}
+	user.store = uf.store
+	return user, nil
+}
 
+func (uf UserFactory) FindByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	user, err := uf.store.users().findByID(ctx, id)
+	if err != nil {
 		return nil, err
 	}
 
+	user.store = uf.store
 	return user, nil
 }
 
-func newUser(db pgxtype.Querier, email, password, firstName, lastName string) (*User, error) {
+func newUser(ctx context.Context, store store, emailValidator EmailValidator, email, password, firstName, lastName string) (*User, error) {
 	if invalidPassword(password) {
 		return nil, invalidPasswordError
 	}
@@ -75,7 +66,13 @@ func newUser(db pgxtype.Querier, email, password, firstName, lastName string) (*
 		return nil, invalidLastNameError
 	}
 
-	if invalidEmail(email) {
+	email = NormalizeEmail(email)
+	valid, err := emailValidator.ValidateEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
 		return nil, invalidEmailError
 	}
 
@@ -86,7 +83,7 @@ func newUser(db pgxtype.Querier, email, password, firstName, lastName string) (*
 
 	return &User{
 		id: uuid.New(),
-		db: db,
+		store: store,
 		email:    email,
 		password: string(passHash),
 		firstName: firstName,
@@ -95,12 +92,15 @@ func newUser(db pgxtype.Querier, email, password, firstName, lastName string) (*
 }
 
 type User struct {
-	db       pgxtype.Querier
+	store    store
 	id       uuid.UUID
 	email    string
 	password string
 	firstName string
 	lastName string
+	admin bool
+	// emailVerifiedAt is set when the user proves they own the email
+	emailVerifiedAt *time.Time
 	wallets []*Wallet
 }
 
@@ -109,10 +109,9 @@ func (u *User) Save(ctx context.Context) error {
 }
 
 func (u *User) create(ctx context.Context) error {
-	_, err := u.db.Exec(ctx, `INSERT INTO users(id, email, password, first_name, last_name) VALUES($1,$2,$3,$4,$5)`,
-		u.id, u.email, u.password, u.firstName, u.lastName)
+	err := u.store.users().insert(ctx, u)
 	if err != nil {
-		if e, ok := err.(*pgconn.PgError); ok && e.Code == uniqueConstraintViolation {
+		if err == errUniqueViolation {
 			return emailConflictError
 		}
 
@@ -129,12 +128,12 @@ func (u *User) create(ctx context.Context) error {
 	return nil
 }
 
-func (u *User) CreateWallets(currencies ...string) ([]*Wallet, error) {
-	currs := unique(currencies)
+func (u *User) CreateWallets(currencies ...*Currency) ([]*Wallet, error) {
+	currs := uniqueCurrencies(currencies)
 
 	wallets := make([]*Wallet, len(currs))
 	for i, c := range currs {
-		w, err := newWalletWithAddress(u.db, u.id, c)
+		w, err := newWalletWithAddress(u.store, u.id, c)
 		if err != nil {
 			return nil, err
 		}
@@ -162,6 +161,60 @@ func (u *User) LastName() string {
 	return u.lastName
 }
 
+func (u *User) IsAdmin() bool {
+	return u.admin
+}
+
+// SetAdmin grants or revokes the admin role
+func (u *User) SetAdmin(ctx context.Context, admin bool) error {
+	err := u.store.users().setAdmin(ctx, u.id, admin)
+	if err != nil {
+		return err
+	}
+
+	u.admin = admin
+	return nil
+}
+
+func (u *User) EmailVerified() bool {
+	return u.emailVerifiedAt != nil
+}
+
+// VerifyEmail marks the email of the user as verified
+func (u *User) VerifyEmail(ctx context.Context) error {
+	now := time.Now().UTC()
+	err := u.store.users().verifyEmail(ctx, u.id, now)
+	if err != nil {
+		return err
+	}
+
+	if u.emailVerifiedAt == nil {
+		u.emailVerifiedAt = &now
+	}
+
+	return nil
+}
+
+// SetPassword validates and stores a new password of the user
+func (u *User) SetPassword(ctx context.Context, password string) error {
+	if invalidPassword(password) {
+		return invalidPasswordError
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = u.store.users().setPassword(ctx, u.id, string(passHash))
+	if err != nil {
+		return err
+	}
+
+	u.password = string(passHash)
+	return nil
+}
+
 func (u *User) Wallets() []*Wallet {
 	return u.wallets
 }
@@ -171,7 +224,7 @@ func (u *User) Password() string {
 }
 
 func (u *User) LoadWallets(ctx context.Context) ([]*Wallet, error) {
-	wallets, err := newWalletFactory(u.db).FindByUserID(ctx, u.id)
+	wallets, err := newWalletFactory(u.store).FindByUserID(ctx, u.id)
 	if err != nil {
 		return nil, err
 	}
@@ -185,39 +238,22 @@ func invalidPassword(password string) bool {
 	return l < 8 || l > 50
 }
 
-func invalidEmail(email string) bool {
-	if strings.ContainsAny(email, " <>") {
-		return true
-	}
-
-	_, err := mail.ParseAddress(email)
-	if err != nil {
-		return true
-	}
-
-	parts := strings.Split(email, "@")
-	domain := parts[1]
-
-	_, err = net.LookupIP(domain)
-	return err != nil
-}
-
 var nameRegexp = regexp.MustCompile(`(?i)^[\p{L}'][ \p{L}'-]*[\p{L}]$`)
 func invalidName(name string) bool {
 	return !nameRegexp.MatchString(name)
 }
 
-func unique(strs []string) []string {
+func uniqueCurrencies(currencies []*Currency) []*Currency {
 	u := make(map[string]struct{})
-	var res []string
-	for _, s := range strs {
-		if s == "" {
+	var res []*Currency
+	for _, c := range currencies {
+		if c == nil {
 			continue
 		}
 
-		if _, ok := u[s]; !ok {
-			u[s] = struct{}{}
-			res = append(res, s)
+		if _, ok := u[c.symbol]; !ok {
+			u[c.symbol] = struct{}{}
+			res = append(res, c)
 		}
 	}
 
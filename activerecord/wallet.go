@@ -9,58 +9,87 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgtype/pgxtype"
 	"github.com/shopspring/decimal"
 )
 
 var addressesRandomGenerator = rand.New(rand.NewSource(time.Now().Unix()))
 
-func newWalletFactory(db pgxtype.Querier) WalletFactory {
+// systemOwner owns the wallets which do not belong to any user, e.g. treasury and fee wallets
+var systemOwner = uuid.UUID{}
+
+func newWalletFactory(store store) WalletFactory {
 	return WalletFactory{
-		db: db,
+		store: store,
 	}
 }
 
 type WalletFactory struct {
-	db pgxtype.Querier
+	store store
 }
 
+// FindByUserID finds all user wallets together with their stored balances
 func (wf WalletFactory) FindByUserID(ctx context.Context, id uuid.UUID) ([]*Wallet, error) {
-	rows, err := wf.db.Query(ctx, `SELECT wallet,currency FROM user_wallets WHERE user_id=$1`, id)
+	wallets, err := wf.store.wallets().findByUserID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	var wallets []*Wallet
-	for rows.Next() {
-		w := &Wallet{
-			db:     wf.db,
-			userID: id,
-		}
-		err := rows.Scan(&w.address, &w.currency)
-		if err != nil {
-			return nil, err
-		}
-
-		wallets = append(wallets, w)
+	for _, w := range wallets {
+		wf.attach(w)
 	}
 
 	return wallets, nil
 }
 
-func (wf WalletFactory) New(owner uuid.UUID, currency, address string) (*Wallet, error) {
-	return newWallet(wf.db, owner, currency, address)
+func (wf WalletFactory) FindByAddress(ctx context.Context, address string) (*Wallet, error) {
+	return wf.findByAddress(ctx, address, false)
+}
+
+// FindByAddressForUpdate finds a wallet and locks it until the end of the surrounding DB transaction.
+// The balance is read after the lock is acquired, so it already includes the changes of the DB transaction
+// which has held the lock before
+func (wf WalletFactory) FindByAddressForUpdate(ctx context.Context, address string) (*Wallet, error) {
+	return wf.findByAddress(ctx, address, true)
+}
+
+func (wf WalletFactory) findByAddress(ctx context.Context, address string, forUpdate bool) (*Wallet, error) {
+	w, err := wf.store.wallets().findByAddress(ctx, address, forUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	wf.attach(w)
+	return w, nil
+}
+
+// VerifyBalances reports the addresses whose stored balance differs from the sum of their ledger postings.
+// The sums are calculated by a single query instead of replaying every wallet
+func (wf WalletFactory) VerifyBalances(ctx context.Context) ([]BalanceMismatch, error) {
+	return wf.store.wallets().balanceMismatches(ctx)
+}
+
+// attach makes the wallet and its currency work with the store of the factory
+func (wf WalletFactory) attach(w *Wallet) {
+	w.store = wf.store
+	w.currency.store = wf.store
 }
 
-func newWalletWithAddress(db pgxtype.Querier, owner uuid.UUID, currency string) (*Wallet, error) {
+func (wf WalletFactory) New(owner uuid.UUID, currency *Currency, address string) (*Wallet, error) {
+	return newWallet(wf.store, owner, currency, address)
+}
+
+func newAddress() string {
 	randomNum := strconv.FormatInt(addressesRandomGenerator.Int63(), 10)
 	hash := sha256.Sum256([]byte(randomNum))
-	addr := hex.EncodeToString(hash[:])
-	return newWallet(db, owner, currency, addr)
+	return hex.EncodeToString(hash[:])
 }
 
-func newWallet(db pgxtype.Querier, owner uuid.UUID, currency, address string) (*Wallet, error) {
-	if len(currency) == 0 {
+func newWalletWithAddress(store store, owner uuid.UUID, currency *Currency) (*Wallet, error) {
+	return newWallet(store, owner, currency, newAddress())
+}
+
+func newWallet(store store, owner uuid.UUID, currency *Currency, address string) (*Wallet, error) {
+	if currency == nil || len(currency.symbol) == 0 {
 		return nil, invalidCurrency
 	}
 
@@ -69,70 +98,132 @@ func newWallet(db pgxtype.Querier, owner uuid.UUID, currency, address string) (*
 	}
 
 	return &Wallet{
-		db: db,
+		store: store,
 		userID: owner,
 		currency: currency,
 		address: address,
 	}, nil
 }
 
+type BalanceMismatch struct {
+	Address  string          `json:"address"`
+	Stored   decimal.Decimal `json:"stored"`
+	Replayed decimal.Decimal `json:"replayed"`
+}
+
 type Wallet struct {
-	db     pgxtype.Querier
+	store  store
 	userID uuid.UUID
-	currency string
+	currency *Currency
 	address string
-	transactions []*Transaction
+	// balance is the stored balance of the wallet, it does not include pending transactions
+	balance decimal.Decimal
+	// pending are accepted transactions which are not saved yet
+	pending []*Transaction
+	// postings are loaded from the ledger to replay the balance
+	postings []Posting
 }
 
 func (w *Wallet) Save(ctx context.Context) error {
-	_, err := w.db.Exec(ctx, `INSERT INTO user_wallets(user_id,wallet,currency) VALUES($1,$2,$3) ON CONFLICT DO NOTHING`,
-									w.userID, w.address, w.currency)
+	err := w.store.wallets().insertIfNotExists(ctx, w.userID, w.address, w.currency.symbol)
 	if err != nil {
 		return err
 	}
 
-	for _, tx := range w.transactions {
+	for len(w.pending) > 0 {
+		tx := w.pending[0]
 		err := tx.Save(ctx)
 		if err != nil {
 			return err
 		}
+
+		w.balance = w.balance.Add(tx.Amount())
+		w.pending = w.pending[1:]
 	}
 
 	return nil
 }
 
+// AcceptTransaction creates a transfer from the wallet to this one.
+// Transfers between system wallets are internal transactions
 func (w *Wallet) AcceptTransaction(from *Wallet, amount decimal.Decimal) (*Transaction, error) {
-	if w.currency != from.currency {
-		return nil, walletCurrencyMismatch
+	kind := TransferTransaction
+	if w.userID == systemOwner && from.userID == systemOwner {
+		kind = InternalTransaction
 	}
 
-	tx, err := newTransaction(w.db, w.currency, from.address, w.address, amount)
+	return w.accept(kind, from, amount)
+}
+
+// AcceptBonus creates a bonus transaction from the treasury wallet to this one.
+// The treasury has to be found with FindByAddressForUpdate, so concurrent bonuses cannot overdraw it
+func (w *Wallet) AcceptBonus(from *Wallet, amount decimal.Decimal) (*Transaction, error) {
+	tx, err := w.newIncoming(BonusTransaction, from, amount)
 	if err != nil {
 		return nil, err
 	}
 
-	w.transactions = append(w.transactions, tx)
+	if from.Balance().LessThan(tx.FullAmount()) {
+		return nil, treasuryDepleted
+	}
+
+	w.pending = append(w.pending, tx)
 	return tx, nil
 }
 
-func (w *Wallet) LoadTransactions(ctx context.Context) ([]*Transaction, error) {
-	txs, err := newTransactionFactory(w.db).FindAllWithWallet(ctx, w.address)
+func (w *Wallet) accept(kind TransactionKind, from *Wallet, amount decimal.Decimal) (*Transaction, error) {
+	tx, err := w.newIncoming(kind, from, amount)
 	if err != nil {
 		return nil, err
 	}
 
-	w.transactions = txs
-	return txs, nil
+	w.pending = append(w.pending, tx)
+	return tx, nil
 }
 
+func (w *Wallet) newIncoming(kind TransactionKind, from *Wallet, amount decimal.Decimal) (*Transaction, error) {
+	if w.currency.symbol != from.currency.symbol {
+		return nil, walletCurrencyMismatch
+	}
+
+	return newTransaction(w.store, kind, w.currency, from.address, w.address, amount)
+}
+
+func (w *Wallet) LoadPostings(ctx context.Context) ([]Posting, error) {
+	postings, err := newLedger(w.store).FindPostings(ctx, w.address)
+	if err != nil {
+		return nil, err
+	}
+
+	w.postings = postings
+	return postings, nil
+}
+
+// FindTransactions returns a page of the wallet transaction history without loading it into the wallet
+func (w *Wallet) FindTransactions(ctx context.Context, filter TransactionFilter) (*TransactionPage, error) {
+	return newTransactionFactory(w.store).FindPageWithWallet(ctx, w.address, filter)
+}
+
+// Balance returns the stored balance together with the pending incoming transactions
 func (w *Wallet) Balance() decimal.Decimal {
+	s := w.balance
+	for _, t := range w.pending {
+		s = s.Add(t.Amount())
+	}
+
+	return s
+}
+
+// BalanceAt returns the stored balance of the wallet at the moment
+func (w *Wallet) BalanceAt(ctx context.Context, at time.Time) (decimal.Decimal, error) {
+	return newLedger(w.store).BalanceAt(ctx, w.address, at)
+}
+
+// ReplayBalance sums up the postings loaded by LoadPostings
+func (w *Wallet) ReplayBalance() decimal.Decimal {
 	s := decimal.Zero
-	for _, t := range w.transactions {
-		if t.to == w.address {
-			s = s.Add(t.Amount())
-		} else if t.from == w.address {
-			s = s.Sub(t.FullAmount())
-		}
+	for _, p := range w.postings {
+		s = s.Add(p.Amount)
 	}
 
 	return s
@@ -142,7 +233,7 @@ func (w *Wallet) UserID() uuid.UUID {
 	return w.userID
 }
 
-func (w *Wallet) Currency() string {
+func (w *Wallet) Currency() *Currency {
 	return w.currency
 }
 
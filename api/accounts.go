@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/merisho/binaryx-test/service"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Server) verifyEmail(ctx *gin.Context) {
+	var req VerifyEmailRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	err = s.accounts.VerifyEmail(ctx, req.Token)
+	if err != nil {
+		s.abortWithAccountTokenError(ctx, err, "could not verify email")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) resendVerification(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if user.EmailVerified() {
+		ctx.AbortWithStatusJSON(http.StatusConflict, emailAlreadyVerified)
+		return
+	}
+
+	err := s.accounts.SendVerification(ctx, user)
+	if err != nil {
+		log.WithError(err).Errorf("could not send verification email to user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// forgotPassword responds the same way whether the account exists or not
+func (s *Server) forgotPassword(ctx *gin.Context) {
+	var req ForgotPasswordRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	err = s.accounts.SendPasswordReset(ctx, req.Email)
+	if err != nil {
+		log.WithError(err).Error("could not send password reset email")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Status(http.StatusAccepted)
+}
+
+func (s *Server) resetPassword(ctx *gin.Context) {
+	var req ResetPasswordRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	err = s.accounts.ResetPassword(ctx, req.Token, req.Password)
+	if err != nil {
+		s.abortWithAccountTokenError(ctx, err, "could not reset password")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) abortWithAccountTokenError(ctx *gin.Context, err error, msg string) {
+	if err == service.ErrInvalidEmailToken {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	switch err.(type) {
+	case activerecord.ValidationError:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	default:
+		log.WithError(err).Error(msg)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
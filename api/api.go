@@ -1,8 +1,14 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,11 +18,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	fakeBTC = "fBTC"
-	fakeETH = "fETH"
-)
-
 type Mode string
 const (
 	TestMode Mode = gin.TestMode
@@ -24,14 +25,50 @@ const (
 	ReleaseMode Mode = gin.ReleaseMode
 )
 
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	defaultAccountThrottle = activerecord.ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		LockoutAttempts: 10,
+		Lockout:         15 * time.Minute,
+		Window:          time.Hour,
+	}
+	// An IP may be shared by many users, so it is allowed more failures than an account
+	defaultIPThrottle = activerecord.ThrottlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		LockoutAttempts: 100,
+		Lockout:         15 * time.Minute,
+		Window:          time.Hour,
+	}
+)
+
 type Config struct {
-	JWTSecret string
 	TokenTTLSeconds time.Duration
 	APIMode Mode
 	Port int
+	// IdempotencyTTL is how long responses are stored for Idempotency-Key retries
+	IdempotencyTTL time.Duration
+	// RefreshTokenTTL is how long a session lives without refreshing
+	RefreshTokenTTL time.Duration
+	// Clock returns the current time for one-time passwords and login throttling, time.Now by default
+	Clock func() time.Time
+	// AccountThrottle and IPThrottle limit failed sign in attempts per account and per client IP
+	AccountThrottle activerecord.ThrottlePolicy
+	IPThrottle activerecord.ThrottlePolicy
+	// DefaultSignupBonus and DefaultFeeSchedules are used for new currencies created without them
+	DefaultSignupBonus decimal.Decimal
+	DefaultFeeSchedules map[activerecord.TransactionKind]activerecord.FeeSchedule
+	// TrustedProxies are IPs or CIDRs of reverse proxies, X-Forwarded-For is read only from them. None are trusted by default
+	TrustedProxies []string
 }
 
-func NewServer(config Config, activeRecordFactory activerecord.Facade, serviceWallets *service.Wallets) (*Server, error) {
+func NewServer(config Config, activeRecordFactory activerecord.Facade, serviceWallets *service.Wallets, keyring *service.Keyring, accounts *service.Accounts) (*Server, error) {
 	if config.APIMode == "" {
 		config.APIMode = ReleaseMode
 	}
@@ -42,12 +79,47 @@ func NewServer(config Config, activeRecordFactory activerecord.Facade, serviceWa
 		config.Port = 8080
 	}
 
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = defaultIdempotencyTTL
+	}
+
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = defaultRefreshTokenTTL
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	if config.AccountThrottle.LockoutAttempts == 0 {
+		config.AccountThrottle = defaultAccountThrottle
+	}
+
+	if config.IPThrottle.LockoutAttempts == 0 {
+		config.IPThrottle = defaultIPThrottle
+	}
+
+	var trustedProxies []*net.IPNet
+	for _, proxy := range config.TrustedProxies {
+		ipNet := activerecord.ParseIPNet(proxy)
+		if ipNet == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+
 	s := &Server{
 		config: config,
 		activeRecords: activeRecordFactory,
 		gin: gin.Default(),
 		serviceWallets: serviceWallets,
+		keyring: keyring,
+		accounts: accounts,
+		trustedProxies: trustedProxies,
 	}
+	// gin trusts forwarding headers from any peer, the client IP is resolved by clientIP instead
+	s.gin.ForwardedByClientIP = false
 
 	s.initEndpoints()
 
@@ -59,104 +131,210 @@ type Server struct {
 	gin *gin.Engine
 	activeRecords activerecord.Facade
 	serviceWallets *service.Wallets
+	keyring *service.Keyring
+	accounts *service.Accounts
+	trustedProxies []*net.IPNet
+
+	http *http.Server
+	workers []Worker
+	stopWorkers context.CancelFunc
+	workersDone sync.WaitGroup
+	serveErr chan error
 }
 
 func (s *Server) Gin() *gin.Engine {
 	return s.gin
 }
 
-func (s *Server) Listen() error {
-	return s.gin.Run(fmt.Sprintf(":%d", s.config.Port))
+// clientIP returns the IP of the client, or an empty string if it is unknown. X-Forwarded-For is taken into account
+// only if the peer is a trusted proxy, the client is the last address of the header which is not a trusted proxy
+func (s *Server) clientIP(c *gin.Context) string {
+	ip, _ := c.RemoteIP()
+	if ip == nil {
+		return ""
+	}
+
+	forwarded := strings.Split(strings.Join(c.Request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && s.trustedProxy(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+	}
+
+	return ip.String()
+}
+
+func (s *Server) trustedProxy(ip net.IP) bool {
+	for _, proxy := range s.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (s *Server) initEndpoints() {
-	s.gin.Handle(http.MethodPost, "/signup", s.signup)
-	s.gin.Handle(http.MethodPost, "/token", s.token)
-	s.gin.Handle(http.MethodGet, "/iam", s.authMiddleware, s.iam)
-	s.gin.Handle(http.MethodGet, "/wallets", s.authMiddleware, s.wallets)
+// AddWorker registers a background worker, it is started by Start and stopped by Shutdown.
+// Workers must be added before Start
+func (s *Server) AddWorker(w Worker) {
+	s.workers = append(s.workers, w)
 }
 
-func (s *Server) signup(ctx *gin.Context) {
-	var req SignupRequest
-	err := ctx.ShouldBindJSON(&req)
+// Start listens on the configured port and serves requests in the background, then starts the workers.
+// It returns when the server is listening, so requests are accepted right after it.
+// Cancelling ctx stops the workers but not the server, Shutdown stops both
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
 	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
-		return
+		return err
 	}
 
-	user, err := s.activeRecords.User().New(req.Email, req.Password, req.FirstName, req.LastName)
-	if err != nil {
-		switch err.(type) {
-		case activerecord.ValidationError:
-			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
-		default:
-			ctx.AbortWithStatus(http.StatusInternalServerError)
-			log.WithError(err).Error("could not create new user")
+	s.http = &http.Server{
+		Handler: s.gin,
+	}
+	s.serveErr = make(chan error, 1)
+	go func() {
+		err := s.http.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.serveErr <- err
 		}
-
-		return
+		close(s.serveErr)
+	}()
+
+	ctx, s.stopWorkers = context.WithCancel(ctx)
+	for _, w := range s.workers {
+		s.workersDone.Add(1)
+		go func(w Worker) {
+			defer s.workersDone.Done()
+			w.Run(ctx)
+		}(w)
 	}
 
-	wallets, err := user.CreateWallets(fakeBTC, fakeETH)
-	if err != nil {
-		log.WithError(err).Error("could not create wallets")
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+	log.Infof("Listening on %s", listener.Addr())
+	return nil
+}
+
+// Err receives the error if the server stops serving by itself, it is closed after the server stops
+func (s *Server) Err() <-chan error {
+	return s.serveErr
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests to finish and stops the workers.
+// If ctx is done first, the remaining connections are closed and ctx error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.http == nil {
+		return nil
 	}
 
-	for _, w := range wallets {
-		serviceWallet := s.serviceWallets.Get(w.Currency())
-		if serviceWallet == nil {
-			log.Errorf("no service wallet for currency %s", w.Currency())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
-			return
+	err := s.http.Shutdown(ctx)
+	if err != nil {
+		closeErr := s.http.Close()
+		if closeErr != nil {
+			log.WithError(closeErr).Error("could not close connections")
 		}
+	}
 
-		_, err := w.AcceptTransaction(serviceWallet, decimal.NewFromInt(100))
-		if err != nil {
-			log.WithError(err).Error("could not create transaction for wallet")
-			ctx.AbortWithStatus(http.StatusInternalServerError)
-			return
+	s.stopWorkers()
+	done := make(chan struct{})
+	go func() {
+		s.workersDone.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
 		}
 	}
 
-	tx, err := s.activeRecords.Tx(ctx)
+	return err
+}
+
+func (s *Server) initEndpoints() {
+	s.gin.Handle(http.MethodPost, "/signup", s.idempotencyMiddleware, s.signup)
+	s.gin.Handle(http.MethodPost, "/verify-email", s.verifyEmail)
+	s.gin.Handle(http.MethodPost, "/verify-email/resend", s.authMiddleware, s.resendVerification)
+	s.gin.Handle(http.MethodPost, "/password/forgot", s.forgotPassword)
+	s.gin.Handle(http.MethodPost, "/password/reset", s.resetPassword)
+	s.gin.Handle(http.MethodPost, "/token", s.token)
+	s.gin.Handle(http.MethodPost, "/token/refresh", s.refreshToken)
+	s.gin.Handle(http.MethodGet, "/.well-known/jwks.json", s.jwks)
+	s.gin.Handle(http.MethodPost, "/logout", s.authMiddleware, s.logout)
+	s.gin.Handle(http.MethodGet, "/sessions", s.authMiddleware, s.sessions)
+	s.gin.Handle(http.MethodDelete, "/sessions/:id", s.authMiddleware, s.deleteSession)
+	s.gin.Handle(http.MethodPost, "/2fa/enroll", s.authMiddleware, s.enrollTwoFactor)
+	s.gin.Handle(http.MethodPost, "/2fa/confirm", s.authMiddleware, s.confirmTwoFactor)
+	s.gin.Handle(http.MethodPost, "/2fa/disable", s.authMiddleware, s.disableTwoFactor)
+	s.gin.Handle(http.MethodGet, "/api-keys", s.authMiddleware, s.apiKeys)
+	s.gin.Handle(http.MethodPost, "/api-keys", s.authMiddleware, s.idempotencyMiddleware, s.createAPIKey)
+	s.gin.Handle(http.MethodGet, "/api-keys/:id", s.authMiddleware, s.apiKey)
+	s.gin.Handle(http.MethodPatch, "/api-keys/:id", s.authMiddleware, s.updateAPIKey)
+	s.gin.Handle(http.MethodDelete, "/api-keys/:id", s.authMiddleware, s.deleteAPIKey)
+	s.gin.Handle(http.MethodGet, "/iam", s.scopedAuthMiddleware(activerecord.ScopeProfileRead), s.iam)
+	s.gin.Handle(http.MethodGet, "/wallets", s.scopedAuthMiddleware(activerecord.ScopeWalletsRead), s.wallets)
+	s.gin.Handle(http.MethodGet, "/wallets/:address/transactions", s.scopedAuthMiddleware(activerecord.ScopeWalletsRead), s.walletTransactions)
+	s.gin.Handle(http.MethodGet, "/wallets/:address/balance", s.scopedAuthMiddleware(activerecord.ScopeWalletsRead), s.walletBalance)
+	s.gin.Handle(http.MethodPost, "/transactions", s.scopedAuthMiddleware(activerecord.ScopeTransactionsWrite), s.idempotencyMiddleware, s.transfer)
+	s.gin.Handle(http.MethodGet, "/currencies", s.currencies)
+	s.gin.Handle(http.MethodPost, "/currencies", s.authMiddleware, s.adminMiddleware, s.idempotencyMiddleware, s.createCurrency)
+	s.gin.Handle(http.MethodPatch, "/currencies/:symbol", s.authMiddleware, s.adminMiddleware, s.idempotencyMiddleware, s.updateCurrency)
+	s.gin.Handle(http.MethodPut, "/currencies/:symbol/fees/:kind", s.authMiddleware, s.adminMiddleware, s.idempotencyMiddleware, s.setFeeSchedule)
+	s.gin.Handle(http.MethodPost, "/currencies/:symbol/mint", s.authMiddleware, s.adminMiddleware, s.idempotencyMiddleware, s.mint)
+	s.gin.Handle(http.MethodPost, "/currencies/:symbol/burn", s.authMiddleware, s.adminMiddleware, s.idempotencyMiddleware, s.burn)
+	s.gin.Handle(http.MethodGet, "/currencies/:symbol/supply", s.authMiddleware, s.adminMiddleware, s.supply)
+	s.gin.Handle(http.MethodGet, "/admin/fees", s.authMiddleware, s.adminMiddleware, s.feeRevenue)
+	s.gin.Handle(http.MethodGet, "/admin/reconciliation", s.authMiddleware, s.adminMiddleware, s.reconciliation)
+	s.gin.Handle(http.MethodPost, "/admin/users/:id/unlock", s.authMiddleware, s.adminMiddleware, s.unlockUser)
+}
+
+func (s *Server) signup(ctx *gin.Context) {
+	var req SignupRequest
+	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		log.WithError(err).Error("CRITICAL: could not begin transaction")
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
 	}
 
-	err = user.Save(ctx)
+	// The email lookup and the password hash are slow, so they are done before the DB transaction
+	// instead of holding its connection
+	user, err := s.activeRecords.User().New(ctx, req.Email, req.Password, req.FirstName, req.LastName)
+	if err == nil {
+		err = s.saveNewUser(ctx, user)
+	}
 	if err != nil {
 		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 		case activerecord.ConflictError:
 			ctx.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		case activerecord.InsufficientFundsError:
+			ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, signupBonusUnavailable)
+			log.WithError(err).Error("could not pay signup bonus")
 		default:
 			ctx.AbortWithStatus(http.StatusInternalServerError)
 			log.WithError(err).Error("could not save new user with wallets and transactions")
 		}
 
-		err = tx.Rollback(ctx)
-		if err != nil {
-			log.WithError(err).Error("CRITICAL: could not rollback transaction")
-		}
-
 		return
 	}
 
-	err = tx.Commit(ctx)
+	// The user can ask for another email if this one is not sent
+	err = s.accounts.SendVerification(ctx, user)
 	if err != nil {
-		log.WithError(err).Error("CRITICAL: could not commit transaction")
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+		log.WithError(err).Errorf("could not send verification email to user %s", user.ID())
 	}
 
 	var walletsRes []WalletResponse
-	for _, w := range wallets {
+	for _, w := range user.Wallets() {
 		walletsRes = append(walletsRes, WalletResponse{
 			UserID:  w.UserID().String(),
 			Address:  w.Address(),
-			Currency: w.Currency(),
+			Currency: w.Currency().Symbol(),
 			Balance:  w.Balance().String(),
 		})
 	}
@@ -170,6 +348,45 @@ func (s *Server) signup(ctx *gin.Context) {
 	})
 }
 
+// saveNewUser saves the user with a wallet in every enabled currency and pays the signup bonuses in a DB transaction
+func (s *Server) saveNewUser(ctx context.Context, user *activerecord.User) error {
+	return s.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		tx.User().Attach(user)
+		currencies, err := tx.Currency().Enabled(ctx)
+		if err != nil {
+			return fmt.Errorf("could not load enabled currencies: %w", err)
+		}
+
+		wallets, err := user.CreateWallets(currencies...)
+		if err != nil {
+			return fmt.Errorf("could not create wallets: %w", err)
+		}
+
+		for _, w := range wallets {
+			bonus := w.Currency().SignupBonus()
+			if bonus.IsZero() {
+				continue
+			}
+
+			serviceWallet, err := s.serviceWallets.WithTx(tx).Get(ctx, w.Currency())
+			if err != nil {
+				return fmt.Errorf("no service wallet for currency %s: %w", w.Currency().Symbol(), err)
+			}
+
+			_, err = w.AcceptBonus(serviceWallet, bonus)
+			if err != nil {
+				if _, ok := err.(activerecord.InsufficientFundsError); ok {
+					return err
+				}
+
+				return fmt.Errorf("could not create transaction for wallet: %w", err)
+			}
+		}
+
+		return user.Save(ctx)
+	})
+}
+
 func (s *Server) wallets(ctx *gin.Context) {
 	user := s.getRequestUser(ctx)
 	if user == nil {
@@ -186,20 +403,231 @@ func (s *Server) wallets(ctx *gin.Context) {
 
 	var res []WalletResponse
 	for _, w := range wallets {
-		_, err := w.LoadTransactions(ctx)
-		if err != nil {
-			log.WithError(err).Errorf("could not load transactions for wallet %s", w.Address())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-
 		res = append(res, WalletResponse{
 			UserID:   w.UserID().String(),
 			Address:  w.Address(),
-			Currency: w.Currency(),
+			Currency: w.Currency().Symbol(),
 			Balance:  w.Balance().String(),
 		})
 	}
 
 	ctx.AbortWithStatusJSON(http.StatusOK, res)
 }
+
+func (s *Server) transfer(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !user.EmailVerified() {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, emailNotVerified)
+		return
+	}
+
+	var req TransferRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	amount, err := decimal.NewFromString(req.Amount)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid amount"})
+		return
+	}
+
+	t, err := s.activeRecords.Transfer(ctx, user.ID(), req.From, req.To, amount)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "wallet not found"})
+		case activerecord.InsufficientFundsError:
+			ctx.AbortWithStatusJSON(http.StatusPaymentRequired, ErrorResponse{Error: err.Error()})
+		case activerecord.ConflictError:
+			ctx.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not transfer from wallet %s to wallet %s", req.From, req.To)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, TransactionResponse{
+		ID:        t.ID().String(),
+		Currency:  t.Currency(),
+		From:      t.From(),
+		To:        t.To(),
+		Amount:    t.Amount().String(),
+		Fee:       t.Fee().String(),
+		FeePolicy: t.FeePolicy(),
+		Timestamp: t.Timestamp().Unix(),
+	})
+}
+
+func (s *Server) walletBalance(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	at := time.Now().UTC()
+	if v := ctx.Query("at"); v != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid at"})
+			return
+		}
+	}
+
+	address := ctx.Param("address")
+	wallet, err := s.activeRecords.Wallet().FindByAddress(ctx, address)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "wallet not found"})
+		default:
+			log.WithError(err).Errorf("could not find wallet %s", address)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if wallet.UserID() != user.ID() {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "wallet not found"})
+		return
+	}
+
+	balance, err := wallet.BalanceAt(ctx, at)
+	if err != nil {
+		log.WithError(err).Errorf("could not calculate balance of wallet %s at %s", address, at)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, WalletBalanceResponse{
+		Address:  wallet.Address(),
+		Currency: wallet.Currency().Symbol(),
+		Balance:  balance.String(),
+		At:       at.Unix(),
+	})
+}
+
+func (s *Server) walletTransactions(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseTransactionFilter(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	address := ctx.Param("address")
+	wallet, err := s.activeRecords.Wallet().FindByAddress(ctx, address)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "wallet not found"})
+		default:
+			log.WithError(err).Errorf("could not find wallet %s", address)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if wallet.UserID() != user.ID() {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "wallet not found"})
+		return
+	}
+
+	page, err := wallet.FindTransactions(ctx, filter)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not load transactions for wallet %s", address)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	res := TransactionHistoryResponse{
+		Transactions: []TransactionHistoryEntry{},
+		NextCursor:   page.NextCursor,
+	}
+	for _, t := range page.Transactions {
+		res.Transactions = append(res.Transactions, TransactionHistoryEntry{
+			ID:           t.ID().String(),
+			Kind:         string(t.Kind()),
+			Direction:    string(t.Direction(address)),
+			Counterparty: t.Counterparty(address),
+			Amount:       t.Amount().String(),
+			Fee:          t.Fee().String(),
+			Timestamp:    t.Timestamp().Unix(),
+		})
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func parseTransactionFilter(ctx *gin.Context) (activerecord.TransactionFilter, error) {
+	filter := activerecord.TransactionFilter{
+		Direction: activerecord.TransactionDirection(ctx.Query("direction")),
+		Cursor:    ctx.Query("cursor"),
+	}
+
+	var err error
+	if v := ctx.Query("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 {
+			return filter, fmt.Errorf("invalid limit")
+		}
+	}
+
+	if v := ctx.Query("since"); v != "" {
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since")
+		}
+	}
+
+	if v := ctx.Query("until"); v != "" {
+		filter.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until")
+		}
+	}
+
+	if v := ctx.Query("minAmount"); v != "" {
+		filter.MinAmount.Decimal, err = decimal.NewFromString(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid minAmount")
+		}
+		filter.MinAmount.Valid = true
+	}
+
+	if v := ctx.Query("maxAmount"); v != "" {
+		filter.MaxAmount.Decimal, err = decimal.NewFromString(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid maxAmount")
+		}
+		filter.MaxAmount.Valid = true
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Server) createAPIKey(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	key, token, err := s.activeRecords.APIKey().New(user.ID(), req.Name, parseScopes(req.Scopes), parseExpiresAt(req.ExpiresAt), req.AllowedIPs)
+	if err == nil {
+		err = key.Save(ctx)
+	}
+
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not create API key for user %s", user.ID())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, CreateAPIKeyResponse{
+		APIKeyResponse: apiKeyResponse(key),
+		Key:            token,
+	})
+}
+
+func (s *Server) apiKeys(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := s.activeRecords.APIKey().FindByUserID(ctx, user.ID())
+	if err != nil {
+		log.WithError(err).Errorf("could not load API keys of user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	res := []APIKeyResponse{}
+	for _, k := range keys {
+		res = append(res, apiKeyResponse(k))
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (s *Server) apiKey(ctx *gin.Context) {
+	key := s.findAPIKey(ctx)
+	if key == nil {
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiKeyResponse(key))
+}
+
+func (s *Server) updateAPIKey(ctx *gin.Context) {
+	var req UpdateAPIKeyRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	key := s.findAPIKey(ctx)
+	if key == nil {
+		return
+	}
+
+	name, scopes, expiresAt, allowedIPs := key.Name(), key.Scopes(), key.ExpiresAt(), key.AllowedIPs()
+	if req.Name != nil {
+		name = *req.Name
+	}
+
+	if req.Scopes != nil {
+		scopes = parseScopes(*req.Scopes)
+	}
+
+	if req.ExpiresAt != nil {
+		expiresAt = parseExpiresAt(*req.ExpiresAt)
+	}
+
+	if req.AllowedIPs != nil {
+		allowedIPs = *req.AllowedIPs
+	}
+
+	err = key.Update(ctx, name, scopes, expiresAt, allowedIPs)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not update API key %s", key.ID())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiKeyResponse(key))
+}
+
+func (s *Server) deleteAPIKey(ctx *gin.Context) {
+	key := s.findAPIKey(ctx)
+	if key == nil {
+		return
+	}
+
+	err := key.Delete(ctx)
+	if err != nil {
+		log.WithError(err).Errorf("could not delete API key %s", key.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// findAPIKey returns the key from the path if it belongs to the request user, otherwise it aborts the request and returns nil
+func (s *Server) findAPIKey(ctx *gin.Context) *activerecord.APIKey {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "API key not found"})
+		return nil
+	}
+
+	key, err := s.activeRecords.APIKey().Find(ctx, user.ID(), id)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "API key not found"})
+		default:
+			log.WithError(err).Errorf("could not find API key %s", id)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return nil
+	}
+
+	return key
+}
+
+func parseScopes(raw []string) []activerecord.Scope {
+	scopes := make([]activerecord.Scope, 0, len(raw))
+	for _, s := range raw {
+		scopes = append(scopes, activerecord.Scope(s))
+	}
+
+	return scopes
+}
+
+func parseExpiresAt(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+
+	t := time.Unix(unix, 0).UTC()
+	return &t
+}
+
+func apiKeyResponse(k *activerecord.APIKey) APIKeyResponse {
+	res := APIKeyResponse{
+		ID:         k.ID().String(),
+		Name:       k.Name(),
+		Prefix:     k.Prefix(),
+		Scopes:     []string{},
+		AllowedIPs: k.AllowedIPs(),
+		CreatedAt:  k.CreatedAt().Unix(),
+	}
+
+	for _, s := range k.Scopes() {
+		res.Scopes = append(res.Scopes, string(s))
+	}
+
+	if k.ExpiresAt() != nil {
+		expiresAt := k.ExpiresAt().Unix()
+		res.ExpiresAt = &expiresAt
+	}
+
+	if k.LastUsedAt() != nil {
+		lastUsedAt := k.LastUsedAt().Unix()
+		res.LastUsedAt = &lastUsedAt
+	}
+
+	return res
+}
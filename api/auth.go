@@ -1,7 +1,10 @@
 package api
 
 import (
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +16,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// dummyPasswordHash is compared with passwords of unknown emails, its cost is the one of users' passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
 func (s *Server) getRequestUser(c *gin.Context) *activerecord.User {
 	userRaw, ok := c.Get("user")
 	if !ok {
@@ -29,25 +35,67 @@ func (s *Server) getRequestUser(c *gin.Context) *activerecord.User {
 	return user
 }
 
+// getRequestSession returns the session of the access token, it must be called after authMiddleware
+func (s *Server) getRequestSession(c *gin.Context) *activerecord.Session {
+	sessionRaw, ok := c.Get("session")
+	if !ok {
+		log.Error("CRITICAL: no session in the context. Call authMiddleware before getting the session from context")
+		return nil
+	}
+
+	session, ok := sessionRaw.(*activerecord.Session)
+	if !ok {
+		log.Error("CRITICAL: session in context is not of *activerecord.Session")
+		return nil
+	}
+
+	return session
+}
+
+// accessClaims identify the user by Id and the session the token was issued for by SessionID
+type accessClaims struct {
+	jwt.StandardClaims
+	SessionID string `json:"sid"`
+}
+
+const (
+	bearerAuthPrefix = "Bearer "
+	apiKeyAuthPrefix = "ApiKey "
+)
+
+// authMiddleware authenticates requests by access tokens, API keys are not accepted
 func (s *Server) authMiddleware(c *gin.Context) {
+	s.authenticate(c, "")
+}
+
+// scopedAuthMiddleware authenticates requests by access tokens or by API keys which have the scope
+func (s *Server) scopedAuthMiddleware(scope activerecord.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.authenticate(c, scope)
+	}
+}
+
+// authenticate accepts API keys only if the scope is not empty
+func (s *Server) authenticate(c *gin.Context, scope activerecord.Scope) {
 	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, invalidAuthHeader)
+	if strings.HasPrefix(authHeader, apiKeyAuthPrefix) {
+		if scope == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, apiKeyNotAccepted)
+			return
+		}
+
+		s.authenticateAPIKey(c, authHeader[len(apiKeyAuthPrefix):], scope)
 		return
 	}
 
-	const prefix = "Bearer "
-	if !strings.HasPrefix(authHeader, prefix) {
+	if !strings.HasPrefix(authHeader, bearerAuthPrefix) {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, invalidAuthHeader)
 		return
 	}
 
-	tokenStr := authHeader[len(prefix):]
-	claims := &jwt.StandardClaims{}
-	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.config.JWTSecret), nil
-	})
-
+	tokenStr := authHeader[len(bearerAuthPrefix):]
+	claims := &accessClaims{}
+	err := s.keyring.Parse(c, tokenStr, claims)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusUnauthorized, invalidToken)
 		return
@@ -59,6 +107,30 @@ func (s *Server) authMiddleware(c *gin.Context) {
 		return
 	}
 
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, invalidToken)
+		return
+	}
+
+	session, err := s.activeRecords.Session().Find(c, sessionID)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, invalidToken)
+		default:
+			log.WithError(err).Error("could not find session by id")
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if !session.Active() || session.UserID() != id {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, sessionRevoked)
+		return
+	}
+
 	user, err := s.activeRecords.User().FindByID(c, id)
 	if err != nil {
 		switch err.(type) {
@@ -72,11 +144,60 @@ func (s *Server) authMiddleware(c *gin.Context) {
 		return
 	}
 
+	c.Set("session", session)
 	c.Set("user", user)
 
 	c.Next()
 }
 
+func (s *Server) authenticateAPIKey(c *gin.Context, token string, scope activerecord.Scope) {
+	key, err := s.activeRecords.APIKey().Authenticate(c, token, net.ParseIP(s.clientIP(c)))
+	if err != nil {
+		switch err.(type) {
+		case activerecord.UnauthorizedError:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Error("could not authenticate API key")
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if !key.HasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, insufficientScope)
+		return
+	}
+
+	user, err := s.activeRecords.User().FindByID(c, key.UserID())
+	if err != nil {
+		log.WithError(err).Errorf("could not find user of API key %s", key.ID())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Set("apiKey", key)
+	c.Set("user", user)
+
+	c.Next()
+}
+
+// adminMiddleware must be called after authMiddleware
+func (s *Server) adminMiddleware(c *gin.Context) {
+	user := s.getRequestUser(c)
+	if user == nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !user.IsAdmin() {
+		c.AbortWithStatusJSON(http.StatusForbidden, adminOnly)
+		return
+	}
+
+	c.Next()
+}
+
 func (s *Server) token(ctx *gin.Context) {
 	var req TokenRequest
 	err := ctx.ShouldBindJSON(&req)
@@ -85,11 +206,20 @@ func (s *Server) token(ctx *gin.Context) {
 		return
 	}
 
+	now := s.config.Clock()
+	if s.throttled(ctx, req.Email, now) {
+		return
+	}
+
+	// Unknown emails and wrong passwords fail the same way, so the response does not tell which accounts exist
 	user, err := s.activeRecords.User().FindByEmail(ctx, req.Email)
 	if err != nil {
 		switch err.(type) {
 		case activerecord.NotFoundError:
-			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "user not found"})
+			// The password is compared anyway, so unknown emails take as long as wrong passwords
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+			s.loginFailed(ctx, nil, req.Email, now)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, invalidCredentials)
 		default:
 			log.WithError(err).Error("could not find user by email")
 			ctx.AbortWithStatus(http.StatusInternalServerError)
@@ -100,30 +230,330 @@ func (s *Server) token(ctx *gin.Context) {
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password()), []byte(req.Password))
 	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid password"})
+		s.loginFailed(ctx, user, req.Email, now)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, invalidCredentials)
 		return
 	}
 
-	expires := time.Now().Add(s.config.TokenTTLSeconds * time.Second)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
-		Id:        user.ID().String(),
-		ExpiresAt: expires.Unix(),
+	twoFactor, err := s.findTwoFactor(ctx, user.ID())
+	if err != nil {
+		log.WithError(err).Errorf("could not find second factor of user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if twoFactor != nil && twoFactor.Enabled() {
+		if req.OTP == "" {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, TwoFactorChallengeResponse{
+				Error:     "one-time password is required",
+				Challenge: "otp",
+			})
+			return
+		}
+
+		err = twoFactor.Verify(ctx, req.OTP, now)
+		if err != nil {
+			switch err.(type) {
+			case activerecord.UnauthorizedError:
+				s.loginFailed(ctx, user, req.Email, now)
+				ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+			default:
+				log.WithError(err).Errorf("could not verify one-time password of user %s", user.ID())
+				ctx.AbortWithStatus(http.StatusInternalServerError)
+			}
+
+			return
+		}
+	}
+
+	// Only the account is reset, otherwise signing in to an own account would reset the failures of the IP
+	err = s.activeRecords.LoginThrottle().Reset(ctx, activerecord.AccountThrottleKey(req.Email))
+	if err != nil {
+		log.WithError(err).Errorf("could not reset login throttle of user %s", user.ID())
+	}
+
+	session, refreshToken, err := s.activeRecords.Session().Start(ctx, user.ID(), s.config.RefreshTokenTTL)
+	if err != nil {
+		log.WithError(err).Error("could not start session")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s.respondWithTokens(ctx, session, refreshToken)
+}
+
+// throttled aborts the request if the account with the email or the client IP is blocked after failed attempts
+func (s *Server) throttled(ctx *gin.Context, email string, now time.Time) bool {
+	blockedUntil, err := s.activeRecords.LoginThrottle().BlockedUntil(ctx, now, s.throttleKeys(ctx, email)...)
+	if err != nil {
+		log.WithError(err).Error("could not check login throttle")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+
+	if !blockedUntil.IsZero() {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(blockedUntil.Sub(now).Seconds()))))
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, tooManyLoginAttempts)
+		return true
+	}
+
+	return false
+}
+
+// throttleKeys returns the keys failed sign in attempts are counted by.
+// Requests without a known client IP, e.g. in tests, are counted only by the account
+func (s *Server) throttleKeys(ctx *gin.Context, email string) []string {
+	keys := []string{activerecord.AccountThrottleKey(email)}
+	if ip := s.clientIP(ctx); ip != "" {
+		keys = append(keys, activerecord.IPThrottleKey(ip))
+	}
+
+	return keys
+}
+
+// loginFailed counts the failure for the account and the client IP and records lockouts in the audit log.
+// The user is nil if there is no account with the email
+func (s *Server) loginFailed(ctx *gin.Context, user *activerecord.User, email string, now time.Time) {
+	throttle := s.activeRecords.LoginThrottle()
+	ip := s.clientIP(ctx)
+
+	var userID *uuid.UUID
+	if user != nil {
+		id := user.ID()
+		userID = &id
+	}
+
+	accountKey := activerecord.AccountThrottleKey(email)
+	locked, err := throttle.Fail(ctx, accountKey, s.config.AccountThrottle, now)
+	if err != nil {
+		log.WithError(err).Errorf("could not count failed login of %s", accountKey)
+	} else if locked {
+		s.audit(ctx, &activerecord.AuditEvent{
+			Kind:    activerecord.AuditAccountLocked,
+			UserID:  userID,
+			Subject: accountKey,
+			IP:      ip,
+		})
+	}
+
+	if ip == "" {
+		return
+	}
+
+	ipKey := activerecord.IPThrottleKey(ip)
+	locked, err = throttle.Fail(ctx, ipKey, s.config.IPThrottle, now)
+	if err != nil {
+		log.WithError(err).Errorf("could not count failed login of %s", ipKey)
+	} else if locked {
+		s.audit(ctx, &activerecord.AuditEvent{
+			Kind:    activerecord.AuditIPLocked,
+			Subject: ipKey,
+			IP:      ip,
+		})
+	}
+}
+
+// audit records the event, a failure is logged and does not fail the request
+func (s *Server) audit(ctx *gin.Context, e *activerecord.AuditEvent) {
+	err := s.activeRecords.Audit().Record(ctx, e)
+	if err != nil {
+		log.WithError(err).Errorf("could not record audit event %s of %s", e.Kind, e.Subject)
+	}
+}
+
+// unlockUser resets the failed sign in attempts of the user's account
+func (s *Server) unlockUser(ctx *gin.Context) {
+	admin := s.getRequestUser(ctx)
+	if admin == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+		return
+	}
+
+	user, err := s.activeRecords.User().FindByID(ctx, id)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "user not found"})
+		default:
+			log.WithError(err).Errorf("could not find user %s", id)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	accountKey := activerecord.AccountThrottleKey(user.Email())
+	err = s.activeRecords.LoginThrottle().Reset(ctx, accountKey)
+	if err != nil {
+		log.WithError(err).Errorf("could not unlock user %s", id)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userID, actor := user.ID(), admin.ID()
+	s.audit(ctx, &activerecord.AuditEvent{
+		Kind:    activerecord.AuditAccountUnlocked,
+		UserID:  &userID,
+		Subject: accountKey,
+		Actor:   &actor,
+		IP:      s.clientIP(ctx),
 	})
 
-	signed, err := token.SignedString([]byte(s.config.JWTSecret))
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) refreshToken(ctx *gin.Context) {
+	var req RefreshTokenRequest
+	err := ctx.ShouldBindJSON(&req)
 	if err != nil {
-		log.WithError(err).Error("error secret signing jwt token")
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	session, refreshToken, err := s.activeRecords.Session().Refresh(ctx, req.RefreshToken, s.config.RefreshTokenTTL)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.UnauthorizedError:
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Error("could not refresh session")
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	s.respondWithTokens(ctx, session, refreshToken)
+}
+
+// respondWithTokens issues an access token for the session and responds with it and the refresh token
+func (s *Server) respondWithTokens(ctx *gin.Context, session *activerecord.Session, refreshToken string) {
+	expires := time.Now().Add(s.config.TokenTTLSeconds * time.Second)
+	signed, err := s.keyring.Sign(ctx, &accessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        session.UserID().String(),
+			ExpiresAt: expires.Unix(),
+		},
+		SessionID: session.ID().String(),
+	})
+	if err != nil {
+		log.WithError(err).Error("could not sign jwt token")
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	res := TokenResponse{
-		Token:     signed,
-		ExpiresAt: expires.Unix(),
+		Token:            signed,
+		ExpiresAt:        expires.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: session.ExpiresAt().Unix(),
+		SessionID:        session.ID().String(),
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (s *Server) logout(ctx *gin.Context) {
+	session := s.getRequestSession(ctx)
+	if session == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	err := session.Revoke(ctx)
+	if err != nil {
+		log.WithError(err).Errorf("could not revoke session %s", session.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) sessions(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	current := s.getRequestSession(ctx)
+	if user == nil || current == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := s.activeRecords.Session().FindActiveByUserID(ctx, user.ID())
+	if err != nil {
+		log.WithError(err).Errorf("could not load sessions of user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	res := []SessionResponse{}
+	for _, session := range sessions {
+		res = append(res, SessionResponse{
+			ID:        session.ID().String(),
+			CreatedAt: session.CreatedAt().Unix(),
+			ExpiresAt: session.ExpiresAt().Unix(),
+			Current:   session.ID() == current.ID(),
+		})
+	}
+
 	ctx.JSON(http.StatusOK, res)
 }
 
+func (s *Server) deleteSession(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "session not found"})
+		return
+	}
+
+	session, err := s.activeRecords.Session().Find(ctx, id)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "session not found"})
+		default:
+			log.WithError(err).Errorf("could not find session %s", id)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if session.UserID() != user.ID() {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "session not found"})
+		return
+	}
+
+	err = session.Revoke(ctx)
+	if err != nil {
+		log.WithError(err).Errorf("could not revoke session %s", id)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (s *Server) jwks(ctx *gin.Context) {
+	set, err := s.keyring.JWKS(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not load signing keys")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, set)
+}
 
 func (s *Server) iam(ctx *gin.Context) {
 	user := s.getRequestUser(ctx)
@@ -133,9 +563,10 @@ func (s *Server) iam(ctx *gin.Context) {
 	}
 
 	ctx.AbortWithStatusJSON(http.StatusOK, IAmResponse{
-		ID:        user.ID().String(),
-		Email:     user.Email(),
-		FirstName: user.FirstName(),
-		LastName:  user.LastName(),
+		ID:            user.ID().String(),
+		Email:         user.Email(),
+		EmailVerified: user.EmailVerified(),
+		FirstName:     user.FirstName(),
+		LastName:      user.LastName(),
 	})
 }
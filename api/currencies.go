@@ -0,0 +1,219 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Server) currencies(ctx *gin.Context) {
+	currencies, err := s.activeRecords.Currency().Enabled(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not load enabled currencies")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	res := []CurrencyResponse{}
+	for _, c := range currencies {
+		res = append(res, currencyResponse(c))
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (s *Server) createCurrency(ctx *gin.Context) {
+	var req CreateCurrencyRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	feeSchedules := s.config.DefaultFeeSchedules
+	if req.FeeSchedules != nil {
+		feeSchedules = make(map[activerecord.TransactionKind]activerecord.FeeSchedule, len(req.FeeSchedules))
+		for kind, raw := range req.FeeSchedules {
+			feeSchedules[activerecord.TransactionKind(kind)], err = activerecord.ParseFeeSchedule(raw)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+		}
+	}
+
+	signupBonus := s.config.DefaultSignupBonus
+	if req.SignupBonus != "" {
+		signupBonus, err = decimal.NewFromString(req.SignupBonus)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid signup bonus"})
+			return
+		}
+	}
+
+	var c *activerecord.Currency
+	err = s.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		c, err = tx.Currency().New(req.Symbol, req.Name, req.Precision, feeSchedules, signupBonus, req.ServiceWallet)
+		if err != nil {
+			return err
+		}
+
+		err = c.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		if req.Enabled != nil && !*req.Enabled {
+			return c.SetEnabled(ctx, false)
+		}
+
+		return nil
+	})
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		case activerecord.ConflictError:
+			ctx.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not create currency %s", req.Symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, currencyResponse(c))
+}
+
+func (s *Server) updateCurrency(ctx *gin.Context) {
+	var req UpdateCurrencyRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	symbol := ctx.Param("symbol")
+	c, err := s.activeRecords.Currency().Find(ctx, symbol)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "currency not found"})
+		default:
+			log.WithError(err).Errorf("could not find currency %s", symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if req.Enabled != nil {
+		err = c.SetEnabled(ctx, *req.Enabled)
+		if err != nil {
+			log.WithError(err).Errorf("could not update currency %s", symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ctx.JSON(http.StatusOK, currencyResponse(c))
+}
+
+func (s *Server) setFeeSchedule(ctx *gin.Context) {
+	raw, err := ctx.GetRawData()
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	schedule, err := activerecord.ParseFeeSchedule(raw)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	symbol := ctx.Param("symbol")
+	c, err := s.activeRecords.Currency().Find(ctx, symbol)
+	if err == nil {
+		err = c.SetFeeSchedule(ctx, activerecord.TransactionKind(ctx.Param("kind")), schedule)
+	}
+
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "currency not found"})
+		default:
+			log.WithError(err).Errorf("could not set fee schedule of currency %s", symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, currencyResponse(c))
+}
+
+func (s *Server) feeRevenue(ctx *gin.Context) {
+	var since, until time.Time
+	var err error
+	if v := ctx.Query("since"); v != "" {
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid since"})
+			return
+		}
+	}
+
+	if v := ctx.Query("until"); v != "" {
+		until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid until"})
+			return
+		}
+	}
+
+	revenues, err := s.activeRecords.Currency().FeeRevenue(ctx, since, until)
+	if err != nil {
+		log.WithError(err).Error("could not calculate fee revenue")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	res := []FeeRevenueResponse{}
+	for _, r := range revenues {
+		res = append(res, FeeRevenueResponse{
+			Currency:  r.Currency,
+			FeeWallet: r.FeeWallet,
+			Revenue:   r.Revenue.String(),
+			Count:     r.Count,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func currencyResponse(c *activerecord.Currency) CurrencyResponse {
+	feeSchedules := make(map[string]json.RawMessage)
+	for kind, schedule := range c.FeeSchedules() {
+		feeSchedules[string(kind)] = json.RawMessage(schedule.Policy())
+	}
+
+	return CurrencyResponse{
+		Symbol:        c.Symbol(),
+		Name:          c.Name(),
+		Precision:     c.Precision(),
+		FeeSchedules:  feeSchedules,
+		SignupBonus:   c.SignupBonus().String(),
+		ServiceWallet: c.ServiceWallet(),
+		FeeWallet:     c.FeeWallet(),
+		Enabled:       c.Enabled(),
+	}
+}
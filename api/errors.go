@@ -2,5 +2,18 @@ package api
 
 var (
 	invalidAuthHeader = ErrorResponse{Error: "invalid auth header"}
+	invalidCredentials = ErrorResponse{Error: "invalid email or password"}
+	tooManyLoginAttempts = ErrorResponse{Error: "too many failed sign in attempts, try again later"}
 	invalidToken = ErrorResponse{Error: "invalid token"}
+	sessionRevoked = ErrorResponse{Error: "session is revoked or expired"}
+	apiKeyNotAccepted = ErrorResponse{Error: "API keys are not accepted by this endpoint"}
+	insufficientScope = ErrorResponse{Error: "API key does not have the required scope"}
+	twoFactorNotEnrolled = ErrorResponse{Error: "two-factor authentication is not enrolled"}
+	emailNotVerified = ErrorResponse{Error: "email is not verified"}
+	emailAlreadyVerified = ErrorResponse{Error: "email is already verified"}
+	adminOnly = ErrorResponse{Error: "admin only"}
+	invalidIdempotencyKey = ErrorResponse{Error: "invalid idempotency key"}
+	idempotencyKeyMismatch = ErrorResponse{Error: "idempotency key was used with a different request"}
+	idempotentRequestInProgress = ErrorResponse{Error: "request with this idempotency key is in progress"}
+	signupBonusUnavailable = ErrorResponse{Error: "signup bonuses are temporarily unavailable"}
 )
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotentReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyMiddleware replays the stored response for retries of a request with the same Idempotency-Key header.
+// Keys are scoped by the method, the path and the authenticated user, so it must be called after authMiddleware if any.
+// Server errors and responses which could not be stored release the key, so the request can be retried with it
+func (s *Server) idempotencyMiddleware(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	if len(key) > maxIdempotencyKeyLength {
+		c.AbortWithStatusJSON(http.StatusBadRequest, invalidIdempotencyKey)
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	scope := c.Request.Method + " " + c.Request.URL.Path
+	if _, ok := c.Get("user"); ok {
+		scope += " " + s.getRequestUser(c).ID().String()
+	}
+
+	hash := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(hash[:])
+
+	idempotencyKey, claimed, err := s.activeRecords.IdempotencyKey().Claim(c, scope, key, requestHash, s.config.IdempotencyTTL)
+	if err != nil {
+		log.WithError(err).Error("could not claim idempotency key")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !claimed {
+		switch {
+		case idempotencyKey.RequestHash() != requestHash:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, idempotencyKeyMismatch)
+		case !idempotencyKey.Completed():
+			c.AbortWithStatusJSON(http.StatusConflict, idempotentRequestInProgress)
+		default:
+			c.Header(idempotentReplayHeader, "true")
+			c.Data(idempotencyKey.Status(), idempotencyKey.ContentType(), idempotencyKey.Response())
+			c.Abort()
+		}
+
+		return
+	}
+
+	// A panic of the handler is answered with a server error by the recovery middleware, so the key is released as well
+	defer func() {
+		if p := recover(); p != nil {
+			releaseIdempotencyKey(c, idempotencyKey, key)
+			panic(p)
+		}
+	}()
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	status := recorder.Status()
+	if status >= http.StatusInternalServerError {
+		releaseIdempotencyKey(c, idempotencyKey, key)
+		return
+	}
+
+	err = idempotencyKey.Complete(c, status, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+	if err != nil {
+		// The key would answer retries as in progress until it expires, so it is released and retries repeat the request
+		log.WithError(err).Errorf("could not store response for idempotency key %s", key)
+		releaseIdempotencyKey(c, idempotencyKey, key)
+	}
+}
+
+func releaseIdempotencyKey(c *gin.Context, idempotencyKey *activerecord.IdempotencyKey, key string) {
+	err := idempotencyKey.Release(c)
+	if err != nil {
+		log.WithError(err).Errorf("could not release idempotency key %s", key)
+	}
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
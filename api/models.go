@@ -1,5 +1,11 @@
 package api
 
+import (
+	"encoding/json"
+
+	"github.com/merisho/binaryx-test/activerecord"
+)
+
 type SignupRequest struct {
 	Email string `json:"email"`
 	FirstName string `json:"firstName"`
@@ -26,19 +32,213 @@ type WalletResponse struct{
 	Balance string `json:"balance"`
 }
 
+type WalletBalanceResponse struct {
+	Address  string `json:"address"`
+	Currency string `json:"currency"`
+	Balance  string `json:"balance"`
+	At       int64  `json:"at"`
+}
+
 type TokenRequest struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
+	// OTP is a TOTP code or a recovery code, it is required if the user has enabled two-factor authentication
+	OTP string `json:"otp"`
+}
+
+// TwoFactorChallengeResponse is returned by /token when a one-time password is required
+type TwoFactorChallengeResponse struct {
+	Error     string `json:"error"`
+	Challenge string `json:"challenge"`
 }
 
 type TokenResponse struct {
 	Token string `json:"token"`
 	ExpiresAt int64 `json:"expiresAt"`
+	RefreshToken string `json:"refreshToken"`
+	RefreshExpiresAt int64 `json:"refreshExpiresAt"`
+	SessionID string `json:"sessionId"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type SessionResponse struct {
+	ID        string `json:"id"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Current   bool   `json:"current"`
 }
 
 type IAmResponse struct {
 	ID string `json:"id"`
 	Email string `json:"email"`
+	EmailVerified bool `json:"emailVerified"`
 	FirstName string `json:"firstName"`
 	LastName string `json:"lastName"`
 }
+
+type TransferRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+}
+
+type TransactionResponse struct {
+	ID        string `json:"id"`
+	Currency  string `json:"currency"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	Fee       string `json:"fee"`
+	FeePolicy string `json:"feePolicy"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type TransactionHistoryEntry struct {
+	ID           string `json:"id"`
+	Kind         string `json:"kind"`
+	Direction    string `json:"direction"`
+	Counterparty string `json:"counterparty"`
+	Amount       string `json:"amount"`
+	Fee          string `json:"fee"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+type TransactionHistoryResponse struct {
+	Transactions []TransactionHistoryEntry `json:"transactions"`
+	NextCursor   string                    `json:"nextCursor,omitempty"`
+}
+
+type CurrencyResponse struct {
+	Symbol        string                     `json:"symbol"`
+	Name          string                     `json:"name"`
+	Precision     int32                      `json:"precision"`
+	FeeSchedules  map[string]json.RawMessage `json:"feeSchedules"`
+	SignupBonus   string                     `json:"signupBonus"`
+	ServiceWallet string                     `json:"serviceWallet"`
+	FeeWallet     string                     `json:"feeWallet"`
+	Enabled       bool                       `json:"enabled"`
+}
+
+// CreateCurrencyRequest.FeeSchedules maps transaction kinds (bonus, transfer, internal) to fee schedules, e.g.
+//	{"transfer": {"type": "capped", "schedule": {"type": "percentage", "rate": "0.01"}, "min": "0.1", "max": "10"}}
+type CreateCurrencyRequest struct {
+	Symbol        string                     `json:"symbol"`
+	Name          string                     `json:"name"`
+	Precision     int32                      `json:"precision"`
+	FeeSchedules  map[string]json.RawMessage `json:"feeSchedules"`
+	SignupBonus   string                     `json:"signupBonus"`
+	ServiceWallet string                     `json:"serviceWallet"`
+	Enabled       *bool                      `json:"enabled"`
+}
+
+type UpdateCurrencyRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type FeeRevenueResponse struct {
+	Currency  string `json:"currency"`
+	FeeWallet string `json:"feeWallet"`
+	Revenue   string `json:"revenue"`
+	Count     int64  `json:"count"`
+}
+
+type SupplyChangeRequest struct {
+	Amount string `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type SupplyOperationResponse struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Currency  string `json:"currency"`
+	Amount    string `json:"amount"`
+	Actor     string `json:"actor"`
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type SupplyResponse struct {
+	Currency       string                    `json:"currency"`
+	TreasuryWallet string                    `json:"treasuryWallet"`
+	Treasury       string                    `json:"treasury"`
+	Minted         string                    `json:"minted"`
+	Burned         string                    `json:"burned"`
+	Issued         string                    `json:"issued"`
+	Operations     []SupplyOperationResponse `json:"operations"`
+}
+
+// ReconciliationResponse is the reconciliation report with its violations inlined
+type ReconciliationResponse struct {
+	OK bool `json:"ok"`
+	*activerecord.ReconciliationReport
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is a unix timestamp, keys without it do not expire
+	ExpiresAt int64 `json:"expiresAt"`
+	// AllowedIPs are IPs or CIDRs the key can be used from, any IP if empty
+	AllowedIPs []string `json:"allowedIps"`
+}
+
+// UpdateAPIKeyRequest changes only the present fields, ExpiresAt of 0 makes the key not expire
+type UpdateAPIKeyRequest struct {
+	Name       *string   `json:"name"`
+	Scopes     *[]string `json:"scopes"`
+	ExpiresAt  *int64    `json:"expiresAt"`
+	AllowedIPs *[]string `json:"allowedIps"`
+}
+
+type APIKeyResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	AllowedIPs []string `json:"allowedIps"`
+	CreatedAt  int64    `json:"createdAt"`
+	ExpiresAt  *int64   `json:"expiresAt"`
+	LastUsedAt *int64   `json:"lastUsedAt"`
+}
+
+// CreateAPIKeyResponse is the only response which contains the key itself
+type CreateAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth URI for authenticator apps
+	URI string `json:"uri"`
+}
+
+type TwoFactorConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+// TwoFactorConfirmResponse is the only response which contains the recovery codes
+type TwoFactorConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type TwoFactorDisableRequest struct {
+	Password string `json:"password"`
+	OTP      string `json:"otp"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Server) reconciliation(ctx *gin.Context) {
+	report, err := s.activeRecords.Reconcile(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not reconcile the ledger")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, ReconciliationResponse{
+		OK:                   report.OK(),
+		ReconciliationReport: report,
+	})
+}
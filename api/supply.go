@@ -0,0 +1,127 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *Server) mint(ctx *gin.Context) {
+	s.changeSupply(ctx, activerecord.MintTransaction)
+}
+
+func (s *Server) burn(ctx *gin.Context) {
+	s.changeSupply(ctx, activerecord.BurnTransaction)
+}
+
+func (s *Server) changeSupply(ctx *gin.Context, kind activerecord.TransactionKind) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var req SupplyChangeRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	amount, err := decimal.NewFromString(req.Amount)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid amount"})
+		return
+	}
+
+	symbol := ctx.Param("symbol")
+	c, err := s.activeRecords.Currency().Find(ctx, symbol)
+	var op *activerecord.SupplyOperation
+	if err == nil {
+		if kind == activerecord.MintTransaction {
+			op, err = s.activeRecords.Treasury().Mint(ctx, c, amount, user.ID(), req.Reason)
+		} else {
+			op, err = s.activeRecords.Treasury().Burn(ctx, c, amount, user.ID(), req.Reason)
+		}
+	}
+
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ValidationError:
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "currency not found"})
+		case activerecord.InsufficientFundsError:
+			ctx.AbortWithStatusJSON(http.StatusPaymentRequired, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not %s currency %s", kind, symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	log.WithField("actor", user.ID().String()).Infof("%s %s %s: %s", kind, op.Amount.String(), op.Currency, op.Reason)
+	ctx.JSON(http.StatusCreated, supplyOperationResponse(op))
+}
+
+func (s *Server) supply(ctx *gin.Context) {
+	symbol := ctx.Param("symbol")
+	c, err := s.activeRecords.Currency().Find(ctx, symbol)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.NotFoundError:
+			ctx.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "currency not found"})
+		default:
+			log.WithError(err).Errorf("could not find currency %s", symbol)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	treasury := s.activeRecords.Treasury()
+	supply, err := treasury.Supply(ctx, c)
+	if err != nil {
+		log.WithError(err).Errorf("could not calculate supply of currency %s", symbol)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ops, err := treasury.FindOperations(ctx, c)
+	if err != nil {
+		log.WithError(err).Errorf("could not load supply operations of currency %s", symbol)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	res := SupplyResponse{
+		Currency:       supply.Currency,
+		TreasuryWallet: c.ServiceWallet(),
+		Treasury:       supply.Treasury.String(),
+		Minted:         supply.Minted.String(),
+		Burned:         supply.Burned.String(),
+		Issued:         supply.Issued.String(),
+		Operations:     []SupplyOperationResponse{},
+	}
+	for _, op := range ops {
+		res.Operations = append(res.Operations, supplyOperationResponse(op))
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func supplyOperationResponse(op *activerecord.SupplyOperation) SupplyOperationResponse {
+	return SupplyOperationResponse{
+		ID:        op.ID.String(),
+		Kind:      string(op.Kind),
+		Currency:  op.Currency,
+		Amount:    op.Amount.String(),
+		Actor:     op.Actor.String(),
+		Reason:    op.Reason,
+		Timestamp: op.CreatedAt.Unix(),
+	}
+}
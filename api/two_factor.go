@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (s *Server) enrollTwoFactor(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	twoFactor, err := s.activeRecords.TwoFactor().Enroll(ctx, user.ID(), s.config.Clock())
+	if err != nil {
+		switch err.(type) {
+		case activerecord.ConflictError:
+			ctx.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not enroll second factor of user %s", user.ID())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, TwoFactorEnrollResponse{
+		Secret: twoFactor.Secret(),
+		URI:    activerecord.TOTPProvisioningURI(twoFactor.Secret(), user.Email()),
+	})
+}
+
+func (s *Server) confirmTwoFactor(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var req TwoFactorConfirmRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	// Wrong codes count as failed sign in attempts, so an access token does not allow guessing them
+	now := s.config.Clock()
+	if s.throttled(ctx, user.Email(), now) {
+		return
+	}
+
+	twoFactor, err := s.findTwoFactor(ctx, user.ID())
+	if err != nil {
+		log.WithError(err).Errorf("could not find second factor of user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if twoFactor == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, twoFactorNotEnrolled)
+		return
+	}
+
+	codes, err := twoFactor.Confirm(ctx, req.Code, now)
+	if err != nil {
+		switch err.(type) {
+		case activerecord.UnauthorizedError:
+			s.loginFailed(ctx, user, user.Email(), now)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		case activerecord.ConflictError:
+			ctx.AbortWithStatusJSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not confirm second factor of user %s", user.ID())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, TwoFactorConfirmResponse{RecoveryCodes: codes})
+}
+
+// disableTwoFactor requires the password and a one-time password, so a stolen access token is not enough to turn 2FA off.
+// Wrong ones count as failed sign in attempts, so they cannot be guessed either
+func (s *Server) disableTwoFactor(ctx *gin.Context) {
+	user := s.getRequestUser(ctx)
+	if user == nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var req TwoFactorDisableRequest
+	err := ctx.ShouldBindJSON(&req)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	now := s.config.Clock()
+	if s.throttled(ctx, user.Email(), now) {
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password()), []byte(req.Password))
+	if err != nil {
+		s.loginFailed(ctx, user, user.Email(), now)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "invalid password"})
+		return
+	}
+
+	twoFactor, err := s.findTwoFactor(ctx, user.ID())
+	if err != nil {
+		log.WithError(err).Errorf("could not find second factor of user %s", user.ID())
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if twoFactor == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, twoFactorNotEnrolled)
+		return
+	}
+
+	// A factor which has not been confirmed does not protect anything yet, so only the password is required to drop it
+	if twoFactor.Enabled() {
+		err = twoFactor.Verify(ctx, req.OTP, now)
+	}
+
+	if err == nil {
+		err = twoFactor.Disable(ctx)
+	}
+
+	if err != nil {
+		switch err.(type) {
+		case activerecord.UnauthorizedError:
+			s.loginFailed(ctx, user, user.Email(), now)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		default:
+			log.WithError(err).Errorf("could not disable second factor of user %s", user.ID())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// findTwoFactor returns nil if the user has not enrolled a second factor
+func (s *Server) findTwoFactor(ctx context.Context, userID uuid.UUID) (*activerecord.TwoFactor, error) {
+	twoFactor, err := s.activeRecords.TwoFactor().Find(ctx, userID)
+	if err != nil {
+		if _, ok := err.(activerecord.NotFoundError); ok {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return twoFactor, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Worker is a background job which runs along with the server, Run must return soon after ctx is cancelled
+type Worker interface {
+	Run(ctx context.Context)
+}
+
+// NewPeriodicWorker creates a worker which runs the job right after the start and then every interval.
+// Errors are logged and the job runs again on the next tick
+func NewPeriodicWorker(name string, interval time.Duration, job func(ctx context.Context) error) *PeriodicWorker {
+	return &PeriodicWorker{
+		name:     name,
+		interval: interval,
+		job:      job,
+	}
+}
+
+type PeriodicWorker struct {
+	name     string
+	interval time.Duration
+	job      func(ctx context.Context) error
+}
+
+func (w *PeriodicWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		err := w.job(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Errorf("%s failed", w.name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
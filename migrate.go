@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/merisho/binaryx-test/migrations"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrate runs fakecoins migrate up|down [N]|status|version, down reverts one migration by default
+func migrate(ctx context.Context, migrator *migrations.Migrator, args []string) int {
+	if len(args) == 0 {
+		log.Error("missing migrate command, available commands: up, down, status, version")
+		return exitFailure
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Infof("applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.WithError(err).Error("could not apply migrations")
+			return exitFailure
+		}
+
+		if len(applied) == 0 {
+			log.Info("no migrations to apply")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Errorf("invalid number of migrations to revert %s", args[1])
+				return exitFailure
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			log.Infof("reverted %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.WithError(err).Error("could not revert migrations")
+			return exitFailure
+		}
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			log.WithError(err).Error("could not get migration status")
+			return exitFailure
+		}
+
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	case "version":
+		version, dirty, err := migrator.Version(ctx)
+		if err != nil {
+			log.WithError(err).Error("could not get schema version")
+			return exitFailure
+		}
+
+		if dirty {
+			fmt.Printf("%d (dirty)\n", version)
+			return exitFailure
+		}
+
+		fmt.Println(version)
+	default:
+		log.Errorf("unknown migrate command %s, available commands: up, down, status, version", args[0])
+		return exitFailure
+	}
+
+	return 0
+}
+
+// checkSchema fails if there are migrations to apply, unless autoMigrate applies them
+func checkSchema(ctx context.Context, migrator *migrations.Migrator, autoMigrate bool) error {
+	err := migrator.Check(ctx)
+	if _, behind := err.(migrations.ErrSchemaBehind); !behind || !autoMigrate {
+		return err
+	}
+
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		log.Infof("applied %04d_%s", m.Version, m.Name)
+	}
+
+	return err
+}
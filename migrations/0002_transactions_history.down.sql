@@ -0,0 +1 @@
+DROP INDEX IF EXISTS transactions_timestamp_id_index;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS transactions_timestamp_id_index ON transactions (timestamp DESC, id DESC);
@@ -0,0 +1,18 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS wallet_balances (
+    wallet TEXT PRIMARY KEY,
+    currency VARCHAR(16),
+    balance NUMERIC NOT NULL DEFAULT 0
+);
+
+INSERT INTO wallet_balances (wallet, currency, balance)
+SELECT wallet, currency, SUM(delta) FROM (
+    SELECT to_wallet AS wallet, currency, amount::numeric AS delta FROM transactions
+    UNION ALL
+    SELECT from_wallet AS wallet, currency, -(amount::numeric + fee::numeric) AS delta FROM transactions
+) AS deltas
+GROUP BY wallet, currency
+ON CONFLICT (wallet) DO NOTHING;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+ALTER TABLE transactions
+    DROP CONSTRAINT IF EXISTS transactions_amount_positive,
+    DROP CONSTRAINT IF EXISTS transactions_fee_not_negative,
+    ALTER COLUMN fee DROP DEFAULT,
+    ALTER COLUMN amount DROP NOT NULL,
+    ALTER COLUMN fee DROP NOT NULL,
+    ALTER COLUMN amount TYPE TEXT USING amount::text,
+    ALTER COLUMN fee TYPE TEXT USING fee::text;
+
+COMMIT;
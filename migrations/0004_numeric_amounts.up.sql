@@ -0,0 +1,14 @@
+BEGIN;
+
+UPDATE transactions SET fee='0' WHERE fee IS NULL OR fee='';
+
+ALTER TABLE transactions
+    ALTER COLUMN amount TYPE NUMERIC USING amount::numeric,
+    ALTER COLUMN fee TYPE NUMERIC USING fee::numeric,
+    ALTER COLUMN amount SET NOT NULL,
+    ALTER COLUMN fee SET NOT NULL,
+    ALTER COLUMN fee SET DEFAULT 0,
+    ADD CONSTRAINT transactions_amount_positive CHECK (amount > 0),
+    ADD CONSTRAINT transactions_fee_not_negative CHECK (fee >= 0);
+
+COMMIT;
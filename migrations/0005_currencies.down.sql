@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE users DROP COLUMN IF EXISTS is_admin;
+ALTER TABLE user_wallets DROP CONSTRAINT IF EXISTS user_wallets_currency_fkey;
+DROP TABLE IF EXISTS currencies;
+
+COMMIT;
@@ -0,0 +1,23 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS currencies (
+    symbol VARCHAR(16) PRIMARY KEY,
+    name TEXT NOT NULL,
+    decimals INT NOT NULL CHECK (decimals >= 0 AND decimals <= 18),
+    fee_rate NUMERIC NOT NULL CHECK (fee_rate >= 0 AND fee_rate <= 1),
+    signup_bonus NUMERIC NOT NULL DEFAULT 0 CHECK (signup_bonus >= 0),
+    service_wallet TEXT NOT NULL UNIQUE,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+INSERT INTO currencies (symbol, name, decimals, fee_rate, signup_bonus, service_wallet) VALUES
+    ('fBTC', 'Fake Bitcoin', 8, 0.2, 100, '0000000000000000000000000000000000000000000000000000000000000000'),
+    ('fETH', 'Fake Ether', 18, 0.2, 100, '1111111111111111111111111111111111111111111111111111111111111111')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE user_wallets
+    ADD CONSTRAINT user_wallets_currency_fkey FOREIGN KEY (currency) REFERENCES currencies (symbol);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMIT;
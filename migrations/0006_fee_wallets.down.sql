@@ -0,0 +1,13 @@
+BEGIN;
+
+DELETE FROM wallet_balances WHERE wallet IN (SELECT fee_wallet FROM currencies);
+DELETE FROM user_wallets WHERE wallet IN (SELECT fee_wallet FROM currencies);
+DELETE FROM transactions WHERE kind='fee';
+
+ALTER TABLE transactions
+    DROP COLUMN IF EXISTS parent_id,
+    DROP COLUMN IF EXISTS kind;
+
+ALTER TABLE currencies DROP COLUMN IF EXISTS fee_wallet;
+
+COMMIT;
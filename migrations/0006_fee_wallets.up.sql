@@ -0,0 +1,30 @@
+BEGIN;
+
+ALTER TABLE currencies ADD COLUMN IF NOT EXISTS fee_wallet TEXT UNIQUE;
+UPDATE currencies SET fee_wallet=encode(sha256(('fee-' || symbol)::bytea), 'hex') WHERE fee_wallet IS NULL;
+ALTER TABLE currencies ALTER COLUMN fee_wallet SET NOT NULL;
+
+-- Fee wallets are owned by the system user with nil UUID
+INSERT INTO user_wallets (user_id, wallet, currency)
+SELECT '00000000-0000-0000-0000-000000000000', fee_wallet, symbol FROM currencies
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE transactions
+    ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'transfer',
+    ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES transactions (id);
+CREATE INDEX IF NOT EXISTS transactions_parent_index ON transactions (parent_id);
+
+-- Fees of the existing transactions were credited to nobody, credit them to the fee wallets
+INSERT INTO transactions (id, kind, parent_id, currency, from_wallet, to_wallet, amount, fee, timestamp)
+SELECT gen_random_uuid(), 'fee', t.id, t.currency, t.from_wallet, c.fee_wallet, t.fee, 0, t.timestamp
+FROM transactions t
+JOIN currencies c ON c.symbol=t.currency
+WHERE t.kind='transfer' AND t.fee > 0;
+
+INSERT INTO wallet_balances (wallet, currency, balance)
+SELECT to_wallet, currency, SUM(amount) FROM transactions
+WHERE kind='fee'
+GROUP BY to_wallet, currency
+ON CONFLICT (wallet) DO UPDATE SET balance=wallet_balances.balance+EXCLUDED.balance;
+
+COMMIT;
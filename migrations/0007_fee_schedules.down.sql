@@ -0,0 +1,13 @@
+BEGIN;
+
+ALTER TABLE currencies ADD COLUMN IF NOT EXISTS fee_rate NUMERIC NOT NULL DEFAULT 0.2 CHECK (fee_rate >= 0 AND fee_rate <= 1);
+
+UPDATE currencies c SET fee_rate=(f.schedule->>'rate')::numeric
+FROM fee_schedules f
+WHERE f.currency=c.symbol AND f.kind='transfer' AND f.schedule->>'type'='percentage';
+
+UPDATE transactions SET kind='transfer' WHERE kind IN ('bonus', 'internal');
+ALTER TABLE transactions DROP COLUMN IF EXISTS fee_policy;
+DROP TABLE IF EXISTS fee_schedules;
+
+COMMIT;
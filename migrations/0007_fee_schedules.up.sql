@@ -0,0 +1,27 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS fee_schedules (
+    currency VARCHAR(16) REFERENCES currencies (symbol),
+    kind VARCHAR(16) CHECK (kind IN ('bonus', 'transfer', 'internal')),
+    schedule JSONB NOT NULL,
+    PRIMARY KEY (currency, kind)
+);
+
+INSERT INTO fee_schedules (currency, kind, schedule)
+SELECT symbol, 'transfer', ('{"type":"percentage","rate":"' || fee_rate::text || '"}')::jsonb FROM currencies
+UNION ALL
+SELECT symbol, 'bonus', '{"type":"flat","amount":"0"}'::jsonb FROM currencies
+UNION ALL
+SELECT symbol, 'internal', '{"type":"flat","amount":"0"}'::jsonb FROM currencies
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fee_policy TEXT NOT NULL DEFAULT '';
+
+-- All the existing transfers and bonuses were charged by the currency fee rate
+UPDATE transactions t SET fee_policy='{"type":"percentage","rate":"' || c.fee_rate::text || '"}'
+FROM currencies c
+WHERE c.symbol=t.currency AND t.kind='transfer';
+
+ALTER TABLE currencies DROP COLUMN IF EXISTS fee_rate;
+
+COMMIT;
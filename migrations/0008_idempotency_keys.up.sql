@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope TEXT,
+    key TEXT,
+    request_hash TEXT NOT NULL,
+    status INT,
+    content_type TEXT,
+    response BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_index ON idempotency_keys (expires_at);
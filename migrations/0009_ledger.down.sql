@@ -0,0 +1,19 @@
+BEGIN;
+
+DROP TRIGGER IF EXISTS postings_balanced ON postings;
+DROP FUNCTION IF EXISTS check_journal_entry_balanced();
+
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES transactions (id);
+CREATE INDEX IF NOT EXISTS transactions_parent_index ON transactions (parent_id);
+
+-- Fee postings of transactions become fee transactions again
+INSERT INTO transactions (id, kind, parent_id, currency, from_wallet, to_wallet, amount, fee, timestamp)
+SELECT gen_random_uuid(), 'fee', t.id, t.currency, t.from_wallet, p.wallet, p.amount, 0, t.timestamp
+FROM transactions t
+JOIN currencies c ON c.symbol=t.currency
+JOIN postings p ON p.entry_id=t.id AND p.wallet=c.fee_wallet AND p.amount > 0;
+
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
+
+COMMIT;
@@ -0,0 +1,66 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id UUID PRIMARY KEY,
+    kind VARCHAR(16) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id UUID NOT NULL REFERENCES journal_entries (id),
+    wallet TEXT NOT NULL,
+    currency VARCHAR(16) NOT NULL,
+    amount NUMERIC NOT NULL CHECK (amount <> 0),
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS postings_wallet_index ON postings (wallet, id);
+CREATE INDEX IF NOT EXISTS postings_entry_index ON postings (entry_id);
+
+-- Every transaction becomes a journal entry with the same id, fee transactions become fee postings of their parents
+INSERT INTO journal_entries (id, kind, created_at)
+SELECT id, kind, timestamp FROM transactions WHERE kind<>'fee';
+
+INSERT INTO postings (entry_id, wallet, currency, amount, created_at)
+SELECT entry_id, wallet, currency, amount, created_at FROM (
+    SELECT id AS entry_id, from_wallet AS wallet, currency, -(amount + fee) AS amount, timestamp AS created_at, 0 AS leg
+    FROM transactions WHERE kind<>'fee'
+    UNION ALL
+    SELECT id, to_wallet, currency, amount, timestamp, 1 FROM transactions WHERE kind<>'fee'
+    UNION ALL
+    SELECT parent_id, to_wallet, currency, amount, timestamp, 2 FROM transactions WHERE kind='fee' AND amount > 0
+) AS legs
+WHERE amount <> 0
+ORDER BY created_at, entry_id, leg;
+
+DELETE FROM transactions WHERE kind='fee';
+DROP INDEX IF EXISTS transactions_parent_index;
+ALTER TABLE transactions DROP COLUMN IF EXISTS parent_id;
+
+-- Balances are the sums of postings from now on
+DELETE FROM wallet_balances;
+INSERT INTO wallet_balances (wallet, currency, balance)
+SELECT wallet, currency, SUM(amount) FROM postings
+GROUP BY wallet, currency;
+
+-- Postings of every journal entry must sum up to zero per currency, checked at commit
+CREATE OR REPLACE FUNCTION check_journal_entry_balanced() RETURNS TRIGGER AS $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM postings WHERE entry_id=NEW.entry_id
+        GROUP BY currency HAVING SUM(amount) <> 0
+    ) THEN
+        RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id;
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER postings_balanced
+    AFTER INSERT OR UPDATE ON postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE PROCEDURE check_journal_entry_balanced();
+
+COMMIT;
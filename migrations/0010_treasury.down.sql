@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Supply operations are dropped from the audit but their postings stay in the ledger, so balances do not change
+DROP TABLE IF EXISTS supply_operations;
+
+DELETE FROM user_wallets WHERE wallet IN (SELECT issuance_wallet FROM currencies);
+DELETE FROM user_wallets WHERE wallet IN (SELECT service_wallet FROM currencies)
+    AND user_id='00000000-0000-0000-0000-000000000000';
+
+ALTER TABLE currencies DROP COLUMN IF EXISTS issuance_wallet;
+
+COMMIT;
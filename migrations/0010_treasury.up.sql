@@ -0,0 +1,50 @@
+BEGIN;
+
+ALTER TABLE currencies ADD COLUMN IF NOT EXISTS issuance_wallet TEXT UNIQUE;
+UPDATE currencies SET issuance_wallet=encode(sha256(('issuance-' || symbol)::bytea), 'hex') WHERE issuance_wallet IS NULL;
+ALTER TABLE currencies ALTER COLUMN issuance_wallet SET NOT NULL;
+
+-- Treasury and issuance wallets are owned by the system user with nil UUID like fee wallets
+INSERT INTO user_wallets (user_id, wallet, currency)
+SELECT '00000000-0000-0000-0000-000000000000', service_wallet, symbol FROM currencies
+UNION ALL
+SELECT '00000000-0000-0000-0000-000000000000', issuance_wallet, symbol FROM currencies
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS supply_operations (
+    id UUID PRIMARY KEY REFERENCES journal_entries (id),
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('mint', 'burn')),
+    currency VARCHAR(16) NOT NULL REFERENCES currencies (symbol),
+    amount NUMERIC NOT NULL CHECK (amount > 0),
+    actor UUID NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS supply_operations_currency_index ON supply_operations (currency, created_at);
+
+-- Treasuries paid signup bonuses without having any funds and went negative.
+-- The genesis mint covers what they have paid and gives them an initial supply of 1000000 coins
+CREATE TEMPORARY TABLE genesis ON COMMIT DROP AS
+SELECT gen_random_uuid() AS id, c.symbol, c.service_wallet, c.issuance_wallet,
+    GREATEST(-COALESCE(b.balance, 0), 0) + 1000000 AS amount
+FROM currencies c
+LEFT JOIN wallet_balances b ON b.wallet=c.service_wallet;
+
+INSERT INTO journal_entries (id, kind, description, created_at)
+SELECT id, 'mint', 'genesis', NOW() FROM genesis;
+
+INSERT INTO postings (entry_id, wallet, currency, amount, created_at)
+SELECT id, issuance_wallet, symbol, -amount, NOW() FROM genesis
+UNION ALL
+SELECT id, service_wallet, symbol, amount, NOW() FROM genesis;
+
+INSERT INTO supply_operations (id, kind, currency, amount, actor, reason, created_at)
+SELECT id, 'mint', symbol, amount, '00000000-0000-0000-0000-000000000000', 'genesis', NOW() FROM genesis;
+
+INSERT INTO wallet_balances (wallet, currency, balance)
+SELECT issuance_wallet, symbol, -amount FROM genesis
+UNION ALL
+SELECT service_wallet, symbol, amount FROM genesis
+ON CONFLICT (wallet) DO UPDATE SET balance=wallet_balances.balance+EXCLUDED.balance;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP TABLE IF EXISTS balance_snapshot_days;
+DROP TABLE IF EXISTS balance_snapshots;
+DROP INDEX IF EXISTS postings_created_at_index;
+DROP INDEX IF EXISTS postings_wallet_created_at_index;
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE INDEX IF NOT EXISTS postings_wallet_created_at_index ON postings (wallet, created_at);
+CREATE INDEX IF NOT EXISTS postings_created_at_index ON postings (created_at);
+
+-- End-of-day balances, a wallet has a snapshot only for the days it has postings on
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    wallet TEXT,
+    day DATE,
+    balance NUMERIC NOT NULL,
+    PRIMARY KEY (wallet, day)
+);
+
+-- Days which have already been snapshotted
+CREATE TABLE IF NOT EXISTS balance_snapshot_days (
+    day DATE PRIMARY KEY
+);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+
+COMMIT;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    algorithm VARCHAR(16) NOT NULL,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    retired_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
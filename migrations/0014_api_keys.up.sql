@@ -0,0 +1,19 @@
+BEGIN;
+
+-- Only hashes of API keys are stored, prefix is the beginning of the key shown to tell keys apart
+CREATE TABLE IF NOT EXISTS api_keys (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id),
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    -- An empty allowlist allows any IP
+    allowed_ips TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_index ON api_keys (user_id);
+
+COMMIT;
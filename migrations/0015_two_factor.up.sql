@@ -0,0 +1,20 @@
+BEGIN;
+
+-- The TOTP secret is kept as is because codes are computed from it, confirmed_at is set when the factor is enabled
+CREATE TABLE IF NOT EXISTS two_factors (
+    user_id UUID PRIMARY KEY REFERENCES users (id),
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- Only hashes of recovery codes are stored, each of them can be used once
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id),
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_user_index ON recovery_codes (user_id);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_throttles;
+
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+
+-- Failed sign in attempts by key, which is an account email or a client IP
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    blocked_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id UUID PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    user_id UUID REFERENCES users (id),
+    subject TEXT NOT NULL,
+    actor UUID REFERENCES users (id),
+    ip TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_user_index ON audit_events (user_id, created_at);
+
+COMMIT;
@@ -0,0 +1 @@
+-- Original spelling of normalized emails is not kept, so there is nothing to revert
@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Emails are stored trimmed and lowercased and looked up the same way. An account whose email collides with another one
+-- after normalization could not sign in anymore, so the migration fails listing such accounts.
+-- They have to be merged or given distinct emails by hand before the migration is applied again
+DO $$
+DECLARE
+    conflicts TEXT;
+BEGIN
+    SELECT string_agg(format('%s (%s)', u.email, u.id), ', ' ORDER BY lower(trim(u.email)), u.email) INTO conflicts
+    FROM users u
+    WHERE EXISTS (SELECT 1 FROM users o WHERE o.id <> u.id AND lower(trim(o.email)) = lower(trim(u.email)));
+
+    IF conflicts IS NOT NULL THEN
+        RAISE EXCEPTION 'emails of these users collide after normalization: %', conflicts
+            USING HINT = 'merge the accounts or change their emails, then fix schema_migrations and migrate again';
+    END IF;
+END
+$$;
+
+UPDATE users SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+
+COMMIT;
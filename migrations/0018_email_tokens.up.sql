@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP;
+-- Users who signed up before verification was introduced keep access to their funds
+UPDATE users SET email_verified_at = NOW() WHERE email_verified_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users (id),
+    purpose VARCHAR(16) NOT NULL CHECK (purpose IN ('verify_email', 'reset_password')),
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS email_tokens_user_index ON email_tokens (user_id);
+
+COMMIT;
@@ -0,0 +1,323 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// sqliteFiles are the migrations of SQLite, they start from the schema the Postgres migrations have arrived at
+//
+//go:embed sqlite/*.sql
+var sqliteFiles embed.FS
+
+// Migration is a pair of up and down SQL files, e.g. 0001_init.up.sql and 0001_init.down.sql
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells if the migration is applied to the DB
+type MigrationStatus struct {
+	Migration
+	Applied bool
+}
+
+// ErrSchemaBehind means that the DB misses some of the embedded migrations
+type ErrSchemaBehind struct {
+	Version uint
+	Latest  uint
+}
+
+func (e ErrSchemaBehind) Error() string {
+	return fmt.Sprintf("DB schema version %d is behind %d, run fakecoins migrate up", e.Version, e.Latest)
+}
+
+// ErrDirty means that a migration has failed in the middle, the schema has to be fixed by hand
+type ErrDirty struct {
+	Version uint
+}
+
+func (e ErrDirty) Error() string {
+	return fmt.Sprintf("migration %d has failed and left the DB dirty, fix the schema and set the version in schema_migrations by hand", e.Version)
+}
+
+// All returns the embedded Postgres migrations ordered by version
+func All() ([]Migration, error) {
+	return load(files)
+}
+
+// AllSQLite returns the embedded SQLite migrations ordered by version
+func AllSQLite() ([]Migration, error) {
+	dir, err := fs.Sub(sqliteFiles, "sqlite")
+	if err != nil {
+		return nil, err
+	}
+
+	return load(dir)
+}
+
+func load(dir fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		i := strings.Index(base, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migration file %s does not start with a version", name)
+		}
+
+		version, err := strconv.ParseUint(base[:i], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid version of migration file %s", name)
+		}
+
+		sql, err := fs.ReadFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &Migration{Version: uint(version), Name: base[i+1:]}
+			byVersion[uint(version)] = m
+		}
+
+		if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.Name, base[i+1:])
+		}
+
+		if direction == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both up and down files", m.Version)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// New creates a migrator of the embedded Postgres migrations.
+// The version is kept in schema_migrations, the same table golang-migrate uses, so DBs migrated by it can be migrated further
+func New(db *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         postgresDB{pool: db},
+		migrations: migrations,
+	}, nil
+}
+
+// NewSQLite creates a migrator of the embedded SQLite migrations, the version is kept in schema_migrations as well
+func NewSQLite(db *sql.DB) (*Migrator, error) {
+	migrations, err := AllSQLite()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         sqliteDB{db: db},
+		migrations: migrations,
+	}, nil
+}
+
+// database is a DB the migrations are applied to
+type database interface {
+	// version returns the version and the dirty flag of schema_migrations, zero if the table is empty or missing
+	version(ctx context.Context) (uint, bool, error)
+	// locked calls f with a connection which keeps other instances from migrating until f returns.
+	// schema_migrations exists when f is called
+	locked(ctx context.Context, f func(conn migrationConn) error) error
+}
+
+type migrationConn interface {
+	version(ctx context.Context) (uint, bool, error)
+	// exec runs the statements of a migration file
+	exec(ctx context.Context, sql string) error
+	setVersion(ctx context.Context, version uint, dirty bool) error
+}
+
+type Migrator struct {
+	db         database
+	migrations []Migration
+}
+
+// Latest returns the version of the newest embedded migration
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the current schema version, zero if nothing has been applied, and whether the last migration has failed
+func (m *Migrator) Version(ctx context.Context) (uint, bool, error) {
+	return m.db.version(ctx)
+}
+
+// Status returns every embedded migration and whether it is applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status = append(status, MigrationStatus{
+			Migration: migration,
+			Applied:   migration.Version <= version,
+		})
+	}
+
+	return status, nil
+}
+
+// Check returns ErrSchemaBehind if there are migrations to apply and ErrDirty if a migration has failed.
+// A schema ahead of the embedded migrations is accepted, so an older binary keeps working during a rollout
+func (m *Migrator) Check(ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return ErrDirty{Version: version}
+	}
+
+	if version < m.Latest() {
+		return ErrSchemaBehind{Version: version, Latest: m.Latest()}
+	}
+
+	return nil
+}
+
+// Up applies all migrations which are not applied yet and returns them
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func(conn migrationConn, version uint) error {
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+
+			err := run(ctx, conn, migration.Up, migration.Version, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the last steps migrations and returns them, the latest first
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func(conn migrationConn, version uint) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+
+			var previous uint
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+
+			err := run(ctx, conn, migration.Down, migration.Version, previous)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+
+			reverted = append(reverted, migration)
+		}
+
+		return nil
+	})
+
+	return reverted, err
+}
+
+// locked calls f with a connection which holds the lock of the migrations and the current version.
+// Dirty DBs are not migrated
+func (m *Migrator) locked(ctx context.Context, f func(conn migrationConn, version uint) error) error {
+	return m.db.locked(ctx, func(conn migrationConn) error {
+		// The version is read after the lock is taken, another instance might have migrated the DB while it was waited for
+		version, dirty, err := conn.version(ctx)
+		if err != nil {
+			return err
+		}
+
+		if dirty {
+			return ErrDirty{Version: version}
+		}
+
+		return f(conn, version)
+	})
+}
+
+// run marks the DB dirty with the version of the migration, executes the SQL and sets the resulting version.
+// If the SQL fails, the DB stays dirty
+func run(ctx context.Context, conn migrationConn, sql string, version, result uint) error {
+	err := conn.setVersion(ctx, version, true)
+	if err != nil {
+		return err
+	}
+
+	err = conn.exec(ctx, sql)
+	if err != nil {
+		return err
+	}
+
+	return conn.setVersion(ctx, result, false)
+}
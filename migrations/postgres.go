@@ -0,0 +1,113 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const undefinedTable = "42P01"
+
+// lockID is the key of the advisory lock held while migrating, so concurrent instances do not migrate at the same time
+const lockID = 7261726536110424
+
+// minServerVersion is the server_version_num of Postgres 13, the first one with built-in gen_random_uuid() used by migrations
+const minServerVersion = 130000
+
+type postgresDB struct {
+	pool *pgxpool.Pool
+}
+
+func (d postgresDB) version(ctx context.Context) (uint, bool, error) {
+	return postgresVersion(ctx, d.pool)
+}
+
+func (d postgresDB) locked(ctx context.Context, f func(conn migrationConn) error) error {
+	conn, err := d.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// An older server would fail in the middle of the migrations and leave the version dirty
+	var serverVersion int
+	err = conn.QueryRow(ctx, `SELECT current_setting('server_version_num')::int`).Scan(&serverVersion)
+	if err != nil {
+		return err
+	}
+
+	if serverVersion < minServerVersion {
+		return fmt.Errorf("migrations require Postgres 13 or newer, the server version is %d", serverVersion)
+	}
+
+	// Session advisory locks belong to the connection, so the lock is taken and released on the same one
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	return f(postgresConn{conn: conn})
+}
+
+func postgresVersion(ctx context.Context, db interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}) (uint, bool, error) {
+	var version uint
+	var dirty bool
+	err := db.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		if e, ok := err.(*pgconn.PgError); errors.Is(err, pgx.ErrNoRows) || ok && e.Code == undefinedTable {
+			return 0, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	return version, dirty, nil
+}
+
+type postgresConn struct {
+	conn *pgxpool.Conn
+}
+
+func (c postgresConn) version(ctx context.Context) (uint, bool, error) {
+	return postgresVersion(ctx, c.conn)
+}
+
+// exec sends the SQL without arguments by the simple protocol, which allows many statements in one file
+func (c postgresConn) exec(ctx context.Context, sql string) error {
+	_, err := c.conn.Exec(ctx, sql)
+	return err
+}
+
+func (c postgresConn) setVersion(ctx context.Context, version uint, dirty bool) error {
+	tx, err := c.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 || dirty {
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations(version, dirty) VALUES($1, $2)`, version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
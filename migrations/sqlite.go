@@ -0,0 +1,101 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+)
+
+// sqliteDB has no advisory locks, BEGIN IMMEDIATE takes the write lock of the DB file instead.
+// DDL of SQLite is transactional, so all the migrations of a run are applied in that DB transaction,
+// a failed migration rolls the run back instead of leaving the DB dirty
+type sqliteDB struct {
+	db *sql.DB
+}
+
+func (d sqliteDB) version(ctx context.Context) (uint, bool, error) {
+	return sqliteVersion(ctx, d.db)
+}
+
+func (d sqliteDB) locked(ctx context.Context, f func(conn migrationConn) error) error {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `BEGIN IMMEDIATE`)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(context.Background(), `ROLLBACK`)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	err = f(sqliteConn{conn: conn})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	if err != nil {
+		return err
+	}
+
+	committed = true
+	return nil
+}
+
+func sqliteVersion(ctx context.Context, db interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}) (uint, bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type='table' AND name='schema_migrations')`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version uint
+	var dirty bool
+	err = db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+
+	return version, dirty, err
+}
+
+type sqliteConn struct {
+	conn *sql.Conn
+}
+
+func (c sqliteConn) version(ctx context.Context) (uint, bool, error) {
+	return sqliteVersion(ctx, c.conn)
+}
+
+// exec runs every statement of the SQL, the statements must not begin or commit DB transactions
+func (c sqliteConn) exec(ctx context.Context, sql string) error {
+	_, err := c.conn.ExecContext(ctx, sql)
+	return err
+}
+
+func (c sqliteConn) setVersion(ctx context.Context, version uint, dirty bool) error {
+	_, err := c.conn.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version > 0 || dirty {
+		_, err = c.conn.ExecContext(ctx, `INSERT INTO schema_migrations(version, dirty) VALUES($1, $2)`, version, dirty)
+	}
+
+	return err
+}
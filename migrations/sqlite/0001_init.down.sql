@@ -0,0 +1,21 @@
+DROP TABLE IF EXISTS email_tokens;
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_throttles;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS two_factors;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS balance_snapshot_days;
+DROP TABLE IF EXISTS balance_snapshots;
+DROP TABLE IF EXISTS supply_operations;
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS wallet_balances;
+DROP TABLE IF EXISTS user_wallets;
+DROP TABLE IF EXISTS fee_schedules;
+DROP TABLE IF EXISTS currencies;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,253 @@
+-- The schema of the Postgres migrations up to 0018_email_tokens for a new DB.
+-- Amounts are kept as decimal strings and summed up by the decimal functions of activerecord,
+-- timestamps are UTC strings which sort in time order, UUIDs and arrays are kept as text
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    email TEXT UNIQUE,
+    password TEXT,
+    first_name TEXT,
+    last_name TEXT,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    email_verified_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS currencies (
+    symbol TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    decimals INTEGER NOT NULL CHECK (decimals >= 0 AND decimals <= 18),
+    signup_bonus TEXT NOT NULL DEFAULT '0',
+    service_wallet TEXT NOT NULL UNIQUE,
+    fee_wallet TEXT NOT NULL UNIQUE,
+    issuance_wallet TEXT NOT NULL UNIQUE,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE IF NOT EXISTS fee_schedules (
+    currency TEXT REFERENCES currencies (symbol),
+    kind TEXT CHECK (kind IN ('bonus', 'transfer', 'internal')),
+    schedule TEXT NOT NULL,
+    PRIMARY KEY (currency, kind)
+);
+
+CREATE TABLE IF NOT EXISTS user_wallets (
+    user_id TEXT,
+    wallet TEXT UNIQUE,
+    currency TEXT REFERENCES currencies (symbol),
+    PRIMARY KEY (user_id, wallet)
+);
+
+CREATE TABLE IF NOT EXISTS wallet_balances (
+    wallet TEXT PRIMARY KEY,
+    currency TEXT,
+    balance TEXT NOT NULL DEFAULT '0'
+);
+
+CREATE TABLE IF NOT EXISTS transactions (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL DEFAULT 'transfer',
+    currency TEXT,
+    to_wallet TEXT,
+    from_wallet TEXT,
+    amount TEXT NOT NULL,
+    fee TEXT NOT NULL DEFAULT '0',
+    fee_policy TEXT NOT NULL DEFAULT '',
+    timestamp TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transactions_to_index ON transactions (to_wallet);
+CREATE INDEX IF NOT EXISTS transactions_from_index ON transactions (from_wallet);
+CREATE INDEX IF NOT EXISTS transactions_timestamp_id_index ON transactions (timestamp DESC, id DESC);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope TEXT,
+    key TEXT,
+    request_hash TEXT NOT NULL,
+    status INTEGER,
+    content_type TEXT,
+    response BLOB,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_index ON idempotency_keys (expires_at);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+-- SQLite has no deferred triggers, activerecord checks that every journal entry is balanced before inserting it
+CREATE TABLE IF NOT EXISTS postings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entry_id TEXT NOT NULL REFERENCES journal_entries (id),
+    wallet TEXT NOT NULL,
+    currency TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS postings_wallet_index ON postings (wallet, id);
+CREATE INDEX IF NOT EXISTS postings_entry_index ON postings (entry_id);
+CREATE INDEX IF NOT EXISTS postings_wallet_created_at_index ON postings (wallet, created_at);
+CREATE INDEX IF NOT EXISTS postings_created_at_index ON postings (created_at);
+
+CREATE TABLE IF NOT EXISTS supply_operations (
+    id TEXT PRIMARY KEY REFERENCES journal_entries (id),
+    kind TEXT NOT NULL CHECK (kind IN ('mint', 'burn')),
+    currency TEXT NOT NULL REFERENCES currencies (symbol),
+    amount TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS supply_operations_currency_index ON supply_operations (currency, created_at);
+
+-- End-of-day balances, a wallet has a snapshot only for the days it has postings on
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    wallet TEXT,
+    day DATE,
+    balance TEXT NOT NULL,
+    PRIMARY KEY (wallet, day)
+);
+
+-- Days which have already been snapshotted
+CREATE TABLE IF NOT EXISTS balance_snapshot_days (
+    day DATE PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users (id),
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS sessions_user_index ON sessions (user_id);
+
+-- Only hashes of refresh tokens are stored, a used token has been exchanged for the next one of the session
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    hash TEXT PRIMARY KEY,
+    session_id TEXT NOT NULL REFERENCES sessions (id),
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_index ON refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid TEXT PRIMARY KEY,
+    algorithm TEXT NOT NULL,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    retired_at TIMESTAMP,
+    expires_at TIMESTAMP
+);
+
+-- Only hashes of API keys are stored, prefix is the beginning of the key shown to tell keys apart.
+-- Scopes and allowed IPs are JSON arrays
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users (id),
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL,
+    -- An empty allowlist allows any IP
+    allowed_ips TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_index ON api_keys (user_id);
+
+-- The TOTP secret is kept as is because codes are computed from it, confirmed_at is set when the factor is enabled
+CREATE TABLE IF NOT EXISTS two_factors (
+    user_id TEXT PRIMARY KEY REFERENCES users (id),
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_step INTEGER NOT NULL DEFAULT 0
+);
+
+-- Only hashes of recovery codes are stored, each of them can be used once
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users (id),
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_user_index ON recovery_codes (user_id);
+
+-- Failed sign in attempts by key, which is an account email or a client IP
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    blocked_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    user_id TEXT REFERENCES users (id),
+    subject TEXT NOT NULL,
+    actor TEXT REFERENCES users (id),
+    ip TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_user_index ON audit_events (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users (id),
+    purpose TEXT NOT NULL CHECK (purpose IN ('verify_email', 'reset_password')),
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS email_tokens_user_index ON email_tokens (user_id);
+
+-- System wallets are hex SHA-256 of 'fee-' and 'issuance-' followed by the symbol, the same as in Postgres
+INSERT INTO currencies (symbol, name, decimals, signup_bonus, service_wallet, fee_wallet, issuance_wallet) VALUES
+    ('fBTC', 'Fake Bitcoin', 8, '100', '0000000000000000000000000000000000000000000000000000000000000000',
+        '1ffff5b242bab26033cbce1ff7e3d60f3b4026d55ea31e35dd8746874fb214cc', '20aee2619f831c36e4c052aef6e9b7192ea972656a4458ec757694dd345caca4'),
+    ('fETH', 'Fake Ether', 18, '100', '1111111111111111111111111111111111111111111111111111111111111111',
+        'f20fb408e727a42be44cdba0ed7bf7bd032bd195c15350f425861b8b82d482af', '3f515df1eee05850a8c6b04da062bb5ac9bd010fb2275fa4e7a9b20dfa651e64');
+
+INSERT INTO fee_schedules (currency, kind, schedule)
+SELECT symbol, 'transfer', '{"type":"percentage","rate":"0.2"}' FROM currencies
+UNION ALL
+SELECT symbol, 'bonus', '{"type":"flat","amount":"0"}' FROM currencies
+UNION ALL
+SELECT symbol, 'internal', '{"type":"flat","amount":"0"}' FROM currencies;
+
+-- Treasury, fee and issuance wallets are owned by the system user with nil UUID
+INSERT INTO user_wallets (user_id, wallet, currency)
+SELECT '00000000-0000-0000-0000-000000000000', service_wallet, symbol FROM currencies
+UNION ALL
+SELECT '00000000-0000-0000-0000-000000000000', fee_wallet, symbol FROM currencies
+UNION ALL
+SELECT '00000000-0000-0000-0000-000000000000', issuance_wallet, symbol FROM currencies;
+
+-- The genesis mint gives every treasury an initial supply of 1000000 coins
+CREATE TEMPORARY TABLE genesis AS
+SELECT CASE symbol WHEN 'fBTC' THEN 'd665fca8-de03-44f7-bc5f-54cace77515a' ELSE '1d57fc06-fd59-47cd-a57c-7bfdcc18cb13' END AS id,
+    symbol, service_wallet, issuance_wallet, '1000000' AS amount,
+    strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') AS created_at
+FROM currencies;
+
+INSERT INTO journal_entries (id, kind, description, created_at)
+SELECT id, 'mint', 'genesis', created_at FROM genesis;
+
+INSERT INTO postings (entry_id, wallet, currency, amount, created_at)
+SELECT id, issuance_wallet, symbol, '-' || amount, created_at FROM genesis
+UNION ALL
+SELECT id, service_wallet, symbol, amount, created_at FROM genesis;
+
+INSERT INTO supply_operations (id, kind, currency, amount, actor, reason, created_at)
+SELECT id, 'mint', symbol, amount, '00000000-0000-0000-0000-000000000000', 'genesis', created_at FROM genesis;
+
+INSERT INTO wallet_balances (wallet, currency, balance)
+SELECT issuance_wallet, symbol, '-' || amount FROM genesis
+UNION ALL
+SELECT service_wallet, symbol, amount FROM genesis;
+
+DROP TABLE genesis;
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exitViolations = 1
+	exitFailure    = 2
+)
+
+// reconcile prints the reconciliation report as JSON and returns the exit code:
+// 0 if the ledger is consistent, 1 if there are violations and 2 if the check failed
+func reconcile(ctx context.Context, activeRecords activerecord.Facade) int {
+	report, err := activeRecords.Reconcile(ctx)
+	if err != nil {
+		log.WithError(err).Error("could not reconcile the ledger")
+		return exitFailure
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		log.WithError(err).Error("could not write the reconciliation report")
+		return exitFailure
+	}
+
+	if !report.OK() {
+		return exitViolations
+	}
+
+	return 0
+}
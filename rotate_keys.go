@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/merisho/binaryx-test/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// rotateKeys creates a new signing key, the previous keys keep verifying tokens during the grace period
+func rotateKeys(ctx context.Context, keyring *service.Keyring, defaultGrace time.Duration, args []string) int {
+	flags := flag.NewFlagSet("rotate-keys", flag.ContinueOnError)
+	grace := flags.Duration("grace", defaultGrace, "how long the previous keys keep verifying tokens")
+	err := flags.Parse(args)
+	if err != nil {
+		return exitFailure
+	}
+
+	key, err := keyring.Rotate(ctx, *grace)
+	if err != nil {
+		log.WithError(err).Error("could not rotate signing keys")
+		return exitFailure
+	}
+
+	log.Infof("new %s signing key %s, previous keys expire in %s", key.Algorithm(), key.ID(), *grace)
+	return 0
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	verificationTokenTTL  = 48 * time.Hour
+	passwordResetTokenTTL = time.Hour
+)
+
+// ErrInvalidEmailToken means that the token is malformed, forged, expired or has already been used
+var ErrInvalidEmailToken = errors.New("invalid or expired token")
+
+// NewAccounts creates the service which verifies emails and resets passwords by tokens sent with the mailer.
+// Tokens are signed with the secret
+func NewAccounts(activeRecords activerecord.Facade, mailer Mailer, secret []byte) *Accounts {
+	return &Accounts{
+		activeRecords: activeRecords,
+		mailer:        mailer,
+		secret:        secret,
+	}
+}
+
+type Accounts struct {
+	activeRecords activerecord.Facade
+	mailer        Mailer
+	secret        []byte
+	// sending counts the emails sent in the background
+	sending sync.WaitGroup
+}
+
+// SendVerification emails the user a token which verifies their email
+func (a *Accounts) SendVerification(ctx context.Context, user *activerecord.User) error {
+	token, err := a.issue(ctx, user.ID(), activerecord.VerifyEmailToken, verificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(ctx, Message{
+		To:      user.Email(),
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Verify your email with POST /verify-email and the token below, it expires in %s.\n\nToken: %s", verificationTokenTTL, token),
+	})
+}
+
+func (a *Accounts) VerifyEmail(ctx context.Context, token string) error {
+	return a.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		user, err := a.use(ctx, tx, token, activerecord.VerifyEmailToken)
+		if err != nil {
+			return err
+		}
+
+		return user.VerifyEmail(ctx)
+	})
+}
+
+// SendPasswordReset emails a password reset token if there is a user with the email.
+// Unknown emails are not reported, and the token is issued and sent in the background,
+// so neither the result nor the time it takes tell which accounts exist
+func (a *Accounts) SendPasswordReset(ctx context.Context, email string) error {
+	user, err := a.activeRecords.User().FindByEmail(ctx, email)
+	if err != nil {
+		if _, ok := err.(activerecord.NotFoundError); ok {
+			return nil
+		}
+
+		return err
+	}
+
+	a.sending.Add(1)
+	go func() {
+		defer a.sending.Done()
+		err := a.sendPasswordReset(context.Background(), user)
+		if err != nil {
+			log.WithError(err).Errorf("could not send password reset email to user %s", user.ID())
+		}
+	}()
+
+	return nil
+}
+
+// Wait blocks until the emails sent in the background are sent or have failed
+func (a *Accounts) Wait() {
+	a.sending.Wait()
+}
+
+func (a *Accounts) sendPasswordReset(ctx context.Context, user *activerecord.User) error {
+	token, err := a.issue(ctx, user.ID(), activerecord.ResetPasswordToken, passwordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(ctx, Message{
+		To:      user.Email(),
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf("Reset your password with POST /password/reset and the token below, it expires in %s.\nIf you have not requested it, ignore this email.\n\nToken: %s", passwordResetTokenTTL, token),
+	})
+}
+
+// ResetPassword sets the password of the token's user and revokes all their sessions.
+// Receiving the token proves the ownership of the email, so the email becomes verified too
+func (a *Accounts) ResetPassword(ctx context.Context, token, password string) error {
+	return a.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		user, err := a.use(ctx, tx, token, activerecord.ResetPasswordToken)
+		if err != nil {
+			return err
+		}
+
+		err = user.SetPassword(ctx, password)
+		if err != nil {
+			return err
+		}
+
+		err = user.VerifyEmail(ctx)
+		if err != nil {
+			return err
+		}
+
+		return tx.Session().RevokeByUserID(ctx, user.ID())
+	})
+}
+
+func (a *Accounts) issue(ctx context.Context, userID uuid.UUID, purpose activerecord.EmailTokenPurpose, ttl time.Duration) (string, error) {
+	t, err := a.activeRecords.EmailToken().Issue(ctx, userID, purpose, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := t.ID().MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+
+	payload := make([]byte, len(id)+8)
+	copy(payload, id)
+	binary.BigEndian.PutUint64(payload[len(id):], uint64(t.ExpiresAt().Unix()))
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(a.sign(purpose, encoded)), nil
+}
+
+// use checks the signature and the expiry of the token before it is marked as used, and returns its user
+func (a *Accounts) use(ctx context.Context, tx activerecord.Facade, token string, purpose activerecord.EmailTokenPurpose) (*activerecord.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidEmailToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, a.sign(purpose, parts[0])) {
+		return nil, ErrInvalidEmailToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != 24 {
+		return nil, ErrInvalidEmailToken
+	}
+
+	id, err := uuid.FromBytes(payload[:16])
+	if err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+
+	if time.Now().Unix() >= int64(binary.BigEndian.Uint64(payload[16:])) {
+		return nil, ErrInvalidEmailToken
+	}
+
+	t, err := tx.EmailToken().Use(ctx, id, purpose)
+	if err != nil {
+		if _, ok := err.(activerecord.ValidationError); ok {
+			return nil, ErrInvalidEmailToken
+		}
+
+		return nil, err
+	}
+
+	return tx.User().FindByID(ctx, t.UserID())
+}
+
+// sign binds the signature to the purpose, so a token of one purpose cannot be used for another
+func (a *Accounts) sign(purpose activerecord.EmailTokenPurpose, payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
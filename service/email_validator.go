@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+// EmailValidators accepts an email only if all of the validators accept it, they are called in order
+type EmailValidators []activerecord.EmailValidator
+
+func (v EmailValidators) ValidateEmail(ctx context.Context, email string) (bool, error) {
+	for _, validator := range v {
+		valid, err := validator.ValidateEmail(ctx, email)
+		if err != nil || !valid {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// DefaultDisposableDomains are well-known providers of throwaway mailboxes
+var DefaultDisposableDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"sharklasers.com",
+	"temp-mail.org",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// NewDisposableEmailValidator creates a validator which rejects emails of the domains and their subdomains
+func NewDisposableEmailValidator(domains []string) *DisposableEmailValidator {
+	v := &DisposableEmailValidator{
+		domains: make(map[string]bool, len(domains)),
+	}
+
+	for _, d := range domains {
+		v.domains[strings.ToLower(d)] = true
+	}
+
+	return v
+}
+
+type DisposableEmailValidator struct {
+	domains map[string]bool
+}
+
+func (v *DisposableEmailValidator) ValidateEmail(_ context.Context, email string) (bool, error) {
+	domain := activerecord.EmailDomain(email)
+	for {
+		if v.domains[domain] {
+			return false, nil
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return true, nil
+		}
+
+		domain = domain[i+1:]
+	}
+}
+
+// MXResolver looks up mail servers of domains, *net.Resolver implements it
+type MXResolver interface {
+	LookupMX(ctx context.Context, domain string) ([]*net.MX, error)
+}
+
+// StaticResolver resolves domains to mail servers from memory, it is meant for tests and offline environments
+type StaticResolver map[string][]string
+
+func (r StaticResolver) LookupMX(_ context.Context, domain string) ([]*net.MX, error) {
+	hosts, ok := r[domain]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+
+	mx := make([]*net.MX, 0, len(hosts))
+	for i, h := range hosts {
+		mx = append(mx, &net.MX{Host: h, Pref: uint16(10 * (i + 1))})
+	}
+
+	return mx, nil
+}
+
+// NewMXEmailValidator creates a validator which accepts emails of domains with mail servers.
+// Results are cached for ttl, every lookup is limited by timeout
+func NewMXEmailValidator(resolver MXResolver, ttl, timeout time.Duration) *MXEmailValidator {
+	return &MXEmailValidator{
+		resolver: resolver,
+		ttl:      ttl,
+		timeout:  timeout,
+		cache:    make(map[string]mxCacheEntry),
+	}
+}
+
+// MXEmailValidator checks that the domain of an email has an MX record.
+// Lookups which time out or fail temporarily accept the email, so a slow DNS does not block signups
+type MXEmailValidator struct {
+	resolver MXResolver
+	ttl      time.Duration
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mxCacheEntry
+}
+
+type mxCacheEntry struct {
+	valid     bool
+	expiresAt time.Time
+}
+
+func (v *MXEmailValidator) ValidateEmail(ctx context.Context, email string) (bool, error) {
+	domain := activerecord.EmailDomain(email)
+
+	v.mu.Lock()
+	entry, ok := v.cache[domain]
+	v.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.valid, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	records, err := v.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			log.WithError(err).Warnf("could not look up MX records of %s, the email is accepted", domain)
+			return true, nil
+		}
+	}
+
+	// A single "." record is a null MX (RFC 7505), the domain does not accept mail
+	valid := len(records) > 0 && !(len(records) == 1 && records[0].Host == ".")
+
+	v.mu.Lock()
+	v.cache[domain] = mxCacheEntry{
+		valid:     valid,
+		expiresAt: time.Now().Add(v.ttl),
+	}
+	v.mu.Unlock()
+
+	return valid, nil
+}
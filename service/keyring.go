@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/merisho/binaryx-test/activerecord"
+)
+
+// keyringReloadInterval is how often keys rotated by other instances are picked up
+const keyringReloadInterval = time.Minute
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// NewKeyring creates a keyring of access token keys stored in the DB, their private keys are encrypted with the secret.
+// If there is no signing key yet, the first use of the keyring creates one of the algorithm
+func NewKeyring(activeRecords activerecord.Facade, algorithm string, secret []byte) *Keyring {
+	return &Keyring{
+		activeRecords: activeRecords,
+		algorithm:     algorithm,
+		secret:        secret,
+	}
+}
+
+// Keyring signs access tokens with the current key and verifies them with any key which is not expired.
+// Tokens carry the id of their key in the kid header
+type Keyring struct {
+	activeRecords activerecord.Facade
+	algorithm     string
+	secret        []byte
+
+	mu       sync.RWMutex
+	signing  *activerecord.SigningKey
+	keys     map[string]*activerecord.SigningKey
+	loadedAt time.Time
+}
+
+// Load reloads the keys from the DB
+func (k *Keyring) Load(ctx context.Context) error {
+	factory := k.activeRecords.SigningKey(k.secret)
+	keys, err := factory.FindActive(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || !keys[0].Signing() {
+		err = factory.EnsureSigningKey(ctx, k.algorithm)
+		if err != nil {
+			return err
+		}
+
+		keys, err = factory.FindActive(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(keys) == 0 || !keys[0].Signing() {
+		return errors.New("no signing key")
+	}
+
+	byID := make(map[string]*activerecord.SigningKey, len(keys))
+	for _, key := range keys {
+		byID[key.ID()] = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.signing = keys[0]
+	k.keys = byID
+	k.loadedAt = time.Now()
+	return nil
+}
+
+// EncryptPlain encrypts the keys stored before the secret was set and returns their number
+func (k *Keyring) EncryptPlain(ctx context.Context) (int, error) {
+	return k.activeRecords.SigningKey(k.secret).EncryptPlain(ctx)
+}
+
+// Rotate creates a new signing key, the previous ones keep verifying tokens during the grace period
+func (k *Keyring) Rotate(ctx context.Context, grace time.Duration) (*activerecord.SigningKey, error) {
+	key, err := k.activeRecords.SigningKey(k.secret).Rotate(ctx, k.algorithm, grace)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, k.Load(ctx)
+}
+
+// Sign signs the claims with the current signing key
+func (k *Keyring) Sign(ctx context.Context, claims jwt.Claims) (string, error) {
+	err := k.reloadIfStale(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.RLock()
+	key := k.signing
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(signingMethod(key.Algorithm()), claims)
+	token.Header["kid"] = key.ID()
+	return token.SignedString(key.PrivateKey())
+}
+
+// Parse verifies the token with the key from its kid header and parses its claims
+func (k *Keyring) Parse(ctx context.Context, token string, claims jwt.Claims) error {
+	err := k.reloadIfStale(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key := k.find(ctx, kid)
+		if key == nil {
+			return nil, errUnknownKey
+		}
+
+		// The algorithm is taken from the key, not from the token, so a token cannot choose how it is verified
+		if t.Method.Alg() != key.Algorithm() {
+			return nil, jwt.ErrSignatureInvalid
+		}
+
+		return key.PublicKey(), nil
+	})
+	return err
+}
+
+// find returns the key by id, unknown ids make the keyring reload once in case the key was rotated by another instance
+func (k *Keyring) find(ctx context.Context, kid string) *activerecord.SigningKey {
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	loadedAt := k.loadedAt
+	k.mu.RUnlock()
+	if ok {
+		return key
+	}
+
+	if kid == "" || time.Since(loadedAt) < time.Second {
+		return nil
+	}
+
+	if k.Load(ctx) != nil {
+		return nil
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[kid]
+}
+
+func (k *Keyring) reloadIfStale(ctx context.Context) error {
+	k.mu.RLock()
+	stale := k.signing == nil || time.Since(k.loadedAt) > keyringReloadInterval
+	k.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	return k.Load(ctx)
+}
+
+// JWKS returns the public keys which verify tokens as a JSON Web Key Set
+func (k *Keyring) JWKS(ctx context.Context) (JWKS, error) {
+	err := k.reloadIfStale(ctx)
+	if err != nil {
+		return JWKS{}, err
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{
+			KeyID:     key.ID(),
+			Use:       "sig",
+			Algorithm: key.Algorithm(),
+		}
+
+		switch public := key.PublicKey().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set, nil
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	if algorithm == activerecord.EdDSA {
+		return SigningMethodEdDSA
+	}
+
+	return jwt.SigningMethodRS256
+}
+
+// JWKS is a JSON Web Key Set (RFC 7517)
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N and E are the modulus and the exponent of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and X are the curve and the public key of OKP keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewSMTPMailer creates a mailer which sends emails from the address through the SMTP server at addr (host:port).
+// Auth is PLAIN if the username is not empty
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: addr,
+		from: from,
+	}
+
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(_ context.Context, msg Message) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg))
+}
+
+// NewFileOutbox creates a mailer which writes emails to files in the directory instead of sending them, for local use
+func NewFileOutbox(dir string) (*FileOutbox, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileOutbox{
+		dir: dir,
+	}, nil
+}
+
+type FileOutbox struct {
+	dir string
+}
+
+func (o *FileOutbox) Send(_ context.Context, msg Message) error {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(o.dir, name), formatMessage("outbox@localhost", msg), 0o600)
+}
+
+// MemoryOutbox keeps sent emails in memory, it is meant for tests
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (o *MemoryOutbox) Send(_ context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Last returns the latest email sent to the address
+func (o *MemoryOutbox) Last(to string) (Message, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := len(o.messages) - 1; i >= 0; i-- {
+		if o.messages[i].To == to {
+			return o.messages[i], true
+		}
+	}
+
+	return Message{}, false
+}
+
+func formatMessage(from string, msg Message) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		from, msg.To, msg.Subject, strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+}
@@ -1,41 +1,31 @@
 package service
 
 import (
-	"github.com/google/uuid"
-	"github.com/merisho/binaryx-test/activerecord"
-)
+	"context"
 
-type currency = string
-
-const (
-	FakeBTC currency = "fBTC"
-	FakeETH currency = "fETH"
+	"github.com/merisho/binaryx-test/activerecord"
 )
 
-// NewWallets creates ephemeral wallets for service purposes
-func NewWallets(activeRecords activerecord.Facade) (*Wallets, error) {
-	fbtc, err := activeRecords.Wallet().New(uuid.UUID{}, FakeBTC, "0000000000000000000000000000000000000000000000000000000000000000")
-	if err != nil {
-		return nil, err
-	}
-
-	feth, err := activeRecords.Wallet().New(uuid.UUID{}, FakeETH, "1111111111111111111111111111111111111111111111111111111111111111")
-	if err != nil {
-		return nil, err
-	}
-
+// NewWallets creates a source of persisted service wallets
+func NewWallets(activeRecords activerecord.Facade) *Wallets {
 	return &Wallets{
-		wallets: map[currency]*activerecord.Wallet{
-			FakeBTC: fbtc,
-			FakeETH: feth,
-		},
-	}, nil
+		activeRecords: activeRecords,
+	}
 }
 
 type Wallets struct {
-	wallets map[currency]*activerecord.Wallet
+	activeRecords activerecord.Facade
+}
+
+// WithTx returns service wallets which are loaded within the unit of work of the scoped facade
+func (w *Wallets) WithTx(tx activerecord.Facade) *Wallets {
+	return &Wallets{
+		activeRecords: tx,
+	}
 }
 
-func (w *Wallets) Get(c currency) *activerecord.Wallet {
-	return w.wallets[c]
+// Get returns the treasury wallet of the currency registered in the currency registry.
+// The wallet row is locked until the end of the DB transaction, so its balance cannot be spent concurrently
+func (w *Wallets) Get(ctx context.Context, c *activerecord.Currency) (*activerecord.Wallet, error) {
+	return w.activeRecords.Wallet().FindByAddressForUpdate(ctx, c.ServiceWallet())
 }
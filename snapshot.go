@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshot stores end-of-day balances for all days which ended at least activerecord.SnapshotDelay ago and have not been snapshotted yet
+func snapshot(ctx context.Context, activeRecords activerecord.Facade) int {
+	days, err := activeRecords.Ledger().SnapshotBalances(ctx, time.Now())
+	if err != nil {
+		log.WithError(err).Errorf("could not snapshot balances, %d days snapshotted", days)
+		return exitFailure
+	}
+
+	log.Infof("%d days snapshotted", days)
+	return 0
+}
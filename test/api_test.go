@@ -1,10 +1,21 @@
 package test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/merisho/binaryx-test/activerecord"
 	"github.com/merisho/binaryx-test/api"
+	"github.com/merisho/binaryx-test/service"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -30,6 +41,25 @@ func (ts *FakeCoinsAPITestSuite) TestAPI() {
 	ts.Run("sign up", ts.testSignUp)
 	ts.Run("sign in", ts.testSignIn)
 	ts.Run("list wallets", ts.testListWallets)
+	ts.Run("transfer", ts.testTransfer)
+	ts.Run("transaction history", ts.testTransactionHistory)
+	ts.Run("stored balances match replayed ones", ts.testVerifyBalances)
+	ts.Run("currencies", ts.testCurrencies)
+	ts.Run("currency defaults", ts.testCurrencyDefaults)
+	ts.Run("fee revenue", ts.testFeeRevenue)
+	ts.Run("ledger", ts.testLedger)
+	ts.Run("treasury", ts.testTreasury)
+	ts.Run("reconciliation", ts.testReconciliation)
+	ts.Run("balance at moment", ts.testBalanceAt)
+	ts.Run("idempotency keys", ts.testIdempotencyKeys)
+	ts.Run("api keys", ts.testAPIKeys)
+	ts.Run("two-factor authentication", ts.testTwoFactor)
+	ts.Run("brute-force protection", ts.testBruteForceProtection)
+	ts.Run("email verification", ts.testEmailVerification)
+	ts.Run("password reset", ts.testPasswordReset)
+	ts.Run("schema is up to date", ts.testSchemaUpToDate)
+	// Rotation expires the keys of all previous tokens, so it goes last
+	ts.Run("signing key rotation", ts.testSigningKeyRotation)
 }
 
 func (ts *FakeCoinsAPITestSuite) testSignUp() {
@@ -38,7 +68,9 @@ func (ts *FakeCoinsAPITestSuite) testSignUp() {
 	ts.Run("password is greater than 50 characters", ts.testLongPassword)
 	ts.Run("email is invalid",  ts.testEmailIsInvalid)
 	ts.Run("email domain does not exist",  ts.testEmailDomainDoesNotExist)
+	ts.Run("email is normalized", ts.testEmailIsNormalized)
 	ts.Run("first name or last name is invalid", ts.testInvalidNames)
+	ts.Run("rolled back DB transaction leaves no user", ts.testSignUpRollback)
 }
 
 func (ts *FakeCoinsAPITestSuite) testSignUpSuccess() {
@@ -114,6 +146,28 @@ func (ts *FakeCoinsAPITestSuite) testEmailDomainDoesNotExist() {
 	ts.Equal("invalid email", apiError.Error)
 }
 
+func (ts *FakeCoinsAPITestSuite) testEmailIsNormalized() {
+	request := DefaultSignupRequest()
+	email := request.Email
+	request.Email = "  " + strings.ToUpper(email) + " "
+
+	var signupRes api.SignupResponse
+	res := ts.Request("POST", "/signup").
+		WithRequestData(request).
+		WithResponseData(&signupRes).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.Equal(email, signupRes.Email)
+
+	request.Email = email
+	res = ts.Request("POST", "/signup").
+		WithRequestData(request).
+		Do()
+	ts.Equal(409, res.Code)
+
+	ts.signIn(strings.ToUpper(email), request.Password)
+}
+
 func (ts *FakeCoinsAPITestSuite) testInvalidNames() {
 	request := DefaultSignupRequest()
 	request.FirstName = "123 Alexei"
@@ -136,9 +190,36 @@ func (ts *FakeCoinsAPITestSuite) testInvalidNames() {
 	ts.Equal("invalid last name", apiError.Error)
 }
 
+func (ts *FakeCoinsAPITestSuite) testSignUpRollback() {
+	ctx := context.Background()
+	request := DefaultSignupRequest()
+	rollback := errors.New("rollback")
+
+	err := ts.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		user, err := tx.User().New(ctx, request.Email, request.Password, request.FirstName, request.LastName)
+		ts.Require().NoError(err)
+
+		currencies, err := tx.Currency().Enabled(ctx)
+		ts.Require().NoError(err)
+
+		_, err = user.CreateWallets(currencies...)
+		ts.Require().NoError(err)
+		ts.Require().NoError(user.Save(ctx))
+
+		return rollback
+	})
+	ts.Equal(rollback, err)
+
+	_, err = ts.activeRecords.User().FindByEmail(ctx, request.Email)
+	ts.IsType(activerecord.NotFoundError{}, err)
+}
+
 func (ts *FakeCoinsAPITestSuite) testSignIn() {
 	ts.Run("retrieve token", ts.testRetrieveToken)
 	ts.Run("auth by token", ts.testAuthByToken)
+	ts.Run("refresh token rotation", ts.testRefreshToken)
+	ts.Run("logout", ts.testLogout)
+	ts.Run("revoke session", ts.testRevokeSession)
 }
 
 func (ts *FakeCoinsAPITestSuite) testRetrieveToken() {
@@ -174,6 +255,107 @@ func (ts *FakeCoinsAPITestSuite) testAuthByToken() {
 	ts.Equal(ts.testUserEmail, iamResponse.Email)
 }
 
+func (ts *FakeCoinsAPITestSuite) testRefreshToken() {
+	first := ts.signIn(ts.testUserEmail, ts.testUserPassword)
+	ts.NotEmpty(first.RefreshToken)
+
+	var second api.TokenResponse
+	res := ts.Request("POST", "/token/refresh").
+		WithRequestData(api.RefreshTokenRequest{RefreshToken: first.RefreshToken}).
+		WithResponseData(&second).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.NotEqual(first.RefreshToken, second.RefreshToken)
+	ts.Equal(first.SessionID, second.SessionID)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(second.Token).
+		Do()
+	ts.Equal(200, res.Code)
+
+	// Reuse of the rotated token revokes the whole session
+	res = ts.Request("POST", "/token/refresh").
+		WithRequestData(api.RefreshTokenRequest{RefreshToken: first.RefreshToken}).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/token/refresh").
+		WithRequestData(api.RefreshTokenRequest{RefreshToken: second.RefreshToken}).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(second.Token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/token/refresh").
+		WithRequestData(api.RefreshTokenRequest{RefreshToken: "unknown"}).
+		Do()
+	ts.Equal(401, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testLogout() {
+	tokens := ts.signIn(ts.testUserEmail, ts.testUserPassword)
+
+	res := ts.Request("POST", "/logout").
+		WithBearerToken(tokens.Token).
+		Do()
+	ts.Equal(204, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(tokens.Token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/token/refresh").
+		WithRequestData(api.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}).
+		Do()
+	ts.Equal(401, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testRevokeSession() {
+	current := ts.signIn(ts.testUserEmail, ts.testUserPassword)
+	other := ts.signIn(ts.testUserEmail, ts.testUserPassword)
+	_, foreignToken := ts.createUser()
+
+	var sessions []api.SessionResponse
+	res := ts.Request("GET", "/sessions").
+		WithResponseData(&sessions).
+		WithBearerToken(current.Token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	found := false
+	for _, s := range sessions {
+		if s.ID == other.SessionID {
+			found = true
+			ts.False(s.Current)
+		}
+	}
+	ts.True(found)
+
+	res = ts.Request("DELETE", "/sessions/"+other.SessionID).
+		WithBearerToken(foreignToken).
+		Do()
+	ts.Equal(404, res.Code)
+
+	res = ts.Request("DELETE", "/sessions/"+other.SessionID).
+		WithBearerToken(current.Token).
+		Do()
+	ts.Equal(204, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(other.Token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(current.Token).
+		Do()
+	ts.Equal(200, res.Code)
+}
+
 func (ts *FakeCoinsAPITestSuite) testListWallets() {
 	var walletsRes []api.WalletResponse
 	res := ts.Request("GET", "/wallets").
@@ -187,3 +369,1413 @@ func (ts *FakeCoinsAPITestSuite) testListWallets() {
 		ts.Equal("100", w.Balance)
 	}
 }
+
+func (ts *FakeCoinsAPITestSuite) testTransfer() {
+	ts.Run("success", ts.testTransferSuccess)
+	ts.Run("insufficient funds", ts.testTransferInsufficientFunds)
+	ts.Run("currency mismatch", ts.testTransferCurrencyMismatch)
+	ts.Run("foreign wallet", ts.testTransferFromForeignWallet)
+	ts.Run("amount exceeds currency precision", ts.testTransferTooPreciseAmount)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransferSuccess() {
+	sender, senderToken := ts.createUser()
+	receiver, receiverToken := ts.createUser()
+
+	var txRes api.TransactionResponse
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+			Amount: "10",
+		}).
+		WithResponseData(&txRes).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(201, res.Code)
+	ts.NotEmpty(txRes.ID)
+	ts.Equal("fBTC", txRes.Currency)
+	ts.Equal("10", txRes.Amount)
+	ts.Equal("2", txRes.Fee)
+
+	ts.Equal("88", ts.walletBalance(senderToken, txRes.From))
+	ts.Equal("110", ts.walletBalance(receiverToken, txRes.To))
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransferInsufficientFunds() {
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+
+	var apiError api.ErrorResponse
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+			Amount: "90",
+		}).
+		WithResponseData(&apiError).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(402, res.Code)
+	ts.Equal("insufficient funds", apiError.Error)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransferCurrencyMismatch() {
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+
+	var apiError api.ErrorResponse
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fETH").Address,
+			Amount: "10",
+		}).
+		WithResponseData(&apiError).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(409, res.Code)
+	ts.Equal("wallet currency mismatch", apiError.Error)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransferTooPreciseAmount() {
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+
+	var apiError api.ErrorResponse
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+			Amount: "0.000000001",
+		}).
+		WithResponseData(&apiError).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(400, res.Code)
+	ts.Equal("amount has too many decimal places", apiError.Error)
+
+	var txRes api.TransactionResponse
+	res = ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fETH").Address,
+			To:     walletByCurrency(receiver.Wallets, "fETH").Address,
+			Amount: "0.000000001",
+		}).
+		WithResponseData(&txRes).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(201, res.Code)
+	ts.Equal("0.0000000002", txRes.Fee)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransferFromForeignWallet() {
+	_, token := ts.createUser()
+	other, _ := ts.createUser()
+	receiver, _ := ts.createUser()
+
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(other.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+			Amount: "10",
+		}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(404, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTransactionHistory() {
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+	from := walletByCurrency(sender.Wallets, "fBTC").Address
+	to := walletByCurrency(receiver.Wallets, "fBTC").Address
+
+	for _, amount := range []string{"1", "2", "3"} {
+		res := ts.Request("POST", "/transactions").
+			WithRequestData(api.TransferRequest{From: from, To: to, Amount: amount}).
+			WithBearerToken(senderToken).
+			Do()
+		ts.Require().Equal(201, res.Code)
+	}
+
+	url := "/wallets/" + from + "/transactions"
+
+	var firstPage api.TransactionHistoryResponse
+	res := ts.Request("GET", url+"?limit=3").
+		WithResponseData(&firstPage).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(200, res.Code)
+	ts.Require().Len(firstPage.Transactions, 3)
+	ts.NotEmpty(firstPage.NextCursor)
+	ts.Equal("3", firstPage.Transactions[0].Amount)
+	ts.Equal("0.6", firstPage.Transactions[0].Fee)
+	ts.Equal("outgoing", firstPage.Transactions[0].Direction)
+	ts.Equal(to, firstPage.Transactions[0].Counterparty)
+
+	var secondPage api.TransactionHistoryResponse
+	res = ts.Request("GET", url+"?limit=3&cursor="+firstPage.NextCursor).
+		WithResponseData(&secondPage).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(200, res.Code)
+	ts.Require().Len(secondPage.Transactions, 1)
+	ts.Empty(secondPage.NextCursor)
+	ts.Equal("incoming", secondPage.Transactions[0].Direction)
+	ts.Equal("100", secondPage.Transactions[0].Amount)
+
+	var filtered api.TransactionHistoryResponse
+	res = ts.Request("GET", url+"?direction=outgoing&minAmount=2").
+		WithResponseData(&filtered).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(200, res.Code)
+	ts.Len(filtered.Transactions, 2)
+
+	res = ts.Request("GET", url+"?direction=sideways").
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(400, res.Code)
+
+	_, otherToken := ts.createUser()
+	res = ts.Request("GET", url).
+		WithBearerToken(otherToken).
+		Do()
+	ts.Equal(404, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testVerifyBalances() {
+	mismatches, err := ts.activeRecords.Wallet().VerifyBalances(context.Background())
+	ts.NoError(err)
+	ts.Empty(mismatches)
+}
+
+func (ts *FakeCoinsAPITestSuite) testCurrencies() {
+	var currencies []api.CurrencyResponse
+	res := ts.Request("GET", "/currencies").
+		WithResponseData(&currencies).
+		Do()
+	ts.Equal(200, res.Code)
+	ts.Equal(int32(8), currencyBySymbol(currencies, "fBTC").Precision)
+	ts.Equal(int32(18), currencyBySymbol(currencies, "fETH").Precision)
+
+	disabled := false
+	request := api.CreateCurrencyRequest{
+		Symbol:    fmt.Sprintf("t%d", rnd.Intn(1000000000)),
+		Name:      "Test Coin",
+		Precision: 2,
+		FeeSchedules: map[string]json.RawMessage{
+			"transfer": json.RawMessage(`{"type":"capped","schedule":{"type":"percentage","rate":"0.1"},"min":"0.5","max":"1"}`),
+		},
+		SignupBonus: "50",
+		Enabled:     &disabled,
+	}
+
+	_, userToken := ts.createUser()
+	res = ts.Request("POST", "/currencies").
+		WithRequestData(request).
+		WithBearerToken(userToken).
+		Do()
+	ts.Equal(403, res.Code)
+
+	adminToken := ts.createAdmin()
+	var created api.CurrencyResponse
+	res = ts.Request("POST", "/currencies").
+		WithRequestData(request).
+		WithResponseData(&created).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.False(created.Enabled)
+	ts.NotEmpty(created.ServiceWallet)
+
+	res = ts.Request("POST", "/currencies").
+		WithRequestData(request).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Equal(409, res.Code)
+
+	res = ts.Request("GET", "/currencies").
+		WithResponseData(&currencies).
+		Do()
+	ts.Equal(200, res.Code)
+	ts.Empty(currencyBySymbol(currencies, request.Symbol).Symbol)
+
+	enabled := true
+	res = ts.Request("PATCH", "/currencies/"+request.Symbol).
+		WithRequestData(api.UpdateCurrencyRequest{Enabled: &enabled}).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	defer func() {
+		res := ts.Request("PATCH", "/currencies/"+request.Symbol).
+			WithRequestData(api.UpdateCurrencyRequest{Enabled: &disabled}).
+			WithBearerToken(adminToken).
+			Do()
+		ts.Equal(200, res.Code)
+	}()
+
+	res = ts.Request("POST", "/signup").
+		WithRequestData(DefaultSignupRequest()).
+		Do()
+	ts.Equal(503, res.Code)
+
+	res = ts.Request("POST", "/currencies/"+request.Symbol+"/mint").
+		WithRequestData(api.SupplyChangeRequest{Amount: "1000", Reason: "initial supply"}).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+	ts.Len(sender.Wallets, 3)
+	from := walletByCurrency(sender.Wallets, request.Symbol).Address
+	to := walletByCurrency(receiver.Wallets, request.Symbol).Address
+	ts.Equal("50", walletByCurrency(sender.Wallets, request.Symbol).Balance)
+
+	for amount, fee := range map[string]string{"2": "0.5", "20": "1"} {
+		var txRes api.TransactionResponse
+		res = ts.Request("POST", "/transactions").
+			WithRequestData(api.TransferRequest{From: from, To: to, Amount: amount}).
+			WithResponseData(&txRes).
+			WithBearerToken(senderToken).
+			Do()
+		ts.Require().Equal(201, res.Code)
+		ts.Equal(fee, txRes.Fee)
+		ts.JSONEq(string(request.FeeSchedules["transfer"]), txRes.FeePolicy)
+	}
+
+	ts.Equal("26.5", ts.walletBalance(senderToken, from))
+
+	var updated api.CurrencyResponse
+	res = ts.Request("PUT", "/currencies/"+request.Symbol+"/fees/transfer").
+		WithRequestData(json.RawMessage(`{"type":"flat","amount":"0.25"}`)).
+		WithResponseData(&updated).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.JSONEq(`{"type":"flat","amount":"0.25"}`, string(updated.FeeSchedules["transfer"]))
+
+	res = ts.Request("PUT", "/currencies/"+request.Symbol+"/fees/fee").
+		WithRequestData(json.RawMessage(`{"type":"flat","amount":"0.25"}`)).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Equal(400, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testCurrencyDefaults() {
+	disabled := false
+	var created api.CurrencyResponse
+	res := ts.Request("POST", "/currencies").
+		WithRequestData(api.CreateCurrencyRequest{
+			Symbol:    fmt.Sprintf("t%d", rnd.Intn(1000000000)),
+			Name:      "Default Coin",
+			Precision: 2,
+			Enabled:   &disabled,
+		}).
+		WithResponseData(&created).
+		WithBearerToken(ts.createAdmin()).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.Equal("7", created.SignupBonus)
+	ts.Len(created.FeeSchedules, 1)
+	ts.Contains(created.FeeSchedules, "transfer")
+}
+
+func (ts *FakeCoinsAPITestSuite) testFeeRevenue() {
+	adminToken := ts.createAdmin()
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+	url := "/admin/fees?since=" + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	var before []api.FeeRevenueResponse
+	res := ts.Request("GET", url).
+		WithResponseData(&before).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	res = ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+			To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+			Amount: "10",
+		}).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	var after []api.FeeRevenueResponse
+	res = ts.Request("GET", url).
+		WithResponseData(&after).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	revenueBefore := feeRevenueByCurrency(before, "fBTC")
+	revenueAfter := feeRevenueByCurrency(after, "fBTC")
+	ts.NotEmpty(revenueAfter.FeeWallet)
+	ts.Equal(revenueBefore.Count+1, revenueAfter.Count)
+	ts.Equal(decimal.RequireFromString(revenueBefore.Revenue).Add(decimal.NewFromInt(2)).String(), revenueAfter.Revenue)
+
+	res = ts.Request("GET", "/admin/fees").
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(403, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testLedger() {
+	ctx := context.Background()
+	ledger := ts.activeRecords.Ledger()
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+	from := walletByCurrency(sender.Wallets, "fBTC").Address
+	to := walletByCurrency(receiver.Wallets, "fBTC").Address
+
+	var transfer api.TransactionResponse
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   from,
+			To:     to,
+			Amount: "10",
+		}).
+		WithResponseData(&transfer).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	entry, err := ledger.FindEntry(ctx, uuid.MustParse(transfer.ID))
+	ts.Require().NoError(err)
+	ts.Equal(activerecord.TransferTransaction, entry.Kind())
+	ts.True(entry.Balanced())
+	ts.Len(entry.Postings(), 3)
+
+	balance, err := ledger.Balance(ctx, from)
+	ts.NoError(err)
+	ts.Equal(ts.walletBalance(senderToken, from), balance.String())
+
+	unbalanced := ledger.NewEntry(activerecord.InternalTransaction, "unbalanced").
+		Debit(from, "fBTC", decimal.NewFromInt(1)).
+		Credit(to, "fBTC", decimal.NewFromInt(2))
+	err = ledger.Post(ctx, unbalanced)
+	ts.IsType(activerecord.ValidationError{}, err)
+
+	err = ledger.Post(ctx, ledger.NewEntry(activerecord.InternalTransaction, "empty"))
+	ts.IsType(activerecord.ValidationError{}, err)
+
+	_, err = ledger.FindEntry(ctx, unbalanced.ID())
+	ts.IsType(activerecord.NotFoundError{}, err)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTreasury() {
+	adminToken := ts.createAdmin()
+	_, userToken := ts.createUser()
+
+	res := ts.Request("POST", "/currencies/fBTC/mint").
+		WithRequestData(api.SupplyChangeRequest{Amount: "10", Reason: "test"}).
+		WithBearerToken(userToken).
+		Do()
+	ts.Equal(403, res.Code)
+
+	var before api.SupplyResponse
+	res = ts.Request("GET", "/currencies/fBTC/supply").
+		WithResponseData(&before).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.NotEmpty(before.TreasuryWallet)
+
+	res = ts.Request("POST", "/currencies/fBTC/mint").
+		WithRequestData(api.SupplyChangeRequest{Amount: "10"}).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Equal(400, res.Code)
+
+	var minted api.SupplyOperationResponse
+	res = ts.Request("POST", "/currencies/fBTC/mint").
+		WithRequestData(api.SupplyChangeRequest{Amount: "10", Reason: "test mint"}).
+		WithResponseData(&minted).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.Equal("mint", minted.Kind)
+	ts.Equal("10", minted.Amount)
+
+	res = ts.Request("POST", "/currencies/fBTC/burn").
+		WithRequestData(api.SupplyChangeRequest{Amount: "4", Reason: "test burn"}).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	var after api.SupplyResponse
+	res = ts.Request("GET", "/currencies/fBTC/supply").
+		WithResponseData(&after).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.Equal(decimal.RequireFromString(before.Minted).Add(decimal.NewFromInt(10)).String(), after.Minted)
+	ts.Equal(decimal.RequireFromString(before.Burned).Add(decimal.NewFromInt(4)).String(), after.Burned)
+	ts.Equal(decimal.RequireFromString(after.Minted).Sub(decimal.RequireFromString(after.Burned)).String(), after.Issued)
+	ts.Equal(minted.ID, after.Operations[1].ID)
+
+	tooMuch := decimal.RequireFromString(after.Treasury).Add(decimal.NewFromInt(1))
+	res = ts.Request("POST", "/currencies/fBTC/burn").
+		WithRequestData(api.SupplyChangeRequest{Amount: tooMuch.String(), Reason: "test burn"}).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Equal(402, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testReconciliation() {
+	adminToken := ts.createAdmin()
+	_, userToken := ts.createUser()
+
+	res := ts.Request("GET", "/admin/reconciliation").
+		WithBearerToken(userToken).
+		Do()
+	ts.Equal(403, res.Code)
+
+	var report api.ReconciliationResponse
+	res = ts.Request("GET", "/admin/reconciliation").
+		WithResponseData(&report).
+		WithBearerToken(adminToken).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.True(report.OK)
+	ts.NotZero(report.Wallets)
+	ts.Empty(report.NegativeBalances)
+	ts.Empty(report.OrphanAddresses)
+	ts.Empty(report.CurrencyMismatches)
+	ts.Empty(report.SupplyMismatches)
+}
+
+func (ts *FakeCoinsAPITestSuite) testBalanceAt() {
+	sender, senderToken := ts.createUser()
+	receiver, receiverToken := ts.createUser()
+	from := walletByCurrency(sender.Wallets, "fBTC").Address
+	to := walletByCurrency(receiver.Wallets, "fBTC").Address
+
+	time.Sleep(10 * time.Millisecond)
+	beforeTransfer := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	res := ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{From: from, To: to, Amount: "10"}).
+		WithBearerToken(senderToken).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	_, err := ts.activeRecords.Ledger().SnapshotBalances(context.Background(), time.Now())
+	ts.Require().NoError(err)
+
+	for at, balance := range map[string]string{
+		beforeTransfer.Add(-time.Hour).Format(time.RFC3339Nano): "0",
+		beforeTransfer.Format(time.RFC3339Nano):                 "100",
+		time.Now().Format(time.RFC3339Nano):                     "88",
+		"":                                                      "88",
+	} {
+		var balanceRes api.WalletBalanceResponse
+		res = ts.Request("GET", "/wallets/"+from+"/balance?at="+url.QueryEscape(at)).
+			WithResponseData(&balanceRes).
+			WithBearerToken(senderToken).
+			Do()
+		ts.Require().Equal(200, res.Code)
+		ts.Equal(balance, balanceRes.Balance, at)
+		ts.Equal("fBTC", balanceRes.Currency)
+	}
+
+	res = ts.Request("GET", "/wallets/"+from+"/balance?at=yesterday").
+		WithBearerToken(senderToken).
+		Do()
+	ts.Equal(400, res.Code)
+
+	res = ts.Request("GET", "/wallets/"+from+"/balance").
+		WithBearerToken(receiverToken).
+		Do()
+	ts.Equal(404, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testSchemaUpToDate() {
+	if ts.migrator == nil {
+		ts.T().Skip("the suite runs in memory, set TEST_DB_URL to check the schema")
+	}
+
+	ctx := context.Background()
+	ts.NoError(ts.migrator.Check(ctx))
+
+	version, dirty, err := ts.migrator.Version(ctx)
+	ts.Require().NoError(err)
+	ts.False(dirty)
+	ts.Equal(ts.migrator.Latest(), version)
+
+	status, err := ts.migrator.Status(ctx)
+	ts.Require().NoError(err)
+	for _, s := range status {
+		ts.True(s.Applied, s.Name)
+	}
+
+	applied, err := ts.migrator.Up(ctx)
+	ts.NoError(err)
+	ts.Empty(applied)
+}
+
+func (ts *FakeCoinsAPITestSuite) testSigningKeyRotation() {
+	_, oldToken := ts.createUser()
+
+	_, err := ts.keyring.Rotate(context.Background(), time.Hour)
+	ts.Require().NoError(err)
+
+	_, newToken := ts.createUser()
+	oldKid, newKid := tokenKeyID(oldToken), tokenKeyID(newToken)
+	ts.NotEqual(oldKid, newKid)
+
+	var jwks service.JWKS
+	res := ts.Request("GET", "/.well-known/jwks.json").
+		WithResponseData(&jwks).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	kids := make(map[string]string)
+	for _, k := range jwks.Keys {
+		kids[k.KeyID] = k.Algorithm
+	}
+	ts.Equal("EdDSA", kids[oldKid])
+	ts.Equal("EdDSA", kids[newKid])
+
+	for _, token := range []string{oldToken, newToken} {
+		res = ts.Request("GET", "/iam").
+			WithBearerToken(token).
+			Do()
+		ts.Equal(200, res.Code)
+	}
+
+	_, err = ts.keyring.Rotate(context.Background(), 0)
+	ts.Require().NoError(err)
+
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(newToken).
+		Do()
+	ts.Equal(401, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testIdempotencyKeys() {
+	key := fmt.Sprintf("signup-%d", rnd.Int())
+	request := DefaultSignupRequest()
+
+	var first, retry api.SignupResponse
+	res := ts.Request("POST", "/signup").
+		WithRequestData(request).
+		WithResponseData(&first).
+		WithHeader("Idempotency-Key", key).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	res = ts.Request("POST", "/signup").
+		WithRequestData(request).
+		WithResponseData(&retry).
+		WithHeader("Idempotency-Key", key).
+		Do()
+	ts.Equal(201, res.Code)
+	ts.Equal("true", res.Header.Get("Idempotent-Replayed"))
+	ts.Equal(first, retry)
+
+	otherRequest := DefaultSignupRequest()
+	res = ts.Request("POST", "/signup").
+		WithRequestData(otherRequest).
+		WithHeader("Idempotency-Key", key).
+		Do()
+	ts.Equal(422, res.Code)
+
+	sender, senderToken := ts.createUser()
+	receiver, _ := ts.createUser()
+	transfer := api.TransferRequest{
+		From:   walletByCurrency(sender.Wallets, "fBTC").Address,
+		To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+		Amount: "10",
+	}
+	key = fmt.Sprintf("transfer-%d", rnd.Int())
+	for i := 0; i < 2; i++ {
+		res = ts.Request("POST", "/transactions").
+			WithRequestData(transfer).
+			WithHeader("Idempotency-Key", key).
+			WithBearerToken(senderToken).
+			Do()
+		ts.Equal(201, res.Code)
+	}
+
+	ts.Equal("88", ts.walletBalance(senderToken, transfer.From))
+}
+
+func (ts *FakeCoinsAPITestSuite) testAPIKeys() {
+	ts.Run("scopes", ts.testAPIKeyScopes)
+	ts.Run("expiry and IP allowlist", ts.testAPIKeyRestrictions)
+	ts.Run("manage keys", ts.testManageAPIKeys)
+}
+
+func (ts *FakeCoinsAPITestSuite) testAPIKeyScopes() {
+	signupRes, token := ts.createUser()
+	key := ts.createAPIKey(token, api.CreateAPIKeyRequest{
+		Name:   "reader",
+		Scopes: []string{string(activerecord.ScopeWalletsRead)},
+	})
+	ts.True(strings.HasPrefix(key.Key, key.Prefix))
+
+	var wallets []api.WalletResponse
+	res := ts.Request("GET", "/wallets").
+		WithResponseData(&wallets).
+		WithAPIKey(key.Key).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.Len(wallets, len(signupRes.Wallets))
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(403, res.Code)
+
+	res = ts.Request("POST", "/transactions").
+		WithRequestData(api.TransferRequest{
+			From:   wallets[0].Address,
+			To:     wallets[0].Address,
+			Amount: "1",
+		}).
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(403, res.Code)
+
+	// Session-only endpoints do not accept API keys at all, so a key cannot create other keys
+	res = ts.Request("POST", "/api-keys").
+		WithRequestData(api.CreateAPIKeyRequest{
+			Name:   "escalated",
+			Scopes: []string{string(activerecord.ScopeTransactionsWrite)},
+		}).
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(403, res.Code)
+
+	res = ts.Request("GET", "/wallets").
+		WithAPIKey(key.Key + "x").
+		Do()
+	ts.Equal(401, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testAPIKeyRestrictions() {
+	_, token := ts.createUser()
+
+	res := ts.Request("POST", "/api-keys").
+		WithRequestData(api.CreateAPIKeyRequest{
+			Name:      "expired",
+			Scopes:    []string{string(activerecord.ScopeProfileRead)},
+			ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+		}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(400, res.Code)
+
+	res = ts.Request("POST", "/api-keys").
+		WithRequestData(api.CreateAPIKeyRequest{
+			Name:   "unknown scope",
+			Scopes: []string{"wallets:delete"},
+		}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(400, res.Code)
+
+	res = ts.Request("POST", "/api-keys").
+		WithRequestData(api.CreateAPIKeyRequest{
+			Name:       "bad allowlist",
+			Scopes:     []string{string(activerecord.ScopeProfileRead)},
+			AllowedIPs: []string{"10.0.0.0/33"},
+		}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(400, res.Code)
+
+	key := ts.createAPIKey(token, api.CreateAPIKeyRequest{
+		Name:       "office",
+		Scopes:     []string{string(activerecord.ScopeProfileRead)},
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+		AllowedIPs: []string{"10.0.0.0/24", "192.168.1.7"},
+	})
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("10.0.0.42:5000").
+		Do()
+	ts.Equal(200, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("192.168.1.7:5000").
+		Do()
+	ts.Equal(200, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("10.0.1.1:5000").
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("10.0.1.1:5000").
+		WithHeader("X-Forwarded-For", "10.0.0.42").
+		Do()
+	ts.Equal(401, res.Code, "X-Forwarded-For of a client which is not a trusted proxy is ignored")
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("127.0.0.1:5000").
+		WithHeader("X-Forwarded-For", "10.0.0.42").
+		Do()
+	ts.Equal(200, res.Code, "the client IP is forwarded by a trusted proxy")
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		WithRemoteAddr("127.0.0.1:5000").
+		WithHeader("X-Forwarded-For", "10.0.0.42, 10.0.1.1").
+		Do()
+	ts.Equal(401, res.Code, "addresses before the one added by the trusted proxy are set by the client")
+}
+
+func (ts *FakeCoinsAPITestSuite) testManageAPIKeys() {
+	_, token := ts.createUser()
+	_, foreignToken := ts.createUser()
+	key := ts.createAPIKey(token, api.CreateAPIKeyRequest{
+		Name:   "bot",
+		Scopes: []string{string(activerecord.ScopeProfileRead)},
+	})
+
+	var keys []api.APIKeyResponse
+	res := ts.Request("GET", "/api-keys").
+		WithResponseData(&keys).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.Require().Len(keys, 1)
+	ts.Equal(key.ID, keys[0].ID)
+	ts.Equal(key.Prefix, keys[0].Prefix)
+
+	res = ts.Request("GET", "/api-keys/"+key.ID).
+		WithBearerToken(foreignToken).
+		Do()
+	ts.Equal(404, res.Code)
+
+	name := "renamed bot"
+	scopes := []string{string(activerecord.ScopeWalletsRead)}
+	var updated api.APIKeyResponse
+	res = ts.Request("PATCH", "/api-keys/"+key.ID).
+		WithRequestData(api.UpdateAPIKeyRequest{
+			Name:   &name,
+			Scopes: &scopes,
+		}).
+		WithResponseData(&updated).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.Equal(name, updated.Name)
+	ts.Equal(scopes, updated.Scopes)
+
+	res = ts.Request("GET", "/iam").
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(403, res.Code)
+
+	res = ts.Request("GET", "/wallets").
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(200, res.Code)
+
+	var found api.APIKeyResponse
+	res = ts.Request("GET", "/api-keys/"+key.ID).
+		WithResponseData(&found).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.NotNil(found.LastUsedAt)
+
+	res = ts.Request("DELETE", "/api-keys/"+key.ID).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(204, res.Code)
+
+	res = ts.Request("GET", "/wallets").
+		WithAPIKey(key.Key).
+		Do()
+	ts.Equal(401, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTwoFactor() {
+	ts.Run("enroll and sign in", ts.testTwoFactorSignIn)
+	ts.Run("recovery codes", ts.testRecoveryCodes)
+	ts.Run("disable", ts.testDisableTwoFactor)
+	ts.Run("throttle", ts.testTwoFactorThrottle)
+}
+
+func (ts *FakeCoinsAPITestSuite) testTwoFactorSignIn() {
+	email, password, token := ts.createUserWithCredentials()
+
+	res := ts.Request("POST", "/2fa/confirm").
+		WithRequestData(api.TwoFactorConfirmRequest{Code: "123456"}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(404, res.Code)
+
+	secret := ts.enrollTwoFactor(token)
+
+	// The factor is not required until it is confirmed
+	ts.signIn(email, password)
+
+	res = ts.Request("POST", "/2fa/confirm").
+		WithRequestData(api.TwoFactorConfirmRequest{Code: ts.otp(secret, ts.clock.Add(-time.Hour))}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	var confirmRes api.TwoFactorConfirmResponse
+	res = ts.Request("POST", "/2fa/confirm").
+		WithRequestData(api.TwoFactorConfirmRequest{Code: ts.otp(secret, ts.clock)}).
+		WithResponseData(&confirmRes).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.Len(confirmRes.RecoveryCodes, 10)
+
+	res = ts.Request("POST", "/2fa/enroll").
+		WithBearerToken(token).
+		Do()
+	ts.Equal(409, res.Code)
+
+	var challenge api.TwoFactorChallengeResponse
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		WithResponseData(&challenge).
+		Do()
+	ts.Equal(401, res.Code)
+	ts.Equal("otp", challenge.Challenge)
+
+	// The code which confirmed the factor cannot be replayed
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password, OTP: ts.otp(secret, ts.clock)}).
+		Do()
+	ts.Equal(401, res.Code)
+
+	ts.clock = ts.clock.Add(30 * time.Second)
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password, OTP: ts.otp(secret, ts.clock)}).
+		Do()
+	ts.Equal(200, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testRecoveryCodes() {
+	email, password, token := ts.createUserWithCredentials()
+	secret := ts.enrollTwoFactor(token)
+
+	var confirmRes api.TwoFactorConfirmResponse
+	res := ts.Request("POST", "/2fa/confirm").
+		WithRequestData(api.TwoFactorConfirmRequest{Code: ts.otp(secret, ts.clock)}).
+		WithResponseData(&confirmRes).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	recoveryCode := confirmRes.RecoveryCodes[0]
+
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password, OTP: recoveryCode}).
+		Do()
+	ts.Equal(200, res.Code)
+
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password, OTP: recoveryCode}).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password, OTP: confirmRes.RecoveryCodes[1]}).
+		Do()
+	ts.Equal(200, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testDisableTwoFactor() {
+	email, password, token := ts.createUserWithCredentials()
+	secret := ts.enrollTwoFactor(token)
+
+	res := ts.Request("POST", "/2fa/confirm").
+		WithRequestData(api.TwoFactorConfirmRequest{Code: ts.otp(secret, ts.clock)}).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	ts.clock = ts.clock.Add(30 * time.Second)
+	res = ts.Request("POST", "/2fa/disable").
+		WithRequestData(api.TwoFactorDisableRequest{Password: "wrong password", OTP: ts.otp(secret, ts.clock)}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/2fa/disable").
+		WithRequestData(api.TwoFactorDisableRequest{Password: password}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/2fa/disable").
+		WithRequestData(api.TwoFactorDisableRequest{Password: password, OTP: ts.otp(secret, ts.clock)}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(204, res.Code)
+
+	ts.signIn(email, password)
+}
+
+// testTwoFactorThrottle guesses codes with a valid access token, the guesses lock the account out like failed sign ins
+func (ts *FakeCoinsAPITestSuite) testTwoFactorThrottle() {
+	email, password, token := ts.createUserWithCredentials()
+	user, err := ts.activeRecords.User().FindByEmail(context.Background(), email)
+	ts.Require().NoError(err)
+	secret := ts.enrollTwoFactor(token)
+	wrongCode := ts.otp(secret, ts.clock.Add(-time.Hour))
+
+	confirm := func(code string) int {
+		return ts.Request("POST", "/2fa/confirm").
+			WithRequestData(api.TwoFactorConfirmRequest{Code: code}).
+			WithBearerToken(token).
+			Do().Code
+	}
+
+	for i := 0; i < 10; i++ {
+		ts.clock = ts.clock.Add(time.Minute)
+		ts.Equal(401, confirm(wrongCode))
+	}
+
+	ts.clock = ts.clock.Add(time.Minute)
+	ts.Equal(429, confirm(ts.otp(secret, ts.clock)), "even the right code waits for the lockout")
+
+	events, err := ts.activeRecords.Audit().FindByUserID(context.Background(), user.ID())
+	ts.Require().NoError(err)
+	ts.Require().NotEmpty(events)
+	ts.Equal(activerecord.AuditAccountLocked, events[0].Kind)
+
+	ts.clock = ts.clock.Add(15 * time.Minute)
+	ts.Equal(200, confirm(ts.otp(secret, ts.clock)))
+
+	// The failures are remembered for the window, so the next wrong password locks the account again
+	ts.clock = ts.clock.Add(30 * time.Second)
+	res := ts.Request("POST", "/2fa/disable").
+		WithRequestData(api.TwoFactorDisableRequest{Password: "wrong password", OTP: ts.otp(secret, ts.clock)}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/2fa/disable").
+		WithRequestData(api.TwoFactorDisableRequest{Password: password, OTP: ts.otp(secret, ts.clock)}).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(429, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testBruteForceProtection() {
+	ts.Run("generic error", ts.testGenericLoginError)
+	ts.Run("backoff and lockout", ts.testAccountLockout)
+	ts.Run("per IP", ts.testIPThrottle)
+}
+
+func (ts *FakeCoinsAPITestSuite) testGenericLoginError() {
+	email, _, _ := ts.createUserWithCredentials()
+
+	var wrongPassword, unknownEmail api.ErrorResponse
+	start := time.Now()
+	res := ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: "wrong password"}).
+		WithResponseData(&wrongPassword).
+		Do()
+	ts.Equal(401, res.Code)
+	wrongPasswordTime := time.Since(start)
+
+	start = time.Now()
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: DefaultSignupRequest().Email, Password: "wrong password"}).
+		WithResponseData(&unknownEmail).
+		Do()
+	ts.Equal(401, res.Code)
+	ts.Equal(wrongPassword, unknownEmail)
+
+	// Both compare a bcrypt hash, which takes far longer than the rest of the request
+	ts.Greater(int64(time.Since(start)), int64(wrongPasswordTime/4), "unknown emails must not answer faster")
+}
+
+func (ts *FakeCoinsAPITestSuite) testAccountLockout() {
+	email, password, _ := ts.createUserWithCredentials()
+	user, err := ts.activeRecords.User().FindByEmail(context.Background(), email)
+	ts.Require().NoError(err)
+	wrong := api.TokenRequest{Email: email, Password: "wrong password"}
+
+	for i := 0; i < 4; i++ {
+		res := ts.Request("POST", "/token").WithRequestData(wrong).Do()
+		ts.Equal(401, res.Code)
+	}
+
+	// Even the right password waits for the backoff
+	res := ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		Do()
+	ts.Equal(429, res.Code)
+	ts.Equal("1", res.Header.Get("Retry-After"))
+
+	ts.clock = ts.clock.Add(time.Second)
+	ts.signIn(email, password)
+
+	// The audit log records the peer, not the address the client claims
+	ip := fmt.Sprintf("10.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+	for i := 0; i < 10; i++ {
+		ts.clock = ts.clock.Add(time.Minute)
+		res = ts.Request("POST", "/token").
+			WithRequestData(wrong).
+			WithRemoteAddr(ip + ":5000").
+			WithHeader("X-Forwarded-For", "203.0.113.1").
+			Do()
+		ts.Equal(401, res.Code)
+	}
+
+	ts.clock = ts.clock.Add(time.Minute)
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		Do()
+	ts.Equal(429, res.Code)
+	ts.Equal("840", res.Header.Get("Retry-After"))
+
+	events, err := ts.activeRecords.Audit().FindByUserID(context.Background(), user.ID())
+	ts.Require().NoError(err)
+	ts.Require().Len(events, 1)
+	ts.Equal(activerecord.AuditAccountLocked, events[0].Kind)
+	ts.Equal(ip, events[0].IP)
+
+	_, userToken := ts.createUser()
+	res = ts.Request("POST", "/admin/users/"+user.ID().String()+"/unlock").
+		WithBearerToken(userToken).
+		Do()
+	ts.Equal(403, res.Code)
+
+	adminToken := ts.createAdmin()
+	res = ts.Request("POST", "/admin/users/"+user.ID().String()+"/unlock").
+		WithBearerToken(adminToken).
+		Do()
+	ts.Equal(204, res.Code)
+
+	ts.signIn(email, password)
+
+	events, err = ts.activeRecords.Audit().FindByUserID(context.Background(), user.ID())
+	ts.Require().NoError(err)
+	ts.Require().Len(events, 2)
+	ts.Equal(activerecord.AuditAccountUnlocked, events[0].Kind)
+	ts.NotNil(events[0].Actor)
+}
+
+func (ts *FakeCoinsAPITestSuite) testIPThrottle() {
+	email, password, _ := ts.createUserWithCredentials()
+	ip := fmt.Sprintf("10.%d.%d.%d", rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+
+	// Every attempt guesses another account and claims another address, so only the IP collects failures
+	for i := 0; i < 21; i++ {
+		res := ts.Request("POST", "/token").
+			WithRequestData(api.TokenRequest{Email: DefaultSignupRequest().Email, Password: "wrong password"}).
+			WithRemoteAddr(ip + ":5000").
+			WithHeader("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i)).
+			Do()
+		ts.Equal(401, res.Code)
+	}
+
+	res := ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		WithRemoteAddr(ip + ":5000").
+		WithHeader("X-Forwarded-For", "203.0.113.100").
+		Do()
+	ts.Equal(429, res.Code)
+
+	// Behind the trusted proxy the forwarded address is the client
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		WithRemoteAddr("127.0.0.1:5000").
+		WithHeader("X-Forwarded-For", ip).
+		Do()
+	ts.Equal(429, res.Code)
+
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		WithRemoteAddr("192.0.2.1:5000").
+		Do()
+	ts.Equal(200, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testEmailVerification() {
+	request := DefaultSignupRequest()
+	var signupRes api.SignupResponse
+	res := ts.Request("POST", "/signup").
+		WithRequestData(request).
+		WithResponseData(&signupRes).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	token := ts.signIn(request.Email, request.Password).Token
+	receiver, _ := ts.createUser()
+
+	transfer := api.TransferRequest{
+		From:   walletByCurrency(signupRes.Wallets, "fBTC").Address,
+		To:     walletByCurrency(receiver.Wallets, "fBTC").Address,
+		Amount: "1",
+	}
+	res = ts.Request("POST", "/transactions").
+		WithRequestData(transfer).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(403, res.Code)
+
+	verificationToken := ts.mailedToken(request.Email)
+	parts := strings.Split(verificationToken, ".")
+	res = ts.Request("POST", "/verify-email").
+		WithRequestData(api.VerifyEmailRequest{Token: parts[0] + ".forged"}).
+		Do()
+	ts.Equal(400, res.Code)
+
+	// A verification token does not reset the password
+	res = ts.Request("POST", "/password/reset").
+		WithRequestData(api.ResetPasswordRequest{Token: verificationToken, Password: "new password"}).
+		Do()
+	ts.Equal(400, res.Code)
+
+	res = ts.Request("POST", "/verify-email").
+		WithRequestData(api.VerifyEmailRequest{Token: verificationToken}).
+		Do()
+	ts.Equal(204, res.Code)
+
+	res = ts.Request("POST", "/verify-email").
+		WithRequestData(api.VerifyEmailRequest{Token: verificationToken}).
+		Do()
+	ts.Equal(400, res.Code)
+
+	var iamRes api.IAmResponse
+	res = ts.Request("GET", "/iam").
+		WithResponseData(&iamRes).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+	ts.True(iamRes.EmailVerified)
+
+	res = ts.Request("POST", "/transactions").
+		WithRequestData(transfer).
+		WithBearerToken(token).
+		Do()
+	ts.Equal(201, res.Code)
+
+	res = ts.Request("POST", "/verify-email/resend").
+		WithBearerToken(token).
+		Do()
+	ts.Equal(409, res.Code)
+}
+
+func (ts *FakeCoinsAPITestSuite) testPasswordReset() {
+	email, password, token := ts.createUserWithCredentials()
+
+	unknown := DefaultSignupRequest().Email
+	res := ts.Request("POST", "/password/forgot").
+		WithRequestData(api.ForgotPasswordRequest{Email: unknown}).
+		Do()
+	ts.Equal(202, res.Code)
+	ts.accounts.Wait()
+	_, sent := ts.outbox.Last(unknown)
+	ts.False(sent)
+
+	res = ts.Request("POST", "/password/forgot").
+		WithRequestData(api.ForgotPasswordRequest{Email: email}).
+		Do()
+	ts.Equal(202, res.Code)
+	resetToken := ts.mailedToken(email)
+
+	res = ts.Request("POST", "/password/reset").
+		WithRequestData(api.ResetPasswordRequest{Token: resetToken, Password: "short"}).
+		Do()
+	ts.Equal(400, res.Code)
+
+	newPassword := password + "new"
+	res = ts.Request("POST", "/password/reset").
+		WithRequestData(api.ResetPasswordRequest{Token: resetToken, Password: newPassword}).
+		Do()
+	ts.Equal(204, res.Code)
+
+	res = ts.Request("POST", "/password/reset").
+		WithRequestData(api.ResetPasswordRequest{Token: resetToken, Password: password}).
+		Do()
+	ts.Equal(400, res.Code)
+
+	// Sessions started with the old password are revoked
+	res = ts.Request("GET", "/iam").
+		WithBearerToken(token).
+		Do()
+	ts.Equal(401, res.Code)
+
+	res = ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{Email: email, Password: password}).
+		Do()
+	ts.Equal(401, res.Code)
+
+	ts.signIn(email, newPassword)
+}
+
+// enrollTwoFactor starts enrollment and returns the TOTP secret
+func (ts *FakeCoinsAPITestSuite) enrollTwoFactor(token string) string {
+	var enrollRes api.TwoFactorEnrollResponse
+	res := ts.Request("POST", "/2fa/enroll").
+		WithResponseData(&enrollRes).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.Contains(enrollRes.URI, enrollRes.Secret)
+
+	return enrollRes.Secret
+}
+
+func (ts *FakeCoinsAPITestSuite) otp(secret string, at time.Time) string {
+	code, err := activerecord.TOTPCode(secret, at)
+	ts.Require().NoError(err)
+
+	return code
+}
+
+func (ts *FakeCoinsAPITestSuite) createAPIKey(token string, req api.CreateAPIKeyRequest) api.CreateAPIKeyResponse {
+	var key api.CreateAPIKeyResponse
+	res := ts.Request("POST", "/api-keys").
+		WithRequestData(req).
+		WithResponseData(&key).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(201, res.Code)
+
+	return key
+}
+
+func (ts *FakeCoinsAPITestSuite) createAdmin() string {
+	signupRes, token := ts.createUser()
+
+	user, err := ts.activeRecords.User().FindByEmail(context.Background(), signupRes.Email)
+	ts.Require().NoError(err)
+	ts.Require().NoError(user.SetAdmin(context.Background(), true))
+
+	return token
+}
+
+func (ts *FakeCoinsAPITestSuite) createUser() (api.SignupResponse, string) {
+	request := DefaultSignupRequest()
+
+	var signupRes api.SignupResponse
+	res := ts.Request("POST", "/signup").
+		WithRequestData(request).
+		WithResponseData(&signupRes).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.verifyEmail(request.Email)
+
+	return signupRes, ts.signIn(request.Email, request.Password).Token
+}
+
+// createUserWithCredentials creates a user and returns its email, password and access token
+func (ts *FakeCoinsAPITestSuite) createUserWithCredentials() (string, string, string) {
+	request := DefaultSignupRequest()
+	res := ts.Request("POST", "/signup").
+		WithRequestData(request).
+		Do()
+	ts.Require().Equal(201, res.Code)
+	ts.verifyEmail(request.Email)
+
+	return request.Email, request.Password, ts.signIn(request.Email, request.Password).Token
+}
+
+func (ts *FakeCoinsAPITestSuite) verifyEmail(email string) {
+	res := ts.Request("POST", "/verify-email").
+		WithRequestData(api.VerifyEmailRequest{Token: ts.mailedToken(email)}).
+		Do()
+	ts.Require().Equal(204, res.Code)
+}
+
+// mailedToken returns the token from the latest email sent to the address, it waits for emails sent in the background
+func (ts *FakeCoinsAPITestSuite) mailedToken(email string) string {
+	ts.accounts.Wait()
+	msg, ok := ts.outbox.Last(email)
+	ts.Require().True(ok, "no email sent to %s", email)
+
+	const prefix = "Token: "
+	i := strings.LastIndex(msg.Body, prefix)
+	ts.Require().True(i >= 0, "no token in email to %s", email)
+
+	return strings.TrimSpace(msg.Body[i+len(prefix):])
+}
+
+func (ts *FakeCoinsAPITestSuite) signIn(email, password string) api.TokenResponse {
+	var tokenRes api.TokenResponse
+	res := ts.Request("POST", "/token").
+		WithRequestData(api.TokenRequest{
+			Email:    email,
+			Password: password,
+		}).
+		WithResponseData(&tokenRes).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	return tokenRes
+}
+
+func (ts *FakeCoinsAPITestSuite) walletBalance(token, address string) string {
+	var walletsRes []api.WalletResponse
+	res := ts.Request("GET", "/wallets").
+		WithResponseData(&walletsRes).
+		WithBearerToken(token).
+		Do()
+	ts.Require().Equal(200, res.Code)
+
+	for _, w := range walletsRes {
+		if w.Address == address {
+			return w.Balance
+		}
+	}
+
+	return ""
+}
+
+func currencyBySymbol(currencies []api.CurrencyResponse, symbol string) api.CurrencyResponse {
+	for _, c := range currencies {
+		if c.Symbol == symbol {
+			return c
+		}
+	}
+
+	return api.CurrencyResponse{}
+}
+
+func feeRevenueByCurrency(revenues []api.FeeRevenueResponse, currency string) api.FeeRevenueResponse {
+	for _, r := range revenues {
+		if r.Currency == currency {
+			return r
+		}
+	}
+
+	return api.FeeRevenueResponse{}
+}
+
+func tokenKeyID(token string) string {
+	t, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.StandardClaims{})
+	if err != nil {
+		return ""
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	return kid
+}
+
+func walletByCurrency(wallets []api.WalletResponse, currency string) api.WalletResponse {
+	for _, w := range wallets {
+		if w.Currency == currency {
+			return w
+		}
+	}
+
+	return api.WalletResponse{}
+}
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/merisho/binaryx-test/api"
+	"github.com/merisho/binaryx-test/config"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	conf, args, err := config.Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.Empty(t, args)
+	assert.Equal(t, config.Default().DB, conf.DB)
+
+	apiConf := conf.API()
+	assert.Equal(t, api.TestMode, apiConf.APIMode)
+	assert.Equal(t, 8080, apiConf.Port)
+	assert.Equal(t, time.Duration(3600), apiConf.TokenTTLSeconds)
+	assert.True(t, apiConf.DefaultSignupBonus.IsZero())
+	assert.Empty(t, apiConf.DefaultFeeSchedules)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+port: 9000
+db:
+  url: postgres://file@db/fakecoins
+  max_conns: 20
+  connect_timeout: 2s
+jwt:
+  algorithm: EdDSA
+  access_token_ttl: 15m
+currencies:
+  signup_bonus: "5"
+  fee_schedules: '{"transfer": {"type": "flat", "amount": "0.5"}}'
+`)
+
+	conf, args, err := config.Load([]string{"-config", file, "-db-max-conns", "30", "reconcile"}, env(map[string]string{
+		"PORT":          "9001",
+		"DB_MAX_CONNS":  "25",
+		"DB_URL":        "postgres://env@db/fakecoins",
+		"SMTP_ADDR":     "smtp.example.com:587",
+		"SMTP_FROM":     "noreply@example.com",
+		"SMTP_PASSWORD": "from-env",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reconcile"}, args)
+
+	assert.Equal(t, 9001, conf.Port)
+	assert.Equal(t, "postgres://env@db/fakecoins", conf.DB.URL)
+	assert.Equal(t, int32(30), conf.DB.MaxConns)
+	assert.Equal(t, 2*time.Second, conf.DB.ConnectTimeout)
+	assert.Equal(t, activerecord.EdDSA, conf.JWT.Algorithm)
+	assert.Equal(t, "from-env", conf.Email.SMTP.Password)
+
+	apiConf := conf.API()
+	assert.Equal(t, time.Duration(900), apiConf.TokenTTLSeconds)
+	assert.True(t, decimal.NewFromInt(5).Equal(apiConf.DefaultSignupBonus))
+	assert.Contains(t, apiConf.DefaultFeeSchedules, activerecord.TransferTransaction)
+
+	poolConfig, err := conf.PoolConfig()
+	require.NoError(t, err)
+	assert.Equal(t, int32(30), poolConfig.MaxConns)
+	assert.Equal(t, 2*time.Second, poolConfig.ConnConfig.ConnectTimeout)
+}
+
+func TestConfigTOML(t *testing.T) {
+	file := writeFile(t, "config.toml", `
+mode = "debug"
+idempotency_ttl = "1h"
+
+[db]
+min_conns = 2
+max_conn_idle_time = "1m"
+`)
+
+	conf, _, err := config.Load(nil, env(map[string]string{"CONFIG_FILE": file}))
+	require.NoError(t, err)
+	assert.Equal(t, api.DebugMode, conf.Mode)
+	assert.Equal(t, time.Hour, conf.IdempotencyTTL)
+	assert.Equal(t, int32(2), conf.DB.MinConns)
+	assert.Equal(t, time.Minute, conf.DB.MaxConnIdleTime)
+}
+
+func TestConfigRejectsUnknownFileKeys(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "db:\n  max_connections: 5\n",
+		"config.toml": "[db]\nmax_connections = 5\n",
+	} {
+		_, _, err := config.Load([]string{"-config", writeFile(t, name, content)}, env(nil))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestConfigSecretFiles(t *testing.T) {
+	secret := strings.Repeat("s", 40)
+	file := writeFile(t, "secret", secret+"\n")
+
+	conf, _, err := config.Load(nil, env(map[string]string{"EMAIL_TOKEN_SECRET_FILE": file}))
+	require.NoError(t, err)
+	assert.Equal(t, secret, conf.Email.TokenSecret)
+
+	_, _, err = config.Load(nil, env(map[string]string{"EMAIL_TOKEN_SECRET_FILE": file, "EMAIL_TOKEN_SECRET": "other"}))
+	assert.Error(t, err)
+
+	_, _, err = config.Load(nil, env(map[string]string{"EMAIL_TOKEN_SECRET_FILE": filepath.Join(t.TempDir(), "missing")}))
+	assert.Error(t, err)
+}
+
+func TestConfigValidation(t *testing.T) {
+	for name, vars := range map[string]map[string]string{
+		"mode":              {"API_MODE": "production"},
+		"port":              {"PORT": "70000"},
+		"malformed port":    {"PORT": "http"},
+		"db url":            {"DB_URL": "mysql://db"},
+		"sqlite path":       {"DB_URL": "sqlite://"},
+		"trusted proxy":     {"TRUSTED_PROXIES": "10.0.0.0/8,proxy"},
+		"max conns":         {"DB_MAX_CONNS": "0"},
+		"min conns":         {"DB_MIN_CONNS": "11"},
+		"connect timeout":   {"DB_CONNECT_TIMEOUT": "0s"},
+		"jwt algorithm":     {"JWT_ALGORITHM": "HS256"},
+		"token ttl":         {"ACCESS_TOKEN_TTL": "-1m"},
+		"rotation grace":    {"ACCESS_TOKEN_TTL": "3h", "KEY_ROTATION_GRACE": "2h"},
+		"smtp from":         {"SMTP_ADDR": "smtp.example.com:587"},
+		"signup bonus":      {"SIGNUP_BONUS": "-1"},
+		"fee schedule":      {"FEE_SCHEDULES": `{"transfer": {"type": "unknown"}}`},
+		"fee schedule kind": {"FEE_SCHEDULES": `{"mint": {"type": "flat", "amount": "1"}}`},
+	} {
+		_, _, err := config.Load(nil, env(vars))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestConfigTrustedProxies(t *testing.T) {
+	conf, _, err := config.Load(nil, env(nil))
+	require.NoError(t, err)
+	assert.Empty(t, conf.API().TrustedProxies, "no proxies are trusted by default")
+
+	conf, _, err = config.Load(nil, env(map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8, 192.168.1.7"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.7"}, conf.API().TrustedProxies)
+}
+
+func TestConfigSQLiteURL(t *testing.T) {
+	conf, _, err := config.Load(nil, env(map[string]string{"DB_URL": "sqlite:///var/lib/fakecoins/fakecoins.db"}))
+	require.NoError(t, err)
+
+	path, ok := conf.DB.SQLitePath()
+	assert.True(t, ok)
+	assert.Equal(t, "/var/lib/fakecoins/fakecoins.db", path)
+
+	_, ok = config.Default().DB.SQLitePath()
+	assert.False(t, ok, "the default DB is Postgres")
+}
+
+func TestConfigReleaseModeRequiresSecrets(t *testing.T) {
+	secret := strings.Repeat("s", 40)
+
+	_, _, err := config.Load([]string{"-mode", "release"}, env(map[string]string{"DB_URL": "postgres://prod@db/fakecoins"}))
+	assert.Error(t, err, "no email token secret")
+
+	_, _, err = config.Load([]string{"-mode", "release"}, env(map[string]string{"DB_URL": "postgres://prod@db/fakecoins", "EMAIL_TOKEN_SECRET": "test"}))
+	assert.Error(t, err, "short email token secret")
+
+	_, _, err = config.Load([]string{"-mode", "release"}, env(map[string]string{"EMAIL_TOKEN_SECRET": secret}))
+	assert.Error(t, err, "default DB URL")
+
+	_, _, err = config.Load([]string{"-mode", "release"}, env(map[string]string{"DB_URL": "postgres://prod@db/fakecoins", "EMAIL_TOKEN_SECRET": secret}))
+	assert.Error(t, err, "no signing key secret")
+
+	_, _, err = config.Load([]string{"-mode", "release"}, env(map[string]string{"DB_URL": "postgres://prod@db/fakecoins", "EMAIL_TOKEN_SECRET": secret,
+		"SIGNING_KEY_SECRET": "test"}))
+	assert.Error(t, err, "short signing key secret")
+
+	conf, _, err := config.Load([]string{"-mode", "release"}, env(map[string]string{"DB_URL": "postgres://prod@db/fakecoins", "EMAIL_TOKEN_SECRET": secret,
+		"SIGNING_KEY_SECRET": secret}))
+	require.NoError(t, err)
+	assert.Equal(t, api.ReleaseMode, conf.Mode)
+}
@@ -0,0 +1,38 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/merisho/binaryx-test/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningMethodEdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	token := jwt.NewWithClaims(service.SigningMethodEdDSA, &jwt.StandardClaims{Id: "test"})
+	signed, err := token.SignedString(private)
+	require.NoError(t, err)
+
+	claims := &jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(signed, claims, func(*jwt.Token) (interface{}, error) {
+		return public, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "test", claims.Id)
+
+	_, err = jwt.ParseWithClaims(signed, &jwt.StandardClaims{}, func(*jwt.Token) (interface{}, error) {
+		return otherPublic, nil
+	})
+	assert.Error(t, err)
+
+	_, err = token.SignedString([]byte("secret"))
+	assert.Equal(t, jwt.ErrInvalidKeyType, err)
+}
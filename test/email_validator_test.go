@@ -0,0 +1,148 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/merisho/binaryx-test/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyntaxEmailValidator(t *testing.T) {
+	v := activerecord.SyntaxEmailValidator{}
+	for email, expected := range map[string]bool{
+		"user@example.com":            true,
+		"first.last+tag@example.com":  true,
+		"q_1s12s_.@3fjjk@example.com": false,
+		"User <user@example.com>":     false,
+		"user example.com":            false,
+		"user@":                       false,
+	} {
+		valid, err := v.ValidateEmail(context.Background(), email)
+		require.NoError(t, err)
+		assert.Equal(t, expected, valid, email)
+	}
+}
+
+func TestDisposableEmailValidator(t *testing.T) {
+	v := service.NewDisposableEmailValidator(service.DefaultDisposableDomains)
+	for email, expected := range map[string]bool{
+		"user@example.com":       true,
+		"user@mailinator.com":    false,
+		"user@eu.mailinator.com": false,
+		"user@notmailinator.com": true,
+	} {
+		valid, err := v.ValidateEmail(context.Background(), email)
+		require.NoError(t, err)
+		assert.Equal(t, expected, valid, email)
+	}
+}
+
+func TestMXEmailValidator(t *testing.T) {
+	resolver := &countingResolver{
+		MXResolver: service.StaticResolver{
+			"example.com": {"mx1.example.com", "mx2.example.com"},
+			"nullmx.com":  {"."},
+		},
+	}
+	v := service.NewMXEmailValidator(resolver, time.Hour, time.Second)
+
+	for email, expected := range map[string]bool{
+		"user@example.com":          true,
+		"user@nullmx.com":           false,
+		"user@asdfqejnviersdvb.com": false,
+	} {
+		valid, err := v.ValidateEmail(context.Background(), email)
+		require.NoError(t, err)
+		assert.Equal(t, expected, valid, email)
+	}
+
+	lookups := resolver.lookups
+	_, err := v.ValidateEmail(context.Background(), "other@example.com")
+	require.NoError(t, err)
+	_, err = v.ValidateEmail(context.Background(), "other@asdfqejnviersdvb.com")
+	require.NoError(t, err)
+	assert.Equal(t, lookups, resolver.lookups, "results must be cached")
+}
+
+func TestMXEmailValidatorTimeout(t *testing.T) {
+	v := service.NewMXEmailValidator(slowResolver{}, time.Hour, 10*time.Millisecond)
+
+	started := time.Now()
+	valid, err := v.ValidateEmail(context.Background(), "user@example.com")
+	require.NoError(t, err)
+	assert.True(t, valid, "emails are accepted if the lookup times out")
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+}
+
+type countingResolver struct {
+	service.MXResolver
+	lookups int
+}
+
+func (r *countingResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	r.lookups++
+	return r.MXResolver.LookupMX(ctx, domain)
+}
+
+type slowResolver struct{}
+
+func (slowResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	<-ctx.Done()
+	return nil, &net.DNSError{Err: ctx.Err().Error(), Name: domain, IsTimeout: true}
+}
+
+// blockingEmailValidator accepts emails once it is released and reports when a validation starts
+type blockingEmailValidator struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (v blockingEmailValidator) ValidateEmail(ctx context.Context, email string) (bool, error) {
+	v.started <- struct{}{}
+	<-v.release
+	return true, nil
+}
+
+func TestSignupValidatesEmailOutsideDBTransaction(t *testing.T) {
+	validator := blockingEmailValidator{started: make(chan struct{}), release: make(chan struct{})}
+	activeRecords := activerecord.NewMemory(validator)
+	srv := newTestServer(t, activeRecords)
+
+	body, err := json.Marshal(DefaultSignupRequest())
+	require.NoError(t, err)
+	signup := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Gin().ServeHTTP(signup, httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body)))
+	}()
+	<-validator.started
+
+	// The memory store serializes DB transactions, so reads would wait for a DB transaction held by the lookup
+	currencies := make(chan int)
+	go func() {
+		res := httptest.NewRecorder()
+		srv.Gin().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/currencies", nil))
+		currencies <- res.Code
+	}()
+
+	select {
+	case code := <-currencies:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Error("the email lookup holds the DB")
+	}
+
+	close(validator.release)
+	<-done
+	assert.Equal(t, http.StatusCreated, signup.Code)
+}
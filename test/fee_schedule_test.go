@@ -0,0 +1,71 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeSchedules(t *testing.T) {
+	cases := []struct {
+		name     string
+		schedule string
+		amounts  map[string]string
+	}{
+		{
+			name:     "flat",
+			schedule: `{"type":"flat","amount":"1.5"}`,
+			amounts:  map[string]string{"1": "1.5", "1000": "1.5"},
+		},
+		{
+			name:     "percentage",
+			schedule: `{"type":"percentage","rate":"0.2"}`,
+			amounts:  map[string]string{"10": "2", "0.5": "0.1"},
+		},
+		{
+			name: "tiered",
+			schedule: `{"type":"tiered","tiers":[
+				{"from":"0","schedule":{"type":"flat","amount":"1"}},
+				{"from":"100","schedule":{"type":"percentage","rate":"0.01"}}
+			]}`,
+			amounts: map[string]string{"50": "1", "100": "1", "1000": "10"},
+		},
+		{
+			name:     "capped",
+			schedule: `{"type":"capped","schedule":{"type":"percentage","rate":"0.1"},"min":"0.5","max":"1"}`,
+			amounts:  map[string]string{"2": "0.5", "7": "0.7", "20": "1"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			schedule, err := activerecord.ParseFeeSchedule([]byte(c.schedule))
+			require.NoError(t, err)
+
+			for amount, fee := range c.amounts {
+				assert.Equal(t, fee, schedule.Fee(decimal.RequireFromString(amount)).String(), "amount %s", amount)
+			}
+
+			reparsed, err := activerecord.ParseFeeSchedule([]byte(schedule.Policy()))
+			require.NoError(t, err)
+			assert.Equal(t, schedule.Policy(), reparsed.Policy())
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{
+			`{"type":"unknown"}`,
+			`{"type":"flat","amount":"-1"}`,
+			`{"type":"percentage","rate":"1.5"}`,
+			`{"type":"tiered","tiers":[{"from":"10","schedule":{"type":"flat","amount":"1"}},{"from":"5","schedule":{"type":"flat","amount":"1"}}]}`,
+			`{"type":"capped","schedule":{"type":"flat","amount":"1"},"min":"2","max":"1"}`,
+			`not json`,
+		} {
+			_, err := activerecord.ParseFeeSchedule([]byte(s))
+			assert.IsType(t, activerecord.ValidationError{}, err, s)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/merisho/binaryx-test/api"
+	"github.com/merisho/binaryx-test/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer creates a server over the facade without the API test suite
+func newTestServer(t *testing.T, activeRecords activerecord.Facade) *api.Server {
+	srv, err := api.NewServer(api.Config{APIMode: api.TestMode}, activeRecords, service.NewWallets(activeRecords),
+		service.NewKeyring(activeRecords, activerecord.EdDSA, []byte("secret")), service.NewAccounts(activeRecords, &service.MemoryOutbox{}, []byte("secret")))
+	require.NoError(t, err)
+	return srv
+}
+
+// panickingFacade panics the first time a handler asks it for users
+type panickingFacade struct {
+	activerecord.Facade
+	panicked int32
+}
+
+func (f *panickingFacade) User() activerecord.UserFactory {
+	if atomic.CompareAndSwapInt32(&f.panicked, 0, 1) {
+		panic("user factory is broken")
+	}
+
+	return f.Facade.User()
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+	srv := newTestServer(t, &panickingFacade{Facade: activerecord.NewMemory(nil)})
+	body, err := json.Marshal(DefaultSignupRequest())
+	require.NoError(t, err)
+
+	signup := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body))
+		req.Header.Set("Idempotency-Key", "panic")
+		res := httptest.NewRecorder()
+		srv.Gin().ServeHTTP(res, req)
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, signup())
+	assert.Equal(t, http.StatusCreated, signup(), "the retry must not find the key in progress")
+}
+
+func TestIdempotencyKeyReleasedWhenResponseNotStored(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+
+	// Keys can be claimed and released, but storing a response fails
+	_, err := db.ExecContext(ctx, `CREATE TRIGGER idempotency_keys_read_only BEFORE UPDATE ON idempotency_keys
+									BEGIN SELECT RAISE(ABORT, 'idempotency keys are read-only'); END`)
+	require.NoError(t, err)
+
+	activeRecords := activerecord.NewSQLite(db, nil)
+	srv := newTestServer(t, activeRecords)
+	body, err := json.Marshal(DefaultSignupRequest())
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body))
+	req.Header.Set("Idempotency-Key", "unstored")
+	res := httptest.NewRecorder()
+	srv.Gin().ServeHTTP(res, req)
+	require.Equal(t, http.StatusCreated, res.Code)
+
+	hash := sha256.Sum256(body)
+	_, claimed, err := activeRecords.IdempotencyKey().Claim(ctx, "POST /signup", "unstored", hex.EncodeToString(hash[:]), time.Hour)
+	require.NoError(t, err)
+	assert.True(t, claimed, "the key must not stay in progress")
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/merisho/binaryx-test/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLifecycleServer creates a server on a free port with a GET /slow endpoint which responds after the delay
+func newLifecycleServer(t *testing.T, delay time.Duration) (*api.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	srv, err := api.NewServer(api.Config{APIMode: api.TestMode, Port: port}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	srv.Gin().GET("/slow", func(c *gin.Context) {
+		time.Sleep(delay)
+		c.Status(http.StatusNoContent)
+	})
+
+	return srv, fmt.Sprintf("http://127.0.0.1:%d/slow", port)
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	srv, url := newLifecycleServer(t, 200*time.Millisecond)
+	require.NoError(t, srv.Start(context.Background()))
+
+	codes := make(chan int, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			codes <- 0
+			return
+		}
+		res.Body.Close()
+		codes <- res.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.Equal(t, http.StatusNoContent, <-codes)
+
+	_, err := http.Get(url)
+	assert.Error(t, err, "the server must not accept requests after shutdown")
+
+	_, open := <-srv.Err()
+	assert.False(t, open)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, url := newLifecycleServer(t, 2*time.Second)
+	require.NoError(t, srv.Start(context.Background()))
+
+	go http.Get(url)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := srv.Shutdown(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWorkersStopOnShutdown(t *testing.T) {
+	srv, _ := newLifecycleServer(t, 0)
+
+	var runs int32
+	srv.AddWorker(api.NewPeriodicWorker("counter", 10*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return errors.New("errors do not stop the worker")
+	}))
+	require.NoError(t, srv.Start(context.Background()))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+
+	stopped := atomic.LoadInt32(&runs)
+	assert.Greater(t, stopped, int32(2))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&runs))
+}
+
+func TestStartFailsOnBusyPort(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	srv, err := api.NewServer(api.Config{APIMode: api.TestMode, Port: listener.Addr().(*net.TCPAddr).Port}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	assert.Error(t, srv.Start(context.Background()))
+}
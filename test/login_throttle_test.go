@@ -0,0 +1,47 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginThrottleBackoffIsCapped(t *testing.T) {
+	ctx := context.Background()
+	throttle := activerecord.NewMemory(nil).LoginThrottle()
+	policy := activerecord.ThrottlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		LockoutAttempts: 100,
+		Lockout:         15 * time.Minute,
+		Window:          time.Hour,
+	}
+	now := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	key := activerecord.IPThrottleKey("192.0.2.1")
+
+	// Far more failures than it takes the doubled delay to exceed the lockout or to overflow a duration
+	for i := 1; i < policy.LockoutAttempts; i++ {
+		locked, err := throttle.Fail(ctx, key, policy, now)
+		require.NoError(t, err)
+		require.False(t, locked)
+
+		until, err := throttle.BlockedUntil(ctx, now, key)
+		require.NoError(t, err)
+		if i <= policy.FreeAttempts {
+			assert.True(t, until.IsZero(), "failure %d", i)
+			continue
+		}
+
+		assert.True(t, until.After(now), "failure %d must block", i)
+		assert.False(t, until.After(now.Add(policy.Lockout)), "failure %d must not block longer than a lockout", i)
+	}
+}
+
+func TestAccountThrottleKeyIsNormalized(t *testing.T) {
+	assert.Equal(t, activerecord.AccountThrottleKey(activerecord.NormalizeEmail(" User@Example.com ")), activerecord.AccountThrottleKey(" User@Example.com "))
+	assert.Equal(t, "account:user@example.com", activerecord.AccountThrottleKey(" User@Example.com "))
+}
@@ -0,0 +1,32 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/merisho/binaryx-test/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	postgres, err := migrations.All()
+	require.NoError(t, err)
+	checkMigrations(t, postgres)
+
+	sqlite, err := migrations.AllSQLite()
+	require.NoError(t, err)
+	checkMigrations(t, sqlite)
+}
+
+func checkMigrations(t *testing.T, all []migrations.Migration) {
+	require.NotEmpty(t, all)
+
+	for i, m := range all {
+		assert.Equal(t, uint(i+1), m.Version, "versions must be sequential")
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+
+	assert.Equal(t, "init", all[0].Name)
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningKeysAreStoredEncrypted(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	activeRecords := activerecord.NewSQLite(db, nil)
+	secret := []byte("test signing key secret")
+
+	storedKeys := func() []string {
+		rows, err := db.QueryContext(ctx, `SELECT private_key FROM signing_keys ORDER BY created_at`)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var keys []string
+		for rows.Next() {
+			var key string
+			require.NoError(t, rows.Scan(&key))
+			keys = append(keys, key)
+		}
+		require.NoError(t, rows.Err())
+		return keys
+	}
+
+	// A key created before the secret was set
+	require.NoError(t, activeRecords.SigningKey(nil).EnsureSigningKey(ctx, activerecord.EdDSA))
+	require.Len(t, storedKeys(), 1)
+	assert.Contains(t, storedKeys()[0], "BEGIN PRIVATE KEY")
+
+	keys := activeRecords.SigningKey(secret)
+	encrypted, err := keys.EncryptPlain(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, encrypted)
+
+	encrypted, err = keys.EncryptPlain(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, encrypted)
+
+	_, err = keys.Rotate(ctx, activerecord.RS256, time.Hour)
+	require.NoError(t, err)
+
+	for _, stored := range storedKeys() {
+		assert.Contains(t, stored, "BEGIN SEALED PRIVATE KEY")
+		assert.NotContains(t, stored, "BEGIN PRIVATE KEY")
+	}
+
+	active, err := keys.FindActive(ctx)
+	require.NoError(t, err)
+	require.Len(t, active, 2)
+	assert.Equal(t, activerecord.RS256, active[0].Algorithm())
+	assert.NotNil(t, active[1].PrivateKey())
+
+	_, err = activeRecords.SigningKey(nil).FindActive(ctx)
+	assert.Error(t, err, "encrypted keys cannot be read without the secret")
+
+	_, err = activeRecords.SigningKey([]byte("wrong secret")).FindActive(ctx)
+	assert.Error(t, err, "encrypted keys cannot be read with another secret")
+}
@@ -0,0 +1,473 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/merisho/binaryx-test/config"
+	"github.com/merisho/binaryx-test/migrations"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestSQLite creates a migrated SQLite DB in a temporary file
+func openTestSQLite(t *testing.T) *sql.DB {
+	db, err := activerecord.OpenSQLite(filepath.Join(t.TempDir(), "fakecoins.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.NewSQLite(db)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, migrator.Check(context.Background()))
+
+	return db
+}
+
+// TestStorage checks that every storage backend behaves the same behind the facade.
+// SQLite runs in a temporary file, Postgres is checked only if TEST_DB_URL is set to a Postgres URL
+func TestStorage(t *testing.T) {
+	backends := map[string]func(t *testing.T) activerecord.Facade{
+		"memory": func(t *testing.T) activerecord.Facade {
+			return activerecord.NewMemory(nil)
+		},
+		"sqlite": func(t *testing.T) activerecord.Facade {
+			return activerecord.NewSQLite(openTestSQLite(t), nil)
+		},
+		"postgres": func(t *testing.T) activerecord.Facade {
+			dbURL := os.Getenv("TEST_DB_URL")
+			if dbURL == "" {
+				t.Skip("TEST_DB_URL is not set")
+			}
+			if _, ok := (config.DB{URL: dbURL}).SQLitePath(); ok {
+				t.Skip("TEST_DB_URL is not a Postgres URL")
+			}
+
+			db, err := pgxpool.Connect(context.Background(), dbURL)
+			require.NoError(t, err)
+			t.Cleanup(db.Close)
+
+			migrator, err := migrations.New(db)
+			require.NoError(t, err)
+			_, err = migrator.Up(context.Background())
+			require.NoError(t, err)
+
+			return activerecord.New(db, nil)
+		},
+	}
+
+	for name, newFacade := range backends {
+		newFacade := newFacade
+		t.Run(name, func(t *testing.T) {
+			s := &storageTest{activeRecords: newFacade(t)}
+			t.Run("seed", s.testSeed)
+			t.Run("users", s.testUsers)
+			t.Run("DB transactions", s.testDBTransactions)
+			t.Run("transfers", s.testTransfers)
+			t.Run("concurrent transfers", s.testConcurrentTransfers)
+			t.Run("opposite transfers", s.testOppositeTransfers)
+			t.Run("transaction history", s.testTransactionHistory)
+			t.Run("idempotency keys", s.testIdempotencyKeys)
+			t.Run("sessions", s.testSessions)
+		})
+	}
+}
+
+type storageTest struct {
+	activeRecords activerecord.Facade
+}
+
+// createUser creates a user with wallets of all enabled currencies and pays a bonus of funds to its fBTC wallet
+func (s *storageTest) createUser(t *testing.T, funds int64) (*activerecord.User, *activerecord.Wallet) {
+	ctx := context.Background()
+	request := DefaultSignupRequest()
+	user, err := s.activeRecords.User().New(ctx, request.Email, request.Password, request.FirstName, request.LastName)
+	require.NoError(t, err)
+
+	currencies, err := s.activeRecords.Currency().Enabled(ctx)
+	require.NoError(t, err)
+	_, err = user.CreateWallets(currencies...)
+	require.NoError(t, err)
+	require.NoError(t, user.Save(ctx))
+
+	var address string
+	for _, w := range user.Wallets() {
+		if w.Currency().Symbol() == "fBTC" {
+			address = w.Address()
+		}
+	}
+	require.NotEmpty(t, address)
+
+	if funds > 0 {
+		btc, err := s.activeRecords.Currency().Find(ctx, "fBTC")
+		require.NoError(t, err)
+
+		err = s.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+			treasury, err := tx.Wallet().FindByAddressForUpdate(ctx, btc.ServiceWallet())
+			if err != nil {
+				return err
+			}
+
+			receiver, err := tx.Wallet().FindByAddress(ctx, address)
+			if err != nil {
+				return err
+			}
+
+			bonus, err := receiver.AcceptBonus(treasury, decimal.NewFromInt(funds))
+			if err != nil {
+				return err
+			}
+
+			return bonus.Save(ctx)
+		})
+		require.NoError(t, err)
+	}
+
+	wallet, err := s.activeRecords.Wallet().FindByAddress(ctx, address)
+	require.NoError(t, err)
+	return user, wallet
+}
+
+func (s *storageTest) balance(t *testing.T, address string) string {
+	w, err := s.activeRecords.Wallet().FindByAddress(context.Background(), address)
+	require.NoError(t, err)
+	return w.Balance().String()
+}
+
+func (s *storageTest) testSeed(t *testing.T) {
+	ctx := context.Background()
+	currencies, err := s.activeRecords.Currency().All(ctx)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(currencies), 2)
+	assert.Equal(t, "fBTC", currencies[0].Symbol())
+	assert.Equal(t, "fETH", currencies[1].Symbol())
+
+	btc := currencies[0]
+	assert.Equal(t, int32(8), btc.Precision())
+	assert.Equal(t, "100", btc.SignupBonus().String())
+	assert.Equal(t, `{"type":"percentage","rate":"0.2"}`, btc.FeeSchedule(activerecord.TransferTransaction).Policy())
+
+	supply, err := s.activeRecords.Treasury().Supply(ctx, btc)
+	require.NoError(t, err)
+	assert.True(t, supply.Minted.GreaterThanOrEqual(decimal.NewFromInt(1000000)))
+	assert.True(t, supply.Issued.Equal(supply.Minted.Sub(supply.Burned)))
+
+	_, err = s.activeRecords.Currency().Find(ctx, "unknown")
+	assert.IsType(t, activerecord.NotFoundError{}, err)
+}
+
+func (s *storageTest) testUsers(t *testing.T) {
+	ctx := context.Background()
+	user, _ := s.createUser(t, 0)
+
+	found, err := s.activeRecords.User().FindByEmail(ctx, user.Email())
+	require.NoError(t, err)
+	assert.Equal(t, user.ID(), found.ID())
+	assert.Equal(t, user.Password(), found.Password())
+	assert.False(t, found.EmailVerified())
+
+	require.NoError(t, found.VerifyEmail(ctx))
+	require.NoError(t, found.SetAdmin(ctx, true))
+	found, err = s.activeRecords.User().FindByID(ctx, user.ID())
+	require.NoError(t, err)
+	assert.True(t, found.EmailVerified())
+	assert.True(t, found.IsAdmin())
+
+	wallets, err := found.LoadWallets(ctx)
+	require.NoError(t, err)
+	require.Len(t, wallets, 2)
+	assert.Equal(t, "fBTC", wallets[0].Currency().Symbol())
+	assert.True(t, wallets[0].Balance().IsZero())
+
+	duplicate, err := s.activeRecords.User().New(ctx, user.Email(), "12345678", "Test", "User")
+	require.NoError(t, err)
+	assert.IsType(t, activerecord.ConflictError{}, duplicate.Save(ctx))
+
+	_, err = s.activeRecords.User().FindByID(ctx, uuid.New())
+	assert.IsType(t, activerecord.NotFoundError{}, err)
+}
+
+func (s *storageTest) testDBTransactions(t *testing.T) {
+	ctx := context.Background()
+	rollback := errors.New("rollback")
+	newUser := func(f activerecord.Facade) string {
+		request := DefaultSignupRequest()
+		user, err := f.User().New(ctx, request.Email, request.Password, request.FirstName, request.LastName)
+		require.NoError(t, err)
+		require.NoError(t, user.Save(ctx))
+		return user.Email()
+	}
+
+	var rolledBack string
+	err := s.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		rolledBack = newUser(tx)
+		_, err := tx.User().FindByEmail(ctx, rolledBack)
+		require.NoError(t, err)
+		return rollback
+	})
+	assert.Equal(t, rollback, err)
+
+	_, err = s.activeRecords.User().FindByEmail(ctx, rolledBack)
+	assert.IsType(t, activerecord.NotFoundError{}, err)
+
+	// A rolled back savepoint discards only its own changes
+	var committed, discarded, released string
+	err = s.activeRecords.WithTx(ctx, func(tx activerecord.Facade) error {
+		committed = newUser(tx)
+		err := tx.WithTx(ctx, func(savepoint activerecord.Facade) error {
+			discarded = newUser(savepoint)
+			return rollback
+		})
+		assert.Equal(t, rollback, err)
+
+		return tx.WithTx(ctx, func(savepoint activerecord.Facade) error {
+			released = newUser(savepoint)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+
+	for _, email := range []string{committed, released} {
+		_, err = s.activeRecords.User().FindByEmail(ctx, email)
+		assert.NoError(t, err, email)
+	}
+
+	_, err = s.activeRecords.User().FindByEmail(ctx, discarded)
+	assert.IsType(t, activerecord.NotFoundError{}, err)
+}
+
+func (s *storageTest) testTransfers(t *testing.T) {
+	ctx := context.Background()
+	sender, from := s.createUser(t, 100)
+	_, to := s.createUser(t, 0)
+	assert.Equal(t, "100", from.Balance().String())
+
+	tx, err := s.activeRecords.Transfer(ctx, sender.ID(), from.Address(), to.Address(), decimal.NewFromInt(10))
+	require.NoError(t, err)
+	assert.Equal(t, "2", tx.Fee().String())
+	assert.Equal(t, "88", s.balance(t, from.Address()))
+	assert.Equal(t, "10", s.balance(t, to.Address()))
+
+	_, err = s.activeRecords.Transfer(ctx, sender.ID(), from.Address(), to.Address(), decimal.NewFromInt(80))
+	assert.IsType(t, activerecord.InsufficientFundsError{}, err)
+	assert.Equal(t, "88", s.balance(t, from.Address()))
+
+	_, err = s.activeRecords.Transfer(ctx, uuid.New(), from.Address(), to.Address(), decimal.NewFromInt(1))
+	assert.IsType(t, activerecord.NotFoundError{}, err)
+
+	entry, err := s.activeRecords.Ledger().FindEntry(ctx, tx.ID())
+	require.NoError(t, err)
+	assert.True(t, entry.Balanced())
+	assert.Len(t, entry.Postings(), 3)
+
+	balance, err := s.activeRecords.Ledger().Balance(ctx, from.Address())
+	require.NoError(t, err)
+	assert.Equal(t, "88", balance.String())
+
+	balance, err = s.activeRecords.Ledger().BalanceAt(ctx, from.Address(), tx.Timestamp().Add(-time.Nanosecond))
+	require.NoError(t, err)
+	assert.Equal(t, "100", balance.String())
+
+	mismatches, err := s.activeRecords.Wallet().VerifyBalances(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func (s *storageTest) testConcurrentTransfers(t *testing.T) {
+	ctx := context.Background()
+	sender, from := s.createUser(t, 50)
+	_, to := s.createUser(t, 0)
+
+	// Every transfer takes 12 with the fee, so only 4 of them fit into the balance
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.activeRecords.Transfer(ctx, sender.ID(), from.Address(), to.Address(), decimal.NewFromInt(10))
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+			continue
+		}
+
+		assert.IsType(t, activerecord.InsufficientFundsError{}, err)
+	}
+
+	assert.Equal(t, 4, succeeded)
+	assert.Equal(t, "2", s.balance(t, from.Address()))
+	assert.Equal(t, "40", s.balance(t, to.Address()))
+}
+
+// testOppositeTransfers sends money both ways between two wallets at once, none of the transfers may deadlock
+func (s *storageTest) testOppositeTransfers(t *testing.T) {
+	ctx := context.Background()
+	a, aWallet := s.createUser(t, 100)
+	b, bWallet := s.createUser(t, 100)
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.activeRecords.Transfer(ctx, a.ID(), aWallet.Address(), bWallet.Address(), decimal.NewFromInt(1))
+			results <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.activeRecords.Transfer(ctx, b.ID(), bWallet.Address(), aWallet.Address(), decimal.NewFromInt(1))
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		assert.NoError(t, err)
+	}
+
+	// Each side sends 10 with 2 of fees and receives 10
+	assert.Equal(t, "98", s.balance(t, aWallet.Address()))
+	assert.Equal(t, "98", s.balance(t, bWallet.Address()))
+}
+
+func (s *storageTest) testTransactionHistory(t *testing.T) {
+	ctx := context.Background()
+	sender, from := s.createUser(t, 100)
+	_, to := s.createUser(t, 0)
+
+	for i := 1; i <= 5; i++ {
+		_, err := s.activeRecords.Transfer(ctx, sender.ID(), from.Address(), to.Address(), decimal.NewFromInt(int64(i)))
+		require.NoError(t, err)
+	}
+
+	var amounts []string
+	filter := activerecord.TransactionFilter{Limit: 2}
+	for {
+		page, err := from.FindTransactions(ctx, filter)
+		require.NoError(t, err)
+		for _, tx := range page.Transactions {
+			amounts = append(amounts, tx.Amount().String())
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+
+		filter.Cursor = page.NextCursor
+	}
+
+	// The bonus which has funded the sender is the oldest transaction
+	assert.Equal(t, []string{"5", "4", "3", "2", "1", "100"}, amounts)
+
+	page, err := from.FindTransactions(ctx, activerecord.TransactionFilter{
+		Direction: activerecord.Outgoing,
+		MinAmount: decimal.NullDecimal{Decimal: decimal.NewFromInt(2), Valid: true},
+		MaxAmount: decimal.NullDecimal{Decimal: decimal.NewFromInt(4), Valid: true},
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 3)
+	assert.Equal(t, "4", page.Transactions[0].Amount().String())
+	assert.Equal(t, "2", page.Transactions[2].Amount().String())
+}
+
+func (s *storageTest) testIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	scope := uuid.New().String()
+	keys := s.activeRecords.IdempotencyKey()
+
+	k, claimed, err := keys.Claim(ctx, scope, "key", "hash", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	require.NoError(t, k.Complete(ctx, 201, "application/json", []byte(`{}`)))
+
+	k, claimed, err = keys.Claim(ctx, scope, "key", "other hash", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.True(t, k.Completed())
+	assert.Equal(t, "hash", k.RequestHash())
+	assert.Equal(t, 201, k.Status())
+	assert.Equal(t, `{}`, string(k.Response()))
+
+	// Expired keys are taken over
+	_, claimed, err = keys.Claim(ctx, scope, "expired", "hash", -time.Second)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	k, claimed, err = keys.Claim(ctx, scope, "expired", "other hash", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	assert.False(t, k.Completed())
+
+	require.NoError(t, k.Release(ctx))
+	_, claimed, err = keys.Claim(ctx, scope, "expired", "hash", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func (s *storageTest) testSessions(t *testing.T) {
+	ctx := context.Background()
+	user, _ := s.createUser(t, 0)
+	sessions := s.activeRecords.Session()
+
+	session, first, err := sessions.Start(ctx, user.ID(), time.Hour)
+	require.NoError(t, err)
+
+	refreshed, second, err := sessions.Refresh(ctx, first, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, session.ID(), refreshed.ID())
+	assert.NotEqual(t, first, second)
+
+	active, err := sessions.FindActiveByUserID(ctx, user.ID())
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	assert.Equal(t, session.ID(), active[0].ID())
+
+	// Reuse of the rotated token revokes the session
+	_, _, err = sessions.Refresh(ctx, first, time.Hour)
+	assert.IsType(t, activerecord.UnauthorizedError{}, err)
+
+	_, _, err = sessions.Refresh(ctx, second, time.Hour)
+	assert.IsType(t, activerecord.UnauthorizedError{}, err)
+
+	found, err := sessions.Find(ctx, session.ID())
+	require.NoError(t, err)
+	assert.False(t, found.Active())
+
+	_, _, err = sessions.Refresh(ctx, "unknown", time.Hour)
+	assert.IsType(t, activerecord.UnauthorizedError{}, err)
+}
+
+func TestSnapshotWaitsForLatePostings(t *testing.T) {
+	ctx := context.Background()
+	ledger := activerecord.NewMemory(nil).Ledger()
+	endOfToday := time.Now().UTC().Truncate(24 * time.Hour).AddDate(0, 0, 1)
+
+	// The genesis is posted today, its DB transaction could still be running right after midnight
+	_, err := ledger.SnapshotBalances(ctx, endOfToday.Add(time.Second))
+	require.NoError(t, err)
+
+	days, err := ledger.SnapshotBalances(ctx, endOfToday.Add(activerecord.SnapshotDelay))
+	require.NoError(t, err)
+	assert.Equal(t, 1, days, "today is snapshotted once the delay has passed")
+}
@@ -0,0 +1,40 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/merisho/binaryx-test/activerecord"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The vectors are the SHA1 ones of RFC 6238 appendix B truncated to 6 digits
+func TestTOTPCode(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range vectors {
+		code, err := activerecord.TOTPCode(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, expected, code, "at %d", unix)
+	}
+
+	_, err := activerecord.TOTPCode("not base32!", time.Unix(59, 0))
+	assert.Error(t, err)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := activerecord.TOTPProvisioningURI("GEZDGNBV", "user@example.com")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/FakeCoins:user@example.com?"))
+	assert.Contains(t, uri, "secret=GEZDGNBV")
+	assert.Contains(t, uri, "issuer=FakeCoins")
+}